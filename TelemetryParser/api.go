@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/websocket"
 )
@@ -27,7 +32,7 @@ func HandleLiveDataSubscriptionRequest(w http.ResponseWriter, req *http.Request)
 	}
 
 	Log.Printf("%s Subscription successful\n", req.RemoteAddr)
-	websocketServer.SubscribeNewClient(&WebsocketClient{conn, make(chan []byte, CLIENT_NEW_PACKET_CHANNEL_BUFFER_SIZE), false})
+	websocketServer.SubscribeNewClient(&WebsocketClient{Connection: conn, NewPacket: make(chan []byte, CLIENT_NEW_PACKET_CHANNEL_BUFFER_SIZE)})
 }
 
 func HandleStopRecordingRequest(w http.ResponseWriter, req *http.Request) {
@@ -40,6 +45,930 @@ func HandleStartReplayRequest(w http.ResponseWriter, req *http.Request) {
 	go packetStore.StartReplay("test_recording.bin")
 }
 
+// GET /api/history?car=3&channels=speed,throttle,brake&from=120&to=210&points=500
+// `from`/`to` are session times in seconds, `points` optionally downsamples each channel
+func HandleHistoryQueryRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	carIndex, err := strconv.ParseUint(query.Get("car"), 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	channels := strings.Split(query.Get("channels"), ",")
+	if query.Get("channels") == "" {
+		http.Error(w, "no channels requested", http.StatusBadRequest)
+		return
+	}
+
+	from, err := strconv.ParseFloat(query.Get("from"), 32)
+	if err != nil {
+		http.Error(w, "invalid start time", http.StatusBadRequest)
+		return
+	}
+
+	to, err := strconv.ParseFloat(query.Get("to"), 32)
+	if err != nil {
+		http.Error(w, "invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	points := 0
+	if query.Has("points") {
+		points, err = strconv.Atoi(query.Get("points"))
+		if err != nil || points < 0 {
+			http.Error(w, "invalid point count", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := packetStore.History.Query(uint8(carIndex), channels, float32(from), float32(to), points)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	WriteJSONResponse(w, result)
+}
+
+// GET /api/laps/{car} lists the completed laps of a car
+// GET /api/laps/{car}/{lap}/trace returns the distance indexed trace of a lap
+// GET /api/laps/{car}/{lap}/corners returns the per corner statistics of a lap
+func HandleLapRequest(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/laps/"), "/"), "/")
+
+	carIndex, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		summaries, err := packetStore.Laps.GetLapSummaries(uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, summaries)
+	case len(parts) == 3 && (parts[2] == "trace" || parts[2] == "corners"):
+		lapNum, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil {
+			http.Error(w, "invalid lap number", http.StatusBadRequest)
+			return
+		}
+
+		trace, err := packetStore.Laps.GetLapTrace(uint8(carIndex), uint8(lapNum))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if parts[2] == "trace" {
+			WriteJSONResponse(w, trace)
+			return
+		}
+
+		corners, err := packetStore.Corners.GetCorners(trace.TrackId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, ComputeCornerStats(trace, corners))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// GET /api/delta/reference returns the reference lap used for the live delta
+// POST /api/delta/reference?source=best|session|recording&car=0&lap=5&recording=name.bin changes it
+func HandleDeltaReferenceRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet && !req.URL.Query().Has("source") {
+		WriteJSONResponse(w, packetStore.Delta.GetReference())
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "the reference has to be changed with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+
+	var carIndex, lapNum uint64
+	var err error
+	if query.Has("car") {
+		carIndex, err = strconv.ParseUint(query.Get("car"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid car index", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("lap") {
+		lapNum, err = strconv.ParseUint(query.Get("lap"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid lap number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch query.Get("source") {
+	case "best":
+		packetStore.Delta.UseSessionBest()
+	case "session":
+		err = packetStore.Delta.UseSessionLap(uint8(carIndex), uint8(lapNum))
+	case "recording":
+		err = packetStore.Delta.UseRecordingLap(query.Get("recording"), uint8(carIndex), uint8(lapNum))
+	default:
+		err = fmt.Errorf("unknown reference source '%s'", query.Get("source"))
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	WriteJSONResponse(w, packetStore.Delta.GetReference())
+}
+
+// GET /api/compare?aCar=0&aLap=3&bCar=0&bLap=5&bRecording=name.bin
+// Laps without a recording name are taken from the live session
+func HandleLapComparisonRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	a, err := ParseLapSelector(query, "a")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := ParseLapSelector(query, "b")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comparison, err := CompareLapSelections(packetStore.LiveLapSources(), packetStore.Corners, a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, comparison)
+}
+
+func ParseLapSelector(query url.Values, prefix string) (LapSelector, error) {
+	selector := LapSelector{RecordingName: query.Get(prefix + "Recording")}
+
+	carIndex, err := strconv.ParseUint(query.Get(prefix+"Car"), 10, 8)
+	if err != nil {
+		return selector, fmt.Errorf("invalid car index for lap %s", prefix)
+	}
+
+	lapNum, err := strconv.ParseUint(query.Get(prefix+"Lap"), 10, 8)
+	if err != nil {
+		return selector, fmt.Errorf("invalid lap number for lap %s", prefix)
+	}
+
+	selector.CarIndex = uint8(carIndex)
+	selector.LapNum = uint8(lapNum)
+	return selector, nil
+}
+
+// GET /api/track/map?track=10&format=svg, without a track ID the current track is used
+func HandleTrackMapRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	trackId := int64(-1)
+	if query.Has("track") {
+		var err error
+		trackId, err = strconv.ParseInt(query.Get("track"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid track ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	trackMap, err := packetStore.TrackMaps.GetTrackMap(int8(trackId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if query.Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		io.WriteString(w, trackMap.SVG())
+		return
+	}
+
+	WriteJSONResponse(w, trackMap)
+}
+
+// GET /api/track/corners?track=10, without a track ID the current track is used
+func HandleTrackCornersRequest(w http.ResponseWriter, req *http.Request) {
+	trackId := int64(-1)
+	if req.URL.Query().Has("track") {
+		var err error
+		trackId, err = strconv.ParseInt(req.URL.Query().Get("track"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid track ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	corners, err := packetStore.Corners.GetCorners(int8(trackId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, corners)
+}
+
+// GET /api/track/cars returns the position of every car on the current track, in world and SVG map coordinates
+func HandleTrackCarsRequest(w http.ResponseWriter, req *http.Request) {
+	positions, err := packetStore.TrackMaps.GetCarPositions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, positions)
+}
+
+// GET /api/timing returns the timing tower
+// GET /api/timing/{car} returns the sector and mini-sector history of a car
+func HandleTimingRequest(w http.ResponseWriter, req *http.Request) {
+	car := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/timing"), "/")
+	if car == "" {
+		WriteJSONResponse(w, packetStore.Timing.GetTower())
+		return
+	}
+
+	carIndex, err := strconv.ParseUint(car, 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	timing, err := packetStore.Timing.GetCarTiming(uint8(carIndex))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	WriteJSONResponse(w, timing)
+}
+
+func HandleGapTowerRequest(w http.ResponseWriter, req *http.Request) {
+	WriteJSONResponse(w, packetStore.Gaps.GetTower())
+}
+
+func HandleFuelStrategyRequest(w http.ResponseWriter, req *http.Request) {
+	WriteJSONResponse(w, packetStore.Fuel.GetStrategy())
+}
+
+// GET /api/tyres/stints?session=123&car=0 returns the tyre stints of a session, without a session ID the current one is used
+// GET /api/tyres/degradation?session=123 returns the wear and lap time loss fitted per compound
+func HandleTyreRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	sessionUID := uint64(0)
+	if query.Has("session") {
+		var err error
+		sessionUID, err = strconv.ParseUint(query.Get("session"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch req.URL.Path {
+	case "/api/tyres/stints":
+		carIndex := uint64(255)
+		if query.Has("car") {
+			var err error
+			carIndex, err = strconv.ParseUint(query.Get("car"), 10, 8)
+			if err != nil || carIndex >= F1_MAX_NUM_CARS {
+				http.Error(w, "invalid car index", http.StatusBadRequest)
+				return
+			}
+		}
+
+		stints, err := packetStore.Tyres.GetStints(sessionUID, uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, stints)
+	case "/api/tyres/degradation":
+		degradation, err := packetStore.Tyres.GetCompoundDegradation(sessionUID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, degradation)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// GET /api/strategy?car=0&rival=3 predicts where a car rejoins if it pits this lap, without a car index the player car is used
+// GET /api/strategy/pit-losses lists the pit stops measured in the session
+func HandleStrategyRequest(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/api/strategy/pit-losses" {
+		WriteJSONResponse(w, packetStore.Strategy.GetPitLosses())
+		return
+	}
+
+	query := req.URL.Query()
+	carIndex := uint64(255)
+	if query.Has("car") {
+		var err error
+		carIndex, err = strconv.ParseUint(query.Get("car"), 10, 8)
+		if err != nil || carIndex >= F1_MAX_NUM_CARS {
+			http.Error(w, "invalid car index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rival := int64(-1)
+	if query.Has("rival") {
+		var err error
+		rival, err = strconv.ParseInt(query.Get("rival"), 10, 8)
+		if err != nil || rival < 0 || rival >= F1_MAX_NUM_CARS {
+			http.Error(w, "invalid rival car index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	prediction, err := packetStore.Strategy.Predict(uint8(carIndex), int(rival))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, prediction)
+}
+
+// GET /api/ers/{car} returns the ERS balance of every completed lap
+// GET /api/ers/{car}/{lap} returns a lap with its per distance accounting
+// GET /api/ers/{car}/{lap}/zones returns the deploy and harvest zones of a lap placed on the track map
+func HandleERSRequest(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/ers/"), "/"), "/")
+
+	carIndex, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 1 {
+		laps, err := packetStore.ERS.GetLaps(uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, laps)
+		return
+	}
+
+	if len(parts) > 3 || (len(parts) == 3 && parts[2] != "zones") {
+		http.NotFound(w, req)
+		return
+	}
+
+	lapNum, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid lap number", http.StatusBadRequest)
+		return
+	}
+
+	lap, err := packetStore.ERS.GetLap(uint8(carIndex), uint8(lapNum))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		WriteJSONResponse(w, lap)
+		return
+	}
+
+	trackMap, err := packetStore.TrackMaps.GetTrackMap(lap.TrackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	WriteJSONResponse(w, lap.ZoneOverlay(trackMap))
+}
+
+// GET /api/temperatures/{car} returns the time spent in, below and above the temperature windows per lap
+// GET /api/temperatures/{car}/stints summarises them per stint
+func HandleTemperatureRequest(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/temperatures/"), "/"), "/")
+
+	carIndex, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		laps, err := packetStore.Temperatures.GetLaps(uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, laps)
+	case len(parts) == 2 && parts[1] == "stints":
+		stints, err := packetStore.Temperatures.GetStintSummaries(uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, stints)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// GET /api/slips returns the number of lockups and wheelspins of every lap of the player car
+// GET /api/slips/{lap} returns the events of a lap
+func HandleSlipRequest(w http.ResponseWriter, req *http.Request) {
+	lap := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/slips"), "/")
+	if lap == "" {
+		WriteJSONResponse(w, packetStore.Slips.GetLapSummaries())
+		return
+	}
+
+	lapNum, err := strconv.ParseUint(lap, 10, 8)
+	if err != nil {
+		http.Error(w, "invalid lap number", http.StatusBadRequest)
+		return
+	}
+
+	WriteJSONResponse(w, packetStore.Slips.GetPlayerLapEvents(uint8(lapNum)))
+}
+
+// GET /api/gg/{car}/{lap} returns the G-G envelope of a lap and its corners with binned data for plotting
+// GET /api/gg/compare?aCar=0&aLap=3&bCar=0&bLap=5&bRecording=name.bin compares the envelopes of two laps
+func HandleGGRequest(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/gg/"), "/"), "/")
+
+	if len(parts) == 1 && parts[0] == "compare" {
+		query := req.URL.Query()
+		a, err := ParseLapSelector(query, "a")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := ParseLapSelector(query, "b")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		comparison, err := CompareGGSelections(packetStore.LiveLapSources(), packetStore.Corners, a, b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, comparison)
+		return
+	}
+
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	carIndex, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+	lapNum, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		http.Error(w, "invalid lap number", http.StatusBadRequest)
+		return
+	}
+
+	lap, err := packetStore.GG.GetLap(uint8(carIndex), uint8(lapNum))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var corners *TrackCorners
+	if lap.TrackId >= 0 {
+		corners, _ = packetStore.Corners.GetCorners(lap.TrackId)
+	}
+
+	analysis, err := packetStore.GG.AnalyseLap(uint8(carIndex), uint8(lapNum), corners)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	WriteJSONResponse(w, analysis)
+}
+
+// GET /api/consistency?car=0&stint=2 reports how consistent a car's braking and full throttle points are per corner.
+// The laps can be limited with stint (live session only) or from/to, and taken from a recording with recording=name.bin
+func HandleConsistencyRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	carIndex, err := strconv.ParseUint(query.Get("car"), 10, 8)
+	if err != nil {
+		http.Error(w, "invalid car index", http.StatusBadRequest)
+		return
+	}
+
+	fromLap, toLap := uint64(0), uint64(255)
+	if query.Has("from") {
+		fromLap, err = strconv.ParseUint(query.Get("from"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid first lap", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("to") {
+		toLap, err = strconv.ParseUint(query.Get("to"), 10, 8)
+		if err != nil {
+			http.Error(w, "invalid last lap", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Has("stint") {
+		// stints are only tracked for the live session
+		if query.Get("recording") != "" {
+			http.Error(w, "stints can't be selected in a recording, use from and to", http.StatusBadRequest)
+			return
+		}
+
+		stintNum, err := strconv.Atoi(query.Get("stint"))
+		if err != nil {
+			http.Error(w, "invalid stint number", http.StatusBadRequest)
+			return
+		}
+
+		stints, err := packetStore.Tyres.GetStints(0, uint8(carIndex))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		found := false
+		for _, stint := range stints {
+			if stint.StintNum == stintNum {
+				fromLap, toLap = uint64(stint.StartLap), uint64(stint.EndLap)
+				found = true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("car %d has no stint %d", carIndex, stintNum), http.StatusNotFound)
+			return
+		}
+	}
+
+	sources, err := SelectLapSources(packetStore.LiveLapSources(), LapSelector{RecordingName: query.Get("recording")}, make(map[string]*LapSources))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	report, err := BuildConsistencyReport(sources.Laps, packetStore.Corners, uint8(carIndex), uint8(fromLap), uint8(toLap))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	WriteJSONResponse(w, report)
+}
+
+// GET /api/incidents?session=123&car=0 returns the incident timeline of a session, without a session ID the current one is used
+func HandleIncidentRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	sessionUID := uint64(0)
+	if query.Has("session") {
+		var err error
+		sessionUID, err = strconv.ParseUint(query.Get("session"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	carIndex := uint64(255)
+	if query.Has("car") {
+		var err error
+		carIndex, err = strconv.ParseUint(query.Get("car"), 10, 8)
+		if err != nil || carIndex >= F1_MAX_NUM_CARS {
+			http.Error(w, "invalid car index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	incidents, err := packetStore.Incidents.GetIncidents(sessionUID, uint8(carIndex))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	WriteJSONResponse(w, incidents)
+}
+
+// GET /api/recordings/metadata?recording=name returns the metadata written when the recording was stopped
+func HandleRecordingMetadataRequest(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("recording")
+	if name == "" {
+		http.Error(w, "missing recording name", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := ReadRecordingMetadata(RecordingPath(name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	WriteJSONResponse(w, metadata)
+}
+
+// GET /api/penalties?car=0 returns the penalty counters of every car and the ledger of one car, without a car index all cars
+func HandlePenaltyRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	carIndex := uint64(255)
+	if query.Has("car") {
+		var err error
+		carIndex, err = strconv.ParseUint(query.Get("car"), 10, 8)
+		if err != nil || carIndex >= F1_MAX_NUM_CARS {
+			http.Error(w, "invalid car index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	WriteJSONResponse(w, struct {
+		Summaries []PenaltyCarSummary
+		Entries   []PenaltyEntry
+	}{packetStore.Penalties.GetSummaries(), packetStore.Penalties.GetEntries(uint8(carIndex))})
+}
+
+// GET /api/damage/{car} returns the damage change log of a car in the current session
+// GET /api/damage/summary summarises the damage of the current session so far
+// GET /api/damage/sessions returns the damage summaries of past sessions
+// GET /api/damage/power-units adds up the power unit wear of every driver over all sessions
+func HandleDamageRequest(w http.ResponseWriter, req *http.Request) {
+	switch path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/damage/"), "/"); path {
+	case "summary":
+		WriteJSONResponse(w, packetStore.Damage.GetSummary())
+	case "sessions":
+		WriteJSONResponse(w, packetStore.Damage.GetSessions())
+	case "power-units":
+		WriteJSONResponse(w, packetStore.Damage.GetPowerUnitUsage())
+	default:
+		carIndex, err := strconv.ParseUint(path, 10, 8)
+		if err != nil || carIndex >= F1_MAX_NUM_CARS {
+			http.Error(w, "invalid car index", http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, packetStore.Damage.GetChanges(uint8(carIndex)))
+	}
+}
+
+// ParseLapFilter reads the optional track, session (type) and driver of a lap database query
+func ParseLapFilter(query url.Values) (LapFilter, error) {
+	filter := LapFilter{TrackId: -1, SessionType: -1, Driver: query.Get("driver")}
+	if query.Has("track") {
+		trackId, err := strconv.ParseInt(query.Get("track"), 10, 8)
+		if err != nil {
+			return filter, fmt.Errorf("invalid track ID")
+		}
+		filter.TrackId = int8(trackId)
+	}
+	if query.Has("session") {
+		sessionType, err := strconv.ParseUint(query.Get("session"), 10, 8)
+		if err != nil {
+			return filter, fmt.Errorf("invalid session type")
+		}
+		filter.SessionType = int16(sessionType)
+	}
+	return filter, nil
+}
+
+// GET /api/lapdb/bests?track=10&session=10&driver=name returns the personal best of every driver per track and session type
+// GET /api/lapdb/laps?track=10&session=10&driver=name returns the stored laps, fastest first
+// GET /api/lapdb/laps/{id}/trace returns the distance indexed trace of a stored lap
+// GET /api/lapdb/setups/{ref} returns a stored car setup
+// POST /api/lapdb/import?recording=name stores the valid laps of a recording
+func HandleLapDatabaseRequest(w http.ResponseWriter, req *http.Request) {
+	if packetStore.LapDB == nil {
+		http.Error(w, "lap database isn't available", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/lapdb/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && (parts[0] == "bests" || parts[0] == "laps"):
+		filter, err := ParseLapFilter(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if parts[0] == "bests" {
+			WriteJSONResponse(w, packetStore.LapDB.GetPersonalBests(filter))
+		} else {
+			WriteJSONResponse(w, packetStore.LapDB.GetLaps(filter))
+		}
+	case len(parts) == 3 && parts[0] == "laps" && parts[2] == "trace":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid lap ID", http.StatusBadRequest)
+			return
+		}
+
+		trace, err := packetStore.LapDB.GetTrace(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, trace)
+	case len(parts) == 2 && parts[0] == "setups":
+		setup, err := packetStore.LapDB.GetSetup(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		WriteJSONResponse(w, setup)
+	case len(parts) == 1 && parts[0] == "import":
+		if req.Method != http.MethodPost {
+			http.Error(w, "import has to be a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := req.URL.Query().Get("recording")
+		if name == "" {
+			http.Error(w, "missing recording name", http.StatusBadRequest)
+			return
+		}
+
+		imported, err := ImportRecording(packetStore.LapDB, RecordingPath(name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		WriteJSONResponse(w, struct{ Imported int }{imported})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// GET /api/export?recording=name&format=csv|parquet&table=lap_data downloads the tables of a recording, without a
+// recording the current session of the telemetry history is exported. Without a table name all tables are zipped.
+func HandleExportRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = ExportFormat_CSV
+	}
+	if format != ExportFormat_CSV && format != ExportFormat_Parquet {
+		http.Error(w, "unknown export format", http.StatusBadRequest)
+		return
+	}
+
+	var tables []*ExportTable
+	name := "history"
+	if query.Has("recording") {
+		name = RecordingPath(query.Get("recording"))
+		var err error
+		tables, err = ExportRecording(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		tables = packetStore.History.Export()
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !query.Has("table") {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"_"+format+".zip"))
+		err := WriteExportArchive(w, tables, format)
+		if err != nil {
+			Log.Printf("Failed to write export of %s - %s\n", name, err)
+		}
+		return
+	}
+
+	for _, table := range tables {
+		if table.Name != query.Get("table") {
+			continue
+		}
+
+		if format == ExportFormat_CSV {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", table.Name+"."+format))
+		err := WriteExportTable(w, table, format)
+		if err != nil {
+			Log.Printf("Failed to write export of %s - %s\n", name, err)
+		}
+		return
+	}
+	http.Error(w, "no such table", http.StatusNotFound)
+}
+
+// GET /api/motec?recording=name&car=3&lap=2&file=ld|ldx converts a recording to a MoTeC i2 log. The player car and the
+// whole session are exported by default, and without a file type the .ld and .ldx files are zipped.
+func HandleMotecRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if !query.Has("recording") {
+		http.Error(w, "no recording given", http.StatusBadRequest)
+		return
+	}
+
+	car, lap, rate := -1, 0, 0
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"car", &car}, {"lap", &lap}, {"rate", &rate}} {
+		if !query.Has(param.name) {
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(param.name))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s", param.name), http.StatusBadRequest)
+			return
+		}
+		*param.value = value
+	}
+	if rate < 0 || rate > MOTEC_MAX_SAMPLE_RATE {
+		http.Error(w, "invalid rate", http.StatusBadRequest)
+		return
+	}
+
+	name := RecordingPath(query.Get("recording"))
+	log, err := ExportMotec(name, car, lap, rate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if lap > 0 {
+		name = fmt.Sprintf("%s_lap%d", name, lap)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch query.Get("file") {
+	case "":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"_motec.zip"))
+		err = WriteMotecArchive(w, log, name)
+	case "ld":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".ld"))
+		err = log.WriteLD(w)
+	case "ldx":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".ldx"))
+		err = log.WriteLDX(w)
+	default:
+		http.Error(w, "unknown file type", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		Log.Printf("Failed to write MoTeC export of %s - %s\n", name, err)
+	}
+}
+
+// GET /metrics serves the pipeline metrics, and the player car gauges when enabled, for Prometheus to scrape
+func HandleMetricsRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := Metrics.WritePrometheus(w)
+	if err != nil {
+		Log.Printf("Failed to write metrics - %s\n", err)
+	}
+}
+
+func WriteJSONResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		Log.Printf("Failed to write JSON response - %s\n", err)
+	}
+}
+
 func HandlePing(w http.ResponseWriter, _ *http.Request) {
 	io.WriteString(w, "Pong")
 }
@@ -52,6 +981,34 @@ func RunAPIServer(wss *WebsocketServer, store *PacketStore) {
 	http.HandleFunc("/api/live", HandleLiveDataSubscriptionRequest)
 	http.HandleFunc("/api/stop-recording", HandleStopRecordingRequest)
 	http.HandleFunc("/api/replay", HandleStartReplayRequest)
+	http.HandleFunc("/api/history", HandleHistoryQueryRequest)
+	http.HandleFunc("/api/laps/", HandleLapRequest)
+	http.HandleFunc("/api/delta/reference", HandleDeltaReferenceRequest)
+	http.HandleFunc("/api/compare", HandleLapComparisonRequest)
+	http.HandleFunc("/api/track/map", HandleTrackMapRequest)
+	http.HandleFunc("/api/track/corners", HandleTrackCornersRequest)
+	http.HandleFunc("/api/track/cars", HandleTrackCarsRequest)
+	http.HandleFunc("/api/timing", HandleTimingRequest)
+	http.HandleFunc("/api/timing/", HandleTimingRequest)
+	http.HandleFunc("/api/gaps", HandleGapTowerRequest)
+	http.HandleFunc("/api/fuel", HandleFuelStrategyRequest)
+	http.HandleFunc("/api/tyres/", HandleTyreRequest)
+	http.HandleFunc("/api/strategy", HandleStrategyRequest)
+	http.HandleFunc("/api/strategy/", HandleStrategyRequest)
+	http.HandleFunc("/api/ers/", HandleERSRequest)
+	http.HandleFunc("/api/temperatures/", HandleTemperatureRequest)
+	http.HandleFunc("/api/slips", HandleSlipRequest)
+	http.HandleFunc("/api/slips/", HandleSlipRequest)
+	http.HandleFunc("/api/gg/", HandleGGRequest)
+	http.HandleFunc("/api/consistency", HandleConsistencyRequest)
+	http.HandleFunc("/api/incidents", HandleIncidentRequest)
+	http.HandleFunc("/api/recordings/metadata", HandleRecordingMetadataRequest)
+	http.HandleFunc("/api/penalties", HandlePenaltyRequest)
+	http.HandleFunc("/api/damage/", HandleDamageRequest)
+	http.HandleFunc("/api/lapdb/", HandleLapDatabaseRequest)
+	http.HandleFunc("/api/export", HandleExportRequest)
+	http.HandleFunc("/api/motec", HandleMotecRequest)
+	http.HandleFunc("/metrics", HandleMetricsRequest)
 
 	GetLogger().Printf("Starting API server on port %d\n", API_SERVER_PORT)
 	err := http.ListenAndServe(fmt.Sprintf(":%d", API_SERVER_PORT), nil)
@@ -43,3 +43,74 @@ func CheckImplements[T any, I any]() bool {
 	_, ok := interface{}(&o).(I)
 	return ok
 }
+
+func Lerp(a float32, b float32, t float32) float32 {
+	return a + (b-a)*t
+}
+
+// BroadcastDue reports whether `interval` seconds of session time have passed since *last and moves *last on if so.
+// A flashback rewinds the session time, then *last is reset rather than waiting for the old time to come round again.
+func BroadcastDue(last *float32, sessionTime float32, interval float32) bool {
+	if sessionTime < *last {
+		*last = 0
+	}
+	if sessionTime-*last < interval {
+		return false
+	}
+	*last = sessionTime
+	return true
+}
+
+// LinearFit returns the least squares slope and intercept of y over x, or zeros with fewer than two distinct x values
+func LinearFit(xs []float32, ys []float32) (float32, float32) {
+	n := float64(len(xs))
+	if n < 2 {
+		return 0, 0
+	}
+
+	var sumX, sumY, sumXX, sumXY float64
+	for i := range xs {
+		x, y := float64(xs[i]), float64(ys[i])
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, 0
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denominator
+	return float32(slope), float32((sumY - slope*sumX) / n)
+}
+
+// The channel helpers read a value of one car from a packet of their type, for channel tables like MOTEC_CHANNELS and MQTT_CHANNELS
+func telemetryChannel(value func(data *F1CarTelemetryData) float32) func(F1Packet, uint8) float32 {
+	return func(packet F1Packet, car uint8) float32 {
+		data := packet.(F1CarTelemetryDataPacket).CarTelemetryData[car]
+		return value(&data)
+	}
+}
+
+func motionChannel(value func(data *F1CarMotionData) float32) func(F1Packet, uint8) float32 {
+	return func(packet F1Packet, car uint8) float32 {
+		data := packet.(F1CarMotionDataPacket).CarMotionData[car]
+		return value(&data)
+	}
+}
+
+func lapChannel(value func(data *F1LapData) float32) func(F1Packet, uint8) float32 {
+	return func(packet F1Packet, car uint8) float32 {
+		data := packet.(F1LapDataPacket).LapData[car]
+		return value(&data)
+	}
+}
+
+func statusChannel(value func(data *F1CarStatusData) float32) func(F1Packet, uint8) float32 {
+	return func(packet F1Packet, car uint8) float32 {
+		data := packet.(F1CarStatusDataPacket).CarStatusData[car]
+		return value(&data)
+	}
+}
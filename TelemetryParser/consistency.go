@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	FULL_THROTTLE_THRESHOLD     float32 = 95 // throttle percentage that counts as flat out
+	CONSISTENCY_OUTLIER_SIGMA   float32 = 2  // standard deviations a lap has to be off the mean of the other laps to be an outlier
+	CONSISTENCY_MIN_OUTLIER_M   float32 = 5  // metres a lap has to be off the mean to be an outlier, however consistent the rest are
+	CONSISTENCY_MIN_LAPS_FOR_SD         = 2
+)
+
+type CornerLapPoints struct {
+	LapNum            uint8
+	BrakingPoint      float32 // -1 if the driver didn't brake
+	FullThrottlePoint float32 // -1 if the driver never got back to full throttle before the end of the corner
+}
+
+type PointOutlier struct {
+	LapNum    uint8
+	Distance  float32
+	Deviation float32 // metres, negative = earlier than the mean of the other laps
+}
+
+type PointStats struct {
+	Laps     int
+	Mean     float32
+	StdDev   float32
+	Outliers []PointOutlier
+}
+
+type CornerConsistency struct {
+	Number       int
+	Laps         []CornerLapPoints
+	Braking      PointStats
+	FullThrottle PointStats
+}
+
+type ConsistencyReport struct {
+	CarIndex uint8
+	TrackId  int8
+	FromLap  uint8
+	ToLap    uint8
+	Laps     int
+	Corners  []CornerConsistency
+}
+
+// PointStatistics computes the mean and standard deviation of the points that were reached (>= 0) and flags outliers.
+// Each point is compared to the mean and deviation of the other laps, so an outlier doesn't widen its own threshold.
+func PointStatistics(lapNums []uint8, points []float32) PointStats {
+	stats := PointStats{Outliers: make([]PointOutlier, 0)}
+
+	var sum, sumSquares float64
+	for _, p := range points {
+		if p >= 0 {
+			sum += float64(p)
+			sumSquares += float64(p) * float64(p)
+			stats.Laps++
+		}
+	}
+	if stats.Laps == 0 {
+		return stats
+	}
+	mean := sum / float64(stats.Laps)
+	stats.Mean = float32(mean)
+
+	if stats.Laps < CONSISTENCY_MIN_LAPS_FOR_SD {
+		return stats
+	}
+	stats.StdDev = float32(sampleStdDev(sum, sumSquares, stats.Laps))
+
+	others := stats.Laps - 1
+	if others < CONSISTENCY_MIN_LAPS_FOR_SD {
+		return stats
+	}
+	for i, p := range points {
+		if p < 0 {
+			continue
+		}
+		othersSum := sum - float64(p)
+		othersMean := othersSum / float64(others)
+		othersStdDev := sampleStdDev(othersSum, sumSquares-float64(p)*float64(p), others)
+
+		deviation := float32(float64(p) - othersMean)
+		magnitude := float32(math.Abs(float64(deviation)))
+		if magnitude >= CONSISTENCY_MIN_OUTLIER_M && magnitude > CONSISTENCY_OUTLIER_SIGMA*float32(othersStdDev) {
+			stats.Outliers = append(stats.Outliers, PointOutlier{lapNums[i], p, deviation})
+		}
+	}
+
+	return stats
+}
+
+func sampleStdDev(sum float64, sumSquares float64, n int) float64 {
+	variance := (sumSquares - sum*sum/float64(n)) / float64(n-1)
+	if variance < 0 {
+		return 0 // rounding of identical points
+	}
+	return math.Sqrt(variance)
+}
+
+// BuildConsistencyReport measures braking and full throttle points of a car at every corner over laps fromLap to toLap
+func BuildConsistencyReport(laps *LapTracker, registry *CornerRegistry, carIndex uint8, fromLap uint8, toLap uint8) (*ConsistencyReport, error) {
+	summaries, err := laps.GetLapSummaries(carIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	traces := make([]*LapTrace, 0, len(summaries))
+	for _, summary := range summaries {
+		if summary.LapNum < fromLap || summary.LapNum > toLap {
+			continue
+		}
+		trace, err := laps.GetLapTrace(carIndex, summary.LapNum)
+		if err == nil {
+			traces = append(traces, trace)
+		}
+	}
+	if len(traces) == 0 {
+		return nil, fmt.Errorf("car %d has no completed laps between lap %d and %d", carIndex, fromLap, toLap)
+	}
+
+	trackId := traces[0].TrackId
+	corners, err := registry.GetCorners(trackId)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ConsistencyReport{
+		CarIndex: carIndex,
+		TrackId:  trackId,
+		FromLap:  traces[0].LapNum,
+		ToLap:    traces[len(traces)-1].LapNum,
+		Laps:     len(traces),
+		Corners:  make([]CornerConsistency, 0, len(corners.Corners)),
+	}
+
+	for _, corner := range corners.Corners {
+		consistency := CornerConsistency{Number: corner.Number, Laps: make([]CornerLapPoints, 0, len(traces))}
+		lapNums := make([]uint8, 0, len(traces))
+		braking := make([]float32, 0, len(traces))
+		throttle := make([]float32, 0, len(traces))
+
+		for _, trace := range traces {
+			points := CornerLapPoints{
+				LapNum:            trace.LapNum,
+				BrakingPoint:      trace.BrakingPoint(corner.StartDistance, corner.ApexDistance, BRAKING_POINT_THRESHOLD),
+				FullThrottlePoint: trace.ThrottlePoint(corner.ApexDistance, corner.EndDistance, FULL_THROTTLE_THRESHOLD),
+			}
+			consistency.Laps = append(consistency.Laps, points)
+			lapNums = append(lapNums, points.LapNum)
+			braking = append(braking, points.BrakingPoint)
+			throttle = append(throttle, points.FullThrottlePoint)
+		}
+
+		consistency.Braking = PointStatistics(lapNums, braking)
+		consistency.FullThrottle = PointStatistics(lapNums, throttle)
+		report.Corners = append(report.Corners, consistency)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPointStatisticsFewLaps(t *testing.T) {
+	// with four laps the early one would widen the deviation enough to hide itself
+	stats := PointStatistics([]uint8{1, 2, 3, 4}, []float32{500, 501, 499, 470})
+	if len(stats.Outliers) != 1 || stats.Outliers[0].LapNum != 4 || stats.Outliers[0].Deviation != -30 {
+		t.Errorf("Expected lap 4 to be 30m early - %+v\n", stats.Outliers)
+	}
+
+	// two laps can't tell which one is off
+	stats = PointStatistics([]uint8{1, 2}, []float32{500, 470})
+	if len(stats.Outliers) != 0 || stats.StdDev == 0 {
+		t.Errorf("Expected no outliers from two laps - %+v\n", stats)
+	}
+}
+
+func TestPointStatistics(t *testing.T) {
+	// lap 5 brakes 30m early, lap 6 never brakes and is left out
+	lapNums := []uint8{1, 2, 3, 4, 5, 6, 7, 8}
+	points := []float32{500, 502, 498, 501, 470, -1, 499, 500}
+
+	stats := PointStatistics(lapNums, points)
+	if stats.Laps != 7 {
+		t.Fatalf("Expected 7 laps with a braking point, got %d\n", stats.Laps)
+	}
+	if math.Abs(float64(stats.Mean)-3470.0/7) > 0.01 {
+		t.Errorf("Unexpected mean - %.2f\n", stats.Mean)
+	}
+	if len(stats.Outliers) != 1 || stats.Outliers[0].LapNum != 5 || stats.Outliers[0].Deviation >= 0 {
+		t.Errorf("Expected lap 5 as the only early outlier - %+v\n", stats.Outliers)
+	}
+}
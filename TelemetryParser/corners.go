@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	CORNER_HEADING_WINDOW      = 2     // centerline points on either side used to measure the change of heading
+	CORNER_CURVATURE_THRESHOLD = 0.004 // 1/m, anything tighter than a 250m radius is part of a corner
+	CORNER_MIN_TURN_ANGLE      = 15    // degrees a corner has to turn the car through in total
+	CORNER_MERGE_GAP           = 40    // metres between two bends in the same direction to still be one corner
+	CORNER_APEX_SEARCH         = 50    // metres around a bend searched for the speed minimum
+	CORNER_APPROACH_DISTANCE   = 150   // metres before a bend that belong to the corner (braking zone)
+	CORNER_EXIT_DISTANCE       = 100   // metres after a bend that belong to the corner (traction zone)
+)
+
+type TrackCorner struct {
+	Number        int
+	Direction     string // "left" or "right"
+	StartDistance float32
+	ApexDistance  float32
+	EndDistance   float32
+	TurnAngle     float32 // degrees
+}
+
+type TrackCorners struct {
+	TrackId              int8
+	MapLaps              int    // laps the track map had when the corners were detected
+	ReferenceLapTimeInMS uint32 // 0 if the apexes weren't placed with a reference lap
+	Corners              []TrackCorner
+}
+
+type CornerStats struct {
+	Number             int
+	EntrySpeed         float32
+	MinSpeed           float32
+	MinSpeedDistance   float32
+	ExitSpeed          float32
+	MinGear            int8
+	BrakeStartDistance float32 // -1 if the driver didn't brake
+	TimeSpentMS        float32
+}
+
+// CornerRegistry detects the corners of each track and keeps the final ones on disk so numbering stays stable across sessions
+type CornerRegistry struct {
+	RWLock    sync.RWMutex
+	DataDir   string
+	TrackMaps *TrackMapBuilder
+	Laps      *LapTracker
+
+	corners map[int8]*TrackCorners
+}
+
+func (registry *CornerRegistry) Init(dataDir string, trackMaps *TrackMapBuilder, laps *LapTracker) {
+	registry.DataDir = dataDir
+	registry.TrackMaps = trackMaps
+	registry.Laps = laps
+	registry.corners = make(map[int8]*TrackCorners)
+}
+
+// GetCorners returns the corners of a track (-1 for the current one). Corners are detected from the track map and
+// re-detected while the map is still growing or a faster reference lap appears, they are only saved once they are final.
+// Final corners keep their numbering and boundaries, a faster reference lap only moves their apexes.
+func (registry *CornerRegistry) GetCorners(trackId int8) (*TrackCorners, error) {
+	if trackId < 0 {
+		trackId = registry.TrackMaps.CurrentTrackId()
+		if trackId < 0 {
+			return nil, fmt.Errorf("no active session")
+		}
+	}
+
+	registry.RWLock.RLock()
+	corners, ok := registry.corners[trackId]
+	registry.RWLock.RUnlock()
+
+	if !ok {
+		if loaded, err := LoadTrackCorners(registry.DataDir, trackId); err == nil {
+			corners = loaded
+			registry.store(corners)
+		}
+	}
+
+	reference := registry.Laps.GetFastestLapOnTrack(trackId)
+	if corners != nil && corners.Final() {
+		if !corners.fasterReference(reference) {
+			return corners, nil
+		}
+		corners = corners.RefineApexes(reference)
+	} else {
+		trackMap, err := registry.TrackMaps.GetTrackMap(trackId)
+		if err != nil {
+			if corners != nil {
+				return corners, nil
+			}
+			return nil, fmt.Errorf("can't detect corners without a track map - %s", err)
+		}
+
+		if corners != nil && corners.MapLaps >= trackMap.LapsUsed && !corners.fasterReference(reference) {
+			return corners, nil
+		}
+
+		// detection runs outside the lock, Cached is called from Poll
+		corners = DetectCorners(trackMap, reference)
+	}
+	registry.store(corners)
+
+	if corners.Final() {
+		err := corners.Save(registry.DataDir)
+		if err != nil {
+			Log.Printf("Failed to save corners of track %d - %s\n", trackId, err)
+		}
+	}
+
+	return corners, nil
+}
+
+// Cached returns the corners of a track (-1 for the current one) that GetCorners already detected or loaded, or nil.
+// It never detects corners or touches the disk, so it's safe to call while packets are being consumed.
+func (registry *CornerRegistry) Cached(trackId int8) *TrackCorners {
+	if trackId < 0 {
+		trackId = registry.TrackMaps.CurrentTrackId()
+	}
+
+	registry.RWLock.RLock()
+	defer registry.RWLock.RUnlock()
+
+	return registry.corners[trackId]
+}
+
+func (registry *CornerRegistry) store(corners *TrackCorners) {
+	registry.RWLock.Lock()
+	defer registry.RWLock.Unlock()
+
+	registry.corners[corners.TrackId] = corners
+}
+
+// Final reports whether the corners were detected on a complete track map with a reference lap to place the apexes
+func (corners *TrackCorners) Final() bool {
+	return corners.MapLaps >= TRACK_MAP_MAX_LAPS && corners.ReferenceLapTimeInMS > 0
+}
+
+func (corners *TrackCorners) fasterReference(reference *LapTrace) bool {
+	return reference != nil && (corners.ReferenceLapTimeInMS == 0 || reference.LapTimeInMS < corners.ReferenceLapTimeInMS)
+}
+
+// RefineApexes returns a copy of the corners with each apex moved to the speed minimum of `reference` inside the corner
+func (corners *TrackCorners) RefineApexes(reference *LapTrace) *TrackCorners {
+	refined := *corners
+	refined.ReferenceLapTimeInMS = reference.LapTimeInMS
+	refined.Corners = append([]TrackCorner(nil), corners.Corners...)
+
+	for i := range refined.Corners {
+		corner := &refined.Corners[i]
+		lo, hi := reference.indexRange(corner.StartDistance, corner.EndDistance)
+		apexIndex := -1
+		for j := lo; j < hi; j++ {
+			if apexIndex < 0 || reference.Speed[j] < reference.Speed[apexIndex] {
+				apexIndex = j
+			}
+		}
+		if apexIndex >= 0 {
+			corner.ApexDistance = reference.Distance[apexIndex]
+		}
+	}
+
+	return &refined
+}
+
+// Segments converts the corners into the segments used for lap comparisons
+func (corners *TrackCorners) Segments() []CornerSegment {
+	segments := make([]CornerSegment, len(corners.Corners))
+	for i, c := range corners.Corners {
+		segments[i] = CornerSegment{c.StartDistance, c.ApexDistance, c.EndDistance}
+	}
+	return segments
+}
+
+// CornerAt returns the number of the corner a lap distance lies in, 0 if it's on a straight or no corners are known
+func (corners *TrackCorners) CornerAt(distance float32) int {
+	if corners == nil {
+		return 0
+	}
+
+	for _, corner := range corners.Corners {
+		if distance >= corner.StartDistance && distance <= corner.EndDistance {
+			return corner.Number
+		}
+	}
+	return 0
+}
+
+// TrackCurvature returns the signed curvature (1/m, positive = right hander) at every centerline point
+func TrackCurvature(trackMap *TrackMap) []float64 {
+	n := len(trackMap.Points)
+	heading := make([]float64, n)
+	for i := 0; i < n; i++ {
+		a, b := trackMap.Points[i], trackMap.Points[(i+1)%n]
+		heading[i] = math.Atan2(float64(b.Z-a.Z), float64(b.X-a.X))
+	}
+
+	curvature := make([]float64, n)
+	baseline := float64(2*CORNER_HEADING_WINDOW) * float64(trackMap.DistanceStep)
+	for i := 0; i < n; i++ {
+		change := heading[(i+CORNER_HEADING_WINDOW)%n] - heading[((i-CORNER_HEADING_WINDOW)%n+n)%n]
+		for change > math.Pi {
+			change -= 2 * math.Pi
+		}
+		for change < -math.Pi {
+			change += 2 * math.Pi
+		}
+		curvature[i] = change / baseline
+	}
+
+	return curvature
+}
+
+// DetectCorners finds bends on the centerline by curvature and places their apex at the speed minimum of `reference`, if given
+func DetectCorners(trackMap *TrackMap, reference *LapTrace) *TrackCorners {
+	curvature := TrackCurvature(trackMap)
+	step := float64(trackMap.DistanceStep)
+
+	type bend struct {
+		start, end int
+		sign       float64
+		turn       float64
+		weighted   float64 // sum of index * curvature, the curvature centroid is used as apex without a reference lap
+	}
+
+	bends := make([]bend, 0)
+	var current *bend
+	for i, k := range curvature {
+		sign := math.Copysign(1, k)
+		if math.Abs(k) < CORNER_CURVATURE_THRESHOLD {
+			if current != nil {
+				bends = append(bends, *current)
+				current = nil
+			}
+			continue
+		}
+
+		if current != nil && current.sign != sign {
+			bends = append(bends, *current)
+			current = nil
+		}
+		if current == nil {
+			current = &bend{start: i, sign: sign}
+		}
+		current.end = i
+		current.turn += k * step
+		current.weighted += float64(i) * k * step
+	}
+	if current != nil {
+		bends = append(bends, *current)
+	}
+
+	merged := make([]bend, 0, len(bends))
+	for _, b := range bends {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.sign == b.sign && float64(b.start-last.end)*step <= CORNER_MERGE_GAP {
+				last.end = b.end
+				last.turn += b.turn
+				last.weighted += b.weighted
+				continue
+			}
+		}
+		merged = append(merged, b)
+	}
+
+	// a bend through the start/finish line shows up as one at either end of the centerline, the last one continues
+	// into the first with its indices shifted a lap back
+	n := len(curvature)
+	wrapped := false
+	if k := len(merged); k > 1 {
+		first, last := &merged[0], merged[k-1]
+		if first.sign == last.sign && float64(first.start+n-last.end)*step <= CORNER_MERGE_GAP {
+			first.start = last.start - n
+			first.turn += last.turn
+			first.weighted += last.weighted - float64(n)*last.turn
+			merged = merged[:k-1]
+			wrapped = true
+		}
+	}
+
+	lapLength := float64(n) * step
+	if trackMap.TrackLength > 0 {
+		lapLength = float64(trackMap.TrackLength)
+	}
+
+	corners := &TrackCorners{TrackId: trackMap.TrackId, MapLaps: trackMap.LapsUsed, Corners: make([]TrackCorner, 0)}
+	if reference != nil {
+		corners.ReferenceLapTimeInMS = reference.LapTimeInMS
+	}
+
+	var lastCorner *TrackCorner
+	for i, b := range merged {
+		turn := math.Abs(b.turn) * 180 / math.Pi
+		if turn < CORNER_MIN_TURN_ANGLE {
+			continue
+		}
+
+		apex := b.weighted / b.turn * step
+		if apex < 0 {
+			apex += float64(n) * step
+		}
+		corner := TrackCorner{
+			Direction:     "left",
+			StartDistance: float32(math.Max(0, float64(b.start)*step-CORNER_APPROACH_DISTANCE)),
+			ApexDistance:  float32(apex),
+			EndDistance:   float32(float64(b.end)*step + CORNER_EXIT_DISTANCE),
+			TurnAngle:     float32(turn),
+		}
+		if b.sign > 0 {
+			corner.Direction = "right"
+		}
+
+		if reference != nil {
+			ranges := [][2]float32{{float32(float64(b.start)*step - CORNER_APEX_SEARCH), float32(float64(b.end)*step + CORNER_APEX_SEARCH)}}
+			if b.start < 0 {
+				// the part of the bend before the line is at the end of the reference lap
+				ranges = append(ranges, [2]float32{ranges[0][0] + float32(float64(n)*step), float32(lapLength)})
+			}
+
+			apexIndex := -1
+			for _, r := range ranges {
+				lo, hi := reference.indexRange(r[0], r[1])
+				for j := lo; j < hi; j++ {
+					if apexIndex < 0 || reference.Speed[j] < reference.Speed[apexIndex] {
+						apexIndex = j
+					}
+				}
+			}
+			if apexIndex >= 0 {
+				corner.ApexDistance = reference.Distance[apexIndex]
+			}
+		}
+
+		// lap traces end at the line, so a corner through it covers the side its apex is on. With the apex before
+		// the line it's the last corner of the lap.
+		if wrapped && i == 0 && float64(corner.ApexDistance) > lapLength/2 {
+			corner.StartDistance = float32(float64(b.start+n)*step - CORNER_APPROACH_DISTANCE)
+			corner.EndDistance = float32(lapLength)
+			lastCorner = &corner
+			continue
+		}
+
+		corners.Corners = append(corners.Corners, corner)
+	}
+	if lastCorner != nil {
+		corners.Corners = append(corners.Corners, *lastCorner)
+	}
+	for i := range corners.Corners {
+		corners.Corners[i].Number = i + 1
+	}
+
+	// neighbouring corners share the straight between them instead of overlapping
+	for i := 1; i < len(corners.Corners); i++ {
+		prev, next := &corners.Corners[i-1], &corners.Corners[i]
+		if prev.EndDistance > next.StartDistance {
+			boundary := (prev.ApexDistance + next.ApexDistance) / 2
+			if prev.EndDistance > boundary {
+				prev.EndDistance = boundary
+			}
+			if next.StartDistance < boundary {
+				next.StartDistance = boundary
+			}
+		}
+	}
+	if n := len(corners.Corners); n > 0 && trackMap.TrackLength > 0 && corners.Corners[n-1].EndDistance > trackMap.TrackLength {
+		corners.Corners[n-1].EndDistance = trackMap.TrackLength
+	}
+
+	return corners
+}
+
+func (corners *TrackCorners) Save(dataDir string) error {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(corners)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(TrackDataPath(dataDir, corners.TrackId, "corners"), data, 0644)
+}
+
+func LoadTrackCorners(dataDir string, trackId int8) (*TrackCorners, error) {
+	data, err := os.ReadFile(TrackDataPath(dataDir, trackId, "corners"))
+	if err != nil {
+		return nil, err
+	}
+
+	corners := &TrackCorners{}
+	err = json.Unmarshal(data, corners)
+	if err != nil {
+		return nil, err
+	}
+
+	return corners, nil
+}
+
+// ComputeCornerStats measures how a lap went through each corner of its track
+func ComputeCornerStats(trace *LapTrace, corners *TrackCorners) []CornerStats {
+	stats := make([]CornerStats, 0, len(corners.Corners))
+	for _, corner := range corners.Corners {
+		lo, hi := trace.indexRange(corner.StartDistance, corner.EndDistance)
+		if lo == hi {
+			continue
+		}
+
+		s := CornerStats{
+			Number:             corner.Number,
+			EntrySpeed:         trace.Speed[lo],
+			MinSpeed:           trace.Speed[lo],
+			MinSpeedDistance:   trace.Distance[lo],
+			ExitSpeed:          trace.Speed[hi-1],
+			MinGear:            trace.Gear[lo],
+			BrakeStartDistance: trace.BrakingPoint(corner.StartDistance, corner.ApexDistance, BRAKING_POINT_THRESHOLD),
+			TimeSpentMS:        trace.TimeAtDistance(corner.EndDistance) - trace.TimeAtDistance(corner.StartDistance),
+		}
+
+		for i := lo; i < hi; i++ {
+			if trace.Speed[i] < s.MinSpeed {
+				s.MinSpeed = trace.Speed[i]
+				s.MinSpeedDistance = trace.Distance[i]
+			}
+			if trace.Gear[i] > 0 && (trace.Gear[i] < s.MinGear || s.MinGear <= 0) {
+				s.MinGear = trace.Gear[i]
+			}
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats
+}
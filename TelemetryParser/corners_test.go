@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// makeStadiumTrackMap builds a 2 x 500m straights + 2 x 180 degree hairpins (radius 50m) track, driven clockwise
+func makeStadiumTrackMap() *TrackMap {
+	const straight = 500
+	const radius = 50
+	turn := math.Pi * radius
+	length := 2*straight + 2*turn
+
+	trackMap := &TrackMap{TrackId: 3, TrackLength: float32(length), DistanceStep: TRACK_MAP_DISTANCE_STEP}
+	for d := 0.0; d < length; d += TRACK_MAP_DISTANCE_STEP {
+		var x, z float64
+		switch {
+		case d < straight:
+			x, z = d, 0
+		case d < straight+turn:
+			a := (d - straight) / radius
+			x, z = straight+radius*math.Sin(a), radius-radius*math.Cos(a)
+		case d < 2*straight+turn:
+			x, z = straight-(d-straight-turn), 2*radius
+		default:
+			a := (d - 2*straight - turn) / radius
+			x, z = -radius*math.Sin(a), radius+radius*math.Cos(a)
+		}
+		trackMap.Points = append(trackMap.Points, TrackMapPoint{float32(d), float32(x), 0, float32(z)})
+	}
+	trackMap.computeBounds()
+	return trackMap
+}
+
+func TestCornerDetection(t *testing.T) {
+	corners := DetectCorners(makeStadiumTrackMap(), nil)
+
+	if len(corners.Corners) != 2 {
+		t.Fatalf("Expected 2 corners, got %d\n", len(corners.Corners))
+	}
+
+	for i, corner := range corners.Corners {
+		if corner.Direction != "right" {
+			t.Errorf("Corner %d should be a right hander\n", corner.Number)
+		}
+
+		if corner.TurnAngle < 170 || corner.TurnAngle > 190 {
+			t.Errorf("Corner %d should turn 180 degrees, got %f\n", corner.Number, corner.TurnAngle)
+		}
+
+		expectedApex := float32(500 + 78.5 + float64(i)*(500+157))
+		if math.Abs(float64(corner.ApexDistance-expectedApex)) > 30 {
+			t.Errorf("Corner %d apex at %f, expected around %f\n", corner.Number, corner.ApexDistance, expectedApex)
+		}
+	}
+}
+
+func TestCornerDetectionAcrossLine(t *testing.T) {
+	// start the lap in the middle of the second hairpin
+	trackMap := makeStadiumTrackMap()
+	shift := len(trackMap.Points) - 16 // half of the 157m hairpin
+	points := append(trackMap.Points[shift:], trackMap.Points[:shift]...)
+	trackMap.Points = make([]TrackMapPoint, len(points))
+	for i, p := range points {
+		trackMap.Points[i] = TrackMapPoint{float32(i) * TRACK_MAP_DISTANCE_STEP, p.X, p.Y, p.Z}
+	}
+
+	corners := DetectCorners(trackMap, nil)
+	if len(corners.Corners) != 2 {
+		t.Fatalf("Expected the hairpin through the line to be one corner, got %d corners\n", len(corners.Corners))
+	}
+	for _, corner := range corners.Corners {
+		if corner.TurnAngle < 170 || corner.TurnAngle > 190 {
+			t.Errorf("Corner %d should turn 180 degrees, got %f\n", corner.Number, corner.TurnAngle)
+		}
+		if corner.StartDistance > corner.EndDistance {
+			t.Errorf("Corner %d ends before it starts\n", corner.Number)
+		}
+	}
+}
+
+func TestCornerRegistry(t *testing.T) {
+	dataDir := t.TempDir()
+	trackMaps := &TrackMapBuilder{}
+	trackMaps.Init(dataDir)
+	laps := &LapTracker{}
+	laps.Init()
+	registry := &CornerRegistry{}
+	registry.Init(dataDir, trackMaps, laps)
+
+	trackMap := makeStadiumTrackMap()
+	trackMap.LapsUsed = 1
+	trackMaps.maps[trackMap.TrackId] = trackMap
+
+	corners, err := registry.GetCorners(trackMap.TrackId)
+	if err != nil || corners.Final() {
+		t.Fatalf("Expected provisional corners from a single lap map - %v\n", err)
+	}
+	if registry.Cached(trackMap.TrackId) != corners {
+		t.Errorf("Expected provisional corners to be cached\n")
+	}
+	if _, err := LoadTrackCorners(dataDir, trackMap.TrackId); err == nil {
+		t.Errorf("Provisional corners shouldn't be saved\n")
+	}
+
+	// slowest in the first hairpin at `slowest` and in the second one a straight and a hairpin later
+	reference := func(lapTime uint32, slowest float32) *LapTrace {
+		trace := &LapTrace{TrackId: trackMap.TrackId, LapTimeInMS: lapTime, Valid: true, DistanceStep: TRACK_MAP_DISTANCE_STEP}
+		for d := float32(0); d < trackMap.TrackLength; d += TRACK_MAP_DISTANCE_STEP {
+			trace.Distance = append(trace.Distance, d)
+			trace.Speed = append(trace.Speed, 100+float32(math.Min(math.Abs(float64(d-slowest)), math.Abs(float64(d-slowest-657)))))
+		}
+		return trace
+	}
+
+	trackMap.LapsUsed = TRACK_MAP_MAX_LAPS
+	laps.laps[0][1] = reference(90000, 560)
+	corners, _ = registry.GetCorners(trackMap.TrackId)
+	if !corners.Final() || corners.Corners[0].ApexDistance != 560 {
+		t.Fatalf("Expected final corners with the apex of the reference lap, got %+v\n", corners)
+	}
+	if _, err := LoadTrackCorners(dataDir, trackMap.TrackId); err != nil {
+		t.Errorf("Final corners should be saved - %s\n", err)
+	}
+
+	// a faster lap on a map that has since changed moves the apexes, but the saved corners keep their boundaries
+	final := corners
+	trackMap.Points = trackMap.Points[:len(trackMap.Points)/2]
+	laps.laps[0][2] = reference(89000, 590)
+	corners, _ = registry.GetCorners(trackMap.TrackId)
+	if corners.ReferenceLapTimeInMS != 89000 || corners.Corners[0].ApexDistance != 590 {
+		t.Errorf("Expected a faster lap to move the apex, got %+v\n", corners.Corners[0])
+	}
+	if len(corners.Corners) != len(final.Corners) {
+		t.Fatalf("Expected %d corners after refining the apexes, got %d\n", len(final.Corners), len(corners.Corners))
+	}
+	for i, corner := range corners.Corners {
+		if corner.Number != final.Corners[i].Number || corner.StartDistance != final.Corners[i].StartDistance || corner.EndDistance != final.Corners[i].EndDistance {
+			t.Errorf("Corner %d changed from %+v to %+v\n", i, final.Corners[i], corner)
+		}
+	}
+	if saved, err := LoadTrackCorners(dataDir, trackMap.TrackId); err != nil || saved.Corners[0].ApexDistance != 590 {
+		t.Errorf("Expected the refined apexes to be saved - %v\n", err)
+	}
+}
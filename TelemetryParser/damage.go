@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DAMAGE_DATA_DIR            = "damage_data"
+	DAMAGE_SESSIONS_FILE       = "sessions.json"
+	DAMAGE_MAX_CHANGES_PER_CAR = 5000
+	DAMAGE_MAX_STORED_SESSIONS = 500
+)
+
+type damageComponent struct {
+	Name  string
+	Body  bool // body parts only get damaged on contact, these jumps are incidents
+	Value func(damage *F1CarDamageData) uint8
+}
+
+// Every damage and wear value of F1CarDamageData, tyre wear is followed by the tyre wear model. Faults are 0 or 1.
+var DAMAGE_COMPONENTS = []damageComponent{
+	{"RL tyre", false, func(d *F1CarDamageData) uint8 { return d.TyresDamage[0] }},
+	{"RR tyre", false, func(d *F1CarDamageData) uint8 { return d.TyresDamage[1] }},
+	{"FL tyre", false, func(d *F1CarDamageData) uint8 { return d.TyresDamage[2] }},
+	{"FR tyre", false, func(d *F1CarDamageData) uint8 { return d.TyresDamage[3] }},
+	{"RL brake", false, func(d *F1CarDamageData) uint8 { return d.BrakesDamage[0] }},
+	{"RR brake", false, func(d *F1CarDamageData) uint8 { return d.BrakesDamage[1] }},
+	{"FL brake", false, func(d *F1CarDamageData) uint8 { return d.BrakesDamage[2] }},
+	{"FR brake", false, func(d *F1CarDamageData) uint8 { return d.BrakesDamage[3] }},
+	{"front left wing", true, func(d *F1CarDamageData) uint8 { return d.FrontLeftWingDamage }},
+	{"front right wing", true, func(d *F1CarDamageData) uint8 { return d.FrontRightWingDamage }},
+	{"rear wing", true, func(d *F1CarDamageData) uint8 { return d.RearWingDamage }},
+	{"floor", true, func(d *F1CarDamageData) uint8 { return d.FloorDamage }},
+	{"diffuser", true, func(d *F1CarDamageData) uint8 { return d.DiffuserDamage }},
+	{"sidepod", true, func(d *F1CarDamageData) uint8 { return d.SidepodDamage }},
+	{"DRS fault", false, func(d *F1CarDamageData) uint8 { return d.DRSFault }},
+	{"ERS fault", false, func(d *F1CarDamageData) uint8 { return d.ERSFault }},
+	{"gearbox", false, func(d *F1CarDamageData) uint8 { return d.GearBoxDamage }},
+	{"engine", false, func(d *F1CarDamageData) uint8 { return d.EngineDamage }},
+	{"MGU-H", false, func(d *F1CarDamageData) uint8 { return d.EngineMGUHWear }},
+	{"ES", false, func(d *F1CarDamageData) uint8 { return d.EngineESWear }},
+	{"CE", false, func(d *F1CarDamageData) uint8 { return d.EngineCEWear }},
+	{"ICE", false, func(d *F1CarDamageData) uint8 { return d.EngineICEWear }},
+	{"MGU-K", false, func(d *F1CarDamageData) uint8 { return d.EngineMGUKWear }},
+	{"TC", false, func(d *F1CarDamageData) uint8 { return d.EngineTCWear }},
+	{"engine blown", false, func(d *F1CarDamageData) uint8 { return d.EngineBlown }},
+	{"engine seized", false, func(d *F1CarDamageData) uint8 { return d.EngineSeized }},
+}
+
+// PowerUnitWear holds the wear of the power unit components and the gearbox, in percent
+type PowerUnitWear struct {
+	ICE     uint8
+	MGUH    uint8
+	MGUK    uint8
+	ES      uint8
+	CE      uint8
+	TC      uint8
+	Gearbox uint8
+}
+
+func MakePowerUnitWear(damage *F1CarDamageData) PowerUnitWear {
+	return PowerUnitWear{
+		ICE:     damage.EngineICEWear,
+		MGUH:    damage.EngineMGUHWear,
+		MGUK:    damage.EngineMGUKWear,
+		ES:      damage.EngineESWear,
+		CE:      damage.EngineCEWear,
+		TC:      damage.EngineTCWear,
+		Gearbox: damage.GearBoxDamage,
+	}
+}
+
+// Added returns the wear added since `start`, components that were replaced in between count from 0
+func (wear PowerUnitWear) Added(start PowerUnitWear) PowerUnitWear {
+	added := func(to uint8, from uint8) uint8 {
+		if to < from {
+			return to
+		}
+		return to - from
+	}
+	return PowerUnitWear{
+		ICE:     added(wear.ICE, start.ICE),
+		MGUH:    added(wear.MGUH, start.MGUH),
+		MGUK:    added(wear.MGUK, start.MGUK),
+		ES:      added(wear.ES, start.ES),
+		CE:      added(wear.CE, start.CE),
+		TC:      added(wear.TC, start.TC),
+		Gearbox: added(wear.Gearbox, start.Gearbox),
+	}
+}
+
+// PowerUnitWearTotal adds up wear over several sessions, it passes 100 once components have been replaced
+type PowerUnitWearTotal struct {
+	ICE     int
+	MGUH    int
+	MGUK    int
+	ES      int
+	CE      int
+	TC      int
+	Gearbox int
+}
+
+func (total *PowerUnitWearTotal) Add(wear PowerUnitWear) {
+	total.ICE += int(wear.ICE)
+	total.MGUH += int(wear.MGUH)
+	total.MGUK += int(wear.MGUK)
+	total.ES += int(wear.ES)
+	total.CE += int(wear.CE)
+	total.TC += int(wear.TC)
+	total.Gearbox += int(wear.Gearbox)
+}
+
+type DamageChange struct {
+	CarIndex    uint8
+	Component   string
+	FromPercent uint8
+	ToPercent   uint8
+	SessionTime float32
+	LapNum      uint8
+}
+
+type CarDamageSummary struct {
+	CarIndex       uint8
+	Driver         string
+	TeamId         uint8
+	Final          map[string]uint8 // every component's damage at the end of the session
+	Changes        int
+	Repairs        int // body parts that were fixed, usually a new front wing at a pit stop
+	PowerUnitWear  PowerUnitWear
+	PowerUnitAdded PowerUnitWear // wear added during the session
+}
+
+type DamageSessionSummary struct {
+	SessionUID  uint64
+	TrackId     int8
+	SessionType uint8
+	EndedAt     time.Time
+	Cars        []CarDamageSummary
+}
+
+// DriverPowerUnitUsage adds up the power unit wear of a driver over all stored sessions
+type DriverPowerUnitUsage struct {
+	Driver      string
+	Sessions    int
+	LastSession uint64
+	Latest      PowerUnitWear      // wear at the end of the driver's latest session
+	Added       PowerUnitWearTotal // wear added over all sessions
+}
+
+type carDamageState struct {
+	damage          F1CarDamageData
+	haveDamage      bool
+	startWear       PowerUnitWear
+	lapNum          uint8
+	participant     F1ParticipantData
+	haveParticipant bool
+	changes         []DamageChange
+	changeCount     int
+	repairs         int
+}
+
+// DamageTracker keeps a change log of the damage of every car and summarises every session it saw
+type DamageTracker struct {
+	RWLock  sync.RWMutex
+	DataDir string
+
+	sessionUID    uint64
+	trackId       int8
+	sessionType   uint8
+	numActiveCars int
+	cars          [F1_MAX_NUM_CARS]carDamageState
+	sessions      []DamageSessionSummary
+}
+
+func (tracker *DamageTracker) Init(dataDir string) {
+	tracker.DataDir = dataDir
+	tracker.sessions = make([]DamageSessionSummary, 0)
+
+	sessions, err := LoadDamageSessions(dataDir)
+	if err == nil {
+		tracker.sessions = sessions
+	} else if !os.IsNotExist(err) {
+		Log.Printf("Failed to load damage history - %s\n", err)
+	}
+
+	tracker.Reset()
+}
+
+// Reset summarises the running session before forgetting it
+func (tracker *DamageTracker) Reset() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.startSession(0)
+}
+
+// Close summarises the running session, so it isn't lost when the app quits before the next session starts
+func (tracker *DamageTracker) Close() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.finishSession()
+}
+
+func (tracker *DamageTracker) startSession(sessionUID uint64) {
+	tracker.finishSession()
+
+	tracker.sessionUID = sessionUID
+	tracker.trackId = -1
+	tracker.sessionType = 0
+	tracker.numActiveCars = 0
+	for i := range tracker.cars {
+		tracker.cars[i] = carDamageState{changes: make([]DamageChange, 0)}
+	}
+}
+
+func (tracker *DamageTracker) finishSession() {
+	if tracker.sessionUID == 0 {
+		return
+	}
+
+	summary := tracker.summary()
+	if len(summary.Cars) == 0 {
+		return
+	}
+
+	// a replayed session replaces the summary it got when it ran live
+	for i := range tracker.sessions {
+		if tracker.sessions[i].SessionUID == summary.SessionUID {
+			tracker.sessions = append(tracker.sessions[:i], tracker.sessions[i+1:]...)
+			break
+		}
+	}
+	tracker.sessions = append(tracker.sessions, summary)
+	if len(tracker.sessions) > DAMAGE_MAX_STORED_SESSIONS {
+		tracker.sessions = tracker.sessions[1:]
+	}
+
+	err := SaveDamageSessions(tracker.DataDir, tracker.sessions)
+	if err != nil {
+		Log.Printf("Failed to save damage history - %s\n", err)
+	}
+}
+
+func (tracker *DamageTracker) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	if header.SessionUID != tracker.sessionUID {
+		tracker.startSession(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		tracker.trackId = p.SessionData.TrackId
+		tracker.sessionType = p.SessionData.SessionType
+	case F1ParticipantsDataPacket:
+		tracker.numActiveCars = int(p.ParticipantsData.NumActiveCars)
+		for i := range p.ParticipantsData.Participants {
+			tracker.cars[i].participant = p.ParticipantsData.Participants[i]
+			tracker.cars[i].haveParticipant = true
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			tracker.cars[i].lapNum = p.LapData[i].CurrentLapNum
+		}
+	case F1CarDamageDataPacket:
+		for i := range p.CarDamageData {
+			tracker.consumeDamage(header, uint8(i), &p.CarDamageData[i])
+		}
+	}
+}
+
+func (tracker *DamageTracker) consumeDamage(header *F1PacketHeader, carIndex uint8, damage *F1CarDamageData) {
+	state := &tracker.cars[carIndex]
+	if !state.haveDamage {
+		state.damage = *damage
+		state.haveDamage = true
+		state.startWear = MakePowerUnitWear(damage)
+		return
+	}
+
+	for _, component := range DAMAGE_COMPONENTS {
+		from := component.Value(&state.damage)
+		to := component.Value(damage)
+		if from == to {
+			continue
+		}
+
+		if component.Body && to < from {
+			state.repairs++
+		}
+		state.changeCount++
+		state.changes = append(state.changes, DamageChange{
+			CarIndex:    carIndex,
+			Component:   component.Name,
+			FromPercent: from,
+			ToPercent:   to,
+			SessionTime: header.SessionTime,
+			LapNum:      state.lapNum,
+		})
+	}
+	if len(state.changes) > DAMAGE_MAX_CHANGES_PER_CAR {
+		state.changes = state.changes[len(state.changes)-DAMAGE_MAX_CHANGES_PER_CAR:]
+	}
+
+	state.damage = *damage
+}
+
+func driverName(carIndex uint8, participant *F1ParticipantData) string {
+	if name := participant.DriverName(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("Car %d", carIndex)
+}
+
+func (tracker *DamageTracker) summary() DamageSessionSummary {
+	summary := DamageSessionSummary{
+		SessionUID:  tracker.sessionUID,
+		TrackId:     tracker.trackId,
+		SessionType: tracker.sessionType,
+		EndedAt:     time.Now(),
+		Cars:        make([]CarDamageSummary, 0, F1_MAX_NUM_CARS),
+	}
+
+	for i := range tracker.cars {
+		state := &tracker.cars[i]
+		// the damage packet covers every grid slot, empty ones aren't worth keeping
+		if !state.haveDamage || !state.haveParticipant || i >= tracker.numActiveCars {
+			continue
+		}
+
+		final := make(map[string]uint8, len(DAMAGE_COMPONENTS))
+		for _, component := range DAMAGE_COMPONENTS {
+			final[component.Name] = component.Value(&state.damage)
+		}
+
+		wear := MakePowerUnitWear(&state.damage)
+		summary.Cars = append(summary.Cars, CarDamageSummary{
+			CarIndex:       uint8(i),
+			Driver:         driverName(uint8(i), &state.participant),
+			TeamId:         state.participant.TeamId,
+			Final:          final,
+			Changes:        state.changeCount,
+			Repairs:        state.repairs,
+			PowerUnitWear:  wear,
+			PowerUnitAdded: wear.Added(state.startWear),
+		})
+	}
+
+	return summary
+}
+
+// GetChanges returns the damage change log of a car in the current session
+func (tracker *DamageTracker) GetChanges(carIndex uint8) []DamageChange {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return append([]DamageChange{}, tracker.cars[carIndex].changes...)
+}
+
+// GetSummary summarises the damage of the current session so far
+func (tracker *DamageTracker) GetSummary() DamageSessionSummary {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return tracker.summary()
+}
+
+// GetSessions returns the summaries of every finished session, oldest first
+func (tracker *DamageTracker) GetSessions() []DamageSessionSummary {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return append([]DamageSessionSummary{}, tracker.sessions...)
+}
+
+// GetPowerUnitUsage adds up the power unit wear of every driver over the finished sessions and the current one
+func (tracker *DamageTracker) GetPowerUnitUsage() []DriverPowerUnitUsage {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	sessions := append([]DamageSessionSummary{}, tracker.sessions...)
+	if current := tracker.summary(); tracker.sessionUID != 0 && len(current.Cars) > 0 {
+		sessions = append(sessions, current)
+	}
+
+	drivers := make(map[string]*DriverPowerUnitUsage)
+	for _, session := range sessions {
+		for _, car := range session.Cars {
+			usage, ok := drivers[car.Driver]
+			if !ok {
+				usage = &DriverPowerUnitUsage{Driver: car.Driver}
+				drivers[car.Driver] = usage
+			}
+
+			usage.Sessions++
+			usage.LastSession = session.SessionUID
+			usage.Latest = car.PowerUnitWear
+			usage.Added.Add(car.PowerUnitAdded)
+		}
+	}
+
+	result := make([]DriverPowerUnitUsage, 0, len(drivers))
+	for _, usage := range drivers {
+		result = append(result, *usage)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Driver < result[j].Driver })
+	return result
+}
+
+func SaveDamageSessions(dataDir string, sessions []DamageSessionSummary) error {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dataDir, DAMAGE_SESSIONS_FILE), data, 0644)
+}
+
+func LoadDamageSessions(dataDir string) ([]DamageSessionSummary, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, DAMAGE_SESSIONS_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]DamageSessionSummary, 0)
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDamageTracker(t *testing.T) {
+	dataDir := t.TempDir()
+	tracker := DamageTracker{}
+	tracker.Init(dataDir)
+
+	// two cars on the grid, the damage packet still has all 22 slots
+	participants := F1ParticipantsDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	participants.ParticipantsData.NumActiveCars = 2
+	copy(participants.ParticipantsData.Participants[0].Name[:], "Driver A")
+	copy(participants.ParticipantsData.Participants[1].Name[:], "Driver B")
+	tracker.ConsumePacket(participants)
+
+	lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	lapData.LapData[0].CurrentLapNum = 7
+	tracker.ConsumePacket(lapData)
+
+	damage := F1CarDamageDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 10}}
+	damage.CarDamageData[0].EngineICEWear = 20
+	tracker.ConsumePacket(damage)
+
+	// a broken front wing that gets replaced, while the ICE wears
+	damage.f1PacketHeader = &F1PacketHeader{SessionUID: 1, SessionTime: 20}
+	damage.CarDamageData[0].FrontLeftWingDamage = 60
+	damage.CarDamageData[0].EngineICEWear = 23
+	tracker.ConsumePacket(damage)
+	damage.f1PacketHeader = &F1PacketHeader{SessionUID: 1, SessionTime: 60}
+	damage.CarDamageData[0].FrontLeftWingDamage = 0
+	tracker.ConsumePacket(damage)
+
+	changes := tracker.GetChanges(0)
+	if len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %+v\n", changes)
+	}
+	if changes[0].Component != "front left wing" || changes[0].ToPercent != 60 || changes[0].LapNum != 7 || changes[0].SessionTime != 20 {
+		t.Errorf("Unexpected wing damage - %+v\n", changes[0])
+	}
+
+	// the next session finishes this one
+	tracker.ConsumePacket(F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 2}})
+
+	sessions := tracker.GetSessions()
+	if len(sessions) != 1 || len(sessions[0].Cars) != 2 {
+		t.Fatalf("Expected one finished session with the active cars - %+v\n", sessions)
+	}
+	car := sessions[0].Cars[0]
+	if car.Driver != "Driver A" || car.Repairs != 1 || car.PowerUnitWear.ICE != 23 || car.PowerUnitAdded.ICE != 3 {
+		t.Errorf("Unexpected summary - %+v\n", car)
+	}
+
+	reloaded := DamageTracker{}
+	reloaded.Init(dataDir)
+	usage := reloaded.GetPowerUnitUsage()
+	if len(usage) != 2 || usage[0].Driver != "Driver A" || usage[1].Driver != "Driver B" {
+		t.Fatalf("Unexpected power unit usage - %+v\n", usage)
+	}
+	for _, driver := range usage {
+		if driver.Driver == "Driver A" && (driver.Sessions != 1 || driver.Added.ICE != 3) {
+			t.Errorf("Unexpected power unit usage of Driver A - %+v\n", driver)
+		}
+	}
+
+	// quitting during a session stores it too
+	participants.f1PacketHeader = &F1PacketHeader{SessionUID: 2}
+	tracker.ConsumePacket(participants)
+	damage.f1PacketHeader = &F1PacketHeader{SessionUID: 2}
+	tracker.ConsumePacket(damage)
+	tracker.Close()
+
+	reloaded.Init(dataDir)
+	if sessions := reloaded.GetSessions(); len(sessions) != 2 || sessions[1].SessionUID != 2 {
+		t.Errorf("Expected the running session to be saved on close - %+v\n", sessions)
+	}
+}
+
+func TestPowerUnitUsageOverASeason(t *testing.T) {
+	tracker := DamageTracker{}
+	tracker.Init(t.TempDir())
+
+	// three sessions that each wear out a fresh ICE
+	for uid := uint64(1); uid <= 3; uid++ {
+		car := CarDamageSummary{Driver: "Driver A", PowerUnitWear: PowerUnitWear{ICE: 90}, PowerUnitAdded: PowerUnitWear{ICE: 90}}
+		tracker.sessions = append(tracker.sessions, DamageSessionSummary{SessionUID: uid, Cars: []CarDamageSummary{car}})
+	}
+
+	usage := tracker.GetPowerUnitUsage()
+	if len(usage) != 1 || usage[0].Sessions != 3 || usage[0].Added.ICE != 270 {
+		t.Errorf("Expected 270%% ICE wear over 3 sessions - %+v\n", usage)
+	}
+}
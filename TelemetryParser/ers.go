@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	ERS_DISTANCE_STEP        float32 = 50      // metres per accounting bin
+	ERS_MAX_DEPLOY_PER_LAP_J float32 = 4000000 // deployment allowance per lap
+	ERS_UNUSED_THRESHOLD_J   float32 = 500000  // energy left in the store and the allowance that counts as wasted at the end of a lap
+	ERS_MIN_ZONE_ENERGY_J    float32 = 1000    // bins with less energy than this don't start or extend a zone
+	ERS_MAX_LAPS_PER_CAR             = 200
+	ERSZone_Deploy                   = "deploy"
+	ERSZone_Harvest                  = "harvest"
+)
+
+var ERS_DEPLOY_MODE_NAMES = [4]string{"none", "medium", "hotlap", "overtake"}
+
+type ERSBin struct {
+	Distance      float32 // start of the bin
+	DeployedJ     float32
+	HarvestedMGUK float32
+	HarvestedMGUH float32
+}
+
+type ERSZone struct {
+	Kind          string
+	StartDistance float32
+	EndDistance   float32
+	EnergyJ       float32
+	Points        []TrackMapPoint `json:",omitempty"` // centerline of the zone, only filled in for overlays
+}
+
+type ERSLap struct {
+	CarIndex        uint8
+	TrackId         int8
+	LapNum          uint8
+	DeployedJ       float32
+	HarvestedMGUK   float32
+	HarvestedMGUH   float32
+	NetBalanceJ     float32 // harvested - deployed
+	StoreAtStartJ   float32
+	StoreAtEndJ     float32
+	UnusedEnergyJ   float32 // energy that could still have been deployed when the lap ended
+	UnusedEnergy    bool
+	DeployModeTimeS map[string]float32
+	Bins            []ERSBin `json:",omitempty"`
+	Zones           []ERSZone
+}
+
+type carERSState struct {
+	lapNum         uint8
+	lapDistance    float32
+	haveStatus     bool
+	lastDeployed   float32
+	lastHarvestedK float32
+	lastHarvestedH float32
+	lastStatusTime float32
+	lap            *ERSLap
+	laps           []*ERSLap
+}
+
+// ERSTracker accounts where on the lap each car deploys and harvests electrical energy
+type ERSTracker struct {
+	RWLock sync.RWMutex
+
+	sessionUID  uint64
+	trackId     int8
+	trackLength float32
+	cars        [F1_MAX_NUM_CARS]carERSState
+}
+
+func (tracker *ERSTracker) Init() {
+	tracker.Reset()
+}
+
+func (tracker *ERSTracker) Reset() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.reset(0)
+}
+
+func (tracker *ERSTracker) reset(sessionUID uint64) {
+	tracker.sessionUID = sessionUID
+	tracker.trackId = -1
+	tracker.trackLength = 0
+	for i := range tracker.cars {
+		tracker.cars[i] = carERSState{laps: make([]*ERSLap, 0)}
+	}
+}
+
+func (tracker *ERSTracker) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	if header.SessionUID != tracker.sessionUID {
+		tracker.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		tracker.trackId = p.SessionData.TrackId
+		tracker.trackLength = float32(p.SessionData.TrackLength)
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			tracker.processLapData(uint8(i), &p.LapData[i])
+		}
+	case F1CarStatusDataPacket:
+		for i := range p.CarStatusData {
+			tracker.processStatus(uint8(i), header.SessionTime, &p.CarStatusData[i])
+		}
+	}
+}
+
+func (tracker *ERSTracker) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &tracker.cars[carIndex]
+	if lapData.ResultStatus < 2 {
+		return
+	}
+
+	if lapData.CurrentLapNum != state.lapNum {
+		if state.lap != nil && lapData.CurrentLapNum == state.lapNum+1 {
+			tracker.closeLap(state)
+		}
+		state.lapNum = lapData.CurrentLapNum
+		state.lap = tracker.newLap(carIndex, state)
+	}
+	state.lapDistance = lapData.LapDistance
+}
+
+func (tracker *ERSTracker) newLap(carIndex uint8, state *carERSState) *ERSLap {
+	bins := 0
+	if tracker.trackLength > 0 {
+		bins = int(tracker.trackLength/ERS_DISTANCE_STEP) + 1
+	}
+
+	lap := &ERSLap{
+		CarIndex:        carIndex,
+		TrackId:         tracker.trackId,
+		LapNum:          state.lapNum,
+		StoreAtStartJ:   -1,
+		DeployModeTimeS: make(map[string]float32),
+		Bins:            make([]ERSBin, bins),
+	}
+	for i := range lap.Bins {
+		lap.Bins[i].Distance = float32(i) * ERS_DISTANCE_STEP
+	}
+	return lap
+}
+
+func (tracker *ERSTracker) processStatus(carIndex uint8, sessionTime float32, status *F1CarStatusData) {
+	state := &tracker.cars[carIndex]
+	if state.lap == nil {
+		return
+	}
+	lap := state.lap
+
+	if lap.StoreAtStartJ < 0 {
+		lap.StoreAtStartJ = status.ERSScoreEnergy
+	}
+	lap.StoreAtEndJ = status.ERSScoreEnergy
+
+	// the game's per lap counters drop back to zero when the car crosses the line
+	deployed := ersDelta(status.ERSDeployedThisLap, state.lastDeployed)
+	harvestedK := ersDelta(status.ERSHarvestedThisLapMGUK, state.lastHarvestedK)
+	harvestedH := ersDelta(status.ERSHarvestedThisLapMGUH, state.lastHarvestedH)
+
+	if state.haveStatus {
+		lap.DeployedJ += deployed
+		lap.HarvestedMGUK += harvestedK
+		lap.HarvestedMGUH += harvestedH
+
+		bin := int(state.lapDistance / ERS_DISTANCE_STEP)
+		if bin >= 0 && bin < len(lap.Bins) {
+			lap.Bins[bin].DeployedJ += deployed
+			lap.Bins[bin].HarvestedMGUK += harvestedK
+			lap.Bins[bin].HarvestedMGUH += harvestedH
+		}
+
+		if status.ERSDeployMode < uint8(len(ERS_DEPLOY_MODE_NAMES)) && sessionTime > state.lastStatusTime {
+			lap.DeployModeTimeS[ERS_DEPLOY_MODE_NAMES[status.ERSDeployMode]] += sessionTime - state.lastStatusTime
+		}
+	}
+
+	state.haveStatus = true
+	state.lastDeployed = status.ERSDeployedThisLap
+	state.lastHarvestedK = status.ERSHarvestedThisLapMGUK
+	state.lastHarvestedH = status.ERSHarvestedThisLapMGUH
+	state.lastStatusTime = sessionTime
+}
+
+func ersDelta(value float32, last float32) float32 {
+	if value < last {
+		return value
+	}
+	return value - last
+}
+
+func (tracker *ERSTracker) closeLap(state *carERSState) {
+	lap := state.lap
+	if lap.StoreAtStartJ < 0 {
+		return
+	}
+
+	lap.NetBalanceJ = lap.HarvestedMGUK + lap.HarvestedMGUH - lap.DeployedJ
+
+	allowance := ERS_MAX_DEPLOY_PER_LAP_J - lap.DeployedJ
+	lap.UnusedEnergyJ = lap.StoreAtEndJ
+	if allowance < lap.UnusedEnergyJ {
+		lap.UnusedEnergyJ = allowance
+	}
+	if lap.UnusedEnergyJ < 0 {
+		lap.UnusedEnergyJ = 0
+	}
+	lap.UnusedEnergy = lap.UnusedEnergyJ >= ERS_UNUSED_THRESHOLD_J
+	lap.Zones = ERSZones(lap.Bins)
+
+	state.laps = append(state.laps, lap)
+	if len(state.laps) > ERS_MAX_LAPS_PER_CAR {
+		state.laps = state.laps[1:]
+	}
+}
+
+// ERSZones merges neighbouring bins where energy was mostly deployed or mostly harvested into zones
+func ERSZones(bins []ERSBin) []ERSZone {
+	zones := make([]ERSZone, 0)
+	var current *ERSZone
+
+	for _, bin := range bins {
+		harvested := bin.HarvestedMGUK + bin.HarvestedMGUH
+		kind, energy := "", float32(0)
+		if bin.DeployedJ >= ERS_MIN_ZONE_ENERGY_J && bin.DeployedJ >= harvested {
+			kind, energy = ERSZone_Deploy, bin.DeployedJ
+		} else if harvested >= ERS_MIN_ZONE_ENERGY_J {
+			kind, energy = ERSZone_Harvest, harvested
+		}
+
+		if current != nil && current.Kind != kind {
+			zones = append(zones, *current)
+			current = nil
+		}
+		if kind == "" {
+			continue
+		}
+		if current == nil {
+			current = &ERSZone{Kind: kind, StartDistance: bin.Distance}
+		}
+		current.EndDistance = bin.Distance + ERS_DISTANCE_STEP
+		current.EnergyJ += energy
+	}
+	if current != nil {
+		zones = append(zones, *current)
+	}
+
+	return zones
+}
+
+// GetLaps returns the completed laps of a car without their bins
+func (tracker *ERSTracker) GetLaps(carIndex uint8) ([]ERSLap, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	laps := make([]ERSLap, 0, len(tracker.cars[carIndex].laps))
+	for _, lap := range tracker.cars[carIndex].laps {
+		summary := *lap
+		summary.Bins = nil
+		laps = append(laps, summary)
+	}
+	return laps, nil
+}
+
+func (tracker *ERSTracker) GetLap(carIndex uint8, lapNum uint8) (*ERSLap, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	for _, lap := range tracker.cars[carIndex].laps {
+		if lap.LapNum == lapNum {
+			return lap, nil
+		}
+	}
+	return nil, fmt.Errorf("no ERS data for lap %d of car %d", lapNum, carIndex)
+}
+
+// ZoneOverlay places the zones of a lap on the centerline of its track map
+func (lap *ERSLap) ZoneOverlay(trackMap *TrackMap) []ERSZone {
+	zones := make([]ERSZone, len(lap.Zones))
+	for i, zone := range lap.Zones {
+		zones[i] = zone
+		zones[i].Points = make([]TrackMapPoint, 0)
+		for d := zone.StartDistance; d < zone.EndDistance; d += trackMap.DistanceStep {
+			zones[i].Points = append(zones[i].Points, trackMap.PositionAtDistance(d))
+		}
+		zones[i].Points = append(zones[i].Points, trackMap.PositionAtDistance(zone.EndDistance))
+	}
+	return zones
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestERSTracker(t *testing.T) {
+	tracker := ERSTracker{}
+	tracker.Init()
+
+	session := F1SessionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Session, SessionUID: 6}}
+	session.SessionData.TrackId = 3
+	session.SessionData.TrackLength = 1000
+	tracker.ConsumePacket(session)
+
+	// lap 1 deploys 100kJ per bin up to 300m and harvests 50kJ per bin from 600 to 800m, lap 2 deploys the whole allowance
+	sessionTime := float32(0)
+	for lap := 1; lap <= 3; lap++ {
+		deployed, harvested := float32(0), float32(0)
+		for d := float32(0); d < 1000; d += ERS_DISTANCE_STEP {
+			switch {
+			case lap == 1 && d > 0 && d <= 300:
+				deployed += 100000
+			case lap == 1 && d >= 600 && d < 800:
+				harvested += 50000
+			case lap == 2:
+				deployed += ERS_MAX_DEPLOY_PER_LAP_J / 20
+			}
+			sessionTime += 1
+
+			lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 6, SessionTime: sessionTime}}
+			lapData.LapData[0].CurrentLapNum = uint8(lap)
+			lapData.LapData[0].LapDistance = d
+			lapData.LapData[0].ResultStatus = 2
+			tracker.ConsumePacket(lapData)
+
+			status := F1CarStatusDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarStatus, SessionUID: 6, SessionTime: sessionTime}}
+			status.CarStatusData[0].ERSDeployedThisLap = deployed
+			status.CarStatusData[0].ERSHarvestedThisLapMGUK = harvested
+			status.CarStatusData[0].ERSScoreEnergy = 3000000
+			status.CarStatusData[0].ERSDeployMode = 1
+			tracker.ConsumePacket(status)
+		}
+	}
+
+	laps, err := tracker.GetLaps(0)
+	if err != nil || len(laps) != 2 {
+		t.Fatalf("Expected 2 completed laps, got %d - %v\n", len(laps), err)
+	}
+
+	lap, _ := tracker.GetLap(0, 1)
+	if lap.DeployedJ != 600000 || lap.HarvestedMGUK != 200000 || lap.NetBalanceJ != -400000 {
+		t.Errorf("Unexpected energy totals - %+v\n", lap)
+	}
+	if len(lap.Zones) != 2 {
+		t.Fatalf("Expected a deploy and a harvest zone, got %+v\n", lap.Zones)
+	}
+	if zone := lap.Zones[0]; zone.Kind != ERSZone_Deploy || zone.StartDistance != 50 || zone.EndDistance != 350 || zone.EnergyJ != 600000 {
+		t.Errorf("Unexpected deploy zone - %+v\n", zone)
+	}
+	if zone := lap.Zones[1]; zone.Kind != ERSZone_Harvest || zone.StartDistance != 600 || zone.EndDistance != 800 || zone.EnergyJ != 200000 {
+		t.Errorf("Unexpected harvest zone - %+v\n", zone)
+	}
+	if lap.DeployModeTimeS["medium"] < 19 {
+		t.Errorf("Expected the lap in medium deploy mode - %v\n", lap.DeployModeTimeS)
+	}
+
+	// a full store with most of the allowance left is wasted energy, using the whole allowance isn't
+	if !lap.UnusedEnergy || lap.UnusedEnergyJ != 3000000 {
+		t.Errorf("Expected 3MJ unused on lap 1, got %f\n", lap.UnusedEnergyJ)
+	}
+	if lap, _ := tracker.GetLap(0, 2); lap.UnusedEnergy || lap.UnusedEnergyJ != 0 || lap.DeployedJ != ERS_MAX_DEPLOY_PER_LAP_J {
+		t.Errorf("Expected the allowance to be used up on lap 2 - %+v\n", lap)
+	}
+
+	overlay := lap.ZoneOverlay(makeStadiumTrackMap())
+	if len(overlay[0].Points) != 61 || overlay[0].Points[0].X != 50 {
+		t.Errorf("Expected the deploy zone on the first straight - %+v\n", overlay[0].Points)
+	}
+}
+
+func TestERSZonesMinimumEnergy(t *testing.T) {
+	bins := []ERSBin{{0, 5000, 0, 0}, {50, 500, 0, 0}, {100, 5000, 0, 0}, {150, 0, 3000, 1000}}
+	zones := ERSZones(bins)
+	if len(zones) != 3 || zones[0].EndDistance != 50 || zones[1].StartDistance != 100 || zones[2].Kind != ERSZone_Harvest || zones[2].EnergyJ != 4000 {
+		t.Errorf("Expected bins below the minimum energy to split zones - %+v\n", zones)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	ExportFormat_CSV     = "csv"
+	ExportFormat_Parquet = "parquet"
+)
+
+const (
+	ExportType_Int64 = iota
+	ExportType_Uint64
+	ExportType_Float32
+	ExportType_String
+)
+
+// Table names of the packet types, indexed by packet ID
+var EXPORT_TABLE_NAMES = [PacketID_Count]string{
+	"motion", "session", "lap_data", "event", "participants", "car_setups", "car_telemetry", "car_status",
+	"final_classification", "lobby_info", "car_damage", "session_history", "tyre_sets", "motion_ex",
+}
+
+// ExportColumn holds the values of one column, only the slice of its type is used
+type ExportColumn struct {
+	Name    string
+	Type    int
+	Ints    []int64
+	Uints   []uint64
+	Floats  []float32
+	Strings []string
+}
+
+func (column *ExportColumn) Format(row int) string {
+	switch column.Type {
+	case ExportType_Int64:
+		return strconv.FormatInt(column.Ints[row], 10)
+	case ExportType_Uint64:
+		return strconv.FormatUint(column.Uints[row], 10)
+	case ExportType_Float32:
+		return strconv.FormatFloat(float64(column.Floats[row]), 'g', -1, 32)
+	default:
+		return column.Strings[row]
+	}
+}
+
+type ExportTable struct {
+	Name    string
+	Columns []*ExportColumn
+	Rows    int
+}
+
+func (table *ExportTable) addColumn(name string, columnType int) *ExportColumn {
+	column := &ExportColumn{Name: name, Type: columnType}
+	table.Columns = append(table.Columns, column)
+	return column
+}
+
+// Truncate drops the rows of a table and keeps its columns
+func (table *ExportTable) Truncate() {
+	for _, column := range table.Columns {
+		column.Ints = column.Ints[:0]
+		column.Uints = column.Uints[:0]
+		column.Floats = column.Floats[:0]
+		column.Strings = column.Strings[:0]
+	}
+	table.Rows = 0
+}
+
+// exportStep is one step from a packet body to a value, a struct field or an array element
+type exportStep struct {
+	field bool
+	index int
+}
+
+type exportLeaf struct {
+	name       string
+	columnType int
+	path       []exportStep
+}
+
+// exportLayout describes how a packet body is flattened into rows. Bodies holding an array with an element per car
+// become a row per car, everything else becomes a single row.
+type exportLayout struct {
+	shared   []exportLeaf // relative to the body
+	perCar   bool
+	carArray []exportStep // path from the body to the per car array
+	car      []exportLeaf // relative to an element of the per car array
+}
+
+var exportHeaderLeaves = exportLeaves(reflect.TypeOf(F1PacketHeader{}), "", nil, "")
+
+// exportLeaves lists the scalar values of a type. [4] arrays are per wheel in the order RL, RR, FL, FR and named after
+// the wheels, other arrays get the element index as a suffix. Byte arrays tagged `export:"string"` are text.
+func exportLeaves(t reflect.Type, name string, path []exportStep, tag reflect.StructTag) []exportLeaf {
+	withStep := func(step exportStep) []exportStep {
+		return append(append(make([]exportStep, 0, len(path)+1), path...), step)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		leaves := make([]exportLeaf, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldName := field.Name
+			if name != "" {
+				fieldName = name + "_" + field.Name
+			}
+			leaves = append(leaves, exportLeaves(field.Type, fieldName, withStep(exportStep{true, i}), field.Tag)...)
+		}
+		return leaves
+	case reflect.Array:
+		if tag.Get("export") == "string" {
+			return []exportLeaf{{name, ExportType_String, path}}
+		}
+		leaves := make([]exportLeaf, 0, t.Len())
+		for i := 0; i < t.Len(); i++ {
+			suffix := strconv.Itoa(i)
+			if t.Len() == 4 {
+				suffix = TYRE_CORNER_NAMES[i]
+			}
+			leaves = append(leaves, exportLeaves(t.Elem(), name+"_"+suffix, withStep(exportStep{false, i}), "")...)
+		}
+		return leaves
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return []exportLeaf{{name, ExportType_Int64, path}}
+	case reflect.Uint64:
+		return []exportLeaf{{name, ExportType_Uint64, path}}
+	case reflect.Float32, reflect.Float64:
+		return []exportLeaf{{name, ExportType_Float32, path}}
+	}
+	return nil
+}
+
+func isPerCarArray(t reflect.Type) bool {
+	return t.Kind() == reflect.Array && t.Len() == F1_MAX_NUM_CARS && t.Elem().Kind() == reflect.Struct
+}
+
+func makeExportLayout(body reflect.Type) exportLayout {
+	if isPerCarArray(body) {
+		return exportLayout{perCar: true, car: exportLeaves(body.Elem(), "", nil, "")}
+	}
+
+	layout := exportLayout{}
+	for i := 0; i < body.NumField(); i++ {
+		field := body.Field(i)
+		if !layout.perCar && isPerCarArray(field.Type) {
+			layout.perCar = true
+			layout.carArray = []exportStep{{true, i}}
+			layout.car = exportLeaves(field.Type.Elem(), "", nil, "")
+			continue
+		}
+		layout.shared = append(layout.shared, exportLeaves(field.Type, field.Name, []exportStep{{true, i}}, field.Tag)...)
+	}
+	return layout
+}
+
+func (leaf *exportLeaf) appendValue(column *ExportColumn, root reflect.Value) {
+	v := root
+	for _, step := range leaf.path {
+		if step.field {
+			v = v.Field(step.index)
+		} else {
+			v = v.Index(step.index)
+		}
+	}
+
+	switch leaf.columnType {
+	case ExportType_Int64:
+		if v.CanInt() {
+			column.Ints = append(column.Ints, v.Int())
+		} else {
+			column.Ints = append(column.Ints, int64(v.Uint()))
+		}
+	case ExportType_Uint64:
+		column.Uints = append(column.Uints, v.Uint())
+	case ExportType_Float32:
+		column.Floats = append(column.Floats, float32(v.Float()))
+	case ExportType_String:
+		text := make([]byte, 0, v.Len())
+		for i := 0; i < v.Len() && v.Index(i).Uint() != 0; i++ {
+			text = append(text, byte(v.Index(i).Uint()))
+		}
+		column.Strings = append(column.Strings, string(text))
+	}
+}
+
+type exportTableBuilder struct {
+	table  *ExportTable
+	layout exportLayout
+}
+
+// PacketExporter flattens packets into a table per packet type. Each row holds the header fields, the car index
+// (255 for packets that aren't about a car) and every field of the packet.
+type PacketExporter struct {
+	builders map[uint8]*exportTableBuilder
+}
+
+func MakePacketExporter() PacketExporter {
+	return PacketExporter{make(map[uint8]*exportTableBuilder)}
+}
+
+func (exporter *PacketExporter) AddPacket(packet F1Packet) {
+	header := packet.Header()
+	if header.PacketId >= PacketID_Count {
+		return
+	}
+	body := reflect.ValueOf(packet).Field(1)
+
+	builder, ok := exporter.builders[header.PacketId]
+	if !ok {
+		builder = &exportTableBuilder{&ExportTable{Name: EXPORT_TABLE_NAMES[header.PacketId]}, makeExportLayout(body.Type())}
+		for _, leaf := range exportHeaderLeaves {
+			builder.table.addColumn(leaf.name, leaf.columnType)
+		}
+		builder.table.addColumn("CarIndex", ExportType_Int64)
+		for _, leaf := range builder.layout.shared {
+			builder.table.addColumn(leaf.name, leaf.columnType)
+		}
+		for _, leaf := range builder.layout.car {
+			builder.table.addColumn(leaf.name, leaf.columnType)
+		}
+		exporter.builders[header.PacketId] = builder
+	}
+
+	if !builder.layout.perCar {
+		builder.addRow(header, 255, body, reflect.Value{})
+		return
+	}
+
+	cars := body
+	for _, step := range builder.layout.carArray {
+		cars = cars.Field(step.index)
+	}
+	for i := 0; i < cars.Len(); i++ {
+		builder.addRow(header, uint8(i), body, cars.Index(i))
+	}
+}
+
+func (builder *exportTableBuilder) addRow(header *F1PacketHeader, carIndex uint8, body reflect.Value, car reflect.Value) {
+	columns := builder.table.Columns
+	headerValue := reflect.ValueOf(header).Elem()
+	for i := range exportHeaderLeaves {
+		exportHeaderLeaves[i].appendValue(columns[i], headerValue)
+	}
+	columns = columns[len(exportHeaderLeaves):]
+
+	columns[0].Ints = append(columns[0].Ints, int64(carIndex))
+	columns = columns[1:]
+
+	for i := range builder.layout.shared {
+		builder.layout.shared[i].appendValue(columns[i], body)
+	}
+	columns = columns[len(builder.layout.shared):]
+
+	for i := range builder.layout.car {
+		builder.layout.car[i].appendValue(columns[i], car)
+	}
+	builder.table.Rows++
+}
+
+// Table returns the table of a packet type, nil until a packet of the type was added
+func (exporter *PacketExporter) Table(packetId uint8) *ExportTable {
+	if builder, ok := exporter.builders[packetId]; ok {
+		return builder.table
+	}
+	return nil
+}
+
+// Tables returns the tables in packet ID order
+func (exporter *PacketExporter) Tables() []*ExportTable {
+	ids := make([]int, 0, len(exporter.builders))
+	for id := range exporter.builders {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	tables := make([]*ExportTable, 0, len(ids))
+	for _, id := range ids {
+		tables = append(tables, exporter.builders[uint8(id)].table)
+	}
+	return tables
+}
+
+// ExportRecording flattens every packet of a recording into tables
+func ExportRecording(filename string) ([]*ExportTable, error) {
+	exporter := MakePacketExporter()
+	err := ReadRecording(filename, exporter.AddPacket)
+	if err != nil {
+		return nil, err
+	}
+	return exporter.Tables(), nil
+}
+
+// Export returns the channels kept in the history as a table per packet type. The history only keeps the
+// channels listed in HISTORY_CHANNELS, so these tables are narrower than the ones of a recording.
+func (h *TelemetryHistory) Export() []*ExportTable {
+	h.RWLock.RLock()
+	defer h.RWLock.RUnlock()
+
+	ids := make([]int, 0, len(HISTORY_TABLE_WIDTHS))
+	for id := range HISTORY_TABLE_WIDTHS {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	tables := make([]*ExportTable, 0, len(ids))
+	for _, id := range ids {
+		packetID := uint8(id)
+		channels := make([]string, HISTORY_TABLE_WIDTHS[packetID])
+		for name, source := range HISTORY_CHANNELS {
+			if source.PacketID == packetID {
+				channels[source.Column] = name
+			}
+		}
+
+		table := &ExportTable{Name: "history_" + EXPORT_TABLE_NAMES[packetID]}
+		sessionUID := table.addColumn("SessionUID", ExportType_Uint64)
+		sessionTime := table.addColumn("SessionTime", ExportType_Float32)
+		carIndex := table.addColumn("CarIndex", ExportType_Int64)
+		values := make([]*ExportColumn, len(channels))
+		for c, name := range channels {
+			values[c] = table.addColumn(name, ExportType_Float32)
+		}
+
+		for car := range h.tables {
+			history, ok := h.tables[car][packetID]
+			if !ok {
+				continue
+			}
+			for i := history.start; i < len(history.Time); i++ {
+				sessionUID.Uints = append(sessionUID.Uints, h.sessionUID)
+				sessionTime.Floats = append(sessionTime.Floats, history.Time[i])
+				carIndex.Ints = append(carIndex.Ints, int64(car))
+				for c := range values {
+					values[c].Floats = append(values[c].Floats, history.Columns[c][i])
+				}
+				table.Rows++
+			}
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+func WriteCSV(w io.Writer, table *ExportTable) error {
+	writer := csv.NewWriter(w)
+
+	record := make([]string, len(table.Columns))
+	for c, column := range table.Columns {
+		record[c] = column.Name
+	}
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+
+	for row := 0; row < table.Rows; row++ {
+		for c, column := range table.Columns {
+			record[c] = column.Format(row)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func WriteExportTable(w io.Writer, table *ExportTable, format string) error {
+	switch format {
+	case ExportFormat_CSV:
+		return WriteCSV(w, table)
+	case ExportFormat_Parquet:
+		return WriteParquet(w, table)
+	}
+	return fmt.Errorf("unknown export format '%s'", format)
+}
+
+// WriteExportArchive writes every table as a file of a zip archive
+func WriteExportArchive(w io.Writer, tables []*ExportTable, format string) error {
+	archive := zip.NewWriter(w)
+	for _, table := range tables {
+		file, err := archive.Create(table.Name + "." + format)
+		if err != nil {
+			return err
+		}
+		if err := WriteExportTable(file, table, format); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// WriteExportFiles writes every table to a file of its own in `dir`
+func WriteExportFiles(dir string, tables []*ExportTable, format string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		file, err := os.Create(filepath.Join(dir, table.Name+"."+format))
+		if err != nil {
+			return err
+		}
+		err = WriteExportTable(file, table, format)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunExportCommand implements `TelemetryParser export -recording file -format csv|parquet -out dir`
+func RunExportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	recording := flags.String("recording", "", "Recording to export")
+	format := flags.String("format", ExportFormat_CSV, "Output format, csv or parquet")
+	out := flags.String("out", "export", "Directory the tables are written to, one file per packet type")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *recording == "" {
+		return fmt.Errorf("no recording given")
+	}
+	if *format != ExportFormat_CSV && *format != ExportFormat_Parquet {
+		return fmt.Errorf("unknown export format '%s'", *format)
+	}
+
+	tables, err := ExportRecording(*recording)
+	if err != nil {
+		return err
+	}
+	err = WriteExportFiles(*out, tables, *format)
+	if err != nil {
+		return err
+	}
+
+	Log.Printf("Exported %d tables of %s to %s\n", len(tables), *recording, *out)
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"math"
+	"testing"
+)
+
+// thriftReader decodes Thrift compact protocol into maps of field id to value, to check the Parquet metadata
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(fieldType byte) interface{} {
+	switch fieldType {
+	case thriftType_I32, thriftType_I64:
+		return r.zigzag()
+	case thriftType_Binary:
+		n := int(r.varint())
+		r.pos += n
+		return string(r.data[r.pos-n : r.pos])
+	case thriftType_List:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0F)
+		}
+		return list
+	case thriftType_Struct:
+		return r.readStruct()
+	}
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	id := int16(0)
+	for {
+		header := r.data[r.pos]
+		r.pos++
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta > 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+		fields[id] = r.value(header & 0x0F)
+	}
+}
+
+func TestPacketExport(t *testing.T) {
+	exporter := MakePacketExporter()
+
+	damage := F1CarDamageDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarDamage, SessionUID: 1 << 63, SessionTime: 1.5}}
+	damage.CarDamageData[3].TyresWear[2] = 12.5
+	exporter.AddPacket(damage)
+
+	participants := F1ParticipantsDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Participants}}
+	participants.ParticipantsData.NumActiveCars = 20
+	copy(participants.ParticipantsData.Participants[1].Name[:], "Driver B")
+	exporter.AddPacket(participants)
+
+	tables := exporter.Tables()
+	if len(tables) != 2 || tables[0].Name != "participants" || tables[1].Name != "car_damage" {
+		t.Fatalf("Unexpected tables - %v, %v\n", tables[0].Name, tables[1].Name)
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteCSV(&buf, tables[1]); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != F1_MAX_NUM_CARS+1 {
+		t.Fatalf("Expected a row per car, got %d rows\n", len(records)-1)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	row := records[4]
+	if row[columns["CarIndex"]] != "3" || row[columns["TyresWear_FL"]] != "12.5" || row[columns["SessionUID"]] != "9223372036854775808" {
+		t.Errorf("Unexpected row of car 3 - %v\n", row)
+	}
+
+	names := tables[0]
+	for _, column := range names.Columns {
+		if column.Name == "Name" && column.Strings[1] != "Driver B" {
+			t.Errorf("Expected the name of car 1 as text, got '%s'\n", column.Strings[1])
+		}
+		if column.Name == "NumActiveCars" && column.Ints[0] != 20 {
+			t.Errorf("Expected the number of active cars on every row\n")
+		}
+	}
+
+	buf.Reset()
+	if err := WriteParquet(&buf, tables[1]); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	footer := binary.LittleEndian.Uint32(data[len(data)-8:])
+	if string(data[:4]) != PARQUET_MAGIC || string(data[len(data)-4:]) != PARQUET_MAGIC || int(footer) >= len(data) {
+		t.Fatalf("Malformed parquet file\n")
+	}
+	checkParquetFile(t, data, tables[1])
+}
+
+// checkParquetFile decodes the footer of a Parquet file and checks it describes the table and its column chunks
+func checkParquetFile(t *testing.T, data []byte, table *ExportTable) {
+	metaEnd := len(data) - 8
+	metaStart := metaEnd - int(binary.LittleEndian.Uint32(data[metaEnd:]))
+	reader := thriftReader{data: data[:metaEnd], pos: metaStart}
+	meta := reader.readStruct()
+	if reader.pos != metaEnd {
+		t.Errorf("Footer is %d bytes, decoded %d\n", metaEnd-metaStart, reader.pos-metaStart)
+	}
+	if meta[1] != int64(1) || meta[3] != int64(table.Rows) {
+		t.Errorf("Expected version 1 and %d rows, got %v and %v\n", table.Rows, meta[1], meta[3])
+	}
+
+	schema := meta[2].([]interface{})
+	if len(schema) != len(table.Columns)+1 || schema[0].(map[int16]interface{})[5] != int64(len(table.Columns)) {
+		t.Fatalf("Expected a root and %d columns in the schema, got %d elements\n", len(table.Columns), len(schema))
+	}
+	for c, column := range table.Columns {
+		element := schema[c+1].(map[int16]interface{})
+		physicalType, convertedType := int64(parquetType_Int64), interface{}(nil)
+		switch column.Type {
+		case ExportType_Float32:
+			physicalType = parquetType_Float
+		case ExportType_String:
+			physicalType, convertedType = parquetType_ByteArray, int64(parquetConverted_UTF8)
+		case ExportType_Uint64:
+			convertedType = int64(parquetConverted_UINT64)
+		}
+		if element[4] != column.Name || element[1] != physicalType || element[6] != convertedType || element[3] != int64(parquetRepetition_Required) {
+			t.Errorf("Unexpected schema element for %s - %v\n", column.Name, element)
+		}
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("Expected one row group, got %d\n", len(rowGroups))
+	}
+	rowGroup := rowGroups[0].(map[int16]interface{})
+	chunks := rowGroup[1].([]interface{})
+	if len(chunks) != len(table.Columns) || rowGroup[3] != int64(table.Rows) {
+		t.Fatalf("Expected %d column chunks of %d rows, got %d\n", len(table.Columns), table.Rows, len(chunks))
+	}
+
+	// the chunks follow each other from the magic number up to the footer
+	offset, totalSize := int64(len(PARQUET_MAGIC)), int64(0)
+	for c, column := range table.Columns {
+		chunk := chunks[c].(map[int16]interface{})
+		chunkMeta := chunk[3].(map[int16]interface{})
+		path := chunkMeta[3].([]interface{})
+		if chunk[2] != offset || chunkMeta[9] != offset || len(path) != 1 || path[0] != column.Name || chunkMeta[5] != int64(table.Rows) {
+			t.Fatalf("Unexpected column chunk for %s at %d - %v\n", column.Name, offset, chunkMeta)
+		}
+
+		page := thriftReader{data: data, pos: int(offset)}
+		header := page.readStruct()
+		dataPage := header[5].(map[int16]interface{})
+		size := int64(page.pos) - offset + header[3].(int64)
+		if header[1] != int64(parquetPageType_Data) || dataPage[1] != int64(table.Rows) || chunkMeta[7] != size {
+			t.Fatalf("Unexpected data page for %s - %v\n", column.Name, header)
+		}
+		if column.Name == "TyresWear_FL" {
+			value := math.Float32frombits(binary.LittleEndian.Uint32(data[page.pos+3*4:]))
+			if value != 12.5 {
+				t.Errorf("Expected the tyre wear of car 3 in the data page, got %v\n", value)
+			}
+		}
+		offset += size
+		totalSize += size
+	}
+	if offset != int64(metaStart) || rowGroup[2] != totalSize {
+		t.Errorf("Column chunks end at %d, the footer starts at %d\n", offset, metaStart)
+	}
+}
@@ -57,11 +57,28 @@ type F1PacketHeader struct {
 	SecondaryPlayerCarIndex uint8   // Index of secondary player's car in the array (splitscreen), 255 if no second player
 }
 
-type F1EventDataDetails struct {
-	f1PacketHeader  *F1PacketHeader
-	EventStringCode [4]byte
+// The details of an event are a union of the event structs below, which one is given by the event code
+type F1EventData struct {
+	EventStringCode [4]byte `export:"string"`
+	EventDetails    [12]byte
 }
 
+type F1EventDataPacket struct {
+	f1PacketHeader *F1PacketHeader
+	EventData      F1EventData
+}
+
+const (
+	EventCode_Button       = "BUTN"
+	EventCode_Collision    = "COLL"
+	EventCode_Penalty      = "PENA"
+	EventCode_SafetyCar    = "SCAR"
+	EventCode_Retirement   = "RTMT"
+	EventCode_DRSDisabled  = "DRSD"
+	EventCode_DriveThrough = "DTSV"
+	EventCode_StopGo       = "SGSV"
+)
+
 const (
 	BUTTON_NONE  uint32 = 0x00
 	BUTTON_LEFT  uint32 = 0x10
@@ -71,8 +88,39 @@ const (
 )
 
 type F1ButtonEvent struct {
-	f1EventDataDetails *F1EventDataDetails
-	ButtonStatus       uint32 // Bit flags specifying which buttons are being pressed
+	ButtonStatus uint32 // Bit flags specifying which buttons are being pressed
+}
+
+type F1CollisionEvent struct {
+	Vehicle1Idx uint8 // Vehicle index of the first vehicle involved in the collision
+	Vehicle2Idx uint8 // Vehicle index of the second vehicle involved in the collision
+}
+
+type F1PenaltyEvent struct {
+	PenaltyType      uint8 // Penalty type – see appendices
+	InfringementType uint8 // Infringement type – see appendices
+	VehicleIdx       uint8 // Vehicle index of the car the penalty is applied to
+	OtherVehicleIdx  uint8 // Vehicle index of the other car involved
+	Time             uint8 // Time gained, or time spent doing action in seconds
+	LapNum           uint8 // Lap the penalty occurred on
+	PlacesGained     uint8 // Number of places gained by this
+}
+
+type F1SafetyCarEvent struct {
+	SafetyCarType uint8 // 0 = No Safety Car, 1 = Full Safety Car, 2 = Virtual Safety Car, 3 = Formation Lap Safety Car
+	EventType     uint8 // 0 = Deployed, 1 = Returning, 2 = Returned, 3 = Resume Race
+}
+
+type F1RetirementEvent struct {
+	VehicleIdx uint8 // Vehicle index of car retiring
+}
+
+type F1DRSDisabledEvent struct {
+	Reason uint8 // 0 = Wet track, 1 = Safety car deployed, 2 = Red flag, 3 = Min lap not reached
+}
+
+type F1ServedPenaltyEvent struct {
+	VehicleIdx uint8 // Vehicle index of the vehicle serving the drive through or stop go
 }
 
 type F1CarMotionData struct {
@@ -101,11 +149,94 @@ type F1CarMotionDataPacket struct {
 	CarMotionData  [F1_MAX_NUM_CARS]F1CarMotionData
 }
 
+// Extended motion data, only sent for the player car. All [4] arrays are in the order RL, RR, FL, FR
+type F1MotionExData struct {
+	SuspensionPosition     [4]float32 // Suspension position
+	SuspensionVelocity     [4]float32 // Suspension velocity
+	SuspensionAcceleration [4]float32 // Suspension acceleration
+	WheelSpeed             [4]float32 // Speed of each wheel
+	WheelSlipRatio         [4]float32 // Slip ratio for each wheel
+	WheelSlipAngle         [4]float32 // Slip angles for each wheel
+	WheelLatForce          [4]float32 // Lateral forces for each wheel
+	WheelLongForce         [4]float32 // Longitudinal forces for each wheel
+	HeightOfCOGAboveGround float32    // Height of centre of gravity above ground
+	LocalVelocityX         float32    // Velocity in local space – metres/s
+	LocalVelocityY         float32    // Velocity in local space
+	LocalVelocityZ         float32    // Velocity in local space
+	AngularVelocityX       float32    // Angular velocity x-component – radians/s
+	AngularVelocityY       float32    // Angular velocity y-component
+	AngularVelocityZ       float32    // Angular velocity z-component
+	AngularAccelerationX   float32    // Angular acceleration x-component – radians/s/s
+	AngularAccelerationY   float32    // Angular acceleration y-component
+	AngularAccelerationZ   float32    // Angular acceleration z-component
+	FrontWheelsAngle       float32    // Current front wheels angle in radians
+	WheelVertForce         [4]float32 // Vertical forces for each wheel
+}
+
+type F1MotionExDataPacket struct {
+	f1PacketHeader *F1PacketHeader
+	MotionExData   F1MotionExData
+}
+
+type F1ParticipantData struct {
+	AiControlled    uint8    // Whether the vehicle is AI (1) or Human (0) controlled
+	DriverId        uint8    // Driver id - see appendix, 255 if network human
+	NetworkId       uint8    // Network id – unique identifier for network players
+	TeamId          uint8    // Team id - see appendix
+	MyTeam          uint8    // My team flag – 1 = My Team, 0 = otherwise
+	RaceNumber      uint8    // Race number of the car
+	Nationality     uint8    // Nationality of the driver
+	Name            [48]byte `export:"string"` // Name of participant in UTF-8 format – null terminated, will be truncated with … (U+2026) if too long
+	YourTelemetry   uint8    // The player's UDP setting, 0 = restricted, 1 = public
+	ShowOnlineNames uint8    // The player's show online names setting, 0 = off, 1 = on
+	Platform        uint8    // 1 = Steam, 3 = PlayStation, 4 = Xbox, 6 = Origin, 255 = unknown
+}
+
+type F1ParticipantsData struct {
+	NumActiveCars uint8 // Number of active cars in the data – should match number of cars on HUD
+	Participants  [F1_MAX_NUM_CARS]F1ParticipantData
+}
+
+type F1ParticipantsDataPacket struct {
+	f1PacketHeader   *F1PacketHeader
+	ParticipantsData F1ParticipantsData
+}
+
+type F1CarSetupData struct {
+	FrontWing              uint8   // Front wing aero
+	RearWing               uint8   // Rear wing aero
+	OnThrottle             uint8   // Differential adjustment on throttle (percentage)
+	OffThrottle            uint8   // Differential adjustment off throttle (percentage)
+	FrontCamber            float32 // Front camber angle (suspension geometry)
+	RearCamber             float32 // Rear camber angle (suspension geometry)
+	FrontToe               float32 // Front toe angle (suspension geometry)
+	RearToe                float32 // Rear toe angle (suspension geometry)
+	FrontSuspension        uint8   // Front suspension
+	RearSuspension         uint8   // Rear suspension
+	FrontAntiRollBar       uint8   // Front anti-roll bar
+	RearAntiRollBar        uint8   // Front anti-roll bar
+	FrontSuspensionHeight  uint8   // Front ride height
+	RearSuspensionHeight   uint8   // Rear ride height
+	BrakePressure          uint8   // Brake pressure (percentage)
+	BrakeBias              uint8   // Brake bias (percentage)
+	RearLeftTyrePressure   float32 // Rear left tyre pressure (PSI)
+	RearRightTyrePressure  float32 // Rear right tyre pressure (PSI)
+	FrontLeftTyrePressure  float32 // Front left tyre pressure (PSI)
+	FrontRightTyrePressure float32 // Front right tyre pressure (PSI)
+	Ballast                uint8   // Ballast
+	FuelLoad               float32 // Fuel load
+}
+
+type F1CarSetupDataPacket struct {
+	f1PacketHeader *F1PacketHeader
+	CarSetups      [F1_MAX_NUM_CARS]F1CarSetupData
+}
+
 type F1CarTelemetryData struct {
 	Speed                   uint16     // Speed of car in kilometres per hour
-	Throttle                float32    // Amount of throttle applied (0.0 to 1.0)
-	Steer                   float32    // Steering (-1.0 (full lock left) to 1.0 (full lock right))
-	Brake                   float32    // Amount of brake applied (0.0 to 1.0)
+	Throttle                float32    // Amount of throttle applied (0.0 to 1.0, scaled to 0 to 100 by Parse)
+	Steer                   float32    // Steering (-1.0 (full lock left) to 1.0 (full lock right), scaled to -100 to 100 by Parse)
+	Brake                   float32    // Amount of brake applied (0.0 to 1.0, scaled to 0 to 100 by Parse)
 	Clutch                  uint8      // Amount of clutch applied (0 to 100)
 	Gear                    int8       // Gear selected (1-8, N=0, R=-1)
 	EngineRPM               uint16     // Engine RPM
@@ -200,6 +331,81 @@ type F1LapDataPacket struct {
 	TimeTrialRivalCarIdx uint8                      // Index of Rival car in time trial (255 if invalid)
 }
 
+type F1MarshalZone struct {
+	ZoneStart float32 // Fraction (0..1) of way through the lap the marshal zone starts
+	ZoneFlag  int8    // -1 = invalid/unknown, 0 = none, 1 = green, 2 = blue, 3 = yellow
+}
+
+type F1WeatherForecastSample struct {
+	SessionType            uint8 // 0 = unknown, 1 = P1, 2 = P2, 3 = P3, 4 = Short P, 5 = Q1, 6 = Q2, 7 = Q3, 8 = Short Q, 9 = OSQ, 10 = R, 11 = R2, 12 = R3, 13 = Time Trial
+	TimeOffset             uint8 // Time in minutes the forecast is for
+	Weather                uint8 // 0 = clear, 1 = light cloud, 2 = overcast, 3 = light rain, 4 = heavy rain, 5 = storm
+	TrackTemperature       int8  // Track temp. in degrees Celsius
+	TrackTemperatureChange int8  // Track temp. change – 0 = up, 1 = down, 2 = no change
+	AirTemperature         int8  // Air temp. in degrees celsius
+	AirTemperatureChange   int8  // Air temp. change – 0 = up, 1 = down, 2 = no change
+	RainPercentage         uint8 // Rain percentage (0-100)
+}
+
+type F1SessionData struct {
+	Weather                         uint8                       // 0 = clear, 1 = light cloud, 2 = overcast, 3 = light rain, 4 = heavy rain, 5 = storm
+	TrackTemperature                int8                        // Track temp. in degrees celsius
+	AirTemperature                  int8                        // Air temp. in degrees celsius
+	TotalLaps                       uint8                       // Total number of laps in this race
+	TrackLength                     uint16                      // Track length in metres
+	SessionType                     uint8                       // See F1WeatherForecastSample.SessionType for mappings
+	TrackId                         int8                        // -1 for unknown, see appendix
+	Formula                         uint8                       // 0 = F1 Modern, 1 = F1 Classic, 2 = F2, 3 = F1 Generic, 4 = Beta, 5 = Supercars, 6 = Esports, 7 = F2 2021
+	SessionTimeLeft                 uint16                      // Time left in session in seconds
+	SessionDuration                 uint16                      // Session duration in seconds
+	PitSpeedLimit                   uint8                       // Pit speed limit in kilometres per hour
+	GamePaused                      uint8                       // Whether the game is paused – network game only
+	IsSpectating                    uint8                       // Whether the player is spectating
+	SpectatorCarIndex               uint8                       // Index of the car being spectated
+	SliProNativeSupport             uint8                       // SLI Pro support, 0 = inactive, 1 = active
+	NumMarshalZones                 uint8                       // Number of marshal zones to follow
+	MarshalZones                    [21]F1MarshalZone           // List of marshal zones – max 21
+	SafetyCarStatus                 uint8                       // 0 = no safety car, 1 = full, 2 = virtual, 3 = formation lap
+	NetworkGame                     uint8                       // 0 = offline, 1 = online
+	NumWeatherForecastSamples       uint8                       // Number of weather samples to follow
+	WeatherForecastSamples          [56]F1WeatherForecastSample // Array of weather forecast samples
+	ForecastAccuracy                uint8                       // 0 = Perfect, 1 = Approximate
+	AIDifficulty                    uint8                       // AI Difficulty rating – 0-110
+	SeasonLinkIdentifier            uint32                      // Identifier for season - persists across saves
+	WeekendLinkIdentifier           uint32                      // Identifier for weekend - persists across saves
+	SessionLinkIdentifier           uint32                      // Identifier for session - persists across saves
+	PitStopWindowIdealLap           uint8                       // Ideal lap to pit on for current strategy (player)
+	PitStopWindowLatestLap          uint8                       // Latest lap to pit on for current strategy (player)
+	PitStopRejoinPosition           uint8                       // Predicted position to rejoin at (player)
+	SteeringAssist                  uint8                       // 0 = off, 1 = on
+	BrakingAssist                   uint8                       // 0 = off, 1 = low, 2 = medium, 3 = high
+	GearboxAssist                   uint8                       // 1 = manual, 2 = manual & suggested gear, 3 = auto
+	PitAssist                       uint8                       // 0 = off, 1 = on
+	PitReleaseAssist                uint8                       // 0 = off, 1 = on
+	ERSAssist                       uint8                       // 0 = off, 1 = on
+	DRSAssist                       uint8                       // 0 = off, 1 = on
+	DynamicRacingLine               uint8                       // 0 = off, 1 = corners only, 2 = full
+	DynamicRacingLineType           uint8                       // 0 = 2D, 1 = 3D
+	GameMode                        uint8                       // Game mode id - see appendix
+	RuleSet                         uint8                       // Ruleset - see appendix
+	TimeOfDay                       uint32                      // Local time of day - minutes since midnight
+	SessionLength                   uint8                       // 0 = None, 2 = Very Short, 3 = Short, 4 = Medium, 5 = Medium Long, 6 = Long, 7 = Full
+	SpeedUnitsLeadPlayer            uint8                       // 0 = MPH, 1 = KPH
+	TemperatureUnitsLeadPlayer      uint8                       // 0 = Celsius, 1 = Fahrenheit
+	SpeedUnitsSecondaryPlayer       uint8                       // 0 = MPH, 1 = KPH
+	TemperatureUnitsSecondaryPlayer uint8                       // 0 = Celsius, 1 = Fahrenheit
+	NumSafetyCarPeriods             uint8                       // Number of safety cars called during session
+	NumVirtualSafetyCarPeriods      uint8                       // Number of virtual safety cars called
+	NumRedFlagPeriods               uint8                       // Number of red flags called during session
+}
+
+// The session data is kept in its own struct (unlike the other packets) so recordings, which only store the
+// second field of a packet, capture all of it
+type F1SessionDataPacket struct {
+	f1PacketHeader *F1PacketHeader // Header
+	SessionData    F1SessionData
+}
+
 type F1FinalClassificationData struct {
 	Position          uint8    // Finishing position
 	NumLaps           uint8    // Number of laps completed
@@ -291,6 +497,49 @@ func (p F1CarDamageDataPacket) Header() *F1PacketHeader {
 	return p.f1PacketHeader
 }
 
+func (p F1SessionDataPacket) Header() *F1PacketHeader {
+	return p.f1PacketHeader
+}
+
+func (p F1MotionExDataPacket) Header() *F1PacketHeader {
+	return p.f1PacketHeader
+}
+
+func (p F1CarSetupDataPacket) Header() *F1PacketHeader {
+	return p.f1PacketHeader
+}
+
+func (p F1ParticipantsDataPacket) Header() *F1PacketHeader {
+	return p.f1PacketHeader
+}
+
+// DriverName returns the name of a participant, without the null terminator
+func (participant *F1ParticipantData) DriverName() string {
+	name := participant.Name[:]
+	if end := bytes.IndexByte(name, 0); end >= 0 {
+		name = name[:end]
+	}
+	return string(name)
+}
+
+func (p F1EventDataPacket) Header() *F1PacketHeader {
+	return p.f1PacketHeader
+}
+
+func (p F1EventDataPacket) Code() string {
+	return string(p.EventData.EventStringCode[:])
+}
+
+// DecodeEventDetails reads the details of an event into the struct matching its code
+func DecodeEventDetails[T any](p F1EventDataPacket, details *T) bool {
+	err := binary.Read(bytes.NewReader(p.EventData.EventDetails[:]), binary.LittleEndian, details)
+	if err != nil {
+		Log.Printf("Failed to decode details of event '%s' - %s\n", p.Code(), err)
+		return false
+	}
+	return true
+}
+
 func ParseStruct(reader *bytes.Reader, dstStruct any) bool {
 	v := reflect.ValueOf(dstStruct).Elem()
 	t := v.Type()
@@ -408,6 +657,9 @@ func (cl *F1UdpClient) Poll(packetStore *PacketStore) error {
 		}
 	}
 
+	if n > 0 {
+		Metrics.DatagramReceived(cl.readbuffer[:n])
+	}
 	cl.processingbuffer = append(cl.processingbuffer, cl.readbuffer[:n]...)
 
 	if len(cl.processingbuffer) > F1_PACKET_HEADER_PACKED_SIZE {
@@ -430,6 +682,18 @@ func (cl *F1UdpClient) Poll(packetStore *PacketStore) error {
 			}
 
 			SavePacket(packetStore, motiondata)
+		case PacketID_Session:
+			if cl.NeedToWaitForMoreData(&packetHeader) {
+				return nil
+			}
+
+			sessiondata := F1SessionDataPacket{f1PacketHeader: &packetHeader}
+			if !sessiondata.Parse(reader) {
+				err = fmt.Errorf("failed to parse session data")
+				Log.Println(err.Error())
+				break
+			}
+			SavePacket(packetStore, sessiondata)
 		case PacketID_LapData:
 			if cl.NeedToWaitForMoreData(&packetHeader) {
 				return nil
@@ -448,13 +712,37 @@ func (cl *F1UdpClient) Poll(packetStore *PacketStore) error {
 				return nil
 			}
 
-			eventDetails := F1EventDataDetails{}
-			if !eventDetails.Parse(reader, &packetHeader) {
+			event := F1EventDataPacket{f1PacketHeader: &packetHeader}
+			if !event.Parse(reader) {
 				err = fmt.Errorf("failed to parse event details")
 				Log.Println(err.Error())
-			} else {
-				eventDetails.ProcessEvent(reader)
+				break
+			}
+			SavePacket(packetStore, event)
+		case PacketID_Participants:
+			if cl.NeedToWaitForMoreData(&packetHeader) {
+				return nil
+			}
+
+			participants := F1ParticipantsDataPacket{f1PacketHeader: &packetHeader}
+			if !participants.Parse(reader) {
+				err = fmt.Errorf("failed to parse participants packet")
+				Log.Println(err.Error())
+				break
+			}
+			SavePacket(packetStore, participants)
+		case PacketID_CarSetups:
+			if cl.NeedToWaitForMoreData(&packetHeader) {
+				return nil
+			}
+
+			carSetups := F1CarSetupDataPacket{f1PacketHeader: &packetHeader}
+			if !carSetups.Parse(reader) {
+				err = fmt.Errorf("failed to parse car setups packet")
+				Log.Println(err.Error())
+				break
 			}
+			SavePacket(packetStore, carSetups)
 		case PacketID_CarTelemetry:
 			if cl.NeedToWaitForMoreData(&packetHeader) {
 				return nil
@@ -492,12 +780,25 @@ func (cl *F1UdpClient) Poll(packetStore *PacketStore) error {
 				break
 			}
 			SavePacket(packetStore, cardamage)
+		case PacketID_MotionEx:
+			if cl.NeedToWaitForMoreData(&packetHeader) {
+				return nil
+			}
+
+			motionEx := F1MotionExDataPacket{f1PacketHeader: &packetHeader}
+			if !motionEx.Parse(reader) {
+				err = fmt.Errorf("failed to parse motion ex packet")
+				Log.Println(err.Error())
+				break
+			}
+			SavePacket(packetStore, motionEx)
 		default:
 			// Log.Printf("not implemented packet type %d handling\n", packetHeader.PacketId)
 			cl.processingbuffer = cl.processingbuffer[n:]
 			return nil
 		}
 
+		Metrics.PacketDecoded(packetHeader.PacketId, err == nil)
 		cl.PacketProcessCleanup(&packetHeader)
 		return err
 	}
@@ -532,46 +833,6 @@ func (header *F1PacketHeader) Parse(data *bytes.Reader) bool {
 	return true
 }
 
-func (details *F1EventDataDetails) Parse(data *bytes.Reader, packetHeader *F1PacketHeader) bool {
-	if data.Len() < len(details.EventStringCode) {
-		Log.Printf("Can't parse EventStringCode, not enough data (%d bytes)\n", data.Len())
-		return false
-	}
-
-	details.f1PacketHeader = packetHeader
-	binary.Read(data, binary.LittleEndian, &details.EventStringCode)
-	return true
-}
-
-func (details *F1EventDataDetails) ProcessEvent(data *bytes.Reader) bool {
-	eventString := string(details.EventStringCode[:])
-
-	switch eventString {
-	case "BUTN":
-		event := F1ButtonEvent{}
-		if !event.Parse(data, details) {
-			Log.Panicln("Failed to process button event, stopping")
-		}
-
-	default:
-		Log.Printf("Event processing for '%s' not implemented\n", eventString)
-	}
-
-	return true
-}
-
-func (event *F1ButtonEvent) Parse(data *bytes.Reader, eventDetails *F1EventDataDetails) bool {
-	bytesNeeded := reflect.TypeOf(event.ButtonStatus).Size()
-	if data.Len() < int(bytesNeeded) {
-		Log.Printf("Can't parse ButtonStatus, not enough data (%d bytes)\n", data.Len())
-	}
-
-	event.f1EventDataDetails = eventDetails
-	binary.Read(data, binary.LittleEndian, &event.ButtonStatus)
-
-	return true
-}
-
 func (motiondata *F1CarMotionData) Parse(data *bytes.Reader, carIndex uint8, header *F1PacketHeader) bool {
 	return ParseStruct(data, motiondata)
 }
@@ -618,3 +879,23 @@ func (packet *F1CarStatusDataPacket) Parse(data *bytes.Reader) bool {
 func (packet *F1CarDamageDataPacket) Parse(data *bytes.Reader) bool {
 	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
 }
+
+func (packet *F1SessionDataPacket) Parse(data *bytes.Reader) bool {
+	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
+}
+
+func (packet *F1MotionExDataPacket) Parse(data *bytes.Reader) bool {
+	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
+}
+
+func (packet *F1CarSetupDataPacket) Parse(data *bytes.Reader) bool {
+	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
+}
+
+func (packet *F1ParticipantsDataPacket) Parse(data *bytes.Reader) bool {
+	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
+}
+
+func (packet *F1EventDataPacket) Parse(data *bytes.Reader) bool {
+	return GenericF1StructParse(data, packet, packet.f1PacketHeader)
+}
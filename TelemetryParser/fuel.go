@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	FUEL_MIX_COUNT                   = 4
+	FUEL_TARGET_MARGIN_KG            = 0.2 // fuel we aim to have left when taking the flag
+	FUEL_BROADCAST_INTERVAL_SECONDS  = 1
+	FUEL_LIFT_AND_COAST_KG_PER_100M  = 0.005 // rough saving of lifting 100m earlier into a braking zone
+	FUEL_MIN_LAPS_FOR_RECOMMENDATION = 1
+)
+
+var FUEL_MIX_NAMES = [FUEL_MIX_COUNT]string{"lean", "standard", "rich", "max"}
+
+type FuelLap struct {
+	LapNum    uint8
+	StartFuel float32
+	EndFuel   float32
+	Burn      float32
+	FuelMix   string // mix used for most of the lap
+	Clean     bool   // no pit stop during the lap
+}
+
+type FuelMixBurn struct {
+	FuelMix   string
+	Laps      int
+	AvgBurnKg float32
+	totalBurn float32
+}
+
+type FuelStrategy struct {
+	CarIndex             uint8
+	LapNum               uint8
+	TotalLaps            uint8
+	LapsRemaining        float32
+	FuelInTank           float32
+	FuelCapacity         float32
+	FuelRemainingLapsMFD float32 // the game's own estimate
+	CurrentFuelMix       string
+	AvgBurnPerLap        float32 // average of all clean laps
+	ProjectedFuelAtFlag  float32 // at the average burn of the current mix, or the overall average if it hasn't been measured
+	FuelDeltaLaps        float32 // laps of fuel left over (negative = short) at the flag
+	TargetBurnPerLap     float32 // burn per lap to finish with FUEL_TARGET_MARGIN_KG left
+	TargetFuelDeltaLaps  float32 // what the MFD fuel delta should read to be on target
+	LiftAndCoastPerLapM  float32 // metres of lift and coast per lap needed to hit the target, 0 if not needed
+	RecommendedFuelMix   string
+	BurnByMix            []FuelMixBurn
+	Laps                 []FuelLap
+}
+
+// FuelModel measures the player's fuel burn per lap and projects it to the end of the race
+type FuelModel struct {
+	RWLock sync.RWMutex
+	WSS    *WebsocketServer
+
+	sessionUID    uint64
+	totalLaps     uint8
+	trackLength   float32
+	playerCar     uint8
+	haveStatus    bool
+	status        F1CarStatusData
+	lapData       F1LapData
+	lapStartFuel  float32
+	lapClean      bool
+	mixTime       [FUEL_MIX_COUNT]float32
+	lastStatus    float32
+	laps          []FuelLap
+	burnByMix     [FUEL_MIX_COUNT]FuelMixBurn
+	lastBroadcast float32
+}
+
+func (model *FuelModel) Init(wss *WebsocketServer) {
+	model.WSS = wss
+	model.Reset()
+}
+
+func (model *FuelModel) Reset() {
+	model.RWLock.Lock()
+	defer model.RWLock.Unlock()
+
+	model.reset(0)
+}
+
+func (model *FuelModel) reset(sessionUID uint64) {
+	model.sessionUID = sessionUID
+	model.totalLaps = 0
+	model.trackLength = 0
+	model.haveStatus = false
+	model.lapData = F1LapData{}
+	model.lapStartFuel = -1
+	model.lapClean = true
+	model.mixTime = [FUEL_MIX_COUNT]float32{}
+	model.laps = make([]FuelLap, 0)
+	model.lastBroadcast = 0
+	for i := range model.burnByMix {
+		model.burnByMix[i] = FuelMixBurn{FuelMix: FUEL_MIX_NAMES[i]}
+	}
+}
+
+func (model *FuelModel) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	model.RWLock.Lock()
+	defer model.RWLock.Unlock()
+
+	if header.SessionUID != model.sessionUID {
+		model.reset(header.SessionUID)
+	}
+	if header.PlayerCarIndex >= F1_MAX_NUM_CARS {
+		return
+	}
+	model.playerCar = header.PlayerCarIndex
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		model.totalLaps = p.SessionData.TotalLaps
+		model.trackLength = float32(p.SessionData.TrackLength)
+	case F1LapDataPacket:
+		lapData := &p.LapData[model.playerCar]
+		if lapData.CurrentLapNum != model.lapData.CurrentLapNum {
+			if model.lapData.CurrentLapNum != 0 && lapData.CurrentLapNum == model.lapData.CurrentLapNum+1 {
+				model.closeLap()
+			}
+			model.lapStartFuel = -1
+			if model.haveStatus {
+				model.lapStartFuel = model.status.FuelInTank
+			}
+			model.lapClean = true
+			model.mixTime = [FUEL_MIX_COUNT]float32{}
+		}
+		if lapData.PitStatus != 0 {
+			model.lapClean = false
+		}
+		model.lapData = *lapData
+	case F1CarStatusDataPacket:
+		status := &p.CarStatusData[model.playerCar]
+		if model.haveStatus && status.FuelMix < FUEL_MIX_COUNT && header.SessionTime > model.lastStatus {
+			model.mixTime[status.FuelMix] += header.SessionTime - model.lastStatus
+		}
+		model.status = *status
+		model.haveStatus = true
+		model.lastStatus = header.SessionTime
+
+		if BroadcastDue(&model.lastBroadcast, header.SessionTime, FUEL_BROADCAST_INTERVAL_SECONDS) {
+			WSSBroadcastDerived(model.WSS, header, PacketID_FuelStrategy, model.strategy())
+		}
+	}
+}
+
+func (model *FuelModel) closeLap() {
+	if model.lapStartFuel < 0 || !model.haveStatus {
+		return
+	}
+
+	mix := 0
+	for i := range model.mixTime {
+		if model.mixTime[i] > model.mixTime[mix] {
+			mix = i
+		}
+	}
+
+	lap := FuelLap{
+		LapNum:    model.lapData.CurrentLapNum,
+		StartFuel: model.lapStartFuel,
+		EndFuel:   model.status.FuelInTank,
+		Burn:      model.lapStartFuel - model.status.FuelInTank,
+		FuelMix:   FUEL_MIX_NAMES[mix],
+		Clean:     model.lapClean && model.lapStartFuel > model.status.FuelInTank,
+	}
+	model.laps = append(model.laps, lap)
+
+	if lap.Clean {
+		burn := &model.burnByMix[mix]
+		burn.Laps += 1
+		burn.totalBurn += lap.Burn
+		burn.AvgBurnKg = burn.totalBurn / float32(burn.Laps)
+	}
+}
+
+func (model *FuelModel) strategy() *FuelStrategy {
+	strategy := &FuelStrategy{
+		CarIndex:             model.playerCar,
+		LapNum:               model.lapData.CurrentLapNum,
+		TotalLaps:            model.totalLaps,
+		FuelInTank:           model.status.FuelInTank,
+		FuelCapacity:         model.status.FuelCapacity,
+		FuelRemainingLapsMFD: model.status.FuelRemainingLaps,
+		BurnByMix:            append([]FuelMixBurn{}, model.burnByMix[:]...),
+		Laps:                 append([]FuelLap{}, model.laps...),
+	}
+	if model.status.FuelMix < FUEL_MIX_COUNT {
+		strategy.CurrentFuelMix = FUEL_MIX_NAMES[model.status.FuelMix]
+	}
+
+	totalLaps, totalBurn := 0, float32(0)
+	for _, burn := range model.burnByMix {
+		totalLaps += burn.Laps
+		totalBurn += burn.totalBurn
+	}
+	if totalLaps < FUEL_MIN_LAPS_FOR_RECOMMENDATION || model.totalLaps == 0 {
+		return strategy
+	}
+	strategy.AvgBurnPerLap = totalBurn / float32(totalLaps)
+
+	// laps left including what's left of the current one
+	lapFraction := float32(0)
+	if model.trackLength > 0 && model.lapData.LapDistance > 0 {
+		lapFraction = model.lapData.LapDistance / model.trackLength
+	}
+	strategy.LapsRemaining = float32(model.totalLaps) - float32(model.lapData.CurrentLapNum) + 1 - lapFraction
+	if strategy.LapsRemaining < 0 {
+		strategy.LapsRemaining = 0
+	}
+
+	burn := strategy.AvgBurnPerLap
+	if model.status.FuelMix < FUEL_MIX_COUNT && model.burnByMix[model.status.FuelMix].Laps > 0 {
+		burn = model.burnByMix[model.status.FuelMix].AvgBurnKg
+	}
+
+	strategy.ProjectedFuelAtFlag = model.status.FuelInTank - burn*strategy.LapsRemaining
+	strategy.FuelDeltaLaps = strategy.ProjectedFuelAtFlag / burn
+	if strategy.LapsRemaining > 0 {
+		strategy.TargetBurnPerLap = (model.status.FuelInTank - FUEL_TARGET_MARGIN_KG) / strategy.LapsRemaining
+	}
+	strategy.TargetFuelDeltaLaps = FUEL_TARGET_MARGIN_KG / burn
+
+	if strategy.TargetBurnPerLap > 0 && burn > strategy.TargetBurnPerLap {
+		strategy.LiftAndCoastPerLapM = (burn - strategy.TargetBurnPerLap) / FUEL_LIFT_AND_COAST_KG_PER_100M * 100
+	}
+
+	// the richest mix we've measured that still gets us to the flag
+	strategy.RecommendedFuelMix = strategy.CurrentFuelMix
+	for mix := FUEL_MIX_COUNT - 1; mix >= 0; mix-- {
+		measured := model.burnByMix[mix]
+		if measured.Laps > 0 && measured.AvgBurnKg <= strategy.TargetBurnPerLap {
+			strategy.RecommendedFuelMix = measured.FuelMix
+			break
+		}
+	}
+
+	return strategy
+}
+
+func (model *FuelModel) GetStrategy() *FuelStrategy {
+	model.RWLock.RLock()
+	defer model.RWLock.RUnlock()
+
+	return model.strategy()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFuelStrategy(t *testing.T) {
+	model := FuelModel{}
+	model.Init(nil)
+
+	session := F1SessionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Session, SessionUID: 4}}
+	session.SessionData.TotalLaps = 10
+	session.SessionData.TrackLength = 1000
+	model.ConsumePacket(session)
+
+	// laps 1 and 2 on the standard mix at 2kg a lap, lap 3 on lean at 1.5kg, then half of lap 4 on standard again
+	fuel := float32(19)
+	sessionTime := float32(0)
+	for lap := 1; lap <= 4; lap++ {
+		mix, burn := uint8(1), float32(2)
+		if lap == 3 {
+			mix, burn = 0, 1.5
+		}
+
+		for d := float32(0); d < 1000 && (lap < 4 || d <= 500); d += 100 {
+			fuel -= burn / 10
+			sessionTime += 1
+
+			lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 4, SessionTime: sessionTime}}
+			lapData.LapData[0].CurrentLapNum = uint8(lap)
+			lapData.LapData[0].LapDistance = d
+			model.ConsumePacket(lapData)
+
+			status := F1CarStatusDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarStatus, SessionUID: 4, SessionTime: sessionTime}}
+			status.CarStatusData[0].FuelInTank = fuel
+			status.CarStatusData[0].FuelMix = mix
+			model.ConsumePacket(status)
+		}
+	}
+
+	near := func(a float32, b float32) bool { return math.Abs(float64(a-b)) < 1e-3 }
+	strategy := model.GetStrategy()
+
+	// lap 1 started before the first status packet, so its burn is unknown
+	if len(strategy.Laps) != 2 || !near(strategy.Laps[0].Burn, 2) || strategy.Laps[1].FuelMix != "lean" || !near(strategy.Laps[1].Burn, 1.5) {
+		t.Fatalf("Unexpected laps - %+v\n", strategy.Laps)
+	}
+	if !near(strategy.AvgBurnPerLap, 1.75) || !near(strategy.LapsRemaining, 6.5) {
+		t.Errorf("Expected 1.75kg a lap over 6.5 laps, got %f over %f\n", strategy.AvgBurnPerLap, strategy.LapsRemaining)
+	}
+
+	// 12.3kg left burning 2kg a lap on the current mix
+	if !near(strategy.ProjectedFuelAtFlag, -0.7) || !near(strategy.FuelDeltaLaps, -0.35) {
+		t.Errorf("Expected to be 0.7kg short, got %f (%f laps)\n", strategy.ProjectedFuelAtFlag, strategy.FuelDeltaLaps)
+	}
+	if !near(strategy.TargetBurnPerLap, 12.1/6.5) || math.Abs(float64(strategy.LiftAndCoastPerLapM)-(2-12.1/6.5)/FUEL_LIFT_AND_COAST_KG_PER_100M*100) > 1 {
+		t.Errorf("Unexpected target - %fkg a lap, %fm lift and coast\n", strategy.TargetBurnPerLap, strategy.LiftAndCoastPerLapM)
+	}
+	if strategy.RecommendedFuelMix != "lean" {
+		t.Errorf("Expected the lean mix to be recommended, got %s\n", strategy.RecommendedFuelMix)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	GG_DISTANCE_STEP    float32 = 5    // metres, the sample with the highest combined G is kept for every step of the lap
+	GG_ANGLE_STEP       float32 = 10   // degrees per direction bin of the envelope
+	GG_GRID_STEP        float32 = 0.25 // G per cell of the binned plot data
+	GG_MIN_USAGE_G      float32 = 0.5  // samples below this combined G (coasting, straights) don't count towards utilisation
+	GG_MAX_LAPS_PER_CAR         = 200
+)
+
+type GGSample struct {
+	Distance     float32
+	Lateral      float32
+	Longitudinal float32
+}
+
+type GGLap struct {
+	CarIndex uint8
+	LapNum   uint8
+	TrackId  int8
+	Samples  []GGSample
+}
+
+// GGEnvelope is the highest combined G reached in every direction. Direction 0 is pure longitudinal G as the
+// game reports it, angles grow towards positive lateral G.
+type GGEnvelope struct {
+	AngleStep                float32
+	MaxG                     []float32
+	PeakLateral              float32 // highest absolute lateral G
+	PeakLongitudinalPositive float32
+	PeakLongitudinalNegative float32
+}
+
+type GGCell struct {
+	Lateral      float32
+	Longitudinal float32
+	Count        int
+}
+
+type GGCornerAnalysis struct {
+	Number             int
+	Envelope           GGEnvelope
+	UtilisationPercent float32
+}
+
+type GGLapAnalysis struct {
+	CarIndex           uint8
+	LapNum             uint8
+	TrackId            int8
+	Envelope           GGEnvelope
+	UtilisationPercent float32 // of the envelope the car reached over all its laps of the session
+	Corners            []GGCornerAnalysis
+	Grid               []GGCell
+}
+
+type GGCornerComparison struct {
+	Number       int
+	UtilisationA float32 // of the combined envelope of both laps in the corner
+	UtilisationB float32
+	UnusedGripA  float32 // average G per sample lap A was short of the combined envelope
+	UnusedGripB  float32
+}
+
+type GGComparison struct {
+	A            LapSelector
+	B            LapSelector
+	EnvelopeA    GGEnvelope
+	EnvelopeB    GGEnvelope
+	UtilisationA float32
+	UtilisationB float32
+	Corners      []GGCornerComparison
+}
+
+type carGGState struct {
+	lapNum      uint8
+	lapDistance float32
+	samples     []GGSample
+	laps        []*GGLap
+}
+
+// GGAnalyzer collects the G forces of every car over the lap to build friction circle envelopes
+type GGAnalyzer struct {
+	RWLock sync.RWMutex
+
+	sessionUID uint64
+	trackId    int8
+	cars       [F1_MAX_NUM_CARS]carGGState
+}
+
+func (analyzer *GGAnalyzer) Init() {
+	analyzer.Reset()
+}
+
+func (analyzer *GGAnalyzer) Reset() {
+	analyzer.RWLock.Lock()
+	defer analyzer.RWLock.Unlock()
+
+	analyzer.reset(0)
+}
+
+func (analyzer *GGAnalyzer) reset(sessionUID uint64) {
+	analyzer.sessionUID = sessionUID
+	analyzer.trackId = -1
+	for i := range analyzer.cars {
+		analyzer.cars[i] = carGGState{laps: make([]*GGLap, 0)}
+	}
+}
+
+func (analyzer *GGAnalyzer) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	analyzer.RWLock.Lock()
+	defer analyzer.RWLock.Unlock()
+
+	if header.SessionUID != analyzer.sessionUID {
+		analyzer.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		analyzer.trackId = p.SessionData.TrackId
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			analyzer.processLapData(uint8(i), &p.LapData[i])
+		}
+	case F1CarMotionDataPacket:
+		for i := range p.CarMotionData {
+			analyzer.processMotion(uint8(i), &p.CarMotionData[i])
+		}
+	}
+}
+
+func (analyzer *GGAnalyzer) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &analyzer.cars[carIndex]
+	if lapData.ResultStatus < 2 {
+		return
+	}
+
+	if lapData.CurrentLapNum != state.lapNum {
+		if state.lapNum != 0 && lapData.CurrentLapNum == state.lapNum+1 && len(state.samples) > 0 {
+			lap := &GGLap{CarIndex: carIndex, LapNum: state.lapNum, TrackId: analyzer.trackId, Samples: make([]GGSample, 0, len(state.samples))}
+			for _, sample := range state.samples {
+				if sample.Lateral != 0 || sample.Longitudinal != 0 {
+					lap.Samples = append(lap.Samples, sample)
+				}
+			}
+
+			state.laps = append(state.laps, lap)
+			if len(state.laps) > GG_MAX_LAPS_PER_CAR {
+				state.laps = state.laps[1:]
+			}
+		}
+		state.lapNum = lapData.CurrentLapNum
+		state.samples = state.samples[:0]
+	}
+	state.lapDistance = lapData.LapDistance
+}
+
+func (analyzer *GGAnalyzer) processMotion(carIndex uint8, motion *F1CarMotionData) {
+	state := &analyzer.cars[carIndex]
+	if state.lapNum == 0 || state.lapDistance < 0 {
+		return
+	}
+
+	bin := int(state.lapDistance / GG_DISTANCE_STEP)
+	for len(state.samples) <= bin {
+		state.samples = append(state.samples, GGSample{Distance: float32(len(state.samples)) * GG_DISTANCE_STEP})
+	}
+
+	sample := &state.samples[bin]
+	if combinedG(motion.GForceLateral, motion.GForceLongitudinal) > combinedG(sample.Lateral, sample.Longitudinal) {
+		sample.Lateral = motion.GForceLateral
+		sample.Longitudinal = motion.GForceLongitudinal
+	}
+}
+
+func combinedG(lateral float32, longitudinal float32) float32 {
+	return float32(math.Hypot(float64(lateral), float64(longitudinal)))
+}
+
+func ggDirection(sample GGSample) int {
+	angle := math.Atan2(float64(sample.Lateral), float64(sample.Longitudinal)) * 180 / math.Pi
+	if angle < 0 {
+		angle += 360
+	}
+	bins := int(360 / GG_ANGLE_STEP)
+	return int(float32(angle)/GG_ANGLE_STEP) % bins
+}
+
+// BuildGGEnvelope finds the highest combined G in every direction
+func BuildGGEnvelope(samples []GGSample) GGEnvelope {
+	envelope := GGEnvelope{AngleStep: GG_ANGLE_STEP, MaxG: make([]float32, int(360/GG_ANGLE_STEP))}
+	for _, sample := range samples {
+		direction := ggDirection(sample)
+		if g := combinedG(sample.Lateral, sample.Longitudinal); g > envelope.MaxG[direction] {
+			envelope.MaxG[direction] = g
+		}
+
+		lateral := float32(math.Abs(float64(sample.Lateral)))
+		if lateral > envelope.PeakLateral {
+			envelope.PeakLateral = lateral
+		}
+		if sample.Longitudinal > envelope.PeakLongitudinalPositive {
+			envelope.PeakLongitudinalPositive = sample.Longitudinal
+		}
+		if sample.Longitudinal < envelope.PeakLongitudinalNegative {
+			envelope.PeakLongitudinalNegative = sample.Longitudinal
+		}
+	}
+	return envelope
+}
+
+// Merge extends the envelope to the maximum of both in every direction
+func (envelope GGEnvelope) Merge(other GGEnvelope) GGEnvelope {
+	merged := GGEnvelope{AngleStep: envelope.AngleStep, MaxG: append([]float32{}, envelope.MaxG...)}
+	for i := range merged.MaxG {
+		if other.MaxG[i] > merged.MaxG[i] {
+			merged.MaxG[i] = other.MaxG[i]
+		}
+	}
+	merged.PeakLateral = float32(math.Max(float64(envelope.PeakLateral), float64(other.PeakLateral)))
+	merged.PeakLongitudinalPositive = float32(math.Max(float64(envelope.PeakLongitudinalPositive), float64(other.PeakLongitudinalPositive)))
+	merged.PeakLongitudinalNegative = float32(math.Min(float64(envelope.PeakLongitudinalNegative), float64(other.PeakLongitudinalNegative)))
+	return merged
+}
+
+// GGUtilisation returns how much of `reference` the samples used on average in percent, and the average G they were short of it
+func GGUtilisation(samples []GGSample, reference GGEnvelope) (float32, float32) {
+	var used, unused float32
+	count := 0
+	for _, sample := range samples {
+		g := combinedG(sample.Lateral, sample.Longitudinal)
+		available := reference.MaxG[ggDirection(sample)]
+		if g < GG_MIN_USAGE_G || available <= 0 {
+			continue
+		}
+
+		if g > available {
+			g = available
+		}
+		used += g / available
+		unused += available - g
+		count++
+	}
+
+	if count == 0 {
+		return 0, 0
+	}
+	return used / float32(count) * 100, unused / float32(count)
+}
+
+// GGGrid counts the samples in every GG_GRID_STEP square of the G-G plane, for plotting
+func GGGrid(samples []GGSample) []GGCell {
+	counts := make(map[[2]int]int)
+	for _, sample := range samples {
+		cell := [2]int{int(math.Floor(float64(sample.Lateral / GG_GRID_STEP))), int(math.Floor(float64(sample.Longitudinal / GG_GRID_STEP)))}
+		counts[cell]++
+	}
+
+	grid := make([]GGCell, 0, len(counts))
+	for cell, count := range counts {
+		grid = append(grid, GGCell{float32(cell[0]) * GG_GRID_STEP, float32(cell[1]) * GG_GRID_STEP, count})
+	}
+	sort.Slice(grid, func(i, j int) bool {
+		if grid[i].Longitudinal != grid[j].Longitudinal {
+			return grid[i].Longitudinal < grid[j].Longitudinal
+		}
+		return grid[i].Lateral < grid[j].Lateral
+	})
+	return grid
+}
+
+func cornerSamples(samples []GGSample, corner TrackCorner) []GGSample {
+	result := make([]GGSample, 0)
+	for _, sample := range samples {
+		if sample.Distance >= corner.StartDistance && sample.Distance < corner.EndDistance {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+func (analyzer *GGAnalyzer) GetLap(carIndex uint8, lapNum uint8) (*GGLap, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	analyzer.RWLock.RLock()
+	defer analyzer.RWLock.RUnlock()
+
+	for _, lap := range analyzer.cars[carIndex].laps {
+		if lap.LapNum == lapNum {
+			return lap, nil
+		}
+	}
+	return nil, fmt.Errorf("no G-G data for lap %d of car %d", lapNum, carIndex)
+}
+
+// SessionEnvelope merges the envelopes of every lap a car completed on a track
+func (analyzer *GGAnalyzer) SessionEnvelope(carIndex uint8, trackId int8) GGEnvelope {
+	analyzer.RWLock.RLock()
+	defer analyzer.RWLock.RUnlock()
+
+	envelope := BuildGGEnvelope(nil)
+	if carIndex >= F1_MAX_NUM_CARS {
+		return envelope
+	}
+	for _, lap := range analyzer.cars[carIndex].laps {
+		if lap.TrackId == trackId {
+			envelope = envelope.Merge(BuildGGEnvelope(lap.Samples))
+		}
+	}
+	return envelope
+}
+
+// AnalyseLap builds the envelope of a lap and each of its corners, `corners` may be nil
+func (analyzer *GGAnalyzer) AnalyseLap(carIndex uint8, lapNum uint8, corners *TrackCorners) (*GGLapAnalysis, error) {
+	lap, err := analyzer.GetLap(carIndex, lapNum)
+	if err != nil {
+		return nil, err
+	}
+
+	reference := analyzer.SessionEnvelope(carIndex, lap.TrackId)
+	analysis := &GGLapAnalysis{
+		CarIndex: carIndex,
+		LapNum:   lapNum,
+		TrackId:  lap.TrackId,
+		Envelope: BuildGGEnvelope(lap.Samples),
+		Corners:  make([]GGCornerAnalysis, 0),
+		Grid:     GGGrid(lap.Samples),
+	}
+	analysis.UtilisationPercent, _ = GGUtilisation(lap.Samples, reference)
+
+	if corners != nil {
+		for _, corner := range corners.Corners {
+			samples := cornerSamples(lap.Samples, corner)
+			cornerAnalysis := GGCornerAnalysis{Number: corner.Number, Envelope: BuildGGEnvelope(samples)}
+			cornerAnalysis.UtilisationPercent, _ = GGUtilisation(samples, reference)
+			analysis.Corners = append(analysis.Corners, cornerAnalysis)
+		}
+	}
+
+	return analysis, nil
+}
+
+// CompareGGLaps measures both laps against their combined envelope, overall and per corner, to show where grip was left unused
+func CompareGGLaps(lapA *GGLap, lapB *GGLap, corners *TrackCorners) *GGComparison {
+	comparison := &GGComparison{
+		EnvelopeA: BuildGGEnvelope(lapA.Samples),
+		EnvelopeB: BuildGGEnvelope(lapB.Samples),
+		Corners:   make([]GGCornerComparison, 0),
+	}
+
+	combined := comparison.EnvelopeA.Merge(comparison.EnvelopeB)
+	comparison.UtilisationA, _ = GGUtilisation(lapA.Samples, combined)
+	comparison.UtilisationB, _ = GGUtilisation(lapB.Samples, combined)
+
+	if corners == nil {
+		return comparison
+	}
+
+	for _, corner := range corners.Corners {
+		samplesA, samplesB := cornerSamples(lapA.Samples, corner), cornerSamples(lapB.Samples, corner)
+		cornerEnvelope := BuildGGEnvelope(samplesA).Merge(BuildGGEnvelope(samplesB))
+
+		c := GGCornerComparison{Number: corner.Number}
+		c.UtilisationA, c.UnusedGripA = GGUtilisation(samplesA, cornerEnvelope)
+		c.UtilisationB, c.UnusedGripB = GGUtilisation(samplesB, cornerEnvelope)
+		comparison.Corners = append(comparison.Corners, c)
+	}
+
+	return comparison
+}
+
+// CompareGGSelections compares the envelopes of two laps from the live session or recordings, split by the corners of lap A's track
+func CompareGGSelections(live *LapSources, registry *CornerRegistry, a LapSelector, b LapSelector) (*GGComparison, error) {
+	cache := make(map[string]*LapSources)
+
+	sourcesA, err := SelectLapSources(live, a, cache)
+	if err != nil {
+		return nil, err
+	}
+	lapA, err := sourcesA.GG.GetLap(a.CarIndex, a.LapNum)
+	if err != nil {
+		return nil, err
+	}
+
+	sourcesB, err := SelectLapSources(live, b, cache)
+	if err != nil {
+		return nil, err
+	}
+	lapB, err := sourcesB.GG.GetLap(b.CarIndex, b.LapNum)
+	if err != nil {
+		return nil, err
+	}
+	if lapA.TrackId != lapB.TrackId {
+		return nil, fmt.Errorf("can't compare laps of different tracks (%d, %d)", lapA.TrackId, lapB.TrackId)
+	}
+
+	var corners *TrackCorners
+	if lapA.TrackId >= 0 {
+		corners, _ = registry.GetCorners(lapA.TrackId)
+	}
+
+	comparison := CompareGGLaps(lapA, lapB, corners)
+	comparison.A = a
+	comparison.B = b
+	return comparison, nil
+}
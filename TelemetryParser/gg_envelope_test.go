@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGGEnvelope(t *testing.T) {
+	// lap A brakes at 4G and corners at 3G, lap B only reaches half of that in the corner
+	lapA := &GGLap{Samples: []GGSample{{0, 0, -4}, {5, 3, 0}, {10, -3, 0}}}
+	lapB := &GGLap{Samples: []GGSample{{0, 0, -4}, {5, 1.5, 0}, {10, -3, 0}}}
+
+	envelope := BuildGGEnvelope(lapA.Samples)
+	if envelope.PeakLateral != 3 || envelope.PeakLongitudinalNegative != -4 || envelope.MaxG[ggDirection(GGSample{0, 0, -4})] != 4 {
+		t.Errorf("Unexpected envelope - %+v\n", envelope)
+	}
+
+	corners := &TrackCorners{Corners: []TrackCorner{{Number: 1, StartDistance: 0, EndDistance: 7}}}
+	comparison := CompareGGLaps(lapA, lapB, corners)
+
+	if comparison.UtilisationA != 100 || math.Abs(float64(comparison.UtilisationB)-100*(1+0.5+1)/3) > 0.01 {
+		t.Errorf("Unexpected utilisation - A %.2f%%, B %.2f%%\n", comparison.UtilisationA, comparison.UtilisationB)
+	}
+
+	corner := comparison.Corners[0]
+	if corner.UnusedGripA != 0 || corner.UnusedGripB != 0.75 {
+		t.Errorf("Unexpected unused grip in T1 - A %.2fG, B %.2fG\n", corner.UnusedGripA, corner.UnusedGripB)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	HISTORY_DEFAULT_RETENTION_SECONDS float32 = 60 * 60
+	HISTORY_DEFAULT_MAX_MEMORY_BYTES  int     = 256 * 1024 * 1024
+	HISTORY_COMPACT_THRESHOLD         int     = 4096 // trimmed samples to accumulate before compacting a table
+)
+
+type HistoryConfig struct {
+	RetentionSeconds float32 // samples older than the newest sample minus this are dropped, 0 = unlimited
+	MaxMemoryBytes   int     // upper bound on memory used by all tables, 0 = unlimited
+}
+
+type historyChannelSource struct {
+	PacketID uint8
+	Column   int
+}
+
+// Channels available for history queries. The order of the channels of one packet type is the column order of its table.
+var HISTORY_CHANNELS = map[string]historyChannelSource{
+	"speed":            {PacketID_CarTelemetry, 0},
+	"throttle":         {PacketID_CarTelemetry, 1},
+	"brake":            {PacketID_CarTelemetry, 2},
+	"steer":            {PacketID_CarTelemetry, 3},
+	"clutch":           {PacketID_CarTelemetry, 4},
+	"gear":             {PacketID_CarTelemetry, 5},
+	"rpm":              {PacketID_CarTelemetry, 6},
+	"drs":              {PacketID_CarTelemetry, 7},
+	"engineTemp":       {PacketID_CarTelemetry, 8},
+	"lapDistance":      {PacketID_LapData, 0},
+	"lapNum":           {PacketID_LapData, 1},
+	"currentLapTimeMs": {PacketID_LapData, 2},
+	"position":         {PacketID_LapData, 3},
+	"gForceLateral":    {PacketID_Motion, 0},
+	"gForceLong":       {PacketID_Motion, 1},
+	"gForceVertical":   {PacketID_Motion, 2},
+	"fuelInTank":       {PacketID_CarStatus, 0},
+	"ersStoreEnergy":   {PacketID_CarStatus, 1},
+}
+
+var HISTORY_TABLE_WIDTHS = map[uint8]int{
+	PacketID_CarTelemetry: 9,
+	PacketID_LapData:      4,
+	PacketID_Motion:       3,
+	PacketID_CarStatus:    2,
+}
+
+// historyTable stores the samples of one packet type for one car column by column.
+// Trimmed samples are skipped using `start` and only released once enough of them pile up, they count towards the
+// memory budget until then.
+type historyTable struct {
+	Time    []float32
+	Columns [][]float32
+	start   int
+}
+
+type TelemetryHistory struct {
+	RWLock sync.RWMutex
+	Config HistoryConfig
+
+	tables      [F1_MAX_NUM_CARS]map[uint8]*historyTable
+	sessionUID  uint64
+	latestTime  float32
+	memoryBytes int
+}
+
+type HistoryChannelData struct {
+	Channel string
+	Time    []float32
+	Values  []float32
+}
+
+type HistoryQueryResult struct {
+	CarIndex uint8
+	From     float32
+	To       float32
+	Channels []HistoryChannelData
+}
+
+func MakeDefaultHistoryConfig() HistoryConfig {
+	return HistoryConfig{HISTORY_DEFAULT_RETENTION_SECONDS, HISTORY_DEFAULT_MAX_MEMORY_BYTES}
+}
+
+func (h *TelemetryHistory) Init(config HistoryConfig) {
+	h.Config = config
+	h.Reset()
+}
+
+func (h *TelemetryHistory) Reset() {
+	h.RWLock.Lock()
+	defer h.RWLock.Unlock()
+
+	for i := range h.tables {
+		h.tables[i] = make(map[uint8]*historyTable)
+	}
+	h.sessionUID = 0
+	h.latestTime = 0
+	h.memoryBytes = 0
+}
+
+func (h *TelemetryHistory) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	h.RWLock.Lock()
+	defer h.RWLock.Unlock()
+
+	if header.SessionUID != h.sessionUID {
+		for i := range h.tables {
+			h.tables[i] = make(map[uint8]*historyTable)
+		}
+		h.sessionUID = header.SessionUID
+		h.latestTime = 0
+		h.memoryBytes = 0
+	}
+
+	switch p := packet.(type) {
+	case F1CarTelemetryDataPacket:
+		for i := range p.CarTelemetryData {
+			ct := &p.CarTelemetryData[i]
+			h.appendSample(uint8(i), PacketID_CarTelemetry, header.SessionTime,
+				float32(ct.Speed), ct.Throttle, ct.Brake, ct.Steer, float32(ct.Clutch),
+				float32(ct.Gear), float32(ct.EngineRPM), float32(ct.DRS), float32(ct.EngineTemperature))
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			ld := &p.LapData[i]
+			h.appendSample(uint8(i), PacketID_LapData, header.SessionTime,
+				ld.LapDistance, float32(ld.CurrentLapNum), float32(ld.CurrentLapTimeInMS), float32(ld.CarPosition))
+		}
+	case F1CarMotionDataPacket:
+		for i := range p.CarMotionData {
+			md := &p.CarMotionData[i]
+			h.appendSample(uint8(i), PacketID_Motion, header.SessionTime, md.GForceLateral, md.GForceLongitudinal, md.GForceVertical)
+		}
+	case F1CarStatusDataPacket:
+		for i := range p.CarStatusData {
+			cs := &p.CarStatusData[i]
+			h.appendSample(uint8(i), PacketID_CarStatus, header.SessionTime, cs.FuelInTank, cs.ERSScoreEnergy)
+		}
+	default:
+		return
+	}
+
+	// a flashback rewinds the session time, retention is measured back from the rewind point
+	h.latestTime = header.SessionTime
+	h.enforceRetention()
+}
+
+func (h *TelemetryHistory) appendSample(carIndex uint8, packetID uint8, sessionTime float32, values ...float32) {
+	table, ok := h.tables[carIndex][packetID]
+	if !ok {
+		table = &historyTable{Columns: make([][]float32, HISTORY_TABLE_WIDTHS[packetID])}
+		h.tables[carIndex][packetID] = table
+	}
+
+	// flashbacks rewind the session time, anything recorded after the rewind point is no longer valid
+	if n := len(table.Time); n > table.start && table.Time[n-1] > sessionTime {
+		cut := sort.Search(n-table.start, func(i int) bool { return table.Time[table.start+i] > sessionTime }) + table.start
+		h.memoryBytes -= (n - cut) * table.sampleSize()
+		table.Time = table.Time[:cut]
+		for c := range table.Columns {
+			table.Columns[c] = table.Columns[c][:cut]
+		}
+	}
+
+	table.Time = append(table.Time, sessionTime)
+	for c := range table.Columns {
+		table.Columns[c] = append(table.Columns[c], values[c])
+	}
+	h.memoryBytes += table.sampleSize()
+}
+
+func (t *historyTable) sampleSize() int {
+	return 4 * (1 + len(t.Columns))
+}
+
+func (t *historyTable) Len() int {
+	return len(t.Time) - t.start
+}
+
+// trimBefore drops all samples older than `cutoff` and returns how many were dropped
+func (t *historyTable) trimBefore(cutoff float32) int {
+	live := t.Time[t.start:]
+	n := sort.Search(len(live), func(i int) bool { return live[i] >= cutoff })
+	t.start += n
+	return n
+}
+
+// compact releases the trimmed samples once enough of them pile up, or right away when forced, and returns the number
+// of bytes released
+func (t *historyTable) compact(force bool) int {
+	if t.start == 0 || (!force && (t.start < HISTORY_COMPACT_THRESHOLD || t.start < len(t.Time)/2)) {
+		return 0
+	}
+
+	released := t.start * t.sampleSize()
+	t.Time = append(make([]float32, 0, len(t.Time)-t.start), t.Time[t.start:]...)
+	for c := range t.Columns {
+		t.Columns[c] = append(make([]float32, 0, len(t.Time)), t.Columns[c][t.start:]...)
+	}
+	t.start = 0
+	return released
+}
+
+func (h *TelemetryHistory) enforceRetention() {
+	if h.Config.RetentionSeconds > 0 && h.latestTime > h.Config.RetentionSeconds {
+		h.trimBefore(h.latestTime-h.Config.RetentionSeconds, false)
+	}
+
+	if h.Config.MaxMemoryBytes <= 0 || h.memoryBytes <= h.Config.MaxMemoryBytes {
+		return
+	}
+
+	// release the trimmed samples, then drop the oldest 10% of the retained window until we fit in the memory budget again
+	h.trimBefore(0, true)
+	for h.memoryBytes > h.Config.MaxMemoryBytes {
+		oldest := h.oldestTime()
+		if oldest >= h.latestTime {
+			break
+		}
+		if h.trimBefore(oldest+(h.latestTime-oldest)*0.1, true) == 0 {
+			break
+		}
+	}
+}
+
+// trimBefore drops the samples older than `cutoff` from every table and returns how many were dropped, the memory they
+// used is only accounted for once a table is compacted
+func (h *TelemetryHistory) trimBefore(cutoff float32, forceCompact bool) int {
+	trimmed := 0
+	for i := range h.tables {
+		for _, table := range h.tables[i] {
+			trimmed += table.trimBefore(cutoff)
+			h.memoryBytes -= table.compact(forceCompact)
+		}
+	}
+	return trimmed
+}
+
+func (h *TelemetryHistory) oldestTime() float32 {
+	oldest := h.latestTime
+	for i := range h.tables {
+		for _, table := range h.tables[i] {
+			if table.Len() > 0 && table.Time[table.start] < oldest {
+				oldest = table.Time[table.start]
+			}
+		}
+	}
+	return oldest
+}
+
+// Query returns the requested channels of a car between two session timestamps (inclusive).
+// If maxPoints is non-zero, each channel is downsampled to at most maxPoints by averaging equal time buckets.
+func (h *TelemetryHistory) Query(carIndex uint8, channels []string, from float32, to float32, maxPoints int) (HistoryQueryResult, error) {
+	result := HistoryQueryResult{CarIndex: carIndex, From: from, To: to, Channels: make([]HistoryChannelData, 0, len(channels))}
+	if carIndex >= F1_MAX_NUM_CARS {
+		return result, fmt.Errorf("invalid car index %d", carIndex)
+	}
+	if to < from {
+		return result, fmt.Errorf("invalid time range %f - %f", from, to)
+	}
+
+	h.RWLock.RLock()
+	defer h.RWLock.RUnlock()
+
+	for _, channel := range channels {
+		source, ok := HISTORY_CHANNELS[channel]
+		if !ok {
+			return result, fmt.Errorf("unknown channel '%s'", channel)
+		}
+
+		data := HistoryChannelData{Channel: channel, Time: []float32{}, Values: []float32{}}
+		if table, ok := h.tables[carIndex][source.PacketID]; ok {
+			times := table.Time[table.start:]
+			values := table.Columns[source.Column][table.start:]
+			lo := sort.Search(len(times), func(i int) bool { return times[i] >= from })
+			hi := sort.Search(len(times), func(i int) bool { return times[i] > to })
+			data.Time, data.Values = DownsampleSeries(times[lo:hi], values[lo:hi], maxPoints)
+		}
+		result.Channels = append(result.Channels, data)
+	}
+
+	return result, nil
+}
+
+// DownsampleSeries averages a time series into at most maxPoints equally sized time buckets.
+// The returned slices never alias the inputs.
+func DownsampleSeries(times []float32, values []float32, maxPoints int) ([]float32, []float32) {
+	if maxPoints <= 0 || len(times) <= maxPoints {
+		return append([]float32{}, times...), append([]float32{}, values...)
+	}
+
+	outTimes := make([]float32, 0, maxPoints)
+	outValues := make([]float32, 0, maxPoints)
+	span := times[len(times)-1] - times[0]
+	bucketWidth := span / float32(maxPoints)
+
+	i := 0
+	for b := 0; b < maxPoints && i < len(times); b++ {
+		bucketEnd := times[0] + bucketWidth*float32(b+1)
+		var sumT, sumV float32
+		count := 0
+		for i < len(times) && (times[i] <= bucketEnd || b == maxPoints-1) {
+			sumT += times[i]
+			sumV += values[i]
+			count++
+			i++
+		}
+
+		if count > 0 {
+			outTimes = append(outTimes, sumT/float32(count))
+			outValues = append(outValues, sumV/float32(count))
+		}
+	}
+
+	return outTimes, outValues
+}
+
+func (h *TelemetryHistory) MemoryUsage() int {
+	h.RWLock.RLock()
+	defer h.RWLock.RUnlock()
+	return h.memoryBytes
+}
+
+func (h *TelemetryHistory) SetConfig(config HistoryConfig) {
+	h.RWLock.Lock()
+	defer h.RWLock.Unlock()
+
+	h.Config = config
+	h.enforceRetention()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func makeTelemetryPacket(sessionTime float32, speed uint16) F1CarTelemetryDataPacket {
+	header := F1PacketHeader{PacketId: PacketID_CarTelemetry, SessionUID: 1, SessionTime: sessionTime}
+	packet := F1CarTelemetryDataPacket{f1PacketHeader: &header}
+	packet.CarTelemetryData[3].Speed = speed
+	packet.CarTelemetryData[3].Throttle = 100
+	return packet
+}
+
+func TestHistoryQuery(t *testing.T) {
+	history := TelemetryHistory{}
+	history.Init(HistoryConfig{0, 0})
+
+	for i := 0; i < 300; i++ {
+		history.ConsumePacket(makeTelemetryPacket(float32(i), uint16(i)))
+	}
+
+	result, err := history.Query(3, []string{"speed", "throttle"}, 120, 210, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	speed := result.Channels[0]
+	if len(speed.Values) != 91 || speed.Values[0] != 120 || speed.Values[90] != 210 {
+		t.Errorf("Unexpected speed samples - %d samples from %f to %f\n", len(speed.Values), speed.Values[0], speed.Values[len(speed.Values)-1])
+	}
+
+	if result.Channels[1].Values[0] != 100 {
+		t.Errorf("Throttle mismatch - %f != 100\n", result.Channels[1].Values[0])
+	}
+
+	result, err = history.Query(3, []string{"speed"}, 0, 299, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Channels[0].Values) != 10 {
+		t.Errorf("Expected 10 downsampled points, got %d\n", len(result.Channels[0].Values))
+	}
+
+	if _, err = history.Query(3, []string{"nonsense"}, 0, 10, 0); err == nil {
+		t.Error("Expected error for unknown channel")
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	history := TelemetryHistory{}
+	history.Init(HistoryConfig{RetentionSeconds: 60})
+
+	for i := 0; i < 300; i++ {
+		history.ConsumePacket(makeTelemetryPacket(float32(i), uint16(i)))
+	}
+
+	result, _ := history.Query(3, []string{"speed"}, 0, 300, 0)
+	if result.Channels[0].Time[0] != 239 {
+		t.Errorf("Expected oldest sample at 239s, got %f\n", result.Channels[0].Time[0])
+	}
+
+	// the trimmed samples still use memory until the tables are compacted
+	sampleSize := 4 * (1 + HISTORY_TABLE_WIDTHS[PacketID_CarTelemetry])
+	if history.MemoryUsage() != sampleSize*F1_MAX_NUM_CARS*300 {
+		t.Errorf("Expected the uncompacted samples to be accounted for - %d bytes\n", history.MemoryUsage())
+	}
+
+	history.SetConfig(HistoryConfig{MaxMemoryBytes: sampleSize * F1_MAX_NUM_CARS * 20})
+	if history.MemoryUsage() > sampleSize*F1_MAX_NUM_CARS*20 {
+		t.Errorf("Memory budget exceeded - %d bytes\n", history.MemoryUsage())
+	}
+
+	// a flashback discards everything after the rewind point
+	history.ConsumePacket(makeTelemetryPacket(295, 1))
+	result, _ = history.Query(3, []string{"speed"}, 0, 300, 0)
+	last := len(result.Channels[0].Values) - 1
+	if result.Channels[0].Time[last] != 295 || result.Channels[0].Values[last] != 1 {
+		t.Errorf("Flashback not applied - last sample %f @ %f\n", result.Channels[0].Values[last], result.Channels[0].Time[last])
+	}
+}
+
+func TestHistoryRetentionAfterFlashback(t *testing.T) {
+	history := TelemetryHistory{}
+	history.Init(HistoryConfig{RetentionSeconds: 60})
+
+	for i := 0; i < 300; i++ {
+		history.ConsumePacket(makeTelemetryPacket(float32(i), uint16(i)))
+	}
+
+	// retention is measured from the rewind point, not the newest time before the flashback
+	for i := 100; i < 110; i++ {
+		history.ConsumePacket(makeTelemetryPacket(float32(i), 1))
+	}
+	result, _ := history.Query(3, []string{"speed"}, 0, 300, 0)
+	if len(result.Channels[0].Time) != 10 || result.Channels[0].Time[0] != 100 {
+		t.Errorf("Expected the 10 samples after the flashback - %v\n", result.Channels[0].Time)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	INCIDENT_DAMAGE_JUMP         uint8   = 5 // percentage points a component has to get worse between two damage packets
+	INCIDENT_G_SPIKE             float32 = 8 // combined lateral and longitudinal G that only a crash or a big kerb strike produces
+	INCIDENT_G_SPIKE_COOLDOWN    float32 = 2 // seconds after a spike in which further spikes of the same car belong to it
+	INCIDENT_MAX_PER_SESSION             = 2000
+	INCIDENT_MAX_STORED_SESSIONS         = 20
+	INCIDENT_NO_CAR              uint8   = 255
+)
+
+const (
+	IncidentType_Collision   = "collision"
+	IncidentType_Penalty     = "penalty"
+	IncidentType_SafetyCar   = "safety car"
+	IncidentType_Retirement  = "retirement"
+	IncidentType_DRSDisabled = "drs disabled"
+	IncidentType_Damage      = "damage"
+	IncidentType_GSpike      = "g spike"
+)
+
+var PENALTY_TYPE_NAMES = []string{
+	"Drive through", "Stop go", "Grid penalty", "Penalty reminder", "Time penalty", "Warning", "Disqualified",
+	"Removed from formation lap", "Parked too long timer", "Tyre regulations", "This lap invalidated",
+	"This and next lap invalidated", "This lap invalidated without reason", "This and next lap invalidated without reason",
+	"This and previous lap invalidated", "This and previous lap invalidated without reason", "Retired", "Black flag timer",
+}
+
+var INFRINGEMENT_TYPE_NAMES = []string{
+	"Blocking by slow driving", "Blocking by wrong way driving", "Reversing off the start line", "Big collision",
+	"Small collision", "Collision failed to hand back position single", "Collision failed to hand back position multiple",
+	"Corner cutting gained time", "Corner cutting overtake single", "Corner cutting overtake multiple",
+	"Crossed pit exit lane", "Ignoring blue flags", "Ignoring yellow flags", "Ignoring drive through",
+	"Too many drive throughs", "Drive through reminder serve within n laps", "Drive through reminder serve this lap",
+	"Pit lane speeding", "Parked for too long", "Ignoring tyre regulations", "Too many penalties", "Multiple warnings",
+	"Approaching disqualification", "Tyre regulations select single", "Tyre regulations select multiple",
+	"Lap invalidated corner cutting", "Lap invalidated running wide", "Corner cutting ran wide gained time minor",
+	"Corner cutting ran wide gained time significant", "Corner cutting ran wide gained time extreme",
+	"Lap invalidated wall riding", "Lap invalidated flashback used", "Lap invalidated reset to track",
+	"Blocking the pitlane", "Jump start", "Safety car to car collision", "Safety car illegal overtake",
+	"Safety car exceeding allowed pace", "Virtual safety car exceeding allowed pace", "Formation lap below allowed speed",
+	"Formation lap parking", "Retired mechanical failure", "Retired terminally damaged", "Safety car falling too far back",
+	"Black flag timer", "Unserved stop go penalty", "Unserved drive through penalty", "Engine component change",
+	"Gearbox change", "Parc fermé change", "League grid penalty", "Retry penalty", "Illegal time gain", "Mandatory pitstop",
+	"Attribute assigned",
+}
+
+var SAFETY_CAR_TYPE_NAMES = []string{"No safety car", "Full safety car", "Virtual safety car", "Formation lap safety car"}
+var SAFETY_CAR_EVENT_NAMES = []string{"deployed", "returning", "returned", "resume race"}
+var DRS_DISABLED_REASON_NAMES = []string{"wet track", "safety car deployed", "red flag", "min lap not reached"}
+
+// EventValueName looks up a value from the appendices of the UDP specification
+func EventValueName(names []string, value uint8) string {
+	if int(value) < len(names) {
+		return names[value]
+	}
+	return fmt.Sprintf("Unknown (%d)", value)
+}
+
+type Incident struct {
+	Seq           uint64 // increases over all sessions, used to find the incidents of a recording
+	SessionUID    uint64
+	SessionTime   float32
+	Type          string
+	CarIndex      uint8 // 255 for incidents that don't involve a car, like the safety car
+	OtherCarIndex uint8 // 255 if no other car is involved
+	LapNum        uint8
+	LapDistance   float32
+	Description   string
+	Component     string  `json:",omitempty"` // damage only
+	FromPercent   uint8   `json:",omitempty"` // damage only
+	ToPercent     uint8   `json:",omitempty"` // damage only
+	GForce        float32 `json:",omitempty"` // g spikes only, the peak of the spike
+}
+
+type carIncidentState struct {
+	lapNum      uint8
+	lapDistance float32
+	damage      F1CarDamageData
+	haveDamage  bool
+	spikeSeq    uint64 // 0 if the car had no spike yet
+	spikeTime   float32
+}
+
+// IncidentTimeline collects events, damage jumps and G spikes of every car into one timeline per session
+type IncidentTimeline struct {
+	RWLock sync.RWMutex
+
+	sessionUID    uint64
+	nextSeq       uint64
+	cars          [F1_MAX_NUM_CARS]carIncidentState
+	sessions      map[uint64][]Incident
+	sessionsOrder []uint64
+}
+
+func (timeline *IncidentTimeline) Init() {
+	timeline.nextSeq = 1
+	timeline.sessions = make(map[uint64][]Incident)
+	timeline.sessionsOrder = make([]uint64, 0)
+	timeline.Reset()
+}
+
+// Reset only forgets the state of the running session, incidents of past sessions are kept
+func (timeline *IncidentTimeline) Reset() {
+	timeline.RWLock.Lock()
+	defer timeline.RWLock.Unlock()
+
+	timeline.startSession(0)
+}
+
+func (timeline *IncidentTimeline) startSession(sessionUID uint64) {
+	timeline.sessionUID = sessionUID
+	for i := range timeline.cars {
+		timeline.cars[i] = carIncidentState{}
+	}
+
+	if _, ok := timeline.sessions[sessionUID]; sessionUID == 0 || ok {
+		return
+	}
+
+	timeline.sessions[sessionUID] = make([]Incident, 0)
+	timeline.sessionsOrder = append(timeline.sessionsOrder, sessionUID)
+	if len(timeline.sessionsOrder) > INCIDENT_MAX_STORED_SESSIONS {
+		delete(timeline.sessions, timeline.sessionsOrder[0])
+		timeline.sessionsOrder = timeline.sessionsOrder[1:]
+	}
+}
+
+func (timeline *IncidentTimeline) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	timeline.RWLock.Lock()
+	defer timeline.RWLock.Unlock()
+
+	if header.SessionUID != timeline.sessionUID {
+		timeline.startSession(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			timeline.cars[i].lapNum = p.LapData[i].CurrentLapNum
+			timeline.cars[i].lapDistance = p.LapData[i].LapDistance
+		}
+	case F1EventDataPacket:
+		timeline.consumeEvent(header, p)
+	case F1CarDamageDataPacket:
+		for i := range p.CarDamageData {
+			timeline.consumeDamage(header, uint8(i), &p.CarDamageData[i])
+		}
+	case F1CarMotionDataPacket:
+		for i := range p.CarMotionData {
+			motion := &p.CarMotionData[i]
+			g := float32(math.Hypot(float64(motion.GForceLateral), float64(motion.GForceLongitudinal)))
+			timeline.consumeGForce(header, uint8(i), g)
+		}
+	}
+}
+
+func (timeline *IncidentTimeline) consumeEvent(header *F1PacketHeader, event F1EventDataPacket) {
+	// COLL and SCAR, and the reason of DRSD, are only sent by games using the F1 24 format
+	switch event.Code() {
+	case EventCode_Collision:
+		details := F1CollisionEvent{}
+		if DecodeEventDetails(event, &details) {
+			timeline.add(header, Incident{
+				Type:          IncidentType_Collision,
+				CarIndex:      details.Vehicle1Idx,
+				OtherCarIndex: details.Vehicle2Idx,
+				Description:   fmt.Sprintf("Collision between car %d and car %d", details.Vehicle1Idx, details.Vehicle2Idx),
+			})
+		}
+	case EventCode_Penalty:
+		details := F1PenaltyEvent{}
+		if DecodeEventDetails(event, &details) {
+			description := fmt.Sprintf("%s for car %d - %s", EventValueName(PENALTY_TYPE_NAMES, details.PenaltyType),
+				details.VehicleIdx, EventValueName(INFRINGEMENT_TYPE_NAMES, details.InfringementType))
+			if details.Time != 255 && details.Time > 0 {
+				description += fmt.Sprintf(" (%ds)", details.Time)
+			}
+			timeline.add(header, Incident{
+				Type:          IncidentType_Penalty,
+				CarIndex:      details.VehicleIdx,
+				OtherCarIndex: details.OtherVehicleIdx,
+				Description:   description,
+			})
+		}
+	case EventCode_SafetyCar:
+		details := F1SafetyCarEvent{}
+		if DecodeEventDetails(event, &details) {
+			timeline.add(header, Incident{
+				Type:          IncidentType_SafetyCar,
+				CarIndex:      INCIDENT_NO_CAR,
+				OtherCarIndex: INCIDENT_NO_CAR,
+				Description: fmt.Sprintf("%s %s", EventValueName(SAFETY_CAR_TYPE_NAMES, details.SafetyCarType),
+					EventValueName(SAFETY_CAR_EVENT_NAMES, details.EventType)),
+			})
+		}
+	case EventCode_Retirement:
+		details := F1RetirementEvent{}
+		if DecodeEventDetails(event, &details) {
+			timeline.add(header, Incident{
+				Type:          IncidentType_Retirement,
+				CarIndex:      details.VehicleIdx,
+				OtherCarIndex: INCIDENT_NO_CAR,
+				Description:   fmt.Sprintf("Car %d retired", details.VehicleIdx),
+			})
+		}
+	case EventCode_DRSDisabled:
+		details := F1DRSDisabledEvent{}
+		if DecodeEventDetails(event, &details) {
+			timeline.add(header, Incident{
+				Type:          IncidentType_DRSDisabled,
+				CarIndex:      INCIDENT_NO_CAR,
+				OtherCarIndex: INCIDENT_NO_CAR,
+				Description:   fmt.Sprintf("DRS disabled - %s", EventValueName(DRS_DISABLED_REASON_NAMES, details.Reason)),
+			})
+		}
+	}
+}
+
+func (timeline *IncidentTimeline) consumeDamage(header *F1PacketHeader, carIndex uint8, damage *F1CarDamageData) {
+	state := &timeline.cars[carIndex]
+	if state.haveDamage {
+		for _, component := range DAMAGE_COMPONENTS {
+			if !component.Body {
+				continue
+			}
+
+			from := component.Value(&state.damage)
+			to := component.Value(damage)
+			if to < from+INCIDENT_DAMAGE_JUMP {
+				continue
+			}
+
+			timeline.add(header, Incident{
+				Type:          IncidentType_Damage,
+				CarIndex:      carIndex,
+				OtherCarIndex: INCIDENT_NO_CAR,
+				Description:   fmt.Sprintf("Car %d %s damage %d%% -> %d%%", carIndex, component.Name, from, to),
+				Component:     component.Name,
+				FromPercent:   from,
+				ToPercent:     to,
+			})
+		}
+	}
+
+	state.damage = *damage
+	state.haveDamage = true
+}
+
+func (timeline *IncidentTimeline) consumeGForce(header *F1PacketHeader, carIndex uint8, g float32) {
+	if g < INCIDENT_G_SPIKE {
+		return
+	}
+
+	state := &timeline.cars[carIndex]
+	if state.spikeSeq != 0 && header.SessionTime-state.spikeTime < INCIDENT_G_SPIKE_COOLDOWN {
+		// still the same spike, keep its peak
+		incidents := timeline.sessions[timeline.sessionUID]
+		for i := len(incidents) - 1; i >= 0 && incidents[i].Seq >= state.spikeSeq; i-- {
+			if incidents[i].Seq == state.spikeSeq && g > incidents[i].GForce {
+				incidents[i].GForce = g
+				incidents[i].Description = fmt.Sprintf("Car %d G spike of %.1fG", carIndex, g)
+			}
+		}
+		state.spikeTime = header.SessionTime
+		return
+	}
+
+	state.spikeSeq = timeline.add(header, Incident{
+		Type:          IncidentType_GSpike,
+		CarIndex:      carIndex,
+		OtherCarIndex: INCIDENT_NO_CAR,
+		Description:   fmt.Sprintf("Car %d G spike of %.1fG", carIndex, g),
+		GForce:        g,
+	})
+	state.spikeTime = header.SessionTime
+}
+
+// add stamps the incident with the session, time and lap position of its car and returns its sequence number
+func (timeline *IncidentTimeline) add(header *F1PacketHeader, incident Incident) uint64 {
+	incident.Seq = timeline.nextSeq
+	incident.SessionUID = header.SessionUID
+	incident.SessionTime = header.SessionTime
+	if incident.CarIndex < F1_MAX_NUM_CARS {
+		incident.LapNum = timeline.cars[incident.CarIndex].lapNum
+		incident.LapDistance = timeline.cars[incident.CarIndex].lapDistance
+	}
+	timeline.nextSeq++
+
+	incidents := append(timeline.sessions[timeline.sessionUID], incident)
+	if len(incidents) > INCIDENT_MAX_PER_SESSION {
+		incidents = incidents[1:]
+	}
+	timeline.sessions[timeline.sessionUID] = incidents
+
+	return incident.Seq
+}
+
+// LastSeq returns the sequence number of the latest incident, 0 if there was none yet
+func (timeline *IncidentTimeline) LastSeq() uint64 {
+	timeline.RWLock.RLock()
+	defer timeline.RWLock.RUnlock()
+
+	return timeline.nextSeq - 1
+}
+
+// GetIncidents returns the incidents of a session (0 = current session), optionally filtered to one car (255 = all cars)
+func (timeline *IncidentTimeline) GetIncidents(sessionUID uint64, carIndex uint8) ([]Incident, error) {
+	timeline.RWLock.RLock()
+	defer timeline.RWLock.RUnlock()
+
+	if sessionUID == 0 {
+		sessionUID = timeline.sessionUID
+	}
+
+	incidents, ok := timeline.sessions[sessionUID]
+	if !ok {
+		return nil, fmt.Errorf("no incidents for session %d", sessionUID)
+	}
+
+	result := make([]Incident, 0, len(incidents))
+	for _, incident := range incidents {
+		if carIndex == 255 || incident.CarIndex == carIndex || incident.OtherCarIndex == carIndex {
+			result = append(result, incident)
+		}
+	}
+	return result, nil
+}
+
+// GetIncidentsSince returns the incidents of all sessions with a sequence number above seq, in order
+func (timeline *IncidentTimeline) GetIncidentsSince(seq uint64) []Incident {
+	timeline.RWLock.RLock()
+	defer timeline.RWLock.RUnlock()
+
+	result := make([]Incident, 0)
+	for _, sessionUID := range timeline.sessionsOrder {
+		for _, incident := range timeline.sessions[sessionUID] {
+			if incident.Seq > seq {
+				result = append(result, incident)
+			}
+		}
+	}
+	// a session that is returned to keeps its place in the order
+	sort.Slice(result, func(i, j int) bool { return result[i].Seq < result[j].Seq })
+	return result
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIncidentTimeline(t *testing.T) {
+	timeline := IncidentTimeline{}
+	timeline.Init()
+
+	lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	lapData.LapData[3].CurrentLapNum = 4
+	lapData.LapData[3].LapDistance = 1200
+	timeline.ConsumePacket(lapData)
+
+	collision := F1EventDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 100}}
+	copy(collision.EventData.EventStringCode[:], EventCode_Collision)
+	collision.EventData.EventDetails[0] = 3
+	collision.EventData.EventDetails[1] = 7
+	timeline.ConsumePacket(collision)
+
+	// the front wing of car 3 breaks, the floor only picks up a scratch
+	damage := F1CarDamageDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 100.1}}
+	timeline.ConsumePacket(damage)
+	damage.f1PacketHeader = &F1PacketHeader{SessionUID: 1, SessionTime: 100.2}
+	damage.CarDamageData[3].FrontLeftWingDamage = 40
+	damage.CarDamageData[3].FloorDamage = 2
+	timeline.ConsumePacket(damage)
+
+	// two samples of the same spike, only the peak is kept
+	for i, g := range []float32{9, 12} {
+		motion := F1CarMotionDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 100 + float32(i)*0.05}}
+		motion.CarMotionData[3].GForceLongitudinal = -g
+		timeline.ConsumePacket(motion)
+	}
+
+	incidents, err := timeline.GetIncidents(0, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incidents) != 1 || incidents[0].Type != IncidentType_Collision || incidents[0].CarIndex != 3 || incidents[0].LapNum != 4 {
+		t.Errorf("Expected the collision to be the only incident of car 7 - %+v\n", incidents)
+	}
+
+	incidents, _ = timeline.GetIncidents(0, 3)
+	if len(incidents) != 3 {
+		t.Fatalf("Expected 3 incidents for car 3, got %+v\n", incidents)
+	}
+	if incidents[1].Component != "front left wing" || incidents[1].FromPercent != 0 || incidents[1].ToPercent != 40 {
+		t.Errorf("Unexpected damage incident - %+v\n", incidents[1])
+	}
+	if incidents[2].Type != IncidentType_GSpike || incidents[2].GForce != 12 {
+		t.Errorf("Unexpected G spike incident - %+v\n", incidents[2])
+	}
+
+	if since := timeline.GetIncidentsSince(incidents[1].Seq); len(since) != 1 || since[0].Seq != incidents[2].Seq {
+		t.Errorf("Unexpected incidents since the damage - %+v\n", since)
+	}
+}
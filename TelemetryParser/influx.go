@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxSink writes packets as InfluxDB line protocol points, one point per car and packet, to an HTTP write
+// endpoint or a local file. Points are batched under the sink's own lock and handed to a writer goroutine through a
+// bounded queue, so a slow or unreachable database drops batches instead of holding up Poll.
+
+const (
+	INFLUX_DEFAULT_MEASUREMENT    = "f1"
+	INFLUX_DEFAULT_PACKETS        = "car_telemetry,motion,lap_data,car_status"
+	INFLUX_DEFAULT_BATCH_SIZE     = 5000 // points
+	INFLUX_DEFAULT_FLUSH_INTERVAL = time.Second
+	INFLUX_DEFAULT_QUEUE_SIZE     = 16 // batches
+	INFLUX_DEFAULT_MAX_RETRIES    = 3
+	INFLUX_DEFAULT_RETRY_DELAY    = 500 * time.Millisecond
+)
+
+type InfluxConfig struct {
+	URL           string // Write endpoint, e.g. http://localhost:8086/api/v2/write?org=o&bucket=b
+	Token         string // Sent as "Authorization: Token <token>" when set
+	File          string // Points are appended to this file when no URL is set
+	Measurement   string
+	Packets       uint16 // bitflags of the packet IDs to write, like RecordingConfig.PacketsToRecord
+	PlayerOnly    bool   // Only write the player car of per car packets
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	MaxRetries    int
+	RetryDelay    time.Duration // Doubled after every failed attempt
+}
+
+func MakeDefaultInfluxConfig() InfluxConfig {
+	packets, _ := PacketMaskFromNames(INFLUX_DEFAULT_PACKETS)
+	return InfluxConfig{
+		Measurement:   INFLUX_DEFAULT_MEASUREMENT,
+		Packets:       packets,
+		BatchSize:     INFLUX_DEFAULT_BATCH_SIZE,
+		FlushInterval: INFLUX_DEFAULT_FLUSH_INTERVAL,
+		QueueSize:     INFLUX_DEFAULT_QUEUE_SIZE,
+		MaxRetries:    INFLUX_DEFAULT_MAX_RETRIES,
+		RetryDelay:    INFLUX_DEFAULT_RETRY_DELAY,
+	}
+}
+
+// PacketMaskFromNames converts a comma separated list of packet table names, see EXPORT_TABLE_NAMES, to bitflags of
+// packet IDs. "all" selects every packet type.
+func PacketMaskFromNames(names string) (uint16, error) {
+	mask := uint16(0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			return 1<<PacketID_Count - 1, nil
+		}
+
+		found := false
+		for id, tableName := range EXPORT_TABLE_NAMES {
+			if tableName == name {
+				mask |= 1 << id
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown packet type '%s'", name)
+		}
+	}
+	return mask, nil
+}
+
+type influxBatch struct {
+	data   []byte
+	points int
+}
+
+type InfluxSink struct {
+	config  InfluxConfig
+	metrics *SinkMetrics
+	client  *http.Client
+	file    *os.File
+
+	lock      sync.Mutex
+	exporter  PacketExporter
+	pending   bytes.Buffer
+	points    int
+	lastFlush time.Time
+
+	queue chan influxBatch
+	done  chan struct{}
+	stop  chan struct{}
+}
+
+func (sink *InfluxSink) Init(config InfluxConfig) error {
+	if config.URL == "" && config.File == "" {
+		return fmt.Errorf("no InfluxDB URL or file given")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = INFLUX_DEFAULT_BATCH_SIZE
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = INFLUX_DEFAULT_FLUSH_INTERVAL
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = INFLUX_DEFAULT_QUEUE_SIZE
+	}
+	sink.config = config
+	sink.metrics = Metrics.Sink("influx")
+
+	if config.URL == "" {
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		sink.file = file
+	} else {
+		sink.client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	sink.exporter = MakePacketExporter()
+	sink.lastFlush = time.Now()
+	sink.queue = make(chan influxBatch, config.QueueSize)
+	sink.done = make(chan struct{})
+	sink.stop = make(chan struct{})
+	go sink.run()
+	return nil
+}
+
+func (sink *InfluxSink) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+	if header.PacketId >= PacketID_Count || sink.config.Packets&(1<<header.PacketId) == 0 {
+		return
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	sink.exporter.AddPacket(packet)
+	table := sink.exporter.Table(header.PacketId)
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+
+	carColumn := table.Columns[len(exportHeaderLeaves)]
+	for row := 0; row < table.Rows; row++ {
+		car := carColumn.Ints[row]
+		if sink.config.PlayerOnly && car != 255 && car != int64(header.PlayerCarIndex) {
+			continue
+		}
+		sink.writePoint(table, row, header, car, timestamp)
+	}
+	table.Truncate()
+
+	if sink.points >= sink.config.BatchSize || now.Sub(sink.lastFlush) >= sink.config.FlushInterval {
+		sink.flushLocked()
+	}
+}
+
+// influxHeaderFields are the header fields written as fields, the rest are tags or don't change within a session
+var influxHeaderFields = map[string]bool{"SessionTime": true, "FrameIdentifier": true, "OverallFrameIdentifier": true}
+
+func (sink *InfluxSink) writePoint(table *ExportTable, row int, header *F1PacketHeader, car int64, timestamp string) {
+	b := &sink.pending
+	b.WriteString(influxEscape(sink.config.Measurement, ", "))
+	b.WriteString(",session_uid=")
+	b.WriteString(strconv.FormatUint(header.SessionUID, 10))
+	if car != 255 {
+		b.WriteString(",car=")
+		b.WriteString(strconv.FormatInt(car, 10))
+	}
+	b.WriteString(",packet=")
+	b.WriteString(table.Name)
+
+	separator := byte(' ')
+	for c, column := range table.Columns {
+		if c <= len(exportHeaderLeaves) && !influxHeaderFields[column.Name] {
+			continue
+		}
+
+		b.WriteByte(separator)
+		separator = ','
+		b.WriteString(influxEscape(column.Name, ",= "))
+		b.WriteByte('=')
+		switch column.Type {
+		case ExportType_Int64:
+			b.WriteString(strconv.FormatInt(column.Ints[row], 10))
+			b.WriteByte('i')
+		case ExportType_Uint64:
+			b.WriteString(strconv.FormatUint(column.Uints[row], 10))
+			b.WriteByte('u')
+		case ExportType_Float32:
+			b.WriteString(strconv.FormatFloat(float64(column.Floats[row]), 'g', -1, 32))
+		case ExportType_String:
+			b.WriteByte('"')
+			b.WriteString(influxEscape(column.Strings[row], `"\`))
+			b.WriteByte('"')
+		}
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(timestamp)
+	b.WriteByte('\n')
+	sink.points++
+}
+
+// influxEscape backslash escapes the characters line protocol treats as delimiters in a name or string
+func influxEscape(s string, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	b := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// flushLocked hands the pending points to the writer, the batch is dropped when the queue is full
+func (sink *InfluxSink) flushLocked() {
+	sink.lastFlush = time.Now()
+	if sink.points == 0 {
+		return
+	}
+
+	batch := influxBatch{append([]byte(nil), sink.pending.Bytes()...), sink.points}
+	sink.pending.Reset()
+	sink.points = 0
+
+	select {
+	case sink.queue <- batch:
+	default:
+		sink.metrics.Dropped.Add(uint64(batch.points))
+	}
+}
+
+func (sink *InfluxSink) Flush() {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.flushLocked()
+}
+
+// Reset flushes the points of the previous session, they are tagged with its SessionUID and stay valid
+func (sink *InfluxSink) Reset() {
+	sink.Flush()
+}
+
+// Close writes the pending points and waits for the queue to drain
+func (sink *InfluxSink) Close() {
+	sink.Flush()
+	close(sink.stop)
+	<-sink.done
+
+	if sink.file != nil {
+		sink.file.Close()
+	}
+}
+
+func (sink *InfluxSink) run() {
+	defer close(sink.done)
+
+	ticker := time.NewTicker(sink.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case batch := <-sink.queue:
+			sink.deliver(batch)
+		case <-ticker.C:
+			// packets stopped arriving, don't hold on to the last points
+			sink.lock.Lock()
+			if time.Since(sink.lastFlush) >= sink.config.FlushInterval {
+				sink.flushLocked()
+			}
+			sink.lock.Unlock()
+		case <-sink.stop:
+			for {
+				select {
+				case batch := <-sink.queue:
+					sink.deliver(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (sink *InfluxSink) deliver(batch influxBatch) {
+	delay := sink.config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := sink.write(batch.data)
+		if err == nil {
+			sink.metrics.Written.Add(uint64(batch.points))
+			return
+		}
+
+		if !retry || attempt >= sink.config.MaxRetries {
+			Log.Printf("InfluxSink: Dropping %d points - %s\n", batch.points, err)
+			sink.metrics.Dropped.Add(uint64(batch.points))
+			return
+		}
+
+		sink.metrics.Retries.Add(1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// write sends a batch, and reports whether a failed write is worth retrying
+func (sink *InfluxSink) write(data []byte) (bool, error) {
+	if sink.file != nil {
+		_, err := sink.file.Write(data)
+		return true, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sink.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if sink.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+sink.config.Token)
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("write failed with status %d - %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	// the server rejects malformed points every time, only overload and server errors are retried
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
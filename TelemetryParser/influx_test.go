@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxSink(t *testing.T) {
+	lock := sync.Mutex{}
+	requests := 0
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		requests++
+		if requests == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Missing token, got '%s'\n", req.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := MakeDefaultInfluxConfig()
+	config.URL = server.URL
+	config.Token = "secret"
+	config.PlayerOnly = true
+	config.RetryDelay = time.Millisecond
+	sink := &InfluxSink{}
+	if err := sink.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarTelemetry, SessionUID: 7, SessionTime: 1.5, PlayerCarIndex: 2}}
+	telemetry.CarTelemetryData[2].Speed = 250
+	telemetry.CarTelemetryData[2].Throttle = 87.5
+	sink.ConsumePacket(telemetry)
+
+	// packet types that aren't configured are skipped
+	sink.ConsumePacket(F1CarDamageDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarDamage, SessionUID: 7}})
+	sink.Close()
+
+	if requests != 2 || len(bodies) != 1 {
+		t.Fatalf("Expected one retried write, got %d requests\n", requests)
+	}
+	lines := strings.Split(strings.TrimSpace(bodies[0]), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a point of the player car only - %v\n", lines)
+	}
+	point := strings.Split(lines[0], " ")
+	if len(point) != 3 || point[0] != "f1,session_uid=7,car=2,packet=car_telemetry" {
+		t.Fatalf("Unexpected point - %s\n", lines[0])
+	}
+	fields := "," + point[1] + ","
+	for _, field := range []string{",SessionTime=1.5,", ",Speed=250i,", ",Throttle=87.5,", ",TyresPressure_FL=0,"} {
+		if !strings.Contains(fields, field) {
+			t.Errorf("Missing field '%s' in %s\n", field, point[1])
+		}
+	}
+	if strings.Contains(fields, "PacketFormat") || strings.Contains(fields, "CarIndex") {
+		t.Errorf("Expected tags and static header fields not to be fields\n")
+	}
+}
+
+func TestInfluxFileSink(t *testing.T) {
+	config := MakeDefaultInfluxConfig()
+	config.File = filepath.Join(t.TempDir(), "points.lp")
+	config.Packets, _ = PacketMaskFromNames("participants")
+	sink := &InfluxSink{}
+	if err := sink.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	participants := F1ParticipantsDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Participants, SessionUID: 7}}
+	copy(participants.ParticipantsData.Participants[0].Name[:], `A "Driver"`)
+	sink.ConsumePacket(participants)
+	sink.Close()
+
+	data, err := os.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != F1_MAX_NUM_CARS || !strings.Contains(lines[0], `Name="A \"Driver\""`) {
+		t.Errorf("Expected a point per car with escaped names - %s\n", lines[0])
+	}
+
+	if _, err := PacketMaskFromNames("car_telemetry,tyres"); err == nil {
+		t.Errorf("Expected an error for an unknown packet type\n")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	CORNER_MIN_SPEED_DROP          float32 = 15 // km/h a speed minimum has to be below the surrounding maxima to count as a corner
+	BRAKING_POINT_THRESHOLD        float32 = 10 // brake percentage at which braking is considered started
+	THROTTLE_APPLICATION_THRESHOLD float32 = 20 // throttle percentage at which the driver is considered back on power
+)
+
+// LapSelector identifies a lap either in the live session or in a recording
+type LapSelector struct {
+	RecordingName string // empty for the live session
+	CarIndex      uint8
+	LapNum        uint8
+}
+
+// CornerSegment spans a corner from the speed maximum before it to the speed maximum after it
+type CornerSegment struct {
+	StartDistance float32
+	ApexDistance  float32
+	EndDistance   float32
+}
+
+type SegmentComparison struct {
+	Name   string
+	TimeA  float32
+	TimeB  float32
+	GainMS float32 // positive = B was faster
+}
+
+type CornerComparison struct {
+	SegmentComparison
+	Segment              CornerSegment
+	MinSpeedA            float32
+	MinSpeedB            float32
+	BrakingPointA        float32 // lap distance, -1 if the driver didn't brake
+	BrakingPointB        float32
+	ThrottleApplicationA float32 // lap distance after the apex, -1 if never reached
+	ThrottleApplicationB float32
+}
+
+type LapComparison struct {
+	A        LapSelector
+	B        LapSelector
+	TraceA   *LapTrace
+	TraceB   *LapTrace
+	Distance []float32
+	DeltaMS  []float32 // B - A at every distance, positive = B is behind
+	Sectors  []SegmentComparison
+	Corners  []CornerComparison
+	SlipsA   []SlipEvent // lockups and wheelspin, only known for the player car
+	SlipsB   []SlipEvent
+}
+
+// SelectLapSources returns the live sources or replays the selected recording.
+// Recordings are loaded through `cache` so two laps from the same recording only parse it once.
+func SelectLapSources(live *LapSources, selector LapSelector, cache map[string]*LapSources) (*LapSources, error) {
+	if selector.RecordingName == "" {
+		return live, nil
+	}
+
+	sources, ok := cache[selector.RecordingName]
+	if !ok {
+		var err error
+		sources, err = LoadRecordingSources(RecordingPath(selector.RecordingName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load recording '%s' - %s", selector.RecordingName, err)
+		}
+		cache[selector.RecordingName] = sources
+	}
+
+	return sources, nil
+}
+
+// CompareLapSelections compares two laps using the stored corners of lap A's track, or its speed minima if the track has none yet
+func CompareLapSelections(live *LapSources, registry *CornerRegistry, a LapSelector, b LapSelector) (*LapComparison, error) {
+	cache := make(map[string]*LapSources)
+
+	sourcesA, err := SelectLapSources(live, a, cache)
+	if err != nil {
+		return nil, err
+	}
+	traceA, err := sourcesA.Laps.GetLapTrace(a.CarIndex, a.LapNum)
+	if err != nil {
+		return nil, err
+	}
+
+	sourcesB, err := SelectLapSources(live, b, cache)
+	if err != nil {
+		return nil, err
+	}
+	traceB, err := sourcesB.Laps.GetLapTrace(b.CarIndex, b.LapNum)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []CornerSegment
+	if traceA.TrackId >= 0 {
+		if corners, err := registry.GetCorners(traceA.TrackId); err == nil {
+			segments = corners.Segments()
+		}
+	}
+	if segments == nil {
+		segments = DetectSpeedCorners(traceA)
+	}
+
+	comparison, err := CompareLaps(traceA, traceB, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison.A = a
+	comparison.B = b
+	comparison.SlipsA = sourcesA.Slips.GetLapEvents(a.CarIndex, a.LapNum)
+	comparison.SlipsB = sourcesB.Slips.GetLapEvents(b.CarIndex, b.LapNum)
+	return comparison, nil
+}
+
+// CompareLaps aligns two lap traces on distance and works out where time was gained or lost
+func CompareLaps(traceA *LapTrace, traceB *LapTrace, corners []CornerSegment) (*LapComparison, error) {
+	if traceA.TrackId != traceB.TrackId {
+		return nil, fmt.Errorf("can't compare laps of different tracks (%d, %d)", traceA.TrackId, traceB.TrackId)
+	}
+	if traceA.DistanceStep != traceB.DistanceStep {
+		return nil, fmt.Errorf("can't compare traces with different distance steps (%f, %f)", traceA.DistanceStep, traceB.DistanceStep)
+	}
+
+	n := len(traceA.Distance)
+	if len(traceB.Distance) < n {
+		n = len(traceB.Distance)
+	}
+
+	comparison := &LapComparison{
+		TraceA:   traceA,
+		TraceB:   traceB,
+		Distance: traceA.Distance[:n],
+		DeltaMS:  make([]float32, n),
+	}
+
+	for i := 0; i < n; i++ {
+		comparison.DeltaMS[i] = traceB.LapTimeMS[i] - traceA.LapTimeMS[i]
+	}
+
+	sectorTimes := func(trace *LapTrace) [3]float32 {
+		s1, s2 := float32(trace.Sector1TimeInMS), float32(trace.Sector2TimeInMS)
+		return [3]float32{s1, s2, float32(trace.LapTimeInMS) - s1 - s2}
+	}
+	hasSectors := func(trace *LapTrace) bool {
+		return trace.Sector1TimeInMS != 0 && trace.Sector2TimeInMS != 0
+	}
+	// a lap without split times would put the whole lap into the last sector
+	if hasSectors(traceA) && hasSectors(traceB) {
+		sectorsA, sectorsB := sectorTimes(traceA), sectorTimes(traceB)
+		for i := range sectorsA {
+			comparison.Sectors = append(comparison.Sectors, SegmentComparison{fmt.Sprintf("S%d", i+1), sectorsA[i], sectorsB[i], sectorsA[i] - sectorsB[i]})
+		}
+	}
+
+	for i, corner := range corners {
+		timeA := traceA.TimeAtDistance(corner.EndDistance) - traceA.TimeAtDistance(corner.StartDistance)
+		timeB := traceB.TimeAtDistance(corner.EndDistance) - traceB.TimeAtDistance(corner.StartDistance)
+
+		comparison.Corners = append(comparison.Corners, CornerComparison{
+			SegmentComparison:    SegmentComparison{fmt.Sprintf("T%d", i+1), timeA, timeB, timeA - timeB},
+			Segment:              corner,
+			MinSpeedA:            traceA.MinSpeed(corner.StartDistance, corner.EndDistance),
+			MinSpeedB:            traceB.MinSpeed(corner.StartDistance, corner.EndDistance),
+			BrakingPointA:        traceA.BrakingPoint(corner.StartDistance, corner.ApexDistance, BRAKING_POINT_THRESHOLD),
+			BrakingPointB:        traceB.BrakingPoint(corner.StartDistance, corner.ApexDistance, BRAKING_POINT_THRESHOLD),
+			ThrottleApplicationA: traceA.ThrottlePoint(corner.ApexDistance, corner.EndDistance, THROTTLE_APPLICATION_THRESHOLD),
+			ThrottleApplicationB: traceB.ThrottlePoint(corner.ApexDistance, corner.EndDistance, THROTTLE_APPLICATION_THRESHOLD),
+		})
+	}
+
+	return comparison, nil
+}
+
+// DetectSpeedCorners finds corners as speed minima that are at least CORNER_MIN_SPEED_DROP below the maxima on either side
+func DetectSpeedCorners(trace *LapTrace) []CornerSegment {
+	corners := make([]CornerSegment, 0)
+	speed := trace.Speed
+	if len(speed) == 0 {
+		return corners
+	}
+
+	maxIdx, minIdx := 0, 0
+	lookingForMin := true
+	var pending *CornerSegment
+
+	for i := 1; i < len(speed); i++ {
+		if lookingForMin {
+			if speed[i] > speed[maxIdx] {
+				maxIdx = i
+				minIdx = i
+			}
+			if speed[i] < speed[minIdx] {
+				minIdx = i
+			}
+			if speed[maxIdx]-speed[minIdx] >= CORNER_MIN_SPEED_DROP && speed[i]-speed[minIdx] >= CORNER_MIN_SPEED_DROP {
+				pending = &CornerSegment{StartDistance: trace.Distance[maxIdx], ApexDistance: trace.Distance[minIdx]}
+				lookingForMin = false
+				maxIdx = i
+			}
+		} else {
+			if speed[i] >= speed[maxIdx] {
+				maxIdx = i
+			}
+			if speed[maxIdx]-speed[i] >= CORNER_MIN_SPEED_DROP {
+				pending.EndDistance = trace.Distance[maxIdx]
+				corners = append(corners, *pending)
+				pending = nil
+				lookingForMin = true
+				minIdx = i
+			}
+		}
+	}
+
+	if pending != nil {
+		pending.EndDistance = trace.Distance[maxIdx]
+		corners = append(corners, *pending)
+	}
+
+	return corners
+}
+
+func (trace *LapTrace) indexRange(from float32, to float32) (int, int) {
+	lo := int(from / trace.DistanceStep)
+	hi := int(to/trace.DistanceStep) + 1
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(trace.Distance) {
+		hi = len(trace.Distance)
+	}
+	if lo > hi {
+		lo = hi
+	}
+	return lo, hi
+}
+
+func (trace *LapTrace) MinSpeed(from float32, to float32) float32 {
+	lo, hi := trace.indexRange(from, to)
+	if lo == hi {
+		return 0
+	}
+
+	minSpeed := trace.Speed[lo]
+	for _, s := range trace.Speed[lo:hi] {
+		if s < minSpeed {
+			minSpeed = s
+		}
+	}
+	return minSpeed
+}
+
+// BrakingPoint returns the first distance in the range where the brake crosses `threshold`, or -1
+func (trace *LapTrace) BrakingPoint(from float32, to float32, threshold float32) float32 {
+	lo, hi := trace.indexRange(from, to)
+	for i := lo; i < hi; i++ {
+		if trace.Brake[i] >= threshold {
+			return trace.Distance[i]
+		}
+	}
+	return -1
+}
+
+// ThrottlePoint returns the distance in the range from which the throttle stays above `threshold`, or -1
+func (trace *LapTrace) ThrottlePoint(from float32, to float32, threshold float32) float32 {
+	lo, hi := trace.indexRange(from, to)
+	point := float32(-1)
+	for i := lo; i < hi; i++ {
+		if trace.Throttle[i] < threshold {
+			point = -1
+		} else if point < 0 {
+			point = trace.Distance[i]
+		}
+	}
+	return point
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// makeCornerLap builds a 1000m lap with one corner at 500m, the driver brakes `brakeOffset` metres before 400m
+func makeCornerLap(minSpeed float32, brakeOffset float32) *LapTrace {
+	samples := make([]lapSample, 0)
+	lapTime := float32(0)
+	for d := float32(0); d <= 1000; d += 1 {
+		speed := float32(250)
+		if d > 400 && d < 600 {
+			dist := d - 500
+			if dist < 0 {
+				dist = -dist
+			}
+			speed = minSpeed + (250-minSpeed)*dist/100
+		}
+
+		sample := lapSample{Distance: d, LapTimeInMS: uint32(lapTime)}
+		sample.Telemetry.Speed = uint16(speed)
+		sample.Telemetry.Throttle = 100
+		if d >= 400-brakeOffset && d < 500 {
+			sample.Telemetry.Brake = 80
+			sample.Telemetry.Throttle = 0
+		}
+		samples = append(samples, sample)
+		lapTime += 1000 / (speed / 3.6)
+	}
+
+	trace := ResampleLap(samples, LAP_TRACE_DISTANCE_STEP)
+	trace.LapTimeInMS = uint32(lapTime)
+	return trace
+}
+
+func TestLapComparison(t *testing.T) {
+	traceA := makeCornerLap(80, 0)
+	traceB := makeCornerLap(100, 20)
+
+	corners := DetectSpeedCorners(traceA)
+	if len(corners) != 1 || corners[0].ApexDistance != 500 {
+		t.Fatalf("Expected a single corner at 500m, got %v\n", corners)
+	}
+
+	comparison, err := CompareLaps(traceA, traceB, corners)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corner := comparison.Corners[0]
+	if corner.MinSpeedA != 80 || corner.MinSpeedB != 100 {
+		t.Errorf("Unexpected minimum speeds - %f, %f\n", corner.MinSpeedA, corner.MinSpeedB)
+	}
+
+	if corner.BrakingPointA != 400 || corner.BrakingPointB != 380 {
+		t.Errorf("Unexpected braking points - %f, %f\n", corner.BrakingPointA, corner.BrakingPointB)
+	}
+
+	if corner.GainMS <= 0 || comparison.DeltaMS[len(comparison.DeltaMS)-1] >= 0 {
+		t.Errorf("Lap B carried more speed through the corner and should be ahead - gain %f\n", corner.GainMS)
+	}
+
+	// the sector times of both laps are known
+	traceA.Sector1TimeInMS, traceA.Sector2TimeInMS = 6000, 7000
+	traceB.Sector1TimeInMS, traceB.Sector2TimeInMS = 6100, 6800
+	comparison, _ = CompareLaps(traceA, traceB, corners)
+	if len(comparison.Sectors) != 3 || comparison.Sectors[0].GainMS != -100 || comparison.Sectors[1].GainMS != 200 {
+		t.Errorf("Unexpected sector gains - %+v\n", comparison.Sectors)
+	}
+
+	// a lap without split times, like one that started in the pits, has no sector gains
+	traceB.Sector2TimeInMS = 0
+	comparison, _ = CompareLaps(traceA, traceB, corners)
+	if len(comparison.Sectors) != 0 {
+		t.Errorf("Expected no sector gains without split times - %+v\n", comparison.Sectors)
+	}
+
+	traceB.TrackId = 4
+	if _, err := CompareLaps(traceA, traceB, corners); err == nil {
+		t.Errorf("Expected an error for laps of different tracks\n")
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LAP_DATABASE_DIR         = "lap_database"
+	LAP_DATABASE_LAPS_FILE   = "laps.jsonl"
+	LAP_DATABASE_SETUPS_FILE = "setups.jsonl"
+	LAP_DATABASE_TRACES_DIR  = "traces"
+	LAP_SOURCE_LIVE          = "live"
+	LAP_ARCHIVE_QUEUE_SIZE   = 64
+)
+
+// LapRecord is a completed valid lap with the conditions it was driven in, its trace is stored in a file of its own
+type LapRecord struct {
+	Id               uint64
+	SessionUID       uint64
+	SessionType      uint8
+	TrackId          int8
+	CarIndex         uint8
+	Driver           string
+	TeamId           uint8
+	LapNum           uint8
+	LapTimeInMS      uint32
+	Sector1TimeInMS  uint32
+	Sector2TimeInMS  uint32
+	ActualCompound   string
+	VisualCompound   string
+	TyreAgeLaps      uint8
+	SetupRef         string // empty if no car setups packet was received
+	Weather          uint8
+	TrackTemperature int8
+	AirTemperature   int8
+	RecordedAt       time.Time
+	Source           string // "live" or the name of the imported recording
+}
+
+type LapFilter struct {
+	TrackId     int8  // -1 = all tracks
+	SessionType int16 // -1 = all session types
+	Driver      string
+}
+
+func (filter LapFilter) Matches(record *LapRecord) bool {
+	return (filter.TrackId < 0 || record.TrackId == filter.TrackId) &&
+		(filter.SessionType < 0 || int16(record.SessionType) == filter.SessionType) &&
+		(filter.Driver == "" || record.Driver == filter.Driver)
+}
+
+// LapDatabase is an append-only store of laps on disk. Lap records and setups are kept as JSON lines and loaded
+// into memory when the database is opened, traces are gzipped JSON files only read when asked for.
+type LapDatabase struct {
+	RWLock sync.RWMutex
+	Dir    string
+
+	nextId  uint64
+	records []LapRecord
+	keys    map[string]struct{} // session, car and lap of every record, so replays and re-imports aren't stored twice
+	setups  map[string]F1CarSetupData
+}
+
+func OpenLapDatabase(dir string) (*LapDatabase, error) {
+	db := &LapDatabase{
+		Dir:     dir,
+		nextId:  1,
+		records: make([]LapRecord, 0),
+		keys:    make(map[string]struct{}),
+		setups:  make(map[string]F1CarSetupData),
+	}
+
+	err := readJSONLines(filepath.Join(dir, LAP_DATABASE_LAPS_FILE), func(line []byte) error {
+		record := LapRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		db.records = append(db.records, record)
+		db.keys[lapRecordKey(record.SessionUID, record.CarIndex, record.LapNum)] = struct{}{}
+		if record.Id >= db.nextId {
+			db.nextId = record.Id + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readJSONLines(filepath.Join(dir, LAP_DATABASE_SETUPS_FILE), func(line []byte) error {
+		entry := struct {
+			Ref   string
+			Setup F1CarSetupData
+		}{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		db.setups[entry.Ref] = entry.Setup
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// readJSONLines calls handler for every line of a file, a missing file is an empty one. A last line without a newline
+// was torn by a crash while appending, it's cut off so the next append starts on a line of its own.
+func readJSONLines(filename string, handler func(line []byte) error) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		torn := err == io.EOF && len(data) > 0
+
+		line := bytes.TrimSpace(data)
+		if len(line) > 0 {
+			handlerErr := handler(line)
+			if handlerErr != nil && !torn {
+				return fmt.Errorf("corrupt line in %s - %s", filename, handlerErr)
+			}
+			if handlerErr != nil {
+				Log.Printf("Dropping the incomplete last line of %s - %s\n", filename, handlerErr)
+				return os.Truncate(filename, offset)
+			}
+			if torn {
+				// only the newline is missing
+				return appendNewline(filename)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		offset += int64(len(data))
+	}
+}
+
+func appendNewline(filename string) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+func appendJSONLine(filename string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func lapRecordKey(sessionUID uint64, carIndex uint8, lapNum uint8) string {
+	return fmt.Sprintf("%d/%d/%d", sessionUID, carIndex, lapNum)
+}
+
+func (db *LapDatabase) tracePath(id uint64) string {
+	return filepath.Join(db.Dir, LAP_DATABASE_TRACES_DIR, fmt.Sprintf("%d.json.gz", id))
+}
+
+// SetupRef identifies a setup by a hash of its values, the fuel load isn't part of a setup
+func SetupRef(setup F1CarSetupData) string {
+	setup.FuelLoad = 0
+	hash := fnv.New64a()
+	binary.Write(hash, binary.LittleEndian, &setup)
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// Add stores a lap, its trace and its setup. Laps already in the database are skipped, false is returned for them.
+func (db *LapDatabase) Add(record LapRecord, trace *LapTrace, setup *F1CarSetupData) (bool, error) {
+	db.RWLock.Lock()
+	defer db.RWLock.Unlock()
+
+	key := lapRecordKey(record.SessionUID, record.CarIndex, record.LapNum)
+	if _, ok := db.keys[key]; ok {
+		return false, nil
+	}
+
+	err := os.MkdirAll(filepath.Join(db.Dir, LAP_DATABASE_TRACES_DIR), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	if setup != nil {
+		record.SetupRef = SetupRef(*setup)
+		if _, ok := db.setups[record.SetupRef]; !ok {
+			entry := struct {
+				Ref   string
+				Setup F1CarSetupData
+			}{record.SetupRef, *setup}
+			if err := appendJSONLine(filepath.Join(db.Dir, LAP_DATABASE_SETUPS_FILE), entry); err != nil {
+				return false, err
+			}
+			db.setups[record.SetupRef] = *setup
+		}
+	}
+
+	record.Id = db.nextId
+	if err := writeGzipJSON(db.tracePath(record.Id), trace); err != nil {
+		return false, err
+	}
+	// the record goes last, a lap is only in the database once its trace is
+	if err := appendJSONLine(filepath.Join(db.Dir, LAP_DATABASE_LAPS_FILE), record); err != nil {
+		return false, err
+	}
+
+	db.nextId++
+	db.records = append(db.records, record)
+	db.keys[key] = struct{}{}
+	return true, nil
+}
+
+func writeGzipJSON(filename string, v any) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// GetLaps returns the stored laps matching a filter, fastest first
+func (db *LapDatabase) GetLaps(filter LapFilter) []LapRecord {
+	db.RWLock.RLock()
+	defer db.RWLock.RUnlock()
+
+	result := make([]LapRecord, 0)
+	for i := range db.records {
+		if filter.Matches(&db.records[i]) {
+			result = append(result, db.records[i])
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].LapTimeInMS < result[j].LapTimeInMS })
+	return result
+}
+
+// GetPersonalBests returns the fastest lap of every driver per track and session type
+func (db *LapDatabase) GetPersonalBests(filter LapFilter) []LapRecord {
+	db.RWLock.RLock()
+	defer db.RWLock.RUnlock()
+
+	bests := make(map[string]int)
+	for i := range db.records {
+		record := &db.records[i]
+		if !filter.Matches(record) {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%d/%d", record.Driver, record.TrackId, record.SessionType)
+		if best, ok := bests[key]; !ok || record.LapTimeInMS < db.records[best].LapTimeInMS {
+			bests[key] = i
+		}
+	}
+
+	result := make([]LapRecord, 0, len(bests))
+	for _, i := range bests {
+		result = append(result, db.records[i])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := &result[i], &result[j]
+		if a.TrackId != b.TrackId {
+			return a.TrackId < b.TrackId
+		}
+		if a.SessionType != b.SessionType {
+			return a.SessionType < b.SessionType
+		}
+		return a.LapTimeInMS < b.LapTimeInMS
+	})
+	return result
+}
+
+func (db *LapDatabase) GetTrace(id uint64) (*LapTrace, error) {
+	db.RWLock.RLock()
+	defer db.RWLock.RUnlock()
+
+	file, err := os.Open(db.tracePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("no trace for lap %d", id)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	trace := &LapTrace{}
+	err = json.NewDecoder(reader).Decode(trace)
+	if err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+func (db *LapDatabase) GetSetup(ref string) (F1CarSetupData, error) {
+	db.RWLock.RLock()
+	defer db.RWLock.RUnlock()
+
+	setup, ok := db.setups[ref]
+	if !ok {
+		return setup, fmt.Errorf("no setup '%s'", ref)
+	}
+	return setup, nil
+}
+
+type carArchiveState struct {
+	lapNum      uint8
+	status      F1CarStatusData
+	haveStatus  bool
+	setup       F1CarSetupData
+	haveSetup   bool
+	participant F1ParticipantData
+}
+
+type lapArchiveJob struct {
+	record LapRecord
+	trace  *LapTrace
+	setup  *F1CarSetupData
+}
+
+// LapArchiver stores the valid laps the LapTracker completes in the lap database, with the conditions they were driven in.
+// The laps of every car are archived once the participants are known. They are written by a goroutine of their own
+// through a bounded queue, so disk I/O doesn't hold up Poll.
+type LapArchiver struct {
+	RWLock sync.RWMutex
+	DB     *LapDatabase
+	Laps   *LapTracker
+	Source string
+	Wait   bool // wait for the writer when the queue is full instead of dropping the lap, for imports
+
+	sessionUID       uint64
+	session          F1SessionData
+	haveParticipants bool
+	cars             [F1_MAX_NUM_CARS]carArchiveState
+
+	queue chan lapArchiveJob
+	done  chan struct{}
+	stop  chan struct{}
+}
+
+// Init takes the lap tracker the laps come from, it has to consume every packet before the archiver does
+func (archiver *LapArchiver) Init(db *LapDatabase, laps *LapTracker, source string) {
+	archiver.DB = db
+	archiver.Laps = laps
+	archiver.Source = source
+	archiver.Reset()
+
+	archiver.queue = make(chan lapArchiveJob, LAP_ARCHIVE_QUEUE_SIZE)
+	archiver.done = make(chan struct{})
+	archiver.stop = make(chan struct{})
+	go archiver.run()
+}
+
+// Close waits for the queued laps to be written
+func (archiver *LapArchiver) Close() {
+	close(archiver.stop)
+	<-archiver.done
+}
+
+func (archiver *LapArchiver) run() {
+	defer close(archiver.done)
+
+	for {
+		select {
+		case job := <-archiver.queue:
+			archiver.write(job)
+		case <-archiver.stop:
+			for {
+				select {
+				case job := <-archiver.queue:
+					archiver.write(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (archiver *LapArchiver) write(job lapArchiveJob) {
+	_, err := archiver.DB.Add(job.record, job.trace, job.setup)
+	if err != nil {
+		Log.Printf("Failed to archive lap %d of car %d - %s\n", job.record.LapNum, job.record.CarIndex, err)
+	}
+}
+
+func (archiver *LapArchiver) Reset() {
+	archiver.RWLock.Lock()
+	defer archiver.RWLock.Unlock()
+
+	archiver.reset(0)
+}
+
+func (archiver *LapArchiver) reset(sessionUID uint64) {
+	archiver.sessionUID = sessionUID
+	archiver.session = F1SessionData{TrackId: -1}
+	archiver.haveParticipants = false
+	for i := range archiver.cars {
+		archiver.cars[i] = carArchiveState{}
+	}
+}
+
+func (archiver *LapArchiver) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	archiver.RWLock.Lock()
+	defer archiver.RWLock.Unlock()
+
+	if archiver.DB == nil {
+		return
+	}
+	if header.SessionUID != archiver.sessionUID {
+		archiver.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		archiver.session = p.SessionData
+	case F1ParticipantsDataPacket:
+		archiver.haveParticipants = true
+		for i := range p.ParticipantsData.Participants {
+			archiver.cars[i].participant = p.ParticipantsData.Participants[i]
+		}
+	case F1CarStatusDataPacket:
+		for i := range p.CarStatusData {
+			archiver.cars[i].status = p.CarStatusData[i]
+			archiver.cars[i].haveStatus = true
+		}
+	case F1CarSetupDataPacket:
+		for i := range p.CarSetups {
+			archiver.cars[i].setup = p.CarSetups[i]
+			archiver.cars[i].haveSetup = true
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			lapNum := p.LapData[i].CurrentLapNum
+			state := &archiver.cars[i]
+			// without the participants the driver's name isn't known yet
+			if state.lapNum != 0 && lapNum == state.lapNum+1 && archiver.haveParticipants {
+				archiver.archive(header, uint8(i), state.lapNum)
+			}
+			state.lapNum = lapNum
+		}
+	}
+}
+
+func (archiver *LapArchiver) archive(header *F1PacketHeader, carIndex uint8, lapNum uint8) {
+	trace, err := archiver.Laps.GetLapTrace(carIndex, lapNum)
+	if err != nil || !trace.Valid {
+		return
+	}
+
+	state := &archiver.cars[carIndex]
+	record := LapRecord{
+		SessionUID:       header.SessionUID,
+		SessionType:      archiver.session.SessionType,
+		TrackId:          trace.TrackId,
+		CarIndex:         carIndex,
+		Driver:           driverName(carIndex, &state.participant),
+		TeamId:           state.participant.TeamId,
+		LapNum:           lapNum,
+		LapTimeInMS:      trace.LapTimeInMS,
+		Sector1TimeInMS:  trace.Sector1TimeInMS,
+		Sector2TimeInMS:  trace.Sector2TimeInMS,
+		Weather:          archiver.session.Weather,
+		TrackTemperature: archiver.session.TrackTemperature,
+		AirTemperature:   archiver.session.AirTemperature,
+		RecordedAt:       time.Now(),
+		Source:           archiver.Source,
+	}
+	if state.haveStatus {
+		record.ActualCompound = CompoundName(ACTUAL_COMPOUND_NAMES, state.status.ActualTyreCompound)
+		record.VisualCompound = CompoundName(VISUAL_COMPOUND_NAMES, state.status.VisualTyreCompound)
+		record.TyreAgeLaps = state.status.TyresAgeLaps
+	}
+
+	job := lapArchiveJob{record: record, trace: trace}
+	if state.haveSetup {
+		setup := state.setup
+		job.setup = &setup
+	}
+
+	if archiver.Wait {
+		archiver.queue <- job
+		return
+	}
+	select {
+	case archiver.queue <- job:
+	default:
+		Log.Printf("Lap archive queue is full, dropping lap %d of car %d\n", lapNum, carIndex)
+	}
+}
+
+// ImportRecording replays a recording into the lap database and returns how many new laps were stored
+func ImportRecording(db *LapDatabase, filename string) (int, error) {
+	before := len(db.GetLaps(LapFilter{TrackId: -1, SessionType: -1}))
+
+	laps := &LapTracker{}
+	laps.Init()
+	archiver := &LapArchiver{}
+	archiver.Init(db, laps, filepath.Base(filename))
+	archiver.Wait = true
+
+	err := ReadRecording(filename, func(packet F1Packet) {
+		laps.ConsumePacket(packet)
+		archiver.ConsumePacket(packet)
+	})
+	archiver.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(db.GetLaps(LapFilter{TrackId: -1, SessionType: -1})) - before, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type consumerChain []PacketConsumer
+
+func (chain consumerChain) ConsumePacket(packet F1Packet) {
+	for _, consumer := range chain {
+		consumer.ConsumePacket(packet)
+	}
+}
+
+func (chain consumerChain) Reset() {
+	for _, consumer := range chain {
+		consumer.Reset()
+	}
+}
+
+func TestLapDatabase(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenLapDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	laps := &LapTracker{}
+	laps.Init()
+	archiver := &LapArchiver{}
+	archiver.Init(db, laps, LAP_SOURCE_LIVE)
+
+	// without the participants the driver isn't known, the laps aren't archived
+	feedSyntheticLaps(consumerChain{laps, archiver}, 2)
+	if records := db.GetLaps(LapFilter{TrackId: -1, SessionType: -1}); len(records) != 0 {
+		t.Fatalf("Expected no laps before the participants are known - %+v\n", records)
+	}
+	laps.Reset()
+	archiver.Reset()
+
+	participants := F1ParticipantsDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Participants, SessionUID: 7}}
+	participants.ParticipantsData.NumActiveCars = 1
+	copy(participants.ParticipantsData.Participants[0].Name[:], "Driver A")
+	participants.ParticipantsData.Participants[0].AiControlled = 1
+	archiver.ConsumePacket(participants)
+
+	setups := F1CarSetupDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 7}}
+	setups.CarSetups[0].FrontWing = 30
+	setups.CarSetups[0].FuelLoad = 10
+	archiver.ConsumePacket(setups)
+
+	feedSyntheticLaps(consumerChain{laps, archiver}, 2)
+	// replaying the same session doesn't store its laps twice
+	feedSyntheticLaps(consumerChain{laps, archiver}, 2)
+	archiver.Close()
+
+	reopened, err := OpenLapDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := reopened.GetLaps(LapFilter{TrackId: 3, SessionType: -1})
+	if len(records) != 2 || records[0].Driver != "Driver A" || records[0].LapTimeInMS != 20000 {
+		t.Fatalf("Expected the 2 laps of the AI driven car 0 - %+v\n", records)
+	}
+
+	bests := reopened.GetPersonalBests(LapFilter{TrackId: -1, SessionType: -1})
+	if len(bests) != 1 || bests[0].TrackId != 3 {
+		t.Errorf("Expected one personal best - %+v\n", bests)
+	}
+
+	trace, err := reopened.GetTrace(records[0].Id)
+	if err != nil || len(trace.Distance) == 0 || trace.LapNum != records[0].LapNum {
+		t.Errorf("Failed to read the trace of lap %d - %v\n", records[0].Id, err)
+	}
+
+	setup, err := reopened.GetSetup(records[0].SetupRef)
+	if err != nil || setup.FrontWing != 30 {
+		t.Errorf("Failed to read the setup of lap %d - %v\n", records[0].Id, err)
+	}
+
+	if len(reopened.GetLaps(LapFilter{TrackId: 4, SessionType: -1})) != 0 {
+		t.Errorf("Expected no laps on another track\n")
+	}
+}
+
+func TestLapDatabaseTornLine(t *testing.T) {
+	InitLogger(false)
+	Log = GetLogger()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, LAP_DATABASE_LAPS_FILE)
+	complete := `{"Id":1,"SessionUID":7,"TrackId":3,"LapNum":1,"LapTimeInMS":20000}` + "\n"
+	if err := os.WriteFile(filename, []byte(complete+`{"Id":2,"SessionUID":7,"Tra`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenLapDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := db.GetLaps(LapFilter{TrackId: -1, SessionType: -1}); len(records) != 1 || records[0].Id != 1 {
+		t.Fatalf("Expected the complete line only - %+v\n", records)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != complete {
+		t.Errorf("Expected the torn line to be cut off - %q\n", data)
+	}
+
+	// a complete record that only misses its newline is kept, and terminated
+	if err := os.WriteFile(filename, []byte(complete[:len(complete)-1]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenLapDatabase(dir); err != nil || len(db.GetLaps(LapFilter{TrackId: -1, SessionType: -1})) != 1 {
+		t.Fatalf("Expected the unterminated record to be read - %v\n", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != complete {
+		t.Errorf("Expected a newline after the last record - %q\n", data)
+	}
+
+	// corruption before the last line is still an error
+	if err := os.WriteFile(filename, []byte("{\n"+complete), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLapDatabase(dir); err == nil {
+		t.Errorf("Expected an error for a corrupt line\n")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type LapReferenceSource uint8
+
+const (
+	LapReferenceSource_SessionBest LapReferenceSource = iota // the player's fastest valid lap of the current session
+	LapReferenceSource_SessionLap                            // a fixed lap of any car in the current session
+	LapReferenceSource_Recording                             // a lap taken from a recording
+)
+
+type LapReferenceInfo struct {
+	Source        LapReferenceSource
+	RecordingName string
+	CarIndex      uint8
+	LapNum        uint8
+	LapTimeInMS   uint32
+}
+
+type LapDelta struct {
+	CarIndex             uint8
+	LapNum               uint8
+	LapDistance          float32
+	CurrentLapTimeInMS   uint32
+	ReferenceLapTimeInMS float32 // time the reference lap took to reach the same lap distance
+	DeltaInMS            float32 // positive = slower than the reference
+	Reference            LapReferenceInfo
+}
+
+// LapDeltaTracker computes the player's running delta against a reference lap and broadcasts it with every lap data packet.
+// A reference lap of another track gives no delta.
+type LapDeltaTracker struct {
+	RWLock sync.RWMutex
+	WSS    *WebsocketServer
+	Laps   *LapTracker
+
+	sessionUID    uint64
+	trackId       int8
+	referenceInfo LapReferenceInfo
+	reference     *LapTrace // only set for fixed references, the session best is looked up on every frame
+	latest        *LapDelta
+}
+
+func (tracker *LapDeltaTracker) Init(wss *WebsocketServer, laps *LapTracker) {
+	tracker.WSS = wss
+	tracker.Laps = laps
+	tracker.Reset()
+}
+
+func (tracker *LapDeltaTracker) Reset() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.startSession(0)
+}
+
+func (tracker *LapDeltaTracker) startSession(sessionUID uint64) {
+	tracker.sessionUID = sessionUID
+	tracker.trackId = -1
+	tracker.latest = nil
+
+	// references from recordings outlive the session, anything else is gone with it
+	if tracker.referenceInfo.Source != LapReferenceSource_Recording {
+		tracker.referenceInfo = LapReferenceInfo{Source: LapReferenceSource_SessionBest}
+		tracker.reference = nil
+	}
+}
+
+func (tracker *LapDeltaTracker) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	tracker.RWLock.Lock()
+	if header.SessionUID != tracker.sessionUID {
+		tracker.startSession(header.SessionUID)
+	}
+	if session, ok := packet.(F1SessionDataPacket); ok {
+		tracker.trackId = session.SessionData.TrackId
+	}
+	reference, info, trackId := tracker.reference, tracker.referenceInfo, tracker.trackId
+	tracker.RWLock.Unlock()
+
+	lapDataPacket, ok := packet.(F1LapDataPacket)
+	if !ok || header.PlayerCarIndex >= F1_MAX_NUM_CARS {
+		return
+	}
+
+	lapData := &lapDataPacket.LapData[header.PlayerCarIndex]
+	if lapData.LapDistance < 0 {
+		return
+	}
+
+	if info.Source != LapReferenceSource_SessionBest && reference.TrackId != trackId {
+		tracker.RWLock.Lock()
+		tracker.latest = nil
+		tracker.RWLock.Unlock()
+		return
+	}
+
+	if info.Source == LapReferenceSource_SessionBest {
+		reference = tracker.Laps.GetBestLap(header.PlayerCarIndex)
+		if reference == nil {
+			return
+		}
+		info.CarIndex = reference.CarIndex
+		info.LapNum = reference.LapNum
+		info.LapTimeInMS = reference.LapTimeInMS
+	}
+
+	referenceTime := reference.TimeAtDistance(lapData.LapDistance)
+	delta := &LapDelta{
+		CarIndex:             header.PlayerCarIndex,
+		LapNum:               lapData.CurrentLapNum,
+		LapDistance:          lapData.LapDistance,
+		CurrentLapTimeInMS:   lapData.CurrentLapTimeInMS,
+		ReferenceLapTimeInMS: referenceTime,
+		DeltaInMS:            float32(lapData.CurrentLapTimeInMS) - referenceTime,
+		Reference:            info,
+	}
+
+	tracker.RWLock.Lock()
+	tracker.latest = delta
+	tracker.RWLock.Unlock()
+
+	WSSBroadcastDerived(tracker.WSS, header, PacketID_LapDelta, delta)
+}
+
+func (tracker *LapDeltaTracker) UseSessionBest() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.referenceInfo = LapReferenceInfo{Source: LapReferenceSource_SessionBest}
+	tracker.reference = nil
+}
+
+func (tracker *LapDeltaTracker) UseSessionLap(carIndex uint8, lapNum uint8) error {
+	trace, err := tracker.Laps.GetLapTrace(carIndex, lapNum)
+	if err != nil {
+		return err
+	}
+
+	tracker.setReference(trace, LapReferenceInfo{LapReferenceSource_SessionLap, "", carIndex, lapNum, trace.LapTimeInMS})
+	return nil
+}
+
+// UseRecordingLap loads a recording and uses one of its laps as reference, lapNum 0 picks the fastest valid lap of the car
+func (tracker *LapDeltaTracker) UseRecordingLap(recordingName string, carIndex uint8, lapNum uint8) error {
+	laps, err := LoadRecordingLaps(RecordingPath(recordingName))
+	if err != nil {
+		return err
+	}
+
+	var trace *LapTrace
+	if lapNum == 0 {
+		trace = laps.GetBestLap(carIndex)
+		if trace == nil {
+			return fmt.Errorf("recording '%s' has no valid lap for car %d", recordingName, carIndex)
+		}
+	} else {
+		trace, err = laps.GetLapTrace(carIndex, lapNum)
+		if err != nil {
+			return err
+		}
+	}
+
+	tracker.setReference(trace, LapReferenceInfo{LapReferenceSource_Recording, recordingName, carIndex, trace.LapNum, trace.LapTimeInMS})
+	return nil
+}
+
+func (tracker *LapDeltaTracker) setReference(trace *LapTrace, info LapReferenceInfo) {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.reference = trace
+	tracker.referenceInfo = info
+}
+
+func (tracker *LapDeltaTracker) GetReference() LapReferenceInfo {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return tracker.referenceInfo
+}
+
+// GetDelta returns the last delta of the player, nil before there's a reference to compare against
+func (tracker *LapDeltaTracker) GetDelta() *LapDelta {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return tracker.latest
+}
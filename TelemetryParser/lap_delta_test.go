@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// recordingWriter writes the packets it consumes in the format of a recording
+type recordingWriter struct {
+	buf *bytes.Buffer
+}
+
+func (writer recordingWriter) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+	writer.buf.WriteByte(header.PacketId)
+	binary.Write(writer.buf, binary.LittleEndian, header)
+	binary.Write(writer.buf, binary.LittleEndian, reflect.ValueOf(packet).Field(1).Interface())
+}
+
+func (writer recordingWriter) Reset() {}
+
+// consumeSession sends a session packet of a track in session 7
+func consumeSession(tracker *LapDeltaTracker, trackId int8) {
+	session := F1SessionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Session, SessionUID: 7}}
+	session.SessionData.TrackId = trackId
+	tracker.ConsumePacket(session)
+}
+
+// consumeLapPosition sends a lap data packet of the player at a point of lap 4
+func consumeLapPosition(tracker *LapDeltaTracker, distance float32, lapTimeInMS uint32) {
+	packet := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 7}}
+	packet.LapData[0].CurrentLapNum = 4
+	packet.LapData[0].LapDistance = distance
+	packet.LapData[0].CurrentLapTimeInMS = lapTimeInMS
+	tracker.ConsumePacket(packet)
+}
+
+func TestLapDelta(t *testing.T) {
+	laps := &LapTracker{}
+	laps.Init()
+	tracker := &LapDeltaTracker{}
+	tracker.Init(nil, laps)
+
+	// the synthetic laps take 20s at a constant 50m/s
+	feedSyntheticLaps(consumerChain{laps, tracker}, 2)
+	consumeLapPosition(tracker, 500, 10500)
+
+	delta := tracker.GetDelta()
+	if delta == nil || delta.ReferenceLapTimeInMS != 10000 || delta.DeltaInMS != 500 {
+		t.Fatalf("Expected to be 500ms down on the session best - %+v\n", delta)
+	}
+	if delta.Reference.Source != LapReferenceSource_SessionBest || delta.Reference.LapTimeInMS != 20000 {
+		t.Errorf("Unexpected reference - %+v\n", delta.Reference)
+	}
+
+	if err := tracker.UseSessionLap(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	consumeLapPosition(tracker, 250, 4800)
+	if delta := tracker.GetDelta(); delta.DeltaInMS != -200 || delta.Reference.Source != LapReferenceSource_SessionLap || delta.Reference.LapNum != 2 {
+		t.Errorf("Expected to be 200ms up on lap 2 - %+v\n", delta)
+	}
+	if err := tracker.UseSessionLap(0, 9); err == nil {
+		t.Errorf("Expected an error for a lap that wasn't driven\n")
+	}
+
+	// a session lap is forgotten with the session
+	tracker.ConsumePacket(F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 8}})
+	if tracker.GetReference().Source != LapReferenceSource_SessionBest {
+		t.Errorf("Expected a new session to go back to the session best\n")
+	}
+
+	tracker.UseSessionLap(0, 2)
+	tracker.Reset()
+	if tracker.GetReference().Source != LapReferenceSource_SessionBest || tracker.GetDelta() != nil {
+		t.Errorf("Expected the reset to go back to the session best\n")
+	}
+}
+
+func TestLapDeltaRecordingReference(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// recordings are looked up in the working directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	recording := bytes.Buffer{}
+	feedSyntheticLaps(recordingWriter{&recording}, 2)
+	if err := os.WriteFile(filepath.Join(dir, "reference.bin"), recording.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	laps := &LapTracker{}
+	laps.Init()
+	tracker := &LapDeltaTracker{}
+	tracker.Init(nil, laps)
+
+	if err := tracker.UseRecordingLap("reference.bin", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	reference := tracker.GetReference()
+	if reference.Source != LapReferenceSource_Recording || reference.RecordingName != "reference.bin" || reference.LapTimeInMS != 20000 || reference.LapNum == 0 {
+		t.Errorf("Expected the fastest lap of the recording - %+v\n", reference)
+	}
+
+	// without any laps of its own the session can still be compared against the recording
+	consumeSession(tracker, 3)
+	consumeLapPosition(tracker, 500, 9900)
+	if delta := tracker.GetDelta(); delta == nil || delta.DeltaInMS != -100 {
+		t.Errorf("Expected to be 100ms up on the recording - %+v\n", delta)
+	}
+
+	// but not on another track
+	consumeSession(tracker, 4)
+	consumeLapPosition(tracker, 500, 9900)
+	if delta := tracker.GetDelta(); delta != nil {
+		t.Errorf("Expected no delta against a lap of another track - %+v\n", delta)
+	}
+
+	tracker.Reset()
+	if tracker.GetReference().Source != LapReferenceSource_Recording {
+		t.Errorf("Expected a recording reference to outlive the session\n")
+	}
+
+	if err := tracker.UseRecordingLap("reference.bin", 1, 0); err == nil {
+		t.Errorf("Expected an error for a car without laps in the recording\n")
+	}
+	if err := tracker.UseRecordingLap("missing.bin", 0, 0); err == nil {
+		t.Errorf("Expected an error for a missing recording\n")
+	}
+}
+
+func TestDeltaReferenceRequest(t *testing.T) {
+	laps := &LapTracker{}
+	laps.Init()
+	previous := packetStore
+	packetStore = &PacketStore{Delta: &LapDeltaTracker{}}
+	packetStore.Delta.Init(nil, laps)
+	t.Cleanup(func() { packetStore = previous })
+	feedSyntheticLaps(laps, 2)
+
+	for _, c := range []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, "?source=session&car=0&lap=2", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", http.StatusBadRequest},
+		{http.MethodPost, "?source=session&car=0&lap=2", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		HandleDeltaReferenceRequest(recorder, httptest.NewRequest(c.method, "/api/delta/reference"+c.query, nil))
+		if recorder.Code != c.status {
+			t.Errorf("%s %s - status %d, expected %d\n", c.method, c.query, recorder.Code, c.status)
+		}
+	}
+
+	if reference := packetStore.Delta.GetReference(); reference.Source != LapReferenceSource_SessionLap || reference.LapNum != 2 {
+		t.Errorf("Expected the POST to change the reference - %+v\n", reference)
+	}
+}
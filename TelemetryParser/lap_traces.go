@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	LAP_TRACE_DISTANCE_STEP      float32 = 5   // metres between two points of a resampled lap trace
+	LAP_TRACE_START_TOLERANCE    float32 = 100 // laps whose first sample is further than this from the line are partial and dropped
+	LAP_TRACE_FLASHBACK_DISTANCE float32 = 50  // jumping back further than this within a lap is treated as a flashback
+	LAP_TRACE_MAX_LAPS_PER_CAR   int     = 200
+)
+
+// lapSample is one raw observation of a car on its current lap, taken whenever lap data arrives
+type lapSample struct {
+	SessionTime float32
+	Distance    float32
+	LapTimeInMS uint32
+	Telemetry   F1CarTelemetryData
+}
+
+// LapTrace is a completed lap resampled onto a fixed lap distance grid.
+// All channel slices have the same length as Distance.
+type LapTrace struct {
+	SessionUID      uint64
+	TrackId         int8 // -1 if the session packet wasn't received before the lap completed
+	CarIndex        uint8
+	LapNum          uint8
+	LapTimeInMS     uint32
+	Sector1TimeInMS uint32
+	Sector2TimeInMS uint32
+	Valid           bool
+	StartTime       float32 // session time the lap started at
+	DistanceStep    float32
+	Distance        []float32
+	LapTimeMS       []float32 // elapsed time into the lap
+	Speed           []float32
+	Throttle        []float32
+	Brake           []float32
+	Steer           []float32
+	Gear            []int8
+	RPM             []uint16
+	DRS             []int8
+}
+
+type LapSummary struct {
+	LapNum          uint8
+	LapTimeInMS     uint32
+	Sector1TimeInMS uint32
+	Sector2TimeInMS uint32
+	Valid           bool
+}
+
+type carLapState struct {
+	LapNum          uint8
+	Invalid         bool
+	Sector1TimeInMS uint32
+	Sector2TimeInMS uint32
+	Samples         []lapSample
+}
+
+type LapTracker struct {
+	RWLock sync.RWMutex
+
+	sessionUID      uint64
+	trackId         int8
+	latestTelemetry [F1_MAX_NUM_CARS]F1CarTelemetryData
+	haveTelemetry   [F1_MAX_NUM_CARS]bool
+	states          [F1_MAX_NUM_CARS]carLapState
+	laps            [F1_MAX_NUM_CARS]map[uint8]*LapTrace
+}
+
+func (tracker *LapTracker) Init() {
+	tracker.Reset()
+}
+
+func (tracker *LapTracker) Reset() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.reset(0)
+}
+
+func (tracker *LapTracker) reset(sessionUID uint64) {
+	tracker.sessionUID = sessionUID
+	tracker.trackId = -1
+	for i := 0; i < F1_MAX_NUM_CARS; i++ {
+		tracker.haveTelemetry[i] = false
+		tracker.states[i] = carLapState{}
+		tracker.laps[i] = make(map[uint8]*LapTrace)
+	}
+}
+
+func (tracker *LapTracker) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	if header.SessionUID != tracker.sessionUID {
+		tracker.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		tracker.trackId = p.SessionData.TrackId
+	case F1CarTelemetryDataPacket:
+		tracker.latestTelemetry = p.CarTelemetryData
+		for i := range tracker.haveTelemetry {
+			tracker.haveTelemetry[i] = true
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			if tracker.haveTelemetry[i] {
+				tracker.processLapData(uint8(i), header, &p.LapData[i])
+			}
+		}
+	}
+}
+
+func (tracker *LapTracker) processLapData(carIndex uint8, header *F1PacketHeader, lapData *F1LapData) {
+	state := &tracker.states[carIndex]
+
+	if lapData.CurrentLapNum != state.LapNum {
+		if state.LapNum != 0 && lapData.CurrentLapNum == state.LapNum+1 {
+			tracker.closeLap(carIndex, state, lapData.LastLapTimeInMS)
+		}
+
+		*state = carLapState{LapNum: lapData.CurrentLapNum, Samples: state.Samples[:0]}
+	}
+
+	if lapData.LapDistance < 0 {
+		return // line hasn't been crossed yet
+	}
+
+	if lapData.CurrentLapInvalid == 1 {
+		state.Invalid = true
+	}
+	if lapData.Sector1TimeInMS > 0 {
+		state.Sector1TimeInMS = uint32(lapData.Sector1TimeMinutes)*60000 + uint32(lapData.Sector1TimeInMS)
+	}
+	if lapData.Sector2TimeInMS > 0 {
+		state.Sector2TimeInMS = uint32(lapData.Sector2TimeMinutes)*60000 + uint32(lapData.Sector2TimeInMS)
+	}
+
+	n := len(state.Samples)
+	if n > 0 && lapData.LapDistance <= state.Samples[n-1].Distance {
+		if state.Samples[n-1].Distance-lapData.LapDistance < LAP_TRACE_FLASHBACK_DISTANCE {
+			return // car is stationary or reversing slightly, keep the trace monotonic
+		}
+
+		cut := sort.Search(n, func(i int) bool { return state.Samples[i].Distance >= lapData.LapDistance })
+		state.Samples = state.Samples[:cut]
+	}
+
+	state.Samples = append(state.Samples, lapSample{header.SessionTime, lapData.LapDistance, lapData.CurrentLapTimeInMS, tracker.latestTelemetry[carIndex]})
+}
+
+func (tracker *LapTracker) closeLap(carIndex uint8, state *carLapState, lapTimeInMS uint32) {
+	if len(state.Samples) < 2 || state.Samples[0].Distance > LAP_TRACE_START_TOLERANCE {
+		return
+	}
+
+	trace := ResampleLap(state.Samples, LAP_TRACE_DISTANCE_STEP)
+	trace.SessionUID = tracker.sessionUID
+	trace.TrackId = tracker.trackId
+	trace.CarIndex = carIndex
+	trace.LapNum = state.LapNum
+	trace.LapTimeInMS = lapTimeInMS
+	trace.Sector1TimeInMS = state.Sector1TimeInMS
+	trace.Sector2TimeInMS = state.Sector2TimeInMS
+	trace.Valid = !state.Invalid
+
+	laps := tracker.laps[carIndex]
+	if len(laps) >= LAP_TRACE_MAX_LAPS_PER_CAR {
+		oldest := trace.LapNum
+		for lapNum := range laps {
+			if lapNum < oldest {
+				oldest = lapNum
+			}
+		}
+		delete(laps, oldest)
+	}
+	laps[trace.LapNum] = trace
+}
+
+// ResampleLap converts raw lap samples (sorted by distance) into a trace with a point every `step` metres.
+// Continuous channels are linearly interpolated, discrete ones (gear, DRS) take the value of the preceding sample.
+func ResampleLap(samples []lapSample, step float32) *LapTrace {
+	trace := &LapTrace{DistanceStep: step, StartTime: samples[0].SessionTime}
+	last := samples[len(samples)-1].Distance
+	count := int(last/step) + 1
+
+	trace.Distance = make([]float32, 0, count)
+	trace.LapTimeMS = make([]float32, 0, count)
+	trace.Speed = make([]float32, 0, count)
+	trace.Throttle = make([]float32, 0, count)
+	trace.Brake = make([]float32, 0, count)
+	trace.Steer = make([]float32, 0, count)
+	trace.Gear = make([]int8, 0, count)
+	trace.RPM = make([]uint16, 0, count)
+	trace.DRS = make([]int8, 0, count)
+
+	j := 0
+	for i := 0; i < count; i++ {
+		d := float32(i) * step
+		for j < len(samples)-2 && samples[j+1].Distance < d {
+			j++
+		}
+
+		a, b := &samples[j], &samples[j+1]
+		t := (d - a.Distance) / (b.Distance - a.Distance)
+		if t < 0 {
+			t = 0 // before the first sample, hold its value
+		}
+		if t > 1 {
+			t = 1
+		}
+		prev := a
+		if t >= 1 {
+			prev = b
+		}
+
+		trace.Distance = append(trace.Distance, d)
+		trace.LapTimeMS = append(trace.LapTimeMS, Lerp(float32(a.LapTimeInMS), float32(b.LapTimeInMS), t))
+		trace.Speed = append(trace.Speed, Lerp(float32(a.Telemetry.Speed), float32(b.Telemetry.Speed), t))
+		trace.Throttle = append(trace.Throttle, Lerp(a.Telemetry.Throttle, b.Telemetry.Throttle, t))
+		trace.Brake = append(trace.Brake, Lerp(a.Telemetry.Brake, b.Telemetry.Brake, t))
+		trace.Steer = append(trace.Steer, Lerp(a.Telemetry.Steer, b.Telemetry.Steer, t))
+		trace.Gear = append(trace.Gear, prev.Telemetry.Gear)
+		trace.RPM = append(trace.RPM, uint16(Lerp(float32(a.Telemetry.EngineRPM), float32(b.Telemetry.EngineRPM), t)))
+		trace.DRS = append(trace.DRS, int8(prev.Telemetry.DRS))
+	}
+
+	return trace
+}
+
+func (tracker *LapTracker) GetLapTrace(carIndex uint8, lapNum uint8) (*LapTrace, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	trace, ok := tracker.laps[carIndex][lapNum]
+	if !ok {
+		return nil, fmt.Errorf("no trace for lap %d of car %d", lapNum, carIndex)
+	}
+	return trace, nil
+}
+
+func (tracker *LapTracker) GetLapSummaries(carIndex uint8) ([]LapSummary, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	summaries := make([]LapSummary, 0, len(tracker.laps[carIndex]))
+	for _, trace := range tracker.laps[carIndex] {
+		summaries = append(summaries, LapSummary{trace.LapNum, trace.LapTimeInMS, trace.Sector1TimeInMS, trace.Sector2TimeInMS, trace.Valid})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].LapNum < summaries[j].LapNum })
+
+	return summaries, nil
+}
+
+// GetBestLap returns the fastest valid lap of a car, or nil if it hasn't completed one
+func (tracker *LapTracker) GetBestLap(carIndex uint8) *LapTrace {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil
+	}
+
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	var best *LapTrace
+	for _, trace := range tracker.laps[carIndex] {
+		if trace.Valid && (best == nil || trace.LapTimeInMS < best.LapTimeInMS) {
+			best = trace
+		}
+	}
+	return best
+}
+
+// GetFastestLapOnTrack returns the fastest valid lap of any car on the given track, or nil
+func (tracker *LapTracker) GetFastestLapOnTrack(trackId int8) *LapTrace {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	var best *LapTrace
+	for i := range tracker.laps {
+		for _, trace := range tracker.laps[i] {
+			if trace.Valid && trace.TrackId == trackId && (best == nil || trace.LapTimeInMS < best.LapTimeInMS) {
+				best = trace
+			}
+		}
+	}
+	return best
+}
+
+// TimeAtDistance returns the elapsed lap time in ms at a lap distance, clamped to the ends of the trace
+func (trace *LapTrace) TimeAtDistance(distance float32) float32 {
+	return trace.sampleAtDistance(trace.LapTimeMS, distance)
+}
+
+func (trace *LapTrace) sampleAtDistance(channel []float32, distance float32) float32 {
+	if distance <= 0 {
+		return channel[0]
+	}
+
+	pos := distance / trace.DistanceStep
+	i := int(pos)
+	if i >= len(channel)-1 {
+		return channel[len(channel)-1]
+	}
+
+	return Lerp(channel[i], channel[i+1], pos-float32(i))
+}
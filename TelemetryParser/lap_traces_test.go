@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+// feedSyntheticLaps drives car 0 around a 1000m track at a constant 50 m/s for the given number of laps
+func feedSyntheticLaps(consumer PacketConsumer, laps int) {
+	const trackLength = 1000
+	const speed = 50
+	const dt = 0.05
+
+	sessionHeader := F1PacketHeader{PacketId: PacketID_Session, SessionUID: 7}
+	session := F1SessionDataPacket{f1PacketHeader: &sessionHeader}
+	session.SessionData.TrackId = 3
+	session.SessionData.TrackLength = trackLength
+	consumer.ConsumePacket(session)
+
+	sessionTime := float32(0)
+	for lap := 1; lap <= laps+1; lap++ {
+		for d := float32(0); d < trackLength; d += speed * dt {
+			header := F1PacketHeader{SessionUID: 7, SessionTime: sessionTime}
+
+			telemetryHeader := header
+			telemetryHeader.PacketId = PacketID_CarTelemetry
+			telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &telemetryHeader}
+			telemetry.CarTelemetryData[0].Speed = speed * 3.6
+			telemetry.CarTelemetryData[0].Gear = 4
+			telemetry.CarTelemetryData[0].Throttle = d / 10
+			consumer.ConsumePacket(telemetry)
+
+			lapHeader := header
+			lapHeader.PacketId = PacketID_LapData
+			lapData := F1LapDataPacket{f1PacketHeader: &lapHeader}
+			lapData.LapData[0].CurrentLapNum = uint8(lap)
+			lapData.LapData[0].LapDistance = d
+			lapData.LapData[0].CurrentLapTimeInMS = uint32(d / speed * 1000)
+			lapData.LapData[0].LastLapTimeInMS = trackLength / speed * 1000
+			lapData.LapData[0].ResultStatus = 2
+			lapData.LapData[0].Sector = uint8(d * 3 / trackLength)
+			lapData.LapData[0].Sector1TimeInMS = 6000
+			lapData.LapData[0].Sector2TimeInMS = 7000
+			consumer.ConsumePacket(lapData)
+
+			sessionTime += dt
+		}
+	}
+}
+
+func TestLapSegmentation(t *testing.T) {
+	tracker := LapTracker{}
+	tracker.Init()
+	feedSyntheticLaps(&tracker, 2)
+
+	summaries, err := tracker.GetLapSummaries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summaries) != 2 || summaries[0].LapNum != 1 || summaries[1].LapNum != 2 {
+		t.Fatalf("Expected laps 1 and 2 to be completed, got %v\n", summaries)
+	}
+
+	trace, err := tracker.GetLapTrace(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trace.LapTimeInMS != 20000 || !trace.Valid {
+		t.Errorf("Unexpected lap info - time %d, valid %t\n", trace.LapTimeInMS, trace.Valid)
+	}
+
+	// raw samples end at 997.5m, so the 5m grid ends at 995m
+	if len(trace.Distance) != 200 || trace.Distance[100] != 500 {
+		t.Errorf("Unexpected distance grid - %d points\n", len(trace.Distance))
+	}
+
+	if trace.Throttle[100] != 50 || trace.Gear[100] != 4 || trace.LapTimeMS[100] != 10000 {
+		t.Errorf("Unexpected channel values at 500m - throttle %f, gear %d, time %f\n", trace.Throttle[100], trace.Gear[100], trace.LapTimeMS[100])
+	}
+
+	if _, err = tracker.GetLapTrace(0, 3); err == nil {
+		t.Error("Lap 3 is still in progress and shouldn't have a trace")
+	}
+}
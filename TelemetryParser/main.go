@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var Log *log.Logger
@@ -12,9 +15,61 @@ var Log *log.Logger
 const LOG_TO_FILE = false
 
 func main() {
+	historyRetention := flag.Float64("history-retention", float64(HISTORY_DEFAULT_RETENTION_SECONDS), "Seconds of telemetry history to keep per car, 0 = unlimited")
+	historyMemoryMB := flag.Int("history-memory-mb", HISTORY_DEFAULT_MAX_MEMORY_BYTES/(1024*1024), "Memory budget for telemetry history in MB, 0 = unlimited")
+	miniSectors := flag.Int("mini-sectors", TIMING_DEFAULT_MINI_SECTORS, "Number of mini-sectors each lap is split into for timing")
+	temperatureAlertSeconds := flag.Float64("temperature-alert-seconds", float64(TEMPERATURE_DEFAULT_ALERT_SECONDS), "Seconds a tyre or brake has to stay out of its temperature window before an alert is sent")
+	metricsLiveTelemetry := flag.Bool("metrics-live-telemetry", false, "Add gauges of the player car's speed, RPM, fuel and lap to the /metrics endpoint")
+	influxURL := flag.String("influx-url", "", "InfluxDB write endpoint packets are sent to as line protocol, e.g. http://localhost:8086/api/v2/write?org=f1&bucket=telemetry")
+	influxToken := flag.String("influx-token", "", "API token for the InfluxDB write endpoint")
+	influxFile := flag.String("influx-file", "", "File line protocol points are appended to instead of an InfluxDB endpoint")
+	influxPackets := flag.String("influx-packets", INFLUX_DEFAULT_PACKETS, "Comma separated packet types written to InfluxDB, or all")
+	influxPlayerOnly := flag.Bool("influx-player-only", false, "Only write the player car to InfluxDB")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker (host:port) selected channels are published to")
+	mqttClientId := flag.String("mqtt-client-id", MQTT_DEFAULT_CLIENT_ID, "Client ID used to connect to the MQTT broker")
+	mqttUsername := flag.String("mqtt-username", "", "Username for the MQTT broker")
+	mqttPassword := flag.String("mqtt-password", "", "Password for the MQTT broker")
+	mqttTopic := flag.String("mqtt-topic", MQTT_DEFAULT_TOPIC, "MQTT topic template with {idx}, {group} and {channel} placeholders")
+	mqttChannels := flag.String("mqtt-channels", MQTT_DEFAULT_CHANNELS, "Comma separated channels published to MQTT, each optionally with its own throttle like rpm:20ms, or all. Channels: "+MQTTChannelNames())
+	mqttThrottle := flag.Duration("mqtt-throttle", MQTT_DEFAULT_THROTTLE, "Minimum time between two messages on an MQTT topic")
+	mqttAllCars := flag.Bool("mqtt-all-cars", false, "Publish every car to MQTT instead of only the player car")
+	mqttRetain := flag.Bool("mqtt-retain", false, "Publish MQTT messages with the retain flag")
+	importRecording := flag.String("import-recording", "", "Store the valid laps of a recording in the lap database and exit")
+	flag.Parse()
+
 	InitLogger(LOG_TO_FILE)
 	Log = GetLogger()
 
+	if flag.Arg(0) == "export" {
+		err := RunExportCommand(flag.Args()[1:])
+		if err != nil {
+			Log.Fatalln("Export failed:", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "motec" {
+		err := RunMotecCommand(flag.Args()[1:])
+		if err != nil {
+			Log.Fatalln("MoTeC export failed:", err)
+		}
+		return
+	}
+
+	if *importRecording != "" {
+		db, err := OpenLapDatabase(LAP_DATABASE_DIR)
+		if err != nil {
+			Log.Fatalln("Failed to open lap database:", err)
+		}
+
+		imported, err := ImportRecording(db, *importRecording)
+		if err != nil {
+			Log.Fatalln("Failed to import recording:", err)
+		}
+		Log.Printf("Imported %d laps from %s\n", imported, *importRecording)
+		return
+	}
+
 	port := fmt.Sprintf(":%d", F1_TELEMETRY_DATA_PORT)
 
 	// Resolve the UDP address
@@ -43,9 +98,67 @@ func main() {
 	packetStore := PacketStore{}
 	packetStore.Init(&wss)
 	packetStore.SetUDPClientRequestChannel(f1UdpClient.SwitchSourceRequest)
+	packetStore.History.SetConfig(HistoryConfig{float32(*historyRetention), *historyMemoryMB * 1024 * 1024})
+	err = packetStore.Timing.SetMiniSectorCount(*miniSectors)
+	if err != nil {
+		Log.Fatalln("Invalid mini-sectors:", err)
+	}
+	packetStore.Temperatures.SetAlertDuration(float32(*temperatureAlertSeconds))
+	// consumers that buffer data, closed on shutdown so it isn't lost
+	closers := []func(){packetStore.Damage.Close, packetStore.Tyres.Close, packetStore.Archiver.Close}
+	if *metricsLiveTelemetry {
+		live := &LiveTelemetryGauges{}
+		live.Init()
+		packetStore.AddConsumer(live)
+		Metrics.SetLiveTelemetry(live)
+	}
+	if *influxURL != "" || *influxFile != "" {
+		config := MakeDefaultInfluxConfig()
+		config.URL, config.Token, config.File, config.PlayerOnly = *influxURL, *influxToken, *influxFile, *influxPlayerOnly
+		config.Packets, err = PacketMaskFromNames(*influxPackets)
+		if err != nil {
+			Log.Fatalln("Invalid InfluxDB packet types:", err)
+		}
+
+		influx := &InfluxSink{}
+		err = influx.Init(config)
+		if err != nil {
+			Log.Fatalln("Failed to start InfluxDB sink:", err)
+		}
+		packetStore.AddConsumer(influx)
+		closers = append(closers, influx.Close)
+	}
+	if *mqttBroker != "" {
+		config := MakeDefaultMQTTConfig()
+		config.Broker, config.ClientId, config.Username, config.Password = *mqttBroker, *mqttClientId, *mqttUsername, *mqttPassword
+		config.Topic, config.AllCars, config.Retain = *mqttTopic, *mqttAllCars, *mqttRetain
+		config.Channels, err = ParseMQTTChannels(*mqttChannels, *mqttThrottle)
+		if err != nil {
+			Log.Fatalln("Invalid MQTT channels:", err)
+		}
+
+		mqtt := &MQTTPublisher{}
+		err = mqtt.Init(config)
+		if err != nil {
+			Log.Fatalln("Failed to start MQTT publisher:", err)
+		}
+		packetStore.AddConsumer(mqtt)
+		closers = append(closers, mqtt.Close)
+	}
 
 	go RunAPIServer(&wss, &packetStore)
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		Log.Println("Shutting down on", sig)
+		for _, closeSink := range closers {
+			closeSink()
+		}
+		os.Exit(0)
+	}()
+
 	for {
 		err := f1UdpClient.Poll(&packetStore)
 		if err != nil {
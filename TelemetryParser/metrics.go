@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus metrics of the packet pipeline. Counters are atomics so Poll and the broadcasts never wait on a scrape,
+// and the text exposition format is written by hand to avoid pulling in the client library.
+
+const METRICS_UNKNOWN_PACKET_ID = PacketID_Count
+
+type WebsocketClientMetrics struct {
+	Address string
+	Sent    atomic.Uint64
+	Dropped atomic.Uint64
+}
+
+// SinkMetrics counts the points a sink forwarding packets to another system wrote, dropped and retried
+type SinkMetrics struct {
+	Written atomic.Uint64
+	Dropped atomic.Uint64
+	Retries atomic.Uint64
+}
+
+type PipelineMetrics struct {
+	datagramsReceived [PacketID_Count + 1]atomic.Uint64 // The last entry counts datagrams with an unknown packet ID
+	bytesReceived     atomic.Uint64
+	packetsDecoded    [PacketID_Count]atomic.Uint64
+	packetsFailed     [PacketID_Count]atomic.Uint64
+
+	websocketSent    atomic.Uint64
+	websocketDropped atomic.Uint64
+	clientsLock      sync.Mutex
+	clients          map[*WebsocketClientMetrics]struct{}
+
+	replayActive    atomic.Bool
+	replayBytesSent atomic.Uint64
+
+	recordingActive       atomic.Bool
+	recordingBytesWritten atomic.Uint64
+
+	sinksLock sync.Mutex
+	sinks     map[string]*SinkMetrics
+
+	live atomic.Pointer[LiveTelemetryGauges]
+}
+
+var Metrics = &PipelineMetrics{}
+
+// DatagramReceived counts a datagram read from the socket, by the packet ID in its header
+func (m *PipelineMetrics) DatagramReceived(datagram []byte) {
+	m.bytesReceived.Add(uint64(len(datagram)))
+
+	// the packet ID follows the packet format, game year, game version and packet version in the header
+	const packetIdOffset = 6
+	packetId := uint8(METRICS_UNKNOWN_PACKET_ID)
+	if len(datagram) > packetIdOffset && datagram[packetIdOffset] < PacketID_Count {
+		packetId = datagram[packetIdOffset]
+	}
+	m.datagramsReceived[packetId].Add(1)
+}
+
+func (m *PipelineMetrics) PacketDecoded(packetId uint8, ok bool) {
+	if packetId >= PacketID_Count {
+		return
+	}
+	if ok {
+		m.packetsDecoded[packetId].Add(1)
+	} else {
+		m.packetsFailed[packetId].Add(1)
+	}
+}
+
+func (m *PipelineMetrics) AddWebsocketClient(address string) *WebsocketClientMetrics {
+	client := &WebsocketClientMetrics{Address: address}
+
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+	if m.clients == nil {
+		m.clients = make(map[*WebsocketClientMetrics]struct{})
+	}
+	m.clients[client] = struct{}{}
+	return client
+}
+
+func (m *PipelineMetrics) RemoveWebsocketClient(client *WebsocketClientMetrics) {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+	delete(m.clients, client)
+}
+
+// WebsocketMessage counts a message written to a client, or dropped because the client's queue was full. Clients
+// that were never registered only count towards the totals.
+func (m *PipelineMetrics) WebsocketMessage(client *WebsocketClientMetrics, sent bool) {
+	if sent {
+		m.websocketSent.Add(1)
+		if client != nil {
+			client.Sent.Add(1)
+		}
+	} else {
+		m.websocketDropped.Add(1)
+		if client != nil {
+			client.Dropped.Add(1)
+		}
+	}
+}
+
+func (m *PipelineMetrics) SetReplayActive(active bool) {
+	m.replayActive.Store(active)
+}
+
+func (m *PipelineMetrics) ReplayBytesSent(n int) {
+	m.replayBytesSent.Add(uint64(n))
+}
+
+func (m *PipelineMetrics) SetRecordingActive(active bool) {
+	m.recordingActive.Store(active)
+}
+
+func (m *PipelineMetrics) RecordingBytesWritten(n int) {
+	m.recordingBytesWritten.Add(uint64(n))
+}
+
+// Sink returns the counters of a sink, sinks with the same name share their counters
+func (m *PipelineMetrics) Sink(name string) *SinkMetrics {
+	m.sinksLock.Lock()
+	defer m.sinksLock.Unlock()
+
+	if m.sinks == nil {
+		m.sinks = make(map[string]*SinkMetrics)
+	}
+	sink, ok := m.sinks[name]
+	if !ok {
+		sink = &SinkMetrics{}
+		m.sinks[name] = sink
+	}
+	return sink
+}
+
+// SetLiveTelemetry adds the gauges of the player car to the metrics, nil removes them
+func (m *PipelineMetrics) SetLiveTelemetry(live *LiveTelemetryGauges) {
+	m.live.Store(live)
+}
+
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) describe(name string, metricType string, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (mw *metricsWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	mw.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) printf(format string, args ...any) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func packetLabels(packetId int) string {
+	if packetId >= int(PacketID_Count) {
+		return `packet_id="unknown",packet="unknown"`
+	}
+	return fmt.Sprintf(`packet_id="%d",packet="%s"`, packetId, EXPORT_TABLE_NAMES[packetId])
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (m *PipelineMetrics) WritePrometheus(w io.Writer) error {
+	mw := metricsWriter{w: w}
+
+	mw.describe("f1_datagrams_received_total", "counter", "UDP datagrams received, by the packet ID in their header")
+	for id := range m.datagramsReceived {
+		mw.sample("f1_datagrams_received_total", packetLabels(id), float64(m.datagramsReceived[id].Load()))
+	}
+	mw.describe("f1_received_bytes_total", "counter", "Bytes received on the telemetry socket")
+	mw.sample("f1_received_bytes_total", "", float64(m.bytesReceived.Load()))
+	mw.describe("f1_packets_decoded_total", "counter", "Packets decoded and saved to the packet store")
+	for id := range m.packetsDecoded {
+		mw.sample("f1_packets_decoded_total", packetLabels(id), float64(m.packetsDecoded[id].Load()))
+	}
+	mw.describe("f1_packets_failed_total", "counter", "Packets that failed to decode")
+	for id := range m.packetsFailed {
+		mw.sample("f1_packets_failed_total", packetLabels(id), float64(m.packetsFailed[id].Load()))
+	}
+
+	mw.describe("f1_websocket_messages_sent_total", "counter", "Messages written to WebSocket clients")
+	mw.sample("f1_websocket_messages_sent_total", "", float64(m.websocketSent.Load()))
+	mw.describe("f1_websocket_messages_dropped_total", "counter", "Messages dropped because a WebSocket client was too slow")
+	mw.sample("f1_websocket_messages_dropped_total", "", float64(m.websocketDropped.Load()))
+
+	m.clientsLock.Lock()
+	clients := make([]*WebsocketClientMetrics, 0, len(m.clients))
+	for client := range m.clients {
+		clients = append(clients, client)
+	}
+	m.clientsLock.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Address < clients[j].Address })
+
+	mw.describe("f1_websocket_clients", "gauge", "Connected WebSocket clients")
+	mw.sample("f1_websocket_clients", "", float64(len(clients)))
+	mw.describe("f1_websocket_client_messages_sent_total", "counter", "Messages written to a connected WebSocket client")
+	for _, client := range clients {
+		mw.sample("f1_websocket_client_messages_sent_total", fmt.Sprintf("client=%q", client.Address), float64(client.Sent.Load()))
+	}
+	mw.describe("f1_websocket_client_messages_dropped_total", "counter", "Messages dropped for a connected WebSocket client")
+	for _, client := range clients {
+		mw.sample("f1_websocket_client_messages_dropped_total", fmt.Sprintf("client=%q", client.Address), float64(client.Dropped.Load()))
+	}
+
+	mw.describe("f1_replay_active", "gauge", "Whether a recording is being replayed")
+	mw.sample("f1_replay_active", "", boolValue(m.replayActive.Load()))
+	mw.describe("f1_replay_sent_bytes_total", "counter", "Bytes of recordings streamed to the replay socket")
+	mw.sample("f1_replay_sent_bytes_total", "", float64(m.replayBytesSent.Load()))
+	mw.describe("f1_recording_active", "gauge", "Whether packets are being recorded")
+	mw.sample("f1_recording_active", "", boolValue(m.recordingActive.Load()))
+	mw.describe("f1_recording_written_bytes_total", "counter", "Bytes written to recording files")
+	mw.sample("f1_recording_written_bytes_total", "", float64(m.recordingBytesWritten.Load()))
+
+	m.sinksLock.Lock()
+	sinkNames := make([]string, 0, len(m.sinks))
+	for name := range m.sinks {
+		sinkNames = append(sinkNames, name)
+	}
+	m.sinksLock.Unlock()
+	sort.Strings(sinkNames)
+
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(sink *SinkMetrics) uint64
+	}{
+		{"f1_sink_points_written_total", "Points a sink delivered", func(sink *SinkMetrics) uint64 { return sink.Written.Load() }},
+		{"f1_sink_points_dropped_total", "Points a sink dropped because its queue was full or delivery failed", func(sink *SinkMetrics) uint64 { return sink.Dropped.Load() }},
+		{"f1_sink_retries_total", "Failed deliveries a sink retried", func(sink *SinkMetrics) uint64 { return sink.Retries.Load() }},
+	} {
+		if len(sinkNames) == 0 {
+			break
+		}
+		mw.describe(counter.name, "counter", counter.help)
+		for _, name := range sinkNames {
+			mw.sample(counter.name, fmt.Sprintf("sink=%q", name), float64(counter.value(m.Sink(name))))
+		}
+	}
+
+	if live := m.live.Load(); live != nil {
+		live.writePrometheus(&mw)
+	}
+	return mw.err
+}
+
+// LiveTelemetryGauges keeps the latest values of the player car for the metrics endpoint, so a session can be
+// graphed from the scraped gauges.
+type LiveTelemetryGauges struct {
+	RWLock sync.RWMutex
+
+	valid  bool
+	values [liveGauge_Count]float64
+}
+
+const (
+	liveGauge_Speed = iota
+	liveGauge_EngineRPM
+	liveGauge_Gear
+	liveGauge_Throttle
+	liveGauge_Brake
+	liveGauge_Fuel
+	liveGauge_FuelRemainingLaps
+	liveGauge_ERSStore
+	liveGauge_LapNumber
+	liveGauge_LapDistance
+	liveGauge_Position
+	liveGauge_SessionTime
+	liveGauge_Count
+)
+
+var LIVE_GAUGES = [liveGauge_Count]struct {
+	Name string
+	Help string
+}{
+	{"f1_player_speed_kmh", "Speed of the player car in km/h"},
+	{"f1_player_engine_rpm", "Engine RPM of the player car"},
+	{"f1_player_gear", "Gear of the player car, 0 = neutral, -1 = reverse"},
+	{"f1_player_throttle_percent", "Throttle applied by the player, 0 to 100"},
+	{"f1_player_brake_percent", "Brake applied by the player, 0 to 100"},
+	{"f1_player_fuel_kg", "Fuel in the tank of the player car"},
+	{"f1_player_fuel_remaining_laps", "Laps of fuel left in the player car"},
+	{"f1_player_ers_store_joules", "ERS energy store of the player car"},
+	{"f1_player_lap_number", "Current lap of the player car"},
+	{"f1_player_lap_distance_metres", "Distance of the player car around the current lap"},
+	{"f1_player_position", "Race position of the player car"},
+	{"f1_session_time_seconds", "Session time of the last packet"},
+}
+
+func (live *LiveTelemetryGauges) Init() {
+	live.Reset()
+}
+
+func (live *LiveTelemetryGauges) Reset() {
+	live.RWLock.Lock()
+	defer live.RWLock.Unlock()
+
+	live.valid = false
+	live.values = [liveGauge_Count]float64{}
+}
+
+func (live *LiveTelemetryGauges) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+	car := header.PlayerCarIndex
+	if car >= F1_MAX_NUM_CARS {
+		return
+	}
+
+	live.RWLock.Lock()
+	defer live.RWLock.Unlock()
+
+	switch p := packet.(type) {
+	case F1CarTelemetryDataPacket:
+		telemetry := &p.CarTelemetryData[car]
+		live.values[liveGauge_Speed] = float64(telemetry.Speed)
+		live.values[liveGauge_EngineRPM] = float64(telemetry.EngineRPM)
+		live.values[liveGauge_Gear] = float64(telemetry.Gear)
+		live.values[liveGauge_Throttle] = float64(telemetry.Throttle) // already percent, see F1CarTelemetryDataPacket.Parse
+		live.values[liveGauge_Brake] = float64(telemetry.Brake)
+	case F1CarStatusDataPacket:
+		status := &p.CarStatusData[car]
+		live.values[liveGauge_Fuel] = float64(status.FuelInTank)
+		live.values[liveGauge_FuelRemainingLaps] = float64(status.FuelRemainingLaps)
+		live.values[liveGauge_ERSStore] = float64(status.ERSScoreEnergy)
+	case F1LapDataPacket:
+		lap := &p.LapData[car]
+		live.values[liveGauge_LapNumber] = float64(lap.CurrentLapNum)
+		live.values[liveGauge_LapDistance] = float64(lap.LapDistance)
+		live.values[liveGauge_Position] = float64(lap.CarPosition)
+	default:
+		return
+	}
+
+	live.valid = true
+	live.values[liveGauge_SessionTime] = float64(header.SessionTime)
+}
+
+func (live *LiveTelemetryGauges) writePrometheus(mw *metricsWriter) {
+	live.RWLock.RLock()
+	defer live.RWLock.RUnlock()
+
+	if !live.valid {
+		return
+	}
+	for i, gauge := range LIVE_GAUGES {
+		mw.describe(gauge.Name, "gauge", gauge.Help)
+		mw.sample(gauge.Name, "", live.values[i])
+	}
+}
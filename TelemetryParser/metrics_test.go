@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPipelineMetrics(t *testing.T) {
+	metrics := &PipelineMetrics{}
+
+	datagram := make([]byte, PACKET_ID_SIZE_MAP[PacketID_CarTelemetry])
+	datagram[6] = PacketID_CarTelemetry
+	metrics.DatagramReceived(datagram)
+	metrics.DatagramReceived(datagram)
+	metrics.DatagramReceived([]byte{1, 2})
+	metrics.PacketDecoded(PacketID_CarTelemetry, true)
+	metrics.PacketDecoded(PacketID_CarTelemetry, false)
+
+	client := metrics.AddWebsocketClient("127.0.0.1:5000")
+	metrics.WebsocketMessage(client, true)
+	metrics.WebsocketMessage(client, false)
+	metrics.WebsocketMessage(nil, false)
+	metrics.SetRecordingActive(true)
+	metrics.RecordingBytesWritten(100)
+
+	live := &LiveTelemetryGauges{}
+	live.Init()
+	metrics.SetLiveTelemetry(live)
+
+	buf := bytes.Buffer{}
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	for _, line := range []string{
+		`f1_datagrams_received_total{packet_id="6",packet="car_telemetry"} 2`,
+		`f1_datagrams_received_total{packet_id="unknown",packet="unknown"} 1`,
+		`f1_received_bytes_total 2706`,
+		`f1_packets_decoded_total{packet_id="6",packet="car_telemetry"} 1`,
+		`f1_packets_failed_total{packet_id="6",packet="car_telemetry"} 1`,
+		`f1_websocket_messages_sent_total 1`,
+		`f1_websocket_messages_dropped_total 2`,
+		`f1_websocket_client_messages_dropped_total{client="127.0.0.1:5000"} 1`,
+		`f1_recording_active 1`,
+		`f1_recording_written_bytes_total 100`,
+		`f1_replay_active 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Missing '%s' in metrics\n", line)
+		}
+	}
+	if strings.Contains(text, "f1_player_speed_kmh") {
+		t.Errorf("Expected no player gauges before the first packet\n")
+	}
+
+	telemetry := parseTelemetryPacket(t, 1, F1CarTelemetryData{Speed: 287, Gear: -1, Throttle: 0.5, Brake: 0.25})
+	telemetry.f1PacketHeader.PlayerCarIndex = 1
+	telemetry.f1PacketHeader.SessionTime = 12.5
+	live.ConsumePacket(telemetry)
+
+	metrics.RemoveWebsocketClient(client)
+	buf.Reset()
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	text = buf.String()
+	for _, line := range []string{"f1_player_speed_kmh 287", "f1_player_gear -1", "f1_player_throttle_percent 50", "f1_player_brake_percent 25", "f1_session_time_seconds 12.5", "f1_websocket_clients 0"} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Missing '%s' in metrics\n", line)
+		}
+	}
+	if strings.Contains(text, `client="127.0.0.1:5000"`) {
+		t.Errorf("Expected the disconnected client to be removed\n")
+	}
+}
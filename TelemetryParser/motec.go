@@ -0,0 +1,529 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MoTeC i2 log export. The .ld layout follows the community documented format i2 opens: a fixed header, event, venue
+// and vehicle blocks, a doubly linked list of channel descriptors and the sample data of each channel. Lap beacons
+// live in a .ldx file next to the .ld file.
+
+const (
+	MOTEC_MAX_SAMPLE_RATE     = 60 // Hz
+	MOTEC_DEFAULT_SAMPLE_RATE = 20 // Hz, used when the rate of a packet type can't be measured
+
+	motecHeaderSize  = 1762
+	motecEventSize   = 1154
+	motecVenueSize   = 1100
+	motecVehicleSize = 260
+	motecChannelSize = 124
+
+	motecEventOffset    = motecHeaderSize
+	motecVenueOffset    = motecEventOffset + motecEventSize
+	motecVehicleOffset  = motecVenueOffset + motecVenueSize
+	motecChannelsOffset = motecVehicleOffset + motecVehicleSize
+)
+
+type MotecChannel struct {
+	Name       string
+	ShortName  string
+	Unit       string
+	SampleRate int
+	Samples    []float32
+}
+
+type MotecLog struct {
+	Driver  string
+	Vehicle string
+	Venue   string
+	Event   string
+	Session string
+	Comment string
+	Date    time.Time
+
+	Channels []*MotecChannel
+	Beacons  []float32 // Seconds since the start of the log the car crossed the line
+	LapTimes []float32 // Seconds, lap times of the laps completed in the log
+}
+
+// motecChannelSource maps a value of one packet type to a MoTeC channel. Discrete channels hold their last value
+// between samples instead of being interpolated.
+type motecChannelSource struct {
+	Name      string
+	ShortName string
+	Unit      string
+	PacketId  uint8
+	Discrete  bool
+	Value     func(packet F1Packet, car uint8) float32
+}
+
+func motecWheelChannels(name string, short string, unit string, value func(data *F1CarTelemetryData, wheel int) float32) []motecChannelSource {
+	channels := make([]motecChannelSource, 0, len(TYRE_CORNER_NAMES))
+	for wheel, corner := range TYRE_CORNER_NAMES {
+		wheel := wheel
+		channels = append(channels, motecChannelSource{
+			Name:      name + " " + corner,
+			ShortName: short + corner,
+			Unit:      unit,
+			PacketId:  PacketID_CarTelemetry,
+			Value:     telemetryChannel(func(data *F1CarTelemetryData) float32 { return value(data, wheel) }),
+		})
+	}
+	return channels
+}
+
+var MOTEC_CHANNELS = append(append(append([]motecChannelSource{
+	{"Ground Speed", "Speed", "km/h", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.Speed) })},
+	// Parse scales the pedals and steering of the game's 0-1 range to percent
+	{"Throttle Pos", "Throttle", "%", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Throttle })},
+	{"Brake Pos", "Brake", "%", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Brake })},
+	{"Steering", "Steer", "%", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Steer })},
+	{"Clutch Pos", "Clutch", "%", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.Clutch) })},
+	{"Gear", "Gear", "", PacketID_CarTelemetry, true, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.Gear) })},
+	{"Engine RPM", "RPM", "rpm", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.EngineRPM) })},
+	{"DRS", "DRS", "", PacketID_CarTelemetry, true, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.DRS) })},
+	{"Engine Temp", "EngTemp", "C", PacketID_CarTelemetry, false, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.EngineTemperature) })},
+
+	{"G Force Lat", "GLat", "G", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.GForceLateral })},
+	{"G Force Long", "GLong", "G", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.GForceLongitudinal })},
+	{"G Force Vert", "GVert", "G", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.GForceVertical })},
+	{"Car Pos X", "PosX", "m", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.WorldPositionX })},
+	{"Car Pos Y", "PosY", "m", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.WorldPositionY })},
+	{"Car Pos Z", "PosZ", "m", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.WorldPositionZ })},
+	{"Yaw", "Yaw", "rad", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.Yaw })},
+	{"Pitch", "Pitch", "rad", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.Pitch })},
+	{"Roll", "Roll", "rad", PacketID_Motion, false, motionChannel(func(d *F1CarMotionData) float32 { return d.Roll })},
+
+	{"Lap Distance", "LapDist", "m", PacketID_LapData, false, lapChannel(func(d *F1LapData) float32 { return d.LapDistance })},
+	{"Total Distance", "Dist", "m", PacketID_LapData, false, lapChannel(func(d *F1LapData) float32 { return d.TotalDistance })},
+	{"Lap Time Running", "LapTime", "s", PacketID_LapData, false, lapChannel(func(d *F1LapData) float32 { return float32(d.CurrentLapTimeInMS) / 1000 })},
+	{"Lap Number", "Lap", "", PacketID_LapData, true, lapChannel(func(d *F1LapData) float32 { return float32(d.CurrentLapNum) })},
+	{"Sector", "Sector", "", PacketID_LapData, true, lapChannel(func(d *F1LapData) float32 { return float32(d.Sector) + 1 })},
+	{"Position", "Pos", "", PacketID_LapData, true, lapChannel(func(d *F1LapData) float32 { return float32(d.CarPosition) })},
+
+	{"Fuel Level", "Fuel", "kg", PacketID_CarStatus, false, statusChannel(func(d *F1CarStatusData) float32 { return d.FuelInTank })},
+	{"Fuel Mix", "FuelMix", "", PacketID_CarStatus, true, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.FuelMix) })},
+	{"Brake Bias", "BBias", "%", PacketID_CarStatus, true, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.FrontBrakeBias) })},
+	{"ERS Store", "ERS", "kJ", PacketID_CarStatus, false, statusChannel(func(d *F1CarStatusData) float32 { return d.ERSScoreEnergy / 1000 })},
+	{"ERS Deploy Mode", "ERSMode", "", PacketID_CarStatus, true, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.ERSDeployMode) })},
+	{"Tyre Age", "TyreAge", "laps", PacketID_CarStatus, true, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.TyresAgeLaps) })},
+},
+	motecWheelChannels("Brake Temp", "BrkT", "C", func(d *F1CarTelemetryData, wheel int) float32 { return float32(d.BrakesTemperature[wheel]) })...),
+	motecWheelChannels("Tyre Temp Surface", "TyrS", "C", func(d *F1CarTelemetryData, wheel int) float32 { return float32(d.TyresSurfaceTemperature[wheel]) })...),
+	motecWheelChannels("Tyre Pressure", "TyrP", "psi", func(d *F1CarTelemetryData, wheel int) float32 { return d.TyresPressure[wheel] })...,
+)
+
+type motecSamples struct {
+	times  []float32
+	values [][]float32 // Per channel of the packet type
+}
+
+// truncate drops the samples at or after `time`, which is where a flashback rewinds the session to
+func (s *motecSamples) truncate(time float32) {
+	n := sort.Search(len(s.times), func(i int) bool { return s.times[i] >= time })
+	s.times = s.times[:n]
+	for c := range s.values {
+		s.values[c] = s.values[c][:n]
+	}
+}
+
+// MotecBuilder collects the channels of one car from a stream of packets. Only the first session of the stream is
+// used, and with a lap number set only the samples taken while the car was on that lap are kept.
+type MotecBuilder struct {
+	car        int // -1 = the player car
+	lap        int // 0 = all laps
+	sampleRate int // 0 = the rate each packet type was sent at
+
+	sessionUID uint64
+	header     *F1PacketHeader
+	session    *F1SessionData
+	driver     string
+	currentLap uint8
+
+	samples  [PacketID_Count]*motecSamples
+	channels [PacketID_Count][]int // Indices into MOTEC_CHANNELS per packet type
+
+	beacons  []float32
+	lapTimes []float32
+}
+
+func MakeMotecBuilder(car int, lap int, sampleRate int) MotecBuilder {
+	builder := MotecBuilder{car: car, lap: lap, sampleRate: sampleRate}
+	for i, channel := range MOTEC_CHANNELS {
+		builder.channels[channel.PacketId] = append(builder.channels[channel.PacketId], i)
+	}
+	return builder
+}
+
+func (builder *MotecBuilder) AddPacket(packet F1Packet) {
+	header := packet.Header()
+	if builder.header == nil {
+		builder.header = header
+		builder.sessionUID = header.SessionUID
+		if builder.car < 0 {
+			builder.car = int(header.PlayerCarIndex)
+		}
+	}
+	if header.SessionUID != builder.sessionUID || builder.car >= F1_MAX_NUM_CARS {
+		return
+	}
+	car := uint8(builder.car)
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		session := p.SessionData
+		builder.session = &session
+		return
+	case F1ParticipantsDataPacket:
+		builder.driver = driverName(car, &p.ParticipantsData.Participants[car])
+		return
+	case F1LapDataPacket:
+		lap := p.LapData[car]
+		if builder.currentLap != 0 && lap.CurrentLapNum > builder.currentLap {
+			builder.beacons = append(builder.beacons, header.SessionTime)
+			builder.lapTimes = append(builder.lapTimes, float32(lap.LastLapTimeInMS)/1000)
+		}
+		builder.currentLap = lap.CurrentLapNum
+	}
+
+	channels := builder.channels[header.PacketId]
+	if len(channels) == 0 || (builder.lap > 0 && int(builder.currentLap) != builder.lap) {
+		return
+	}
+
+	samples := builder.samples[header.PacketId]
+	if samples == nil {
+		samples = &motecSamples{values: make([][]float32, len(channels))}
+		builder.samples[header.PacketId] = samples
+	}
+	if len(samples.times) > 0 && header.SessionTime <= samples.times[len(samples.times)-1] {
+		samples.truncate(header.SessionTime)
+	}
+
+	samples.times = append(samples.times, header.SessionTime)
+	for c, channel := range channels {
+		samples.values[c] = append(samples.values[c], MOTEC_CHANNELS[channel].Value(packet, car))
+	}
+}
+
+// measuredRate is the rate, in whole Hz, a packet type was sent at
+func (s *motecSamples) measuredRate() int {
+	if len(s.times) < 2 {
+		return MOTEC_DEFAULT_SAMPLE_RATE
+	}
+	rate := int(math.Round(float64(len(s.times)-1) / float64(s.times[len(s.times)-1]-s.times[0])))
+	if rate < 1 {
+		return 1
+	}
+	if rate > MOTEC_MAX_SAMPLE_RATE {
+		return MOTEC_MAX_SAMPLE_RATE
+	}
+	return rate
+}
+
+// resample returns the value of a channel every 1/rate seconds from `start` to `end`
+func (s *motecSamples) resample(c int, discrete bool, start float32, end float32, rate int) []float32 {
+	count := int((end-start)*float32(rate)) + 1
+	values := s.values[c]
+	resampled := make([]float32, count)
+
+	next := 0
+	for i := range resampled {
+		t := start + float32(i)/float32(rate)
+		for next < len(s.times) && s.times[next] <= t {
+			next++
+		}
+
+		switch {
+		case next == 0:
+			resampled[i] = values[0]
+		case next == len(s.times) || discrete:
+			resampled[i] = values[next-1]
+		default:
+			t0, t1 := s.times[next-1], s.times[next]
+			resampled[i] = values[next-1] + (values[next]-values[next-1])*(t-t0)/(t1-t0)
+		}
+	}
+	return resampled
+}
+
+func (builder *MotecBuilder) Build() (*MotecLog, error) {
+	if builder.header == nil {
+		return nil, fmt.Errorf("no packets to export")
+	}
+	if builder.car >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", builder.car)
+	}
+
+	start, end := float32(math.MaxFloat32), float32(0)
+	for _, samples := range builder.samples {
+		if samples == nil || len(samples.times) == 0 {
+			continue
+		}
+		if samples.times[0] < start {
+			start = samples.times[0]
+		}
+		if last := samples.times[len(samples.times)-1]; last > end {
+			end = last
+		}
+	}
+	if end < start {
+		if builder.lap > 0 {
+			return nil, fmt.Errorf("no samples of lap %d of car %d", builder.lap, builder.car)
+		}
+		return nil, fmt.Errorf("no samples of car %d", builder.car)
+	}
+
+	log := &MotecLog{
+		Driver:  builder.driver,
+		Vehicle: fmt.Sprintf("F1 %d", builder.header.GameYear),
+		Event:   fmt.Sprintf("Session %d", builder.sessionUID),
+		Comment: fmt.Sprintf("Car %d", builder.car),
+		Date:    time.Now(),
+	}
+	if log.Driver == "" {
+		log.Driver = fmt.Sprintf("Car %d", builder.car)
+	}
+	if builder.session != nil {
+		log.Venue = fmt.Sprintf("Track %d", builder.session.TrackId)
+		log.Session = fmt.Sprintf("Session type %d", builder.session.SessionType)
+	}
+	if builder.lap > 0 {
+		log.Comment += fmt.Sprintf(", lap %d", builder.lap)
+	}
+
+	for packetId, samples := range builder.samples {
+		if samples == nil || len(samples.times) == 0 {
+			continue
+		}
+
+		rate := builder.sampleRate
+		if rate <= 0 {
+			rate = samples.measuredRate()
+		}
+		for c, channel := range builder.channels[packetId] {
+			source := &MOTEC_CHANNELS[channel]
+			log.Channels = append(log.Channels, &MotecChannel{
+				Name:       source.Name,
+				ShortName:  source.ShortName,
+				Unit:       source.Unit,
+				SampleRate: rate,
+				Samples:    samples.resample(c, source.Discrete, start, end, rate),
+			})
+		}
+	}
+
+	for i, beacon := range builder.beacons {
+		if beacon > start && beacon <= end {
+			log.Beacons = append(log.Beacons, beacon-start)
+			log.LapTimes = append(log.LapTimes, builder.lapTimes[i])
+		}
+	}
+	return log, nil
+}
+
+func putMotecString(buf []byte, offset int, size int, s string) {
+	copy(buf[offset:offset+size], s)
+}
+
+func (log *MotecLog) WriteLD(w io.Writer) error {
+	dataOffset := motecChannelsOffset + len(log.Channels)*motecChannelSize
+	size := dataOffset
+	for _, channel := range log.Channels {
+		size += 4 * len(channel.Samples)
+	}
+	buf := make([]byte, size)
+	le := binary.LittleEndian
+
+	le.PutUint32(buf[0:], 0x40)
+	if len(log.Channels) > 0 {
+		le.PutUint32(buf[8:], motecChannelsOffset)
+		le.PutUint32(buf[12:], uint32(dataOffset))
+	}
+	le.PutUint32(buf[36:], motecEventOffset)
+	le.PutUint16(buf[64:], 1)
+	le.PutUint16(buf[66:], 0x4240)
+	le.PutUint16(buf[68:], 0xf)
+	le.PutUint32(buf[70:], 0x1f44) // device serial
+	putMotecString(buf, 74, 8, "ADL")
+	le.PutUint16(buf[82:], 420) // device version
+	le.PutUint16(buf[84:], 0xadb0)
+	le.PutUint32(buf[86:], uint32(len(log.Channels)))
+	putMotecString(buf, 94, 16, log.Date.Format("02/01/2006"))
+	putMotecString(buf, 126, 16, log.Date.Format("15:04:05"))
+	putMotecString(buf, 158, 64, log.Driver)
+	putMotecString(buf, 222, 64, log.Vehicle)
+	putMotecString(buf, 350, 64, log.Venue)
+	le.PutUint32(buf[1502:], 0xc81a4) // pro logging
+	putMotecString(buf, 1572, 64, log.Comment)
+
+	putMotecString(buf, motecEventOffset, 64, log.Event)
+	putMotecString(buf, motecEventOffset+64, 64, log.Session)
+	putMotecString(buf, motecEventOffset+128, 1024, log.Comment)
+	le.PutUint16(buf[motecEventOffset+1152:], motecVenueOffset)
+
+	putMotecString(buf, motecVenueOffset, 64, log.Venue)
+	le.PutUint16(buf[motecVenueOffset+1098:], motecVehicleOffset)
+
+	putMotecString(buf, motecVehicleOffset, 64, log.Vehicle)
+
+	data := dataOffset
+	for i, channel := range log.Channels {
+		offset := motecChannelsOffset + i*motecChannelSize
+		if i > 0 {
+			le.PutUint32(buf[offset:], uint32(offset-motecChannelSize))
+		}
+		if i < len(log.Channels)-1 {
+			le.PutUint32(buf[offset+4:], uint32(offset+motecChannelSize))
+		}
+		le.PutUint32(buf[offset+8:], uint32(data))
+		le.PutUint32(buf[offset+12:], uint32(len(channel.Samples)))
+		le.PutUint16(buf[offset+16:], uint16(0x2ee1+i))
+		le.PutUint16(buf[offset+18:], 0x07) // float
+		le.PutUint16(buf[offset+20:], 4)    // 4 bytes per sample
+		le.PutUint16(buf[offset+22:], uint16(channel.SampleRate))
+		le.PutUint16(buf[offset+24:], 0) // shift
+		le.PutUint16(buf[offset+26:], 1) // multiplier
+		le.PutUint16(buf[offset+28:], 1) // scale
+		le.PutUint16(buf[offset+30:], 0) // decimal places
+		putMotecString(buf, offset+32, 32, channel.Name)
+		putMotecString(buf, offset+64, 8, channel.ShortName)
+		putMotecString(buf, offset+72, 12, channel.Unit)
+
+		for _, sample := range channel.Samples {
+			le.PutUint32(buf[data:], math.Float32bits(sample))
+			data += 4
+		}
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func formatMotecLapTime(seconds float32) string {
+	minutes := int(seconds) / 60
+	return fmt.Sprintf("%d:%06.3f", minutes, seconds-float32(minutes*60))
+}
+
+// WriteLDX writes the lap beacons i2 splits the log into laps with
+func (log *MotecLog) WriteLDX(w io.Writer) error {
+	b := strings.Builder{}
+	b.WriteString("<?xml version=\"1.0\"?>\n")
+	b.WriteString("<LDXFile Locale=\"English_United States.1252\" DefaultLocale=\"C\" Version=\"1.6\">\n")
+	b.WriteString(" <Layers>\n  <Layer>\n   <MarkerBlock>\n    <MarkerGroup Name=\"Beacons\" Index=\"3\">\n")
+	for i, beacon := range log.Beacons {
+		fmt.Fprintf(&b, "     <Marker Version=\"100\" ClassName=\"BCN\" Name=\"Manual.%d\" Flags=\"77\" Time=\"%d\"/>\n", i+1, int64(float64(beacon)*1e6))
+	}
+	b.WriteString("    </MarkerGroup>\n   </MarkerBlock>\n   <RangeBlock/>\n  </Layer>\n  <Details>\n")
+
+	fmt.Fprintf(&b, "   <String Id=\"Total Laps\" Value=\"%d\"/>\n", len(log.LapTimes))
+	fastest := -1
+	for i, lapTime := range log.LapTimes {
+		if lapTime > 0 && (fastest < 0 || lapTime < log.LapTimes[fastest]) {
+			fastest = i
+		}
+	}
+	if fastest >= 0 {
+		fmt.Fprintf(&b, "   <String Id=\"Fastest Time\" Value=\"%s\"/>\n", formatMotecLapTime(log.LapTimes[fastest]))
+		fmt.Fprintf(&b, "   <String Id=\"Fastest Lap\" Value=\"%d\"/>\n", fastest+1)
+	}
+	b.WriteString("  </Details>\n </Layers>\n</LDXFile>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMotecArchive zips the .ld and .ldx files of a log, both named `name`
+func WriteMotecArchive(w io.Writer, log *MotecLog, name string) error {
+	archive := zip.NewWriter(w)
+	file, err := archive.Create(name + ".ld")
+	if err != nil {
+		return err
+	}
+	if err := log.WriteLD(file); err != nil {
+		return err
+	}
+
+	file, err = archive.Create(name + ".ldx")
+	if err != nil {
+		return err
+	}
+	if err := log.WriteLDX(file); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// ExportMotec converts a lap, or all laps with lap = 0, of a car in a recording to a MoTeC log. The player car is
+// used with car = -1.
+func ExportMotec(filename string, car int, lap int, sampleRate int) (*MotecLog, error) {
+	builder := MakeMotecBuilder(car, lap, sampleRate)
+	err := ReadRecording(filename, builder.AddPacket)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	if metadata, err := ReadRecordingMetadata(filename); err == nil {
+		log.Date = metadata.StartedAt
+	}
+	return log, nil
+}
+
+func RunMotecCommand(args []string) error {
+	flags := flag.NewFlagSet("motec", flag.ContinueOnError)
+	recording := flags.String("recording", "", "Recording to export")
+	car := flags.Int("car", -1, "Index of the car to export, -1 = the player car")
+	lap := flags.Int("lap", 0, "Lap to export, 0 = the whole session")
+	rate := flags.Int("rate", 0, "Sample rate of all channels in Hz, 0 = the rate each packet type was recorded at")
+	out := flags.String("out", "", "Path of the .ld file, the .ldx file is written next to it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *recording == "" {
+		return fmt.Errorf("no recording given")
+	}
+	if *rate < 0 || *rate > MOTEC_MAX_SAMPLE_RATE {
+		return fmt.Errorf("sample rate has to be between 0 and %d Hz", MOTEC_MAX_SAMPLE_RATE)
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(*recording, filepath.Ext(*recording)) + ".ld"
+	}
+
+	log, err := ExportMotec(*recording, *car, *lap, *rate)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []struct {
+		path  string
+		write func(io.Writer) error
+	}{{*out, log.WriteLD}, {strings.TrimSuffix(*out, ".ld") + ".ldx", log.WriteLDX}} {
+		f, err := os.Create(file.path)
+		if err != nil {
+			return err
+		}
+		err = file.write(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	Log.Printf("Exported %d channels of %s to %s\n", len(log.Channels), *recording, *out)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// parseTelemetryPacket encodes car telemetry the way the game sends it and parses it back
+func parseTelemetryPacket(t *testing.T, car int, data F1CarTelemetryData) F1CarTelemetryDataPacket {
+	raw := [F1_MAX_NUM_CARS]F1CarTelemetryData{}
+	raw[car] = data
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.LittleEndian, raw)
+	buf.Write(make([]byte, 3)) // MFD panels and suggested gear
+
+	packet := F1CarTelemetryDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarTelemetry}}
+	if !packet.Parse(bytes.NewReader(buf.Bytes())) {
+		t.Fatalf("Failed to parse car telemetry\n")
+	}
+	return packet
+}
+
+func TestMotecPedalChannels(t *testing.T) {
+	packet := parseTelemetryPacket(t, 1, F1CarTelemetryData{Throttle: 0.75, Brake: 0.25, Steer: -0.5})
+
+	expected := map[string]float32{"Throttle Pos": 75, "Brake Pos": 25, "Steering": -50}
+	for _, channel := range MOTEC_CHANNELS {
+		want, ok := expected[channel.Name]
+		if !ok {
+			continue
+		}
+		if channel.Unit != "%" || channel.Value(packet, 1) != want {
+			t.Errorf("%s is %f%s, expected %f%%\n", channel.Name, channel.Value(packet, 1), channel.Unit, want)
+		}
+	}
+}
+
+func TestMotecExport(t *testing.T) {
+	builder := MakeMotecBuilder(-1, 0, 0)
+
+	for frame := 0; frame <= 100; frame++ {
+		time := float32(frame) * 0.05
+		header := F1PacketHeader{SessionUID: 5, SessionTime: time, PlayerCarIndex: 2}
+
+		lapHeader := header
+		lapHeader.PacketId = PacketID_LapData
+		lap := F1LapDataPacket{f1PacketHeader: &lapHeader}
+		lap.LapData[2].CurrentLapNum = 1
+		lap.LapData[2].LapDistance = time * 10
+		if time >= 3 {
+			lap.LapData[2].CurrentLapNum = 2
+			lap.LapData[2].LastLapTimeInMS = 3000
+		}
+		builder.AddPacket(lap)
+
+		telemetryHeader := header
+		telemetryHeader.PacketId = PacketID_CarTelemetry
+		telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &telemetryHeader}
+		telemetry.CarTelemetryData[2].Speed = uint16(frame)
+		telemetry.CarTelemetryData[2].Gear = int8(frame / 50)
+		builder.AddPacket(telemetry)
+
+		if frame%10 == 0 {
+			statusHeader := header
+			statusHeader.PacketId = PacketID_CarStatus
+			status := F1CarStatusDataPacket{f1PacketHeader: &statusHeader}
+			status.CarStatusData[2].FuelInTank = 10 - time
+			builder.AddPacket(status)
+		}
+	}
+
+	// a flashback rewinds the session, the samples after it are replaced
+	flashback := F1PacketHeader{SessionUID: 5, SessionTime: 4, PlayerCarIndex: 2, PacketId: PacketID_CarTelemetry}
+	telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &flashback}
+	telemetry.CarTelemetryData[2].Speed = 500
+	builder.AddPacket(telemetry)
+
+	log, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels := make(map[string]*MotecChannel)
+	for _, channel := range log.Channels {
+		channels[channel.Name] = channel
+	}
+
+	speed := channels["Ground Speed"]
+	if speed == nil || speed.SampleRate != 20 || speed.Unit != "km/h" || len(speed.Samples) != 101 {
+		t.Fatalf("Unexpected speed channel - %+v\n", speed)
+	}
+	if math.Abs(float64(speed.Samples[40]-40)) > 1e-3 || speed.Samples[80] != 500 || speed.Samples[100] != 500 {
+		t.Errorf("Expected the samples after the flashback to be replaced - %v\n", speed.Samples[78:])
+	}
+
+	fuel := channels["Fuel Level"]
+	if fuel == nil || fuel.SampleRate != 2 || math.Abs(float64(fuel.Samples[3]-8.5)) > 1e-4 {
+		t.Errorf("Expected the fuel level at 2Hz - %+v\n", fuel)
+	}
+
+	if len(log.Beacons) != 1 || math.Abs(float64(log.Beacons[0]-3)) > 1e-4 || log.LapTimes[0] != 3 {
+		t.Errorf("Expected a beacon at the start of lap 2 - %v\n", log.Beacons)
+	}
+
+	buf := bytes.Buffer{}
+	if err := log.WriteLD(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	if le.Uint32(data) != 0x40 || int(le.Uint32(data[86:])) != len(log.Channels) {
+		t.Fatalf("Malformed .ld header\n")
+	}
+
+	// follow the channel list to the speed channel and read back its data
+	found := false
+	for offset := le.Uint32(data[8:]); offset != 0; offset = le.Uint32(data[offset+4:]) {
+		name := string(bytes.TrimRight(data[offset+32:offset+64], "\x00"))
+		if name != "Ground Speed" {
+			continue
+		}
+		found = true
+		samples, count := le.Uint32(data[offset+8:]), le.Uint32(data[offset+12:])
+		if count != 101 || le.Uint16(data[offset+22:]) != 20 {
+			t.Errorf("Unexpected speed channel descriptor\n")
+		}
+		if math.Float32frombits(le.Uint32(data[samples+40*4:])) != speed.Samples[40] {
+			t.Errorf("Unexpected speed sample\n")
+		}
+	}
+	if !found {
+		t.Errorf("Speed channel missing from the .ld file\n")
+	}
+
+	buf.Reset()
+	if err := log.WriteLDX(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `Time="3000000"`) || !strings.Contains(buf.String(), `Value="0:03.000"`) {
+		t.Errorf("Unexpected .ldx file - %s\n", buf.String())
+	}
+
+	lapBuilder := MakeMotecBuilder(2, 3, 0)
+	lap := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 5}}
+	lap.LapData[2].CurrentLapNum = 1
+	lapBuilder.AddPacket(lap)
+	if _, err := lapBuilder.Build(); err == nil {
+		t.Errorf("Expected no samples of a lap that wasn't driven\n")
+	}
+}
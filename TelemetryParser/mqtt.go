@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTPublisher publishes selected channels of packets to an MQTT broker, for wheel displays and LED rigs. A topic is
+// published when its value changes, at most once per throttle interval of session time, and the newest value of a
+// throttled topic is held back until the interval has passed, even if no further packet arrives. Messages are handed
+// to a connection goroutine through a bounded queue like the InfluxSink, so a slow broker never holds up Poll.
+//
+// Only what's needed to publish is implemented of MQTT 3.1.1: CONNECT, QoS 0 PUBLISH, PINGREQ and DISCONNECT.
+
+const (
+	MQTT_DEFAULT_TOPIC       = "f1/car/{idx}/{group}/{channel}"
+	MQTT_DEFAULT_CHANNELS    = "speed,gear,rpm,rev_lights,drs,drs_allowed,flags"
+	MQTT_DEFAULT_THROTTLE    = 100 * time.Millisecond
+	MQTT_DEFAULT_QUEUE_SIZE  = 1024 // messages
+	MQTT_DEFAULT_KEEP_ALIVE  = 30 * time.Second
+	MQTT_DEFAULT_CLIENT_ID   = "f1-telemetry"
+	MQTT_RECONNECT_DELAY     = time.Second
+	MQTT_MAX_RECONNECT_DELAY = 30 * time.Second
+)
+
+// MQTT control packet types, shifted into the upper nibble of the fixed header
+const (
+	mqttPacket_Connect    = 1 << 4
+	mqttPacket_ConnAck    = 2 << 4
+	mqttPacket_Publish    = 3 << 4
+	mqttPacket_PingReq    = 12 << 4
+	mqttPacket_Disconnect = 14 << 4
+)
+
+type MQTTChannel struct {
+	Name     string
+	Group    string // Part of the topic, the kind of packet the channel is read from
+	PacketId uint8
+	Value    func(packet F1Packet, car uint8) float32
+}
+
+var MQTT_CHANNELS = []MQTTChannel{
+	{"speed", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.Speed) })},
+	{"throttle", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Throttle })},
+	{"brake", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Brake })},
+	{"steer", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return d.Steer })},
+	{"gear", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.Gear) })},
+	{"rpm", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.EngineRPM) })},
+	{"rev_lights", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.RevLightsBitValue) })},
+	{"rev_lights_percent", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.RevLightsPercent) })},
+	{"drs", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.DRS) })},
+	{"engine_temp", "telemetry", PacketID_CarTelemetry, telemetryChannel(func(d *F1CarTelemetryData) float32 { return float32(d.EngineTemperature) })},
+
+	{"drs_allowed", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.DRSAllowed) })},
+	{"flags", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.VehicleFIAFlags) })},
+	{"pit_limiter", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.PitLimiterStatus) })},
+	{"max_rpm", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.MaxRPM) })},
+	{"fuel_mix", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.FuelMix) })},
+	{"fuel_remaining_laps", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return d.FuelRemainingLaps })},
+	{"brake_bias", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.FrontBrakeBias) })},
+	{"ers_store", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return d.ERSScoreEnergy })},
+	{"ers_mode", "status", PacketID_CarStatus, statusChannel(func(d *F1CarStatusData) float32 { return float32(d.ERSDeployMode) })},
+
+	{"lap", "lap", PacketID_LapData, lapChannel(func(d *F1LapData) float32 { return float32(d.CurrentLapNum) })},
+	{"position", "lap", PacketID_LapData, lapChannel(func(d *F1LapData) float32 { return float32(d.CarPosition) })},
+	{"sector", "lap", PacketID_LapData, lapChannel(func(d *F1LapData) float32 { return float32(d.Sector) + 1 })},
+	{"lap_distance", "lap", PacketID_LapData, lapChannel(func(d *F1LapData) float32 { return d.LapDistance })},
+	{"pit_status", "lap", PacketID_LapData, lapChannel(func(d *F1LapData) float32 { return float32(d.PitStatus) })},
+}
+
+type MQTTConfig struct {
+	Broker    string // host:port
+	ClientId  string
+	Username  string
+	Password  string
+	Topic     string // Template with {idx}, {group} and {channel} placeholders
+	Channels  map[string]time.Duration
+	AllCars   bool // Publish every car instead of only the player car
+	Retain    bool
+	QueueSize int
+	KeepAlive time.Duration
+}
+
+func MakeDefaultMQTTConfig() MQTTConfig {
+	channels, _ := ParseMQTTChannels(MQTT_DEFAULT_CHANNELS, MQTT_DEFAULT_THROTTLE)
+	return MQTTConfig{
+		ClientId:  MQTT_DEFAULT_CLIENT_ID,
+		Topic:     MQTT_DEFAULT_TOPIC,
+		Channels:  channels,
+		QueueSize: MQTT_DEFAULT_QUEUE_SIZE,
+		KeepAlive: MQTT_DEFAULT_KEEP_ALIVE,
+	}
+}
+
+// ParseMQTTChannels reads a comma separated list of channel names, each optionally followed by its own throttle
+// interval, e.g. "gear,rpm:20ms,flags:1s". "all" selects every channel.
+func ParseMQTTChannels(list string, throttle time.Duration) (map[string]time.Duration, error) {
+	channels := make(map[string]time.Duration)
+	for _, entry := range strings.Split(list, ",") {
+		name, interval, hasInterval := strings.Cut(strings.TrimSpace(entry), ":")
+		if name == "" {
+			continue
+		}
+
+		channelThrottle := throttle
+		if hasInterval {
+			var err error
+			channelThrottle, err = time.ParseDuration(interval)
+			if err != nil || channelThrottle < 0 {
+				return nil, fmt.Errorf("invalid throttle interval of channel '%s'", name)
+			}
+		}
+
+		found := false
+		for _, channel := range MQTT_CHANNELS {
+			if name == "all" || channel.Name == name {
+				channels[channel.Name] = channelThrottle
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown channel '%s'", name)
+		}
+	}
+	return channels, nil
+}
+
+type mqttMessage struct {
+	topic   string
+	payload string
+}
+
+type mqttTopicState struct {
+	published   string
+	publishedAt float32 // session time
+	throttle    float32
+	pending     string // newest value held back by the throttle
+	hasPending  bool
+}
+
+type mqttSelectedChannel struct {
+	channel  *MQTTChannel
+	throttle float32 // seconds of session time
+	topics   [F1_MAX_NUM_CARS]string
+}
+
+type MQTTPublisher struct {
+	config   MQTTConfig
+	metrics  *SinkMetrics
+	channels [PacketID_Count][]mqttSelectedChannel
+
+	lock   sync.Mutex
+	topics map[string]*mqttTopicState
+	// session time of the latest packet and when it arrived, to tell when a pending value may go out
+	sessionTime   float32
+	sessionTimeAt time.Time
+	flushInterval time.Duration
+
+	queue chan mqttMessage
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func (publisher *MQTTPublisher) Init(config MQTTConfig) error {
+	if config.Broker == "" {
+		return fmt.Errorf("no MQTT broker given")
+	}
+	// MQTT 3.1.1 section 3.1.2.9, the password flag must be 0 when the user name flag is
+	if config.Password != "" && config.Username == "" {
+		return fmt.Errorf("an MQTT password needs a username")
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = MQTT_DEFAULT_QUEUE_SIZE
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = MQTT_DEFAULT_KEEP_ALIVE
+	}
+	if config.ClientId == "" {
+		config.ClientId = MQTT_DEFAULT_CLIENT_ID
+	}
+	publisher.config = config
+	publisher.metrics = Metrics.Sink("mqtt")
+
+	publisher.channels = [PacketID_Count][]mqttSelectedChannel{}
+	publisher.flushInterval = MQTT_DEFAULT_THROTTLE
+	for i := range MQTT_CHANNELS {
+		channel := &MQTT_CHANNELS[i]
+		throttle, ok := config.Channels[channel.Name]
+		if !ok {
+			continue
+		}
+		if throttle > 0 && throttle < publisher.flushInterval {
+			publisher.flushInterval = throttle
+		}
+
+		selected := mqttSelectedChannel{channel: channel, throttle: float32(throttle.Seconds())}
+		for car := range selected.topics {
+			selected.topics[car] = strings.NewReplacer("{idx}", strconv.Itoa(car), "{group}", channel.Group, "{channel}", channel.Name).Replace(config.Topic)
+		}
+		publisher.channels[channel.PacketId] = append(publisher.channels[channel.PacketId], selected)
+	}
+
+	publisher.Reset()
+	publisher.queue = make(chan mqttMessage, config.QueueSize)
+	publisher.stop = make(chan struct{})
+	publisher.done = make(chan struct{})
+	go publisher.run()
+	return nil
+}
+
+// Reset forgets the published values, a new session publishes every topic again
+func (publisher *MQTTPublisher) Reset() {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	publisher.topics = make(map[string]*mqttTopicState)
+}
+
+func (publisher *MQTTPublisher) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+	if header.PacketId >= PacketID_Count || len(publisher.channels[header.PacketId]) == 0 {
+		return
+	}
+
+	cars := []uint8{header.PlayerCarIndex}
+	if publisher.config.AllCars {
+		cars = make([]uint8, F1_MAX_NUM_CARS)
+		for i := range cars {
+			cars[i] = uint8(i)
+		}
+	} else if header.PlayerCarIndex >= F1_MAX_NUM_CARS {
+		return
+	}
+
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	publisher.sessionTime = header.SessionTime
+	publisher.sessionTimeAt = time.Now()
+	for _, car := range cars {
+		for i := range publisher.channels[header.PacketId] {
+			selected := &publisher.channels[header.PacketId][i]
+			topic := selected.topics[car]
+			state, ok := publisher.topics[topic]
+			if !ok {
+				state = &mqttTopicState{throttle: selected.throttle}
+				publisher.topics[topic] = state
+			}
+			value := strconv.FormatFloat(float64(selected.channel.Value(packet, car)), 'g', -1, 32)
+			if ok && value == state.published {
+				state.hasPending = false
+				continue
+			}
+			// a flashback moves the session time back, which restarts the interval
+			elapsed := header.SessionTime - state.publishedAt
+			if ok && elapsed >= 0 && elapsed < selected.throttle {
+				state.pending = value
+				state.hasPending = true
+				continue
+			}
+
+			state.hasPending = false
+			state.published = value
+			state.publishedAt = header.SessionTime
+			publisher.enqueue(mqttMessage{topic, value})
+		}
+	}
+}
+
+func (publisher *MQTTPublisher) enqueue(message mqttMessage) {
+	select {
+	case publisher.queue <- message:
+	default:
+		publisher.metrics.Dropped.Add(1)
+	}
+}
+
+// flushPending publishes the values held back by the throttle once their interval has passed, all of them when closing.
+// Packets may have stopped arriving, so the session time is advanced by the time since the latest packet.
+func (publisher *MQTTPublisher) flushPending(all bool) {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	now := publisher.sessionTime + float32(time.Since(publisher.sessionTimeAt).Seconds())
+	for topic, state := range publisher.topics {
+		if !state.hasPending {
+			continue
+		}
+		elapsed := now - state.publishedAt
+		if !all && elapsed >= 0 && elapsed < state.throttle {
+			continue
+		}
+
+		// the earliest the value could have gone out, so the interval of the next value isn't stretched
+		state.publishedAt += state.throttle
+		if elapsed < 0 || state.publishedAt > now {
+			state.publishedAt = now
+		}
+		state.published = state.pending
+		state.hasPending = false
+		publisher.enqueue(mqttMessage{topic, state.published})
+	}
+}
+
+// Close publishes the pending and queued messages, if the broker is reachable, and disconnects
+func (publisher *MQTTPublisher) Close() {
+	publisher.flushPending(true)
+	close(publisher.stop)
+	<-publisher.done
+}
+
+func (publisher *MQTTPublisher) run() {
+	defer close(publisher.done)
+
+	delay := MQTT_RECONNECT_DELAY
+	for {
+		conn, err := publisher.connect()
+		if err == nil {
+			delay = MQTT_RECONNECT_DELAY
+			stopped := publisher.publish(conn)
+			conn.Close()
+			if stopped {
+				return
+			}
+		} else {
+			Log.Printf("MQTTPublisher: Failed to connect to %s - %s\n", publisher.config.Broker, err)
+		}
+
+		publisher.metrics.Retries.Add(1)
+		select {
+		case <-publisher.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > MQTT_MAX_RECONNECT_DELAY {
+			delay = MQTT_MAX_RECONNECT_DELAY
+		}
+	}
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// mqttPacket prefixes the body of a control packet with its fixed header
+func mqttPacket(packetType byte, body []byte) []byte {
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func (publisher *MQTTPublisher) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", publisher.config.Broker, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.Buffer{}
+	mqttString(&body, "MQTT")
+	body.WriteByte(4)   // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	if publisher.config.Username != "" {
+		flags |= 0x80
+	}
+	if publisher.config.Password != "" {
+		flags |= 0x40
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(publisher.config.KeepAlive.Seconds()))
+	mqttString(&body, publisher.config.ClientId)
+	if publisher.config.Username != "" {
+		mqttString(&body, publisher.config.Username)
+	}
+	if publisher.config.Password != "" {
+		mqttString(&body, publisher.config.Password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(mqttPacket_Connect, body.Bytes())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var connAck [4]byte
+	if _, err := io.ReadFull(conn, connAck[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connAck[0] != mqttPacket_ConnAck || connAck[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused with return code %d", connAck[3])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (publisher *MQTTPublisher) publishPacket(message mqttMessage) []byte {
+	packetType := byte(mqttPacket_Publish)
+	if publisher.config.Retain {
+		packetType |= 0x01
+	}
+
+	body := bytes.Buffer{}
+	mqttString(&body, message.topic)
+	body.WriteString(message.payload)
+	return mqttPacket(packetType, body.Bytes())
+}
+
+// publish writes queued messages until the connection fails, or the publisher is closed which it reports
+func (publisher *MQTTPublisher) publish(conn net.Conn) bool {
+	// only PINGRESPs arrive for QoS 0 publishes, reading them detects a broker that went away
+	lost := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(lost)
+	}()
+
+	writer := bufio.NewWriter(conn)
+	ping := time.NewTicker(publisher.config.KeepAlive / 2)
+	defer ping.Stop()
+	flush := time.NewTicker(publisher.flushInterval)
+	defer flush.Stop()
+
+	write := func(packet []byte) bool {
+		conn.SetWriteDeadline(time.Now().Add(publisher.config.KeepAlive))
+		if _, err := writer.Write(packet); err != nil {
+			return false
+		}
+		// batch the messages that are already queued into one write
+		if len(publisher.queue) == 0 {
+			return writer.Flush() == nil
+		}
+		return true
+	}
+
+	for {
+		select {
+		case message := <-publisher.queue:
+			if !write(publisher.publishPacket(message)) {
+				Log.Printf("MQTTPublisher: Lost connection to %s\n", publisher.config.Broker)
+				publisher.metrics.Dropped.Add(1)
+				return false
+			}
+			publisher.metrics.Written.Add(1)
+		case <-ping.C:
+			if !write(mqttPacket(mqttPacket_PingReq, nil)) {
+				return false
+			}
+		case <-flush.C:
+			publisher.flushPending(false)
+		case <-lost:
+			Log.Printf("MQTTPublisher: Broker %s closed the connection\n", publisher.config.Broker)
+			return false
+		case <-publisher.stop:
+			for len(publisher.queue) > 0 {
+				if !write(publisher.publishPacket(<-publisher.queue)) {
+					return true
+				}
+				publisher.metrics.Written.Add(1)
+			}
+			write(mqttPacket(mqttPacket_Disconnect, nil))
+			writer.Flush()
+			return true
+		}
+	}
+}
+
+// MQTTChannelNames lists the channels that can be published, for the command line help
+func MQTTChannelNames() string {
+	names := make([]string, 0, len(MQTT_CHANNELS))
+	for _, channel := range MQTT_CHANNELS {
+		names = append(names, channel.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readMQTTPacket reads a control packet, returning its type and body
+func readMQTTPacket(reader *bufio.Reader) (byte, []byte, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return packetType, body, err
+}
+
+// startMQTTBroker accepts one connection and sends the topic=payload of every PUBLISH it reads
+func startMQTTBroker(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	published := make(chan string, 64)
+	go func() {
+		defer close(published)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		packetType, body, err := readMQTTPacket(reader)
+		if err != nil || packetType != mqttPacket_Connect || string(body[2:6]) != "MQTT" {
+			t.Errorf("Expected a CONNECT packet, got %d\n", packetType)
+			return
+		}
+		conn.Write([]byte{mqttPacket_ConnAck, 2, 0, 0})
+
+		for {
+			packetType, body, err := readMQTTPacket(reader)
+			if err != nil || packetType == mqttPacket_Disconnect {
+				return
+			}
+			if packetType&0xF0 == mqttPacket_Publish {
+				topicLength := int(binary.BigEndian.Uint16(body))
+				published <- fmt.Sprintf("%s=%s", body[2:2+topicLength], body[2+topicLength:])
+			}
+		}
+	}()
+	return listener.Addr().String(), published
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker, published := startMQTTBroker(t)
+
+	config := MakeDefaultMQTTConfig()
+	config.Broker = broker
+	var err error
+	config.Channels, err = ParseMQTTChannels("gear,rpm,flags:0s", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &MQTTPublisher{}
+	if err := publisher.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range []struct {
+		time  float32
+		gear  int8
+		rpm   uint16
+		flags int8
+	}{
+		{0, 3, 10000, 1},
+		{0.05, 3, 10100, 3}, // rpm is throttled, flags aren't
+		{0.15, 4, 10100, 3},
+		{0.2, 4, 10100, 3}, // nothing changed
+	} {
+		header := &F1PacketHeader{PacketId: PacketID_CarTelemetry, SessionTime: sample.time, PlayerCarIndex: 1}
+		telemetry := F1CarTelemetryDataPacket{f1PacketHeader: header}
+		telemetry.CarTelemetryData[1].Gear = sample.gear
+		telemetry.CarTelemetryData[1].EngineRPM = sample.rpm
+		publisher.ConsumePacket(telemetry)
+
+		statusHeader := *header
+		statusHeader.PacketId = PacketID_CarStatus
+		status := F1CarStatusDataPacket{f1PacketHeader: &statusHeader}
+		status.CarStatusData[1].VehicleFIAFlags = sample.flags
+		publisher.ConsumePacket(status)
+	}
+	publisher.Close()
+
+	expected := []string{
+		"f1/car/1/telemetry/gear=3",
+		"f1/car/1/telemetry/rpm=10000",
+		"f1/car/1/status/flags=1",
+		"f1/car/1/status/flags=3",
+		"f1/car/1/telemetry/gear=4",
+		"f1/car/1/telemetry/rpm=10100",
+	}
+	for i, want := range expected {
+		select {
+		case got, ok := <-published:
+			if !ok {
+				t.Fatalf("Broker got %d messages, expected %d\n", i, len(expected))
+			}
+			if got != want {
+				t.Errorf("Message %d is '%s', expected '%s'\n", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d\n", i)
+		}
+	}
+	if extra, ok := <-published; ok {
+		t.Errorf("Unexpected message '%s'\n", extra)
+	}
+
+	if _, err := ParseMQTTChannels("gear,boost", time.Second); err == nil {
+		t.Errorf("Expected an error for an unknown channel\n")
+	}
+}
+
+func TestMQTTPublisherFlushesThrottledValue(t *testing.T) {
+	broker, published := startMQTTBroker(t)
+
+	config := MakeDefaultMQTTConfig()
+	config.Broker = broker
+	config.Channels, _ = ParseMQTTChannels("rpm", 100*time.Millisecond)
+	publisher := &MQTTPublisher{}
+	if err := publisher.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	for _, sample := range []struct {
+		time float32
+		rpm  uint16
+	}{
+		{0, 10000},
+		{0.05, 10500}, // throttled, and no packet follows
+	} {
+		telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_CarTelemetry, SessionTime: sample.time}}
+		telemetry.CarTelemetryData[0].EngineRPM = sample.rpm
+		publisher.ConsumePacket(telemetry)
+	}
+
+	for _, want := range []string{"f1/car/0/telemetry/rpm=10000", "f1/car/0/telemetry/rpm=10500"} {
+		select {
+		case got := <-published:
+			if got != want {
+				t.Errorf("Message is '%s', expected '%s'\n", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for '%s'\n", want)
+		}
+	}
+}
+
+func TestMQTTPasswordNeedsUsername(t *testing.T) {
+	config := MakeDefaultMQTTConfig()
+	config.Broker = "127.0.0.1:1883"
+	config.Password = "secret"
+	if err := (&MQTTPublisher{}).Init(config); err == nil {
+		t.Errorf("Expected an error for a password without a username\n")
+	}
+}
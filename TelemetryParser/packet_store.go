@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -27,6 +28,13 @@ type RecordingConfig struct {
 	PacketsToRecord uint16 // bitflags to indicate which packets to record (each bit corresponds to a packet ID)
 }
 
+// PacketConsumer is handed every packet saved to the store, while the store lock is held.
+// Reset is called whenever the store itself is reset (e.g. when a replay starts).
+type PacketConsumer interface {
+	ConsumePacket(packet F1Packet)
+	Reset()
+}
+
 type PacketStore struct {
 	RWLock                    sync.RWMutex `json:"-"`
 	F1CarTelemetryDataPackets []SavedPacket[F1CarTelemetryDataPacket]
@@ -34,15 +42,44 @@ type PacketStore struct {
 	F1LapDataPackets          []SavedPacket[F1LapDataPacket]
 	F1CarStatusDataPackets    []SavedPacket[F1CarStatusDataPacket]
 	F1CarDamageDataPackets    []SavedPacket[F1CarDamageDataPacket]
+	F1SessionDataPackets      []SavedPacket[F1SessionDataPacket]
+	F1MotionExDataPackets     []SavedPacket[F1MotionExDataPacket]
+	F1EventDataPackets        []SavedPacket[F1EventDataPacket]
+	F1ParticipantsDataPackets []SavedPacket[F1ParticipantsDataPacket]
+	F1CarSetupDataPackets     []SavedPacket[F1CarSetupDataPacket]
 
 	// Recording
 	RecordingConfig RecordingConfig `json:"-"`
 	RecordingActive bool            `json:"-"`
 	RecordingFile   *os.File        `json:"-"`
+	RecordingStart  time.Time       `json:"-"`
+	recordingSeq    uint64          // last incident before the recording started
 
 	// Socket Server
 	WSS *WebsocketServer `json:"-"`
 
+	// Long running history of all cars, queried through the API
+	History      *TelemetryHistory   `json:"-"`
+	Laps         *LapTracker         `json:"-"`
+	Delta        *LapDeltaTracker    `json:"-"`
+	TrackMaps    *TrackMapBuilder    `json:"-"`
+	Corners      *CornerRegistry     `json:"-"`
+	Timing       *TimingEngine       `json:"-"`
+	Gaps         *GapTracker         `json:"-"`
+	Fuel         *FuelModel          `json:"-"`
+	Tyres        *TyreWearModel      `json:"-"`
+	Strategy     *StrategyEngine     `json:"-"`
+	ERS          *ERSTracker         `json:"-"`
+	Temperatures *TemperatureMonitor `json:"-"`
+	Slips        *SlipDetector       `json:"-"`
+	GG           *GGAnalyzer         `json:"-"`
+	Incidents    *IncidentTimeline   `json:"-"`
+	Penalties    *PenaltyLedger      `json:"-"`
+	Damage       *DamageTracker      `json:"-"`
+	LapDB        *LapDatabase        `json:"-"`
+	Archiver     *LapArchiver        `json:"-"`
+	Consumers    []PacketConsumer    `json:"-"`
+
 	UDPClientRequestChannel chan<- UDPClientTarget
 }
 
@@ -51,8 +88,61 @@ func (store *PacketStore) Init(wss *WebsocketServer) {
 	store.F1CarMotionDataPackets = make([]SavedPacket[F1CarMotionDataPacket], 0, PACKET_STORE_SIZE)
 	store.F1LapDataPackets = make([]SavedPacket[F1LapDataPacket], 0, PACKET_STORE_SIZE)
 	store.F1CarStatusDataPackets = make([]SavedPacket[F1CarStatusDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1SessionDataPackets = make([]SavedPacket[F1SessionDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1MotionExDataPackets = make([]SavedPacket[F1MotionExDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1EventDataPackets = make([]SavedPacket[F1EventDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1ParticipantsDataPackets = make([]SavedPacket[F1ParticipantsDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1CarSetupDataPackets = make([]SavedPacket[F1CarSetupDataPacket], 0, PACKET_STORE_SIZE)
 	store.RWLock = sync.RWMutex{}
 	store.WSS = wss
+
+	store.History = &TelemetryHistory{}
+	store.History.Init(MakeDefaultHistoryConfig())
+	store.Laps = &LapTracker{}
+	store.Laps.Init()
+	store.Delta = &LapDeltaTracker{}
+	store.Delta.Init(wss, store.Laps)
+	store.TrackMaps = &TrackMapBuilder{}
+	store.TrackMaps.Init(TRACK_DATA_DIR)
+	store.Corners = &CornerRegistry{}
+	store.Corners.Init(TRACK_DATA_DIR, store.TrackMaps, store.Laps)
+	store.Timing = &TimingEngine{}
+	store.Timing.Init(wss, TIMING_DEFAULT_MINI_SECTORS)
+	store.Gaps = &GapTracker{}
+	store.Gaps.Init(wss)
+	store.Fuel = &FuelModel{}
+	store.Fuel.Init(wss)
+	store.Tyres = &TyreWearModel{}
+	store.Tyres.Init(TYRE_DATA_DIR)
+	store.Strategy = &StrategyEngine{}
+	store.Strategy.Init(wss, store.Tyres)
+	store.ERS = &ERSTracker{}
+	store.ERS.Init()
+	store.Temperatures = &TemperatureMonitor{}
+	store.Temperatures.Init(wss, store.Tyres, TEMPERATURE_DEFAULT_ALERT_SECONDS)
+	store.Slips = &SlipDetector{}
+	store.Slips.Init(wss, store.Corners)
+	store.GG = &GGAnalyzer{}
+	store.GG.Init()
+	store.Incidents = &IncidentTimeline{}
+	store.Incidents.Init()
+	store.Penalties = &PenaltyLedger{}
+	store.Penalties.Init(wss, store.Corners)
+	store.Damage = &DamageTracker{}
+	store.Damage.Init(DAMAGE_DATA_DIR)
+	lapDB, err := OpenLapDatabase(LAP_DATABASE_DIR)
+	if err != nil {
+		Log.Printf("Failed to open lap database, laps won't be archived - %s\n", err)
+	}
+	store.LapDB = lapDB
+	store.Archiver = &LapArchiver{}
+	store.Archiver.Init(lapDB, store.Laps, LAP_SOURCE_LIVE)
+	store.Consumers = []PacketConsumer{store.History, store.Laps, store.Delta, store.TrackMaps, store.Timing, store.Gaps, store.Fuel, store.Tyres, store.Strategy, store.ERS, store.Temperatures, store.Slips, store.GG, store.Incidents, store.Penalties, store.Damage, store.Archiver}
+}
+
+// LiveLapSources are the live session's trackers laps can be selected from for comparisons
+func (store *PacketStore) LiveLapSources() *LapSources {
+	return &LapSources{store.Laps, store.Slips, store.GG}
 }
 
 func (store *PacketStore) Reset() {
@@ -60,6 +150,22 @@ func (store *PacketStore) Reset() {
 	store.F1CarMotionDataPackets = make([]SavedPacket[F1CarMotionDataPacket], 0, PACKET_STORE_SIZE)
 	store.F1LapDataPackets = make([]SavedPacket[F1LapDataPacket], 0, PACKET_STORE_SIZE)
 	store.F1CarStatusDataPackets = make([]SavedPacket[F1CarStatusDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1SessionDataPackets = make([]SavedPacket[F1SessionDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1MotionExDataPackets = make([]SavedPacket[F1MotionExDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1EventDataPackets = make([]SavedPacket[F1EventDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1ParticipantsDataPackets = make([]SavedPacket[F1ParticipantsDataPacket], 0, PACKET_STORE_SIZE)
+	store.F1CarSetupDataPackets = make([]SavedPacket[F1CarSetupDataPacket], 0, PACKET_STORE_SIZE)
+
+	for _, consumer := range store.Consumers {
+		consumer.Reset()
+	}
+}
+
+func (store *PacketStore) AddConsumer(consumer PacketConsumer) {
+	store.RWLock.Lock()
+	defer store.RWLock.Unlock()
+
+	store.Consumers = append(store.Consumers, consumer)
 }
 
 func (store *PacketStore) SetUDPClientRequestChannel(c chan<- UDPClientTarget) {
@@ -86,6 +192,10 @@ func SavePacket[T F1Packet](store *PacketStore, packet T) {
 
 	WSSBroadcast[T](store.WSS, &s)
 
+	for _, consumer := range store.Consumers {
+		consumer.ConsumePacket(packet)
+	}
+
 	if store.RecordingConfig.IsRecordingPacket(s.Header.PacketId) {
 		RecordSavedPacket(store, &s)
 	}
@@ -93,6 +203,8 @@ func SavePacket[T F1Packet](store *PacketStore, packet T) {
 
 // ==== Recording ====
 
+// RecordSavedPacket writes the packet id, the header and the second field of the packet struct. Packets nest
+// everything they carry in that field, like F1SessionDataPacket.SessionData, so recordings capture all of it.
 func RecordSavedPacket[T any](store *PacketStore, packet *SavedPacket[T]) {
 	if !store.RecordingActive || !store.RecordingConfig.IsRecordingPacket(packet.Header.PacketId) {
 		return
@@ -117,7 +229,9 @@ func RecordSavedPacket[T any](store *PacketStore, packet *SavedPacket[T]) {
 	if err != nil {
 		Log.Println("Error writing packet to recording file")
 		Log.Println(err.Error())
+		return
 	}
+	Metrics.RecordingBytesWritten(1 + binary.Size(packet.Header) + binary.Size(f1Packet))
 }
 
 func (store *PacketStore) StartRecording(config RecordingConfig) bool {
@@ -137,6 +251,9 @@ func (store *PacketStore) StartRecording(config RecordingConfig) bool {
 
 	store.RecordingFile = file
 	store.RecordingActive = true
+	store.RecordingStart = time.Now()
+	Metrics.SetRecordingActive(true)
+	store.recordingSeq = store.Incidents.LastSeq()
 	return true
 }
 
@@ -147,8 +264,39 @@ func (store *PacketStore) StopRecording() {
 	}
 
 	store.RecordingActive = false
-	store.RecordingConfig = MakeRecordingConfig("", false)
 	store.RecordingFile.Close()
+	Metrics.SetRecordingActive(false)
+
+	metadata := RecordingMetadata{
+		RecordingName: store.RecordingConfig.RecordingName,
+		StartedAt:     store.RecordingStart,
+		StoppedAt:     time.Now(),
+		Incidents:     store.Incidents.GetIncidentsSince(store.recordingSeq),
+	}
+	err := WriteRecordingMetadata(metadata)
+	if err != nil {
+		Log.Printf("Failed to write metadata of recording '%s' - %s\n", metadata.RecordingName, err)
+	}
+
+	store.RecordingConfig = MakeRecordingConfig("", false)
+}
+
+// RecordingMetadata is written next to a recording when it stops, so a recording can be browsed without replaying it
+type RecordingMetadata struct {
+	RecordingName string
+	StartedAt     time.Time
+	StoppedAt     time.Time
+	Incidents     []Incident
+}
+
+const RECORDING_METADATA_SUFFIX = ".meta.json"
+
+func WriteRecordingMetadata(metadata RecordingMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metadata.RecordingName+RECORDING_METADATA_SUFFIX, data, 0644)
 }
 
 func MakeRecordingConfig(name string, compressPackets bool) RecordingConfig {
@@ -191,6 +339,9 @@ func (store *PacketStore) StartReplay(filename string) {
 
 	store.RWLock.Unlock()
 
+	Metrics.SetReplayActive(true)
+	defer Metrics.SetReplayActive(false)
+
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		Log.Fatalf("Failed to open recording file - %s\n", err)
@@ -222,10 +373,12 @@ func (store *PacketStore) StartReplay(filename string) {
 
 		tries := 0
 		for tries < 3 {
-			_, err = loopbackConn.Write(writeBuffer)
+			var written int
+			written, err = loopbackConn.Write(writeBuffer)
 			if err != nil {
 				tries += 1
 			} else {
+				Metrics.ReplayBytesSent(written)
 				break
 			}
 		}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -15,7 +16,8 @@ func TestRecording(t *testing.T) {
 	wss.Init()
 	packetStore.Init(&wss)
 
-	recordingFileName := "test_recording.ftr"
+	// StopRecording writes the metadata next to the recording, keep both out of the source tree
+	recordingFileName := filepath.Join(t.TempDir(), "test_recording.ftr")
 	recordingConfig := MakeRecordingConfig(recordingFileName, false)
 	recordingConfig.RecordAllPackets()
 
@@ -32,6 +34,10 @@ func TestRecording(t *testing.T) {
 	SavePacket(&packetStore, packet)
 	packetStore.StopRecording()
 
+	if _, err := os.Stat(recordingFileName + RECORDING_METADATA_SUFFIX); err != nil {
+		t.Errorf("Expected the recording's metadata - %s\n", err)
+	}
+
 	data, err := os.ReadFile(recordingFileName)
 	if err != nil {
 		t.Error(err)
@@ -67,6 +73,26 @@ func TestRecording(t *testing.T) {
 	}
 }
 
+func TestReadRecording(t *testing.T) {
+	InitLogger(false)
+	Log = GetLogger()
+
+	counts := make(map[uint8]int)
+	err := ReadRecording("test_recording.bin", func(packet F1Packet) {
+		counts[packet.Header().PacketId] += 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint8]int{PacketID_Motion: 249, PacketID_LapData: 252, PacketID_CarTelemetry: 253, PacketID_CarStatus: 252, PacketID_CarDamage: 88}
+	for packetID, count := range expected {
+		if counts[packetID] != count {
+			t.Errorf("Packet count mismatch for ID %d - '%d' != '%d'\n", packetID, counts[packetID], count)
+		}
+	}
+}
+
 func TestReplayParsing(t *testing.T) {
 	InitLogger(false)
 	Log = GetLogger()
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// A minimal Parquet writer: one row group, one uncompressed PLAIN encoded data page per column and only required
+// columns, which is all a flattened packet table needs. Metadata is encoded with the Thrift compact protocol.
+
+const PARQUET_MAGIC = "PAR1"
+
+// Parquet physical and converted types
+const (
+	parquetType_Int64     = 2
+	parquetType_Float     = 4
+	parquetType_ByteArray = 6
+
+	parquetConverted_UTF8   = 0
+	parquetConverted_UINT64 = 14
+
+	parquetRepetition_Required = 0
+	parquetEncoding_Plain      = 0
+	parquetEncoding_RLE        = 3
+	parquetCodec_Uncompressed  = 0
+	parquetPageType_Data       = 0
+)
+
+// Thrift compact protocol types
+const (
+	thriftType_I32    = 5
+	thriftType_I64    = 6
+	thriftType_Binary = 8
+	thriftType_List   = 9
+	thriftType_Struct = 12
+)
+
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	t.buf.Write(tmp[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	last := t.lastField[len(t.lastField)-1]
+	if delta := id - last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buf.WriteByte(fieldType)
+		t.zigzag(int64(id))
+	}
+	t.lastField[len(t.lastField)-1] = id
+}
+
+func (t *thriftWriter) beginStruct() {
+	t.lastField = append(t.lastField, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftType_I32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftType_I64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.fieldHeader(id, thriftType_Binary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftType_Struct)
+	t.beginStruct()
+}
+
+func (t *thriftWriter) list(id int16, elementType byte, size int) {
+	t.fieldHeader(id, thriftType_List)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elementType)
+	} else {
+		t.buf.WriteByte(0xF0 | elementType)
+		t.varint(uint64(size))
+	}
+}
+
+func parquetPhysicalType(column *ExportColumn) int32 {
+	switch column.Type {
+	case ExportType_Float32:
+		return parquetType_Float
+	case ExportType_String:
+		return parquetType_ByteArray
+	}
+	return parquetType_Int64
+}
+
+// parquetPlainValues encodes the values of a column with the PLAIN encoding
+func parquetPlainValues(column *ExportColumn, rows int) []byte {
+	buf := bytes.Buffer{}
+	var tmp [8]byte
+	for row := 0; row < rows; row++ {
+		switch column.Type {
+		case ExportType_Int64:
+			binary.LittleEndian.PutUint64(tmp[:], uint64(column.Ints[row]))
+			buf.Write(tmp[:8])
+		case ExportType_Uint64:
+			binary.LittleEndian.PutUint64(tmp[:], column.Uints[row])
+			buf.Write(tmp[:8])
+		case ExportType_Float32:
+			binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(column.Floats[row]))
+			buf.Write(tmp[:4])
+		case ExportType_String:
+			binary.LittleEndian.PutUint32(tmp[:], uint32(len(column.Strings[row])))
+			buf.Write(tmp[:4])
+			buf.WriteString(column.Strings[row])
+		}
+	}
+	return buf.Bytes()
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+func WriteParquet(w io.Writer, table *ExportTable) error {
+	offset := int64(len(PARQUET_MAGIC))
+	if _, err := io.WriteString(w, PARQUET_MAGIC); err != nil {
+		return err
+	}
+
+	chunks := make([]parquetChunk, len(table.Columns))
+	for c, column := range table.Columns {
+		values := parquetPlainValues(column, table.Rows)
+
+		// required columns have no repetition or definition levels, the page is just the values
+		page := thriftWriter{}
+		page.beginStruct()
+		page.i32(1, parquetPageType_Data)
+		page.i32(2, int32(len(values)))
+		page.i32(3, int32(len(values)))
+		page.structField(5)
+		page.i32(1, int32(table.Rows))
+		page.i32(2, parquetEncoding_Plain)
+		page.i32(3, parquetEncoding_RLE)
+		page.i32(4, parquetEncoding_RLE)
+		page.endStruct()
+		page.endStruct()
+
+		if _, err := w.Write(page.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(values); err != nil {
+			return err
+		}
+
+		chunks[c] = parquetChunk{offset, int64(page.buf.Len() + len(values))}
+		offset += chunks[c].size
+	}
+
+	meta := thriftWriter{}
+	meta.beginStruct()
+	meta.i32(1, 1)
+
+	meta.list(2, thriftType_Struct, len(table.Columns)+1)
+	meta.beginStruct()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(table.Columns)))
+	meta.endStruct()
+	for _, column := range table.Columns {
+		meta.beginStruct()
+		meta.i32(1, parquetPhysicalType(column))
+		meta.i32(3, parquetRepetition_Required)
+		meta.str(4, column.Name)
+		if column.Type == ExportType_String {
+			meta.i32(6, parquetConverted_UTF8)
+		} else if column.Type == ExportType_Uint64 {
+			meta.i32(6, parquetConverted_UINT64)
+		}
+		meta.endStruct()
+	}
+
+	meta.i64(3, int64(table.Rows))
+
+	totalSize := int64(0)
+	for _, chunk := range chunks {
+		totalSize += chunk.size
+	}
+	meta.list(4, thriftType_Struct, 1)
+	meta.beginStruct()
+	meta.list(1, thriftType_Struct, len(table.Columns))
+	for c, column := range table.Columns {
+		meta.beginStruct()
+		meta.i64(2, chunks[c].offset)
+		meta.structField(3)
+		meta.i32(1, parquetPhysicalType(column))
+		meta.list(2, thriftType_I32, 2)
+		meta.zigzag(parquetEncoding_Plain)
+		meta.zigzag(parquetEncoding_RLE)
+		meta.list(3, thriftType_Binary, 1)
+		meta.varint(uint64(len(column.Name)))
+		meta.buf.WriteString(column.Name)
+		meta.i32(4, parquetCodec_Uncompressed)
+		meta.i64(5, int64(table.Rows))
+		meta.i64(6, chunks[c].size)
+		meta.i64(7, chunks[c].size)
+		meta.i64(9, chunks[c].offset)
+		meta.endStruct()
+		meta.endStruct()
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, int64(table.Rows))
+	meta.endStruct()
+
+	meta.str(6, "TelemetryParser")
+	meta.endStruct()
+
+	if _, err := w.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, PARQUET_MAGIC)
+	return err
+}
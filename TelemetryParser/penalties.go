@@ -0,0 +1,382 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	PENALTY_MATCH_WINDOW_S      float32 = 5 // seconds a PENA event and the lap data counter it changes are matched within
+	PENALTY_MAX_ENTRIES_PER_CAR         = 500
+)
+
+// Penalties whose issue and serve show up in the lap data counters
+const (
+	PenaltyKind_Warning = iota
+	PenaltyKind_TimePenalty
+	PenaltyKind_DriveThrough
+	PenaltyKind_StopGo
+	PenaltyKind_Count
+	PenaltyKind_Other = -1
+)
+
+var PENALTY_KIND_NAMES = [PenaltyKind_Count]string{"Warning", "Time penalty", "Drive through", "Stop go"}
+
+// Penalty types of the PENA event, see the appendices of the UDP specification
+const (
+	PenaltyType_DriveThrough uint8 = 0
+	PenaltyType_StopGo       uint8 = 1
+	PenaltyType_TimePenalty  uint8 = 4
+	PenaltyType_Warning      uint8 = 5
+)
+
+const (
+	PenaltySource_Event   = "event"
+	PenaltySource_LapData = "lap data"
+)
+
+type PenaltyEntry struct {
+	Id                int
+	CarIndex          uint8
+	Kind              string // the penalty type name
+	Infringement      string // empty if the penalty was only seen in the lap data counters
+	OtherCarIndex     uint8  // 255 if no other car is involved
+	TimeS             uint8  // time penalty in seconds, 0 for everything else
+	Source            string // what it was first seen in, a PENA event or a lap data counter
+	CornerCutting     bool
+	IssuedSessionTime float32
+	IssuedLap         uint8
+	IssuedDistance    float32
+	IssuedCorner      int
+	NeedsServing      bool // drive throughs, stop gos and time penalties are served, warnings and everything else aren't
+	Served            bool
+	ServedSessionTime float32
+	ServedLap         uint8
+
+	kind int
+}
+
+// PenaltyCarSummary holds the counters of the latest lap data of a car
+type PenaltyCarSummary struct {
+	CarIndex              uint8
+	Warnings              uint8
+	CornerCuttingWarnings uint8
+	TimePenaltiesS        uint8
+	UnservedDriveThroughs uint8
+	UnservedStopGos       uint8
+	Entries               int
+}
+
+type PenaltyLedgerUpdate struct {
+	Entry   PenaltyEntry
+	Summary PenaltyCarSummary
+}
+
+type carPenaltyState struct {
+	haveLapData   bool
+	lapData       F1LapData
+	entries       []*PenaltyEntry
+	eventOnly     [PenaltyKind_Count][]*PenaltyEntry // issued by an event, not seen in the counters yet
+	counterOnly   [PenaltyKind_Count][]*PenaltyEntry // seen in the counters, the event hasn't arrived (yet)
+	eventServed   [PenaltyKind_Count]int             // serves announced by an event before the counter dropped
+	counterServed [PenaltyKind_Count]int             // serves seen in the counter before the event arrived
+}
+
+// PenaltyLedger records the warnings and penalties of every car, when they were issued and when they were served
+type PenaltyLedger struct {
+	RWLock  sync.RWMutex
+	WSS     *WebsocketServer
+	Corners *CornerRegistry
+
+	sessionUID uint64
+	nextId     int
+	cars       [F1_MAX_NUM_CARS]carPenaltyState
+}
+
+func (ledger *PenaltyLedger) Init(wss *WebsocketServer, corners *CornerRegistry) {
+	ledger.WSS = wss
+	ledger.Corners = corners
+	ledger.Reset()
+}
+
+func (ledger *PenaltyLedger) Reset() {
+	ledger.RWLock.Lock()
+	defer ledger.RWLock.Unlock()
+
+	ledger.reset(0)
+}
+
+func (ledger *PenaltyLedger) reset(sessionUID uint64) {
+	ledger.sessionUID = sessionUID
+	ledger.nextId = 1
+	for i := range ledger.cars {
+		ledger.cars[i] = carPenaltyState{entries: make([]*PenaltyEntry, 0)}
+	}
+}
+
+func (ledger *PenaltyLedger) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	ledger.RWLock.Lock()
+	defer ledger.RWLock.Unlock()
+
+	if header.SessionUID != ledger.sessionUID {
+		ledger.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			ledger.consumeLapData(header, uint8(i), &p.LapData[i])
+		}
+	case F1EventDataPacket:
+		ledger.consumeEvent(header, p)
+	}
+}
+
+func penaltyKind(penaltyType uint8) int {
+	switch penaltyType {
+	case PenaltyType_Warning:
+		return PenaltyKind_Warning
+	case PenaltyType_TimePenalty:
+		return PenaltyKind_TimePenalty
+	case PenaltyType_DriveThrough:
+		return PenaltyKind_DriveThrough
+	case PenaltyType_StopGo:
+		return PenaltyKind_StopGo
+	}
+	return PenaltyKind_Other
+}
+
+func isCornerCutting(infringementType uint8) bool {
+	// corner cutting and running wide, see the appendices of the UDP specification
+	return (infringementType >= 7 && infringementType <= 9) || (infringementType >= 25 && infringementType <= 29)
+}
+
+func (ledger *PenaltyLedger) consumeEvent(header *F1PacketHeader, event F1EventDataPacket) {
+	switch event.Code() {
+	case EventCode_Penalty:
+		details := F1PenaltyEvent{}
+		if !DecodeEventDetails(event, &details) || details.VehicleIdx >= F1_MAX_NUM_CARS {
+			return
+		}
+
+		state := &ledger.cars[details.VehicleIdx]
+		kind := penaltyKind(details.PenaltyType)
+
+		var entry *PenaltyEntry
+		if kind != PenaltyKind_Other {
+			entry = popRecent(&state.counterOnly[kind], header.SessionTime)
+		}
+		if entry == nil {
+			entry = ledger.issue(header, details.VehicleIdx, kind, PenaltySource_Event)
+			entry.IssuedLap = details.LapNum
+			if kind != PenaltyKind_Other {
+				state.eventOnly[kind] = append(state.eventOnly[kind], entry)
+			}
+		}
+
+		entry.Kind = EventValueName(PENALTY_TYPE_NAMES, details.PenaltyType)
+		entry.Infringement = EventValueName(INFRINGEMENT_TYPE_NAMES, details.InfringementType)
+		entry.OtherCarIndex = details.OtherVehicleIdx
+		entry.CornerCutting = isCornerCutting(details.InfringementType)
+		entry.NeedsServing = kind == PenaltyKind_TimePenalty || kind == PenaltyKind_DriveThrough || kind == PenaltyKind_StopGo
+		if kind == PenaltyKind_TimePenalty && details.Time != 255 {
+			entry.TimeS = details.Time
+		}
+		ledger.publish(header, details.VehicleIdx, entry)
+	case EventCode_DriveThrough, EventCode_StopGo:
+		details := F1ServedPenaltyEvent{}
+		if !DecodeEventDetails(event, &details) || details.VehicleIdx >= F1_MAX_NUM_CARS {
+			return
+		}
+
+		kind := PenaltyKind_DriveThrough
+		if event.Code() == EventCode_StopGo {
+			kind = PenaltyKind_StopGo
+		}
+		state := &ledger.cars[details.VehicleIdx]
+		if state.counterServed[kind] > 0 {
+			state.counterServed[kind]--
+			return
+		}
+		if entry := ledger.serve(header, details.VehicleIdx, kind); entry != nil {
+			state.eventServed[kind]++
+			ledger.publish(header, details.VehicleIdx, entry)
+		}
+	}
+}
+
+func (ledger *PenaltyLedger) consumeLapData(header *F1PacketHeader, carIndex uint8, lapData *F1LapData) {
+	state := &ledger.cars[carIndex]
+	previous := state.lapData
+	first := !state.haveLapData
+	state.lapData = *lapData
+	state.haveLapData = true
+	if first || lapData.ResultStatus < 2 {
+		return
+	}
+
+	counters := [PenaltyKind_Count][2]uint8{
+		{previous.TotalWarnings, lapData.TotalWarnings},
+		{previous.Penalties, lapData.Penalties},
+		{previous.NumUnservedDriveThroughPens, lapData.NumUnservedDriveThroughPens},
+		{previous.NumUnservedStopGoPens, lapData.NumUnservedStopGoPens},
+	}
+
+	for kind, counter := range counters {
+		before, after := counter[0], counter[1]
+		if after > before {
+			// time penalties add seconds, every other counter counts penalties
+			issued := int(after - before)
+			if kind == PenaltyKind_TimePenalty {
+				issued = 1
+			}
+
+			for i := 0; i < issued; i++ {
+				if popRecent(&state.eventOnly[kind], header.SessionTime) != nil {
+					continue
+				}
+
+				entry := ledger.issue(header, carIndex, kind, PenaltySource_LapData)
+				entry.Kind = PENALTY_KIND_NAMES[kind]
+				entry.NeedsServing = kind != PenaltyKind_Warning
+				entry.CornerCutting = kind == PenaltyKind_Warning && lapData.CornerCuttingWarnings > previous.CornerCuttingWarnings
+				if kind == PenaltyKind_TimePenalty {
+					entry.TimeS = after - before
+				}
+				state.counterOnly[kind] = append(state.counterOnly[kind], entry)
+				ledger.publish(header, carIndex, entry)
+			}
+		} else if after < before && kind != PenaltyKind_Warning {
+			// time penalties are served at a pit stop all at once
+			served := int(before - after)
+			if kind == PenaltyKind_TimePenalty {
+				served = len(state.entries)
+			}
+
+			for i := 0; i < served; i++ {
+				if kind != PenaltyKind_TimePenalty && state.eventServed[kind] > 0 {
+					state.eventServed[kind]--
+					continue
+				}
+
+				entry := ledger.serve(header, carIndex, kind)
+				if entry == nil {
+					break
+				}
+				if kind != PenaltyKind_TimePenalty {
+					state.counterServed[kind]++
+				}
+				ledger.publish(header, carIndex, entry)
+			}
+		}
+	}
+}
+
+// popRecent takes the oldest entry off a queue, dropping entries that are too old to belong to the same penalty
+func popRecent(queue *[]*PenaltyEntry, sessionTime float32) *PenaltyEntry {
+	for len(*queue) > 0 {
+		entry := (*queue)[0]
+		*queue = (*queue)[1:]
+		if sessionTime-entry.IssuedSessionTime <= PENALTY_MATCH_WINDOW_S {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (ledger *PenaltyLedger) issue(header *F1PacketHeader, carIndex uint8, kind int, source string) *PenaltyEntry {
+	state := &ledger.cars[carIndex]
+	entry := &PenaltyEntry{
+		Id:                ledger.nextId,
+		CarIndex:          carIndex,
+		OtherCarIndex:     255,
+		Source:            source,
+		IssuedSessionTime: header.SessionTime,
+		IssuedLap:         state.lapData.CurrentLapNum,
+		IssuedDistance:    state.lapData.LapDistance,
+		IssuedCorner:      ledger.cornerAt(state.lapData.LapDistance),
+		kind:              kind,
+	}
+	ledger.nextId++
+
+	state.entries = append(state.entries, entry)
+	if len(state.entries) > PENALTY_MAX_ENTRIES_PER_CAR {
+		state.entries = state.entries[1:]
+	}
+	return entry
+}
+
+// serve marks the oldest unserved penalty of a kind as served, nil if there is none
+func (ledger *PenaltyLedger) serve(header *F1PacketHeader, carIndex uint8, kind int) *PenaltyEntry {
+	state := &ledger.cars[carIndex]
+	for _, entry := range state.entries {
+		if entry.Served || !entry.NeedsServing || entry.kind != kind {
+			continue
+		}
+
+		entry.Served = true
+		entry.ServedSessionTime = header.SessionTime
+		entry.ServedLap = state.lapData.CurrentLapNum
+		return entry
+	}
+	return nil
+}
+
+// cornerAt only looks at corners that were already detected, detection is left to the API
+func (ledger *PenaltyLedger) cornerAt(distance float32) int {
+	if ledger.Corners == nil {
+		return 0
+	}
+	return ledger.Corners.Cached(-1).CornerAt(distance)
+}
+
+func (ledger *PenaltyLedger) summary(carIndex uint8) PenaltyCarSummary {
+	state := &ledger.cars[carIndex]
+	return PenaltyCarSummary{
+		CarIndex:              carIndex,
+		Warnings:              state.lapData.TotalWarnings,
+		CornerCuttingWarnings: state.lapData.CornerCuttingWarnings,
+		TimePenaltiesS:        state.lapData.Penalties,
+		UnservedDriveThroughs: state.lapData.NumUnservedDriveThroughPens,
+		UnservedStopGos:       state.lapData.NumUnservedStopGoPens,
+		Entries:               len(state.entries),
+	}
+}
+
+func (ledger *PenaltyLedger) publish(header *F1PacketHeader, carIndex uint8, entry *PenaltyEntry) {
+	WSSBroadcastDerived(ledger.WSS, header, PacketID_PenaltyUpdate, PenaltyLedgerUpdate{*entry, ledger.summary(carIndex)})
+}
+
+// GetEntries returns the ledger of one car (255 = all cars) in the order the penalties were issued
+func (ledger *PenaltyLedger) GetEntries(carIndex uint8) []PenaltyEntry {
+	ledger.RWLock.RLock()
+	defer ledger.RWLock.RUnlock()
+
+	result := make([]PenaltyEntry, 0)
+	for i := range ledger.cars {
+		if carIndex != 255 && uint8(i) != carIndex {
+			continue
+		}
+		for _, entry := range ledger.cars[i].entries {
+			result = append(result, *entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// GetSummaries returns the penalty counters of every car that has lap data
+func (ledger *PenaltyLedger) GetSummaries() []PenaltyCarSummary {
+	ledger.RWLock.RLock()
+	defer ledger.RWLock.RUnlock()
+
+	summaries := make([]PenaltyCarSummary, 0, F1_MAX_NUM_CARS)
+	for i := range ledger.cars {
+		if ledger.cars[i].haveLapData && ledger.cars[i].lapData.ResultStatus >= 2 {
+			summaries = append(summaries, ledger.summary(uint8(i)))
+		}
+	}
+	return summaries
+}
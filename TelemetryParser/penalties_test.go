@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPenaltyLedger(t *testing.T) {
+	ledger := PenaltyLedger{}
+	ledger.Init(nil, nil)
+
+	lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 10}}
+	lapData.LapData[2].ResultStatus = 2
+	lapData.LapData[2].CurrentLapNum = 5
+	lapData.LapData[2].LapDistance = 800
+	ledger.ConsumePacket(lapData)
+
+	// a drive through for pit lane speeding, the event arrives before the counter goes up
+	penalty := F1EventDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 11}}
+	copy(penalty.EventData.EventStringCode[:], EventCode_Penalty)
+	penalty.EventData.EventDetails = [12]byte{PenaltyType_DriveThrough, 17, 2, 255, 255, 5, 0}
+	ledger.ConsumePacket(penalty)
+
+	lapData.f1PacketHeader = &F1PacketHeader{SessionUID: 1, SessionTime: 11.1}
+	lapData.LapData[2].NumUnservedDriveThroughPens = 1
+	// a warning that only shows up in the counters
+	lapData.LapData[2].TotalWarnings = 1
+	lapData.LapData[2].CornerCuttingWarnings = 1
+	ledger.ConsumePacket(lapData)
+
+	entries := ledger.GetEntries(2)
+	if len(entries) != 2 {
+		t.Fatalf("Expected a drive through and a warning, got %+v\n", entries)
+	}
+	if entries[0].Kind != "Drive through" || entries[0].Infringement != "Pit lane speeding" || entries[0].Source != PenaltySource_Event || entries[0].IssuedLap != 5 {
+		t.Errorf("Unexpected drive through - %+v\n", entries[0])
+	}
+	if entries[1].Kind != "Warning" || !entries[1].CornerCutting || entries[1].Source != PenaltySource_LapData || entries[1].IssuedDistance != 800 {
+		t.Errorf("Unexpected warning - %+v\n", entries[1])
+	}
+
+	// served, the counter drops before the DTSV event arrives and both only serve it once
+	lapData.f1PacketHeader = &F1PacketHeader{SessionUID: 1, SessionTime: 60}
+	lapData.LapData[2].CurrentLapNum = 6
+	lapData.LapData[2].NumUnservedDriveThroughPens = 0
+	ledger.ConsumePacket(lapData)
+
+	served := F1EventDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: 60.1}}
+	copy(served.EventData.EventStringCode[:], EventCode_DriveThrough)
+	served.EventData.EventDetails[0] = 2
+	ledger.ConsumePacket(served)
+
+	entries = ledger.GetEntries(2)
+	if !entries[0].Served || entries[0].ServedLap != 6 || entries[0].ServedSessionTime != 60 {
+		t.Errorf("Expected the drive through to be served on lap 6 - %+v\n", entries[0])
+	}
+	if entries[1].Served {
+		t.Errorf("A warning can't be served - %+v\n", entries[1])
+	}
+
+	summaries := ledger.GetSummaries()
+	if len(summaries) != 1 || summaries[0].Warnings != 1 || summaries[0].UnservedDriveThroughs != 0 {
+		t.Errorf("Unexpected summaries - %+v\n", summaries)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	GAP_TREND_LAPS         = 5   // laps of interval history the trend is calculated over
+	GAP_TREND_THRESHOLD_MS = 100 // ms per lap the interval has to change by to flag a car as closing or pulling away
+)
+
+const (
+	GapTrend_Closing      = "closing"
+	GapTrend_PullingAway  = "pulling away"
+	PitStatus_None        = "none"
+	PitStatus_Pitting     = "pitting"
+	PitStatus_InPitArea   = "in pit area"
+	PitStatus_Unavailable = "unknown"
+)
+
+// gapSample is taken every time a car starts a new lap
+type gapSample struct {
+	CarInFront      uint8
+	IntervalInMS    uint16
+	GapToLeaderInMS uint16
+}
+
+type GapTowerEntry struct {
+	Position            uint8
+	CarIndex            uint8
+	LapNum              uint8
+	IntervalInMS        uint16
+	GapToLeaderInMS     uint16
+	IntervalTrendPerLap float32 // ms per lap, negative = gap to the car in front is shrinking
+	GapTrendPerLap      float32 // ms per lap, negative = gap to the leader is shrinking
+	Trend               string
+	LapsDown            uint8
+	PitStatus           string
+	NumPitStops         uint8
+}
+
+type GapTower struct {
+	SessionTime float32
+	Entries     []GapTowerEntry
+}
+
+// GapTracker orders the field by position and follows how the gaps between cars develop over the last laps
+type GapTracker struct {
+	RWLock sync.RWMutex
+	WSS    *WebsocketServer
+
+	sessionUID uint64
+	lapNums    [F1_MAX_NUM_CARS]uint8
+	samples    [F1_MAX_NUM_CARS][]gapSample
+	latest     *GapTower
+}
+
+func (tracker *GapTracker) Init(wss *WebsocketServer) {
+	tracker.WSS = wss
+	tracker.Reset()
+}
+
+func (tracker *GapTracker) Reset() {
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	tracker.reset(0)
+}
+
+func (tracker *GapTracker) reset(sessionUID uint64) {
+	tracker.sessionUID = sessionUID
+	tracker.latest = &GapTower{Entries: make([]GapTowerEntry, 0)}
+	for i := range tracker.samples {
+		tracker.lapNums[i] = 0
+		tracker.samples[i] = make([]gapSample, 0, GAP_TREND_LAPS+1)
+	}
+}
+
+func (tracker *GapTracker) ConsumePacket(packet F1Packet) {
+	lapDataPacket, ok := packet.(F1LapDataPacket)
+	if !ok {
+		return
+	}
+	header := packet.Header()
+
+	tracker.RWLock.Lock()
+	defer tracker.RWLock.Unlock()
+
+	if header.SessionUID != tracker.sessionUID {
+		tracker.reset(header.SessionUID)
+	}
+
+	// position -> car index, to find the car in front of every car
+	var byPosition [F1_MAX_NUM_CARS + 1]int
+	for i := range byPosition {
+		byPosition[i] = -1
+	}
+	leader := -1
+	for i := range lapDataPacket.LapData {
+		ld := &lapDataPacket.LapData[i]
+		if ld.ResultStatus < 2 || ld.CarPosition == 0 || int(ld.CarPosition) > F1_MAX_NUM_CARS {
+			continue
+		}
+		byPosition[ld.CarPosition] = i
+		if ld.CarPosition == 1 {
+			leader = i
+		}
+	}
+
+	tower := &GapTower{SessionTime: header.SessionTime, Entries: make([]GapTowerEntry, 0, F1_MAX_NUM_CARS)}
+	for i := range lapDataPacket.LapData {
+		ld := &lapDataPacket.LapData[i]
+		if ld.ResultStatus < 2 || ld.CarPosition == 0 || int(ld.CarPosition) > F1_MAX_NUM_CARS {
+			continue
+		}
+
+		carInFront := uint8(255)
+		if ld.CarPosition > 1 && byPosition[ld.CarPosition-1] >= 0 {
+			carInFront = uint8(byPosition[ld.CarPosition-1])
+		}
+
+		if ld.CurrentLapNum != tracker.lapNums[i] {
+			tracker.lapNums[i] = ld.CurrentLapNum
+			samples := append(tracker.samples[i], gapSample{carInFront, ld.DeltaToCarInFrontInMS, ld.DeltaToRaceLeaderInMS})
+			if len(samples) > GAP_TREND_LAPS+1 {
+				samples = samples[1:]
+			}
+			tracker.samples[i] = samples
+		}
+
+		entry := GapTowerEntry{
+			Position:        ld.CarPosition,
+			CarIndex:        uint8(i),
+			LapNum:          ld.CurrentLapNum,
+			IntervalInMS:    ld.DeltaToCarInFrontInMS,
+			GapToLeaderInMS: ld.DeltaToRaceLeaderInMS,
+			PitStatus:       PitStatusName(ld.PitStatus),
+			NumPitStops:     ld.NumPitStops,
+		}
+
+		if leader >= 0 && leader != i {
+			entry.LapsDown = LapsDown(&lapDataPacket.LapData[leader], ld)
+		}
+
+		entry.IntervalTrendPerLap, entry.GapTrendPerLap = gapTrends(tracker.samples[i])
+		if entry.IntervalTrendPerLap <= -GAP_TREND_THRESHOLD_MS {
+			entry.Trend = GapTrend_Closing
+		} else if entry.IntervalTrendPerLap >= GAP_TREND_THRESHOLD_MS {
+			entry.Trend = GapTrend_PullingAway
+		}
+
+		tower.Entries = append(tower.Entries, entry)
+	}
+
+	sort.Slice(tower.Entries, func(a, b int) bool { return tower.Entries[a].Position < tower.Entries[b].Position })
+	tracker.latest = tower
+
+	WSSBroadcastDerived(tracker.WSS, header, PacketID_GapTower, tower)
+}
+
+// gapTrends fits the change of interval and gap to leader per lap over the collected samples.
+// The interval trend only uses the laps since the car in front last changed.
+func gapTrends(samples []gapSample) (float32, float32) {
+	n := len(samples)
+	if n < 2 {
+		return 0, 0
+	}
+
+	last := samples[n-1]
+	gapTrend := (float32(last.GapToLeaderInMS) - float32(samples[0].GapToLeaderInMS)) / float32(n-1)
+
+	first := n - 1
+	for first > 0 && samples[first-1].CarInFront == last.CarInFront {
+		first--
+	}
+	intervalTrend := float32(0)
+	if first < n-1 {
+		intervalTrend = (float32(last.IntervalInMS) - float32(samples[first].IntervalInMS)) / float32(n-1-first)
+	}
+
+	return intervalTrend, gapTrend
+}
+
+// LapsDown returns how many laps a car is behind the leader
+func LapsDown(leader *F1LapData, car *F1LapData) uint8 {
+	if leader.CurrentLapNum <= car.CurrentLapNum {
+		return 0
+	}
+
+	laps := leader.CurrentLapNum - car.CurrentLapNum
+	if leader.LapDistance < car.LapDistance {
+		laps -= 1
+	}
+	return laps
+}
+
+func PitStatusName(pitStatus uint8) string {
+	switch pitStatus {
+	case 0:
+		return PitStatus_None
+	case 1:
+		return PitStatus_Pitting
+	case 2:
+		return PitStatus_InPitArea
+	default:
+		return PitStatus_Unavailable
+	}
+}
+
+func (tracker *GapTracker) GetTower() *GapTower {
+	tracker.RWLock.RLock()
+	defer tracker.RWLock.RUnlock()
+
+	return tracker.latest
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGapTracker(t *testing.T) {
+	tracker := GapTracker{}
+	tracker.Init(nil)
+
+	// car 1 closes in on the leader by 200ms a lap, car 2 drops back by 150ms a lap to car 1 and gets lapped
+	for lap := 1; lap <= 6; lap++ {
+		packet := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 9, SessionTime: float32(lap) * 90}}
+		leader, second, third := &packet.LapData[0], &packet.LapData[1], &packet.LapData[2]
+
+		leader.CarPosition, leader.CurrentLapNum, leader.LapDistance = 1, uint8(lap+1), 3500
+		second.CarPosition, second.CurrentLapNum, second.LapDistance = 2, uint8(lap), 4000
+		second.DeltaToCarInFrontInMS = uint16(3000 - 200*lap)
+		second.DeltaToRaceLeaderInMS = second.DeltaToCarInFrontInMS
+		third.CarPosition, third.CurrentLapNum, third.LapDistance = 3, uint8(lap), 3000
+		third.DeltaToCarInFrontInMS = uint16(1000 + 150*lap)
+		third.DeltaToRaceLeaderInMS = second.DeltaToRaceLeaderInMS + third.DeltaToCarInFrontInMS
+		third.PitStatus = 1
+		for i := 0; i < 3; i++ {
+			packet.LapData[i].ResultStatus = 2
+		}
+
+		tracker.ConsumePacket(packet)
+	}
+
+	tower := tracker.GetTower()
+	if len(tower.Entries) != 3 || tower.Entries[0].CarIndex != 0 || tower.Entries[2].CarIndex != 2 {
+		t.Fatalf("Expected the tower ordered by position - %+v\n", tower.Entries)
+	}
+
+	second, third := tower.Entries[1], tower.Entries[2]
+	if second.IntervalTrendPerLap != -200 || second.Trend != GapTrend_Closing || second.LapsDown != 0 {
+		t.Errorf("Expected car 1 to be closing on the leader - %+v\n", second)
+	}
+	if third.IntervalTrendPerLap != 150 || third.GapTrendPerLap != -50 || third.Trend != GapTrend_PullingAway {
+		t.Errorf("Expected car 2 to drop back from car 1 - %+v\n", third)
+	}
+	if third.LapsDown != 1 || third.PitStatus != PitStatus_Pitting {
+		t.Errorf("Expected car 2 to be a lap down in the pits - %+v\n", third)
+	}
+}
+
+func TestGapTrendsCarInFrontChange(t *testing.T) {
+	// the interval trend restarts when a different car is in front, the gap to the leader doesn't
+	samples := []gapSample{{4, 500, 5000}, {4, 1500, 5500}, {7, 800, 6000}, {7, 600, 6500}}
+	interval, gap := gapTrends(samples)
+	if interval != -200 || gap != 500 {
+		t.Errorf("Unexpected trends - interval %f, gap %f\n", interval, gap)
+	}
+}
+
+func TestLapsDown(t *testing.T) {
+	for _, c := range []struct {
+		leaderLap, carLap           uint8
+		leaderDistance, carDistance float32
+		expected                    uint8
+	}{
+		{5, 5, 100, 900, 0},
+		{6, 5, 100, 900, 0}, // leader is a lap ahead on the timing line but still behind on the road
+		{6, 5, 900, 100, 1},
+		{8, 5, 100, 900, 2},
+	} {
+		leader := F1LapData{CurrentLapNum: c.leaderLap, LapDistance: c.leaderDistance}
+		car := F1LapData{CurrentLapNum: c.carLap, LapDistance: c.carDistance}
+		if laps := LapsDown(&leader, &car); laps != c.expected {
+			t.Errorf("Leader on lap %d at %.0fm, car on lap %d at %.0fm - %d laps down, expected %d\n", c.leaderLap, c.leaderDistance, c.carLap, c.carDistance, laps, c.expected)
+		}
+	}
+}
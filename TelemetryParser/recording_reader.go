@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ReadRecording parses a recording written by RecordSavedPacket and hands every packet to `handler` in the order
+// it was recorded. Only the per car arrays are part of a recording, so trailing packet fields are left zeroed.
+func ReadRecording(filename string, handler func(packet F1Packet)) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		packetID, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		header := &F1PacketHeader{}
+		if !ParseStruct(reader, header) {
+			return fmt.Errorf("failed to read packet header at offset %d", len(data)-reader.Len())
+		}
+
+		if header.PacketId != packetID {
+			return fmt.Errorf("packet ID mismatch at offset %d - '%d' != '%d'", len(data)-reader.Len(), packetID, header.PacketId)
+		}
+
+		var packet F1Packet
+		switch packetID {
+		case PacketID_Motion:
+			p := F1CarMotionDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.CarMotionData)
+			packet = p
+		case PacketID_Session:
+			p := F1SessionDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.SessionData)
+			packet = p
+		case PacketID_LapData:
+			p := F1LapDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.LapData)
+			packet = p
+		case PacketID_CarTelemetry:
+			p := F1CarTelemetryDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.CarTelemetryData)
+			packet = p
+		case PacketID_CarStatus:
+			p := F1CarStatusDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.CarStatusData)
+			packet = p
+		case PacketID_CarDamage:
+			p := F1CarDamageDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.CarDamageData)
+			packet = p
+		case PacketID_Event:
+			p := F1EventDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.EventData)
+			packet = p
+		case PacketID_Participants:
+			p := F1ParticipantsDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.ParticipantsData)
+			packet = p
+		case PacketID_CarSetups:
+			p := F1CarSetupDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.CarSetups)
+			packet = p
+		case PacketID_MotionEx:
+			p := F1MotionExDataPacket{f1PacketHeader: header}
+			err = binary.Read(reader, binary.LittleEndian, &p.MotionExData)
+			packet = p
+		default:
+			return fmt.Errorf("unsupported packet ID '%d' in recording", packetID)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read packet with ID '%d' - %s", packetID, err)
+		}
+
+		handler(packet)
+	}
+
+	return nil
+}
+
+// RecordingPath resolves a recording name received over the API, recordings are only read from the working directory
+func RecordingPath(name string) string {
+	return filepath.Base(name)
+}
+
+// ReadRecordingMetadata reads the metadata written when a recording was stopped
+func ReadRecordingMetadata(filename string) (*RecordingMetadata, error) {
+	data, err := os.ReadFile(filename + RECORDING_METADATA_SUFFIX)
+	if err != nil {
+		return nil, fmt.Errorf("no metadata for recording '%s'", filename)
+	}
+
+	metadata := &RecordingMetadata{}
+	err = json.Unmarshal(data, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// LoadRecordingLaps runs a recording through a fresh LapTracker and returns it with all completed laps
+func LoadRecordingLaps(filename string) (*LapTracker, error) {
+	tracker := &LapTracker{}
+	tracker.Init()
+
+	err := ReadRecording(filename, tracker.ConsumePacket)
+	if err != nil {
+		return nil, err
+	}
+
+	return tracker, nil
+}
+
+// LapSources are what a lap can be selected from for comparisons, either the live session or a replayed recording
+type LapSources struct {
+	Laps  *LapTracker
+	Slips *SlipDetector
+	GG    *GGAnalyzer
+}
+
+// LoadRecordingSources replays a recording once through fresh trackers for every lap source
+func LoadRecordingSources(filename string) (*LapSources, error) {
+	sources := &LapSources{&LapTracker{}, &SlipDetector{}, &GGAnalyzer{}}
+	sources.Laps.Init()
+	sources.Slips.Init(nil, nil)
+	sources.GG.Init()
+
+	err := ReadRecording(filename, func(packet F1Packet) {
+		sources.Laps.ConsumePacket(packet)
+		sources.Slips.ConsumePacket(packet)
+		sources.GG.ConsumePacket(packet)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
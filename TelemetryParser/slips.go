@@ -0,0 +1,249 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	LOCKUP_SLIP_RATIO       float32 = -0.2 // slip ratio a braking wheel has to drop below to count as locked
+	WHEELSPIN_SLIP_RATIO    float32 = 0.2  // slip ratio a driven wheel has to exceed to count as spinning
+	LOCKUP_MIN_BRAKE        float32 = 10   // brake percentage
+	WHEELSPIN_MIN_THROTTLE  float32 = 20   // throttle percentage
+	SLIP_MIN_SPEED                  = 20   // km/h, below this slip ratios are too noisy to use
+	SLIP_MIN_DURATION       float32 = 0.1  // seconds a slip has to last to be reported
+	SLIP_MAJOR_SEVERITY     float32 = 0.5  // peak slip ratio above which an event is a major one
+	SLIP_MAX_EVENTS_PER_LAP         = 100
+	SLIP_MAX_LAPS                   = 200
+	SlipKind_Lockup                 = "lockup"
+	SlipKind_Wheelspin              = "wheelspin"
+)
+
+type SlipEvent struct {
+	Kind           string
+	Wheel          string
+	LapNum         uint8
+	LapDistance    float32 // where the slip started
+	EndDistance    float32
+	Corner         int // number of the corner the slip started in, 0 if it's not in one or the track has no corners yet
+	StartTime      float32
+	DurationS      float32
+	Severity       float32 // peak absolute slip ratio
+	Major          bool
+	PeakWheelSpeed float32 // wheel speed relative to the car's speed at the peak of the slip, in %
+}
+
+type SlipLapSummary struct {
+	LapNum     uint8
+	Lockups    int
+	Wheelspins int
+	Major      int
+}
+
+type openSlip struct {
+	event    SlipEvent
+	lastTime float32
+}
+
+// SlipDetector finds lockups and wheelspin of the player car from the wheel slip in the extended motion packet
+type SlipDetector struct {
+	RWLock  sync.RWMutex
+	WSS     *WebsocketServer
+	Corners *CornerRegistry
+
+	sessionUID uint64
+	carIndex   uint8
+	haveInputs bool
+	telemetry  F1CarTelemetryData
+	lapData    F1LapData
+	open       [2][4]*openSlip // [lockup, wheelspin][wheel]
+	laps       map[uint8][]SlipEvent
+	lapOrder   []uint8
+}
+
+func (detector *SlipDetector) Init(wss *WebsocketServer, corners *CornerRegistry) {
+	detector.WSS = wss
+	detector.Corners = corners
+	detector.Reset()
+}
+
+func (detector *SlipDetector) Reset() {
+	detector.RWLock.Lock()
+	defer detector.RWLock.Unlock()
+
+	detector.reset(0)
+}
+
+func (detector *SlipDetector) reset(sessionUID uint64) {
+	detector.sessionUID = sessionUID
+	detector.haveInputs = false
+	detector.lapData = F1LapData{}
+	detector.open = [2][4]*openSlip{}
+	detector.laps = make(map[uint8][]SlipEvent)
+	detector.lapOrder = make([]uint8, 0)
+}
+
+func (detector *SlipDetector) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	detector.RWLock.Lock()
+	defer detector.RWLock.Unlock()
+
+	if header.SessionUID != detector.sessionUID || header.PlayerCarIndex != detector.carIndex {
+		detector.reset(header.SessionUID)
+		detector.carIndex = header.PlayerCarIndex
+	}
+	if detector.carIndex >= F1_MAX_NUM_CARS {
+		return
+	}
+
+	switch p := packet.(type) {
+	case F1CarTelemetryDataPacket:
+		detector.telemetry = p.CarTelemetryData[detector.carIndex]
+		detector.haveInputs = true
+	case F1LapDataPacket:
+		lapData := &p.LapData[detector.carIndex]
+		if lapData.CurrentLapNum != detector.lapData.CurrentLapNum {
+			detector.closeAll(header)
+		}
+		detector.lapData = *lapData
+	case F1MotionExDataPacket:
+		if detector.haveInputs && detector.lapData.CurrentLapNum > 0 {
+			detector.processMotionEx(header, &p.MotionExData)
+		}
+	}
+}
+
+func (detector *SlipDetector) processMotionEx(header *F1PacketHeader, motionEx *F1MotionExData) {
+	telemetry := &detector.telemetry
+	fastEnough := telemetry.Speed >= SLIP_MIN_SPEED
+
+	for wheel := 0; wheel < 4; wheel++ {
+		slip := motionEx.WheelSlipRatio[wheel]
+		active := [2]bool{
+			fastEnough && telemetry.Brake >= LOCKUP_MIN_BRAKE && slip <= LOCKUP_SLIP_RATIO,
+			fastEnough && telemetry.Throttle >= WHEELSPIN_MIN_THROTTLE && slip >= WHEELSPIN_SLIP_RATIO,
+		}
+
+		for kind := range active {
+			current := detector.open[kind][wheel]
+			if !active[kind] {
+				if current != nil {
+					detector.close(header, kind, wheel)
+				}
+				continue
+			}
+
+			severity := slip
+			if severity < 0 {
+				severity = -severity
+			}
+
+			if current == nil {
+				current = &openSlip{event: SlipEvent{
+					Kind:        SlipKind_Lockup,
+					Wheel:       TYRE_CORNER_NAMES[wheel],
+					LapNum:      detector.lapData.CurrentLapNum,
+					LapDistance: detector.lapData.LapDistance,
+					Corner:      detector.cornerAt(detector.lapData.LapDistance),
+					StartTime:   header.SessionTime,
+				}}
+				if kind == 1 {
+					current.event.Kind = SlipKind_Wheelspin
+				}
+				detector.open[kind][wheel] = current
+			}
+
+			current.lastTime = header.SessionTime
+			current.event.EndDistance = detector.lapData.LapDistance
+			if severity > current.event.Severity {
+				current.event.Severity = severity
+				current.event.PeakWheelSpeed = motionEx.WheelSpeed[wheel] / (float32(telemetry.Speed) / 3.6) * 100
+			}
+		}
+	}
+}
+
+// cornerAt only looks at corners that were already detected, detection is left to the API
+func (detector *SlipDetector) cornerAt(distance float32) int {
+	if detector.Corners == nil {
+		return 0
+	}
+	return detector.Corners.Cached(-1).CornerAt(distance)
+}
+
+func (detector *SlipDetector) close(header *F1PacketHeader, kind int, wheel int) {
+	current := detector.open[kind][wheel]
+	detector.open[kind][wheel] = nil
+
+	event := current.event
+	event.DurationS = current.lastTime - event.StartTime
+	if event.DurationS < SLIP_MIN_DURATION {
+		return
+	}
+	event.Major = event.Severity >= SLIP_MAJOR_SEVERITY
+
+	events, ok := detector.laps[event.LapNum]
+	if !ok {
+		detector.lapOrder = append(detector.lapOrder, event.LapNum)
+		if len(detector.lapOrder) > SLIP_MAX_LAPS {
+			delete(detector.laps, detector.lapOrder[0])
+			detector.lapOrder = detector.lapOrder[1:]
+		}
+	}
+	if len(events) < SLIP_MAX_EVENTS_PER_LAP {
+		detector.laps[event.LapNum] = append(events, event)
+	}
+
+	WSSBroadcastDerived(detector.WSS, header, PacketID_SlipEvent, &event)
+}
+
+// closeAll ends every open slip, used when a lap ends so no event spans two laps
+func (detector *SlipDetector) closeAll(header *F1PacketHeader) {
+	for kind := range detector.open {
+		for wheel := range detector.open[kind] {
+			if detector.open[kind][wheel] != nil {
+				detector.close(header, kind, wheel)
+			}
+		}
+	}
+}
+
+// GetLapEvents returns the slips of a lap, or nil if the car isn't the one the detector follows
+func (detector *SlipDetector) GetLapEvents(carIndex uint8, lapNum uint8) []SlipEvent {
+	detector.RWLock.RLock()
+	defer detector.RWLock.RUnlock()
+
+	if carIndex != detector.carIndex {
+		return nil
+	}
+	return append([]SlipEvent{}, detector.laps[lapNum]...)
+}
+
+func (detector *SlipDetector) GetPlayerLapEvents(lapNum uint8) []SlipEvent {
+	detector.RWLock.RLock()
+	defer detector.RWLock.RUnlock()
+
+	return append([]SlipEvent{}, detector.laps[lapNum]...)
+}
+
+func (detector *SlipDetector) GetLapSummaries() []SlipLapSummary {
+	detector.RWLock.RLock()
+	defer detector.RWLock.RUnlock()
+
+	summaries := make([]SlipLapSummary, 0, len(detector.lapOrder))
+	for _, lapNum := range detector.lapOrder {
+		summary := SlipLapSummary{LapNum: lapNum}
+		for _, event := range detector.laps[lapNum] {
+			if event.Kind == SlipKind_Lockup {
+				summary.Lockups++
+			} else {
+				summary.Wheelspins++
+			}
+			if event.Major {
+				summary.Major++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLockupDetection(t *testing.T) {
+	detector := SlipDetector{}
+	detector.Init(nil, nil)
+
+	lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	lapData.LapData[0].CurrentLapNum = 3
+	lapData.LapData[0].LapDistance = 400
+	detector.ConsumePacket(lapData)
+
+	telemetry := F1CarTelemetryDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	telemetry.CarTelemetryData[0].Speed = 180
+	telemetry.CarTelemetryData[0].Brake = 80
+	detector.ConsumePacket(telemetry)
+
+	// the front left locks for 0.3s, the front right only for a single sample
+	for i := 0; i < 10; i++ {
+		motionEx := F1MotionExDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1, SessionTime: float32(i) * 0.05}}
+		if i < 7 {
+			motionEx.MotionExData.WheelSlipRatio[2] = -0.6
+			motionEx.MotionExData.WheelSpeed[2] = 20
+		}
+		if i == 2 {
+			motionEx.MotionExData.WheelSlipRatio[3] = -0.3
+		}
+		detector.ConsumePacket(motionEx)
+	}
+
+	events := detector.GetLapEvents(0, 3)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 slip event, got %d\n", len(events))
+	}
+
+	event := events[0]
+	if event.Kind != SlipKind_Lockup || event.Wheel != "FL" || event.LapDistance != 400 || !event.Major {
+		t.Errorf("Unexpected event - %+v\n", event)
+	}
+	if event.DurationS < 0.29 || event.DurationS > 0.31 {
+		t.Errorf("Expected a 0.3s lockup, got %.2fs\n", event.DurationS)
+	}
+
+	summaries := detector.GetLapSummaries()
+	if len(summaries) != 1 || summaries[0].Lockups != 1 || summaries[0].Wheelspins != 0 {
+		t.Errorf("Unexpected lap summaries - %+v\n", summaries)
+	}
+}
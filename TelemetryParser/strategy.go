@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	STRATEGY_DEFAULT_PIT_LOSS_MS        = 22000 // used until a pit stop has been measured in the session
+	STRATEGY_OUTLAP_WARMUP_MS           = 1000  // time lost on the out lap bringing cold tyres up to temperature
+	STRATEGY_UNDERCUT_LAPS              = 1     // laps the other car is assumed to stay out for
+	STRATEGY_BROADCAST_INTERVAL_SECONDS = 1
+	STRATEGY_MAX_PIT_LANE_TIME_MS       = 60000 // longer lane times are garage visits or penalties, not comparable stops
+	StrategyVerdict_Undercut            = "undercut"
+	StrategyVerdict_Overcut             = "overcut"
+	StrategyVerdict_Cover               = "cover"
+	StrategyVerdict_Hold                = "hold"
+	StrategyRecommendation_Box          = "box"
+	StrategyRecommendation_StayOut      = "stay out"
+)
+
+type PitLossSample struct {
+	CarIndex     uint8
+	LapNum       uint8
+	LaneTimeInMS uint16
+	LaneDistance float32
+	LossInMS     float32 // lane time minus the time the same distance takes at racing pace
+}
+
+type StrategyCar struct {
+	CarIndex uint8
+	Position uint8
+	GapInMS  float32 // to the car the prediction is for, always positive
+	TyreAge  uint8
+	Compound string
+}
+
+type UndercutEstimate struct {
+	RivalIndex     uint8
+	RivalPosition  uint8
+	GapToRivalInMS float32 // positive = rival is ahead
+	RivalTyreAge   uint8
+	UndercutGainMS float32 // time gained by pitting now while the rival stays out for STRATEGY_UNDERCUT_LAPS
+	OvercutGainMS  float32 // time gained by staying out for STRATEGY_UNDERCUT_LAPS while the rival pits now
+	Verdict        string
+}
+
+type PitPrediction struct {
+	SessionTime         float32
+	CarIndex            uint8
+	LapNum              uint8
+	Position            uint8
+	TyreAge             uint8
+	PitLossInMS         float32
+	PitLossSamples      int
+	RejoinPosition      uint8
+	RejoinGapToLeaderMS float32
+	CarAhead            *StrategyCar // around the car after rejoining
+	CarBehind           *StrategyCar
+	Undercuts           []UndercutEstimate
+	Recommendation      string
+}
+
+type strategyCarState struct {
+	pace         float32 // last lap time without a pit stop
+	lapNum       uint8
+	lapPitted    bool
+	inPitLane    bool
+	laneEntry    float32
+	laneTimeInMS uint16
+	tyreAge      uint8
+}
+
+// StrategyEngine measures pit lane losses and predicts where a car rejoins and whether it can undercut the cars around it
+type StrategyEngine struct {
+	RWLock sync.RWMutex
+	WSS    *WebsocketServer
+	Tyres  *TyreWearModel
+
+	sessionUID    uint64
+	trackLength   float32
+	playerCar     uint8
+	haveLapData   bool
+	lapData       [F1_MAX_NUM_CARS]F1LapData
+	cars          [F1_MAX_NUM_CARS]strategyCarState
+	pitLosses     []PitLossSample
+	lastBroadcast float32
+}
+
+func (engine *StrategyEngine) Init(wss *WebsocketServer, tyres *TyreWearModel) {
+	engine.WSS = wss
+	engine.Tyres = tyres
+	engine.Reset()
+}
+
+func (engine *StrategyEngine) Reset() {
+	engine.RWLock.Lock()
+	defer engine.RWLock.Unlock()
+
+	engine.reset(0)
+}
+
+func (engine *StrategyEngine) reset(sessionUID uint64) {
+	engine.sessionUID = sessionUID
+	engine.trackLength = 0
+	engine.haveLapData = false
+	engine.cars = [F1_MAX_NUM_CARS]strategyCarState{}
+	engine.pitLosses = make([]PitLossSample, 0)
+	engine.lastBroadcast = 0
+}
+
+func (engine *StrategyEngine) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	engine.RWLock.Lock()
+	defer engine.RWLock.Unlock()
+
+	if header.SessionUID != engine.sessionUID {
+		engine.reset(header.SessionUID)
+	}
+	engine.playerCar = header.PlayerCarIndex
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		engine.trackLength = float32(p.SessionData.TrackLength)
+	case F1CarStatusDataPacket:
+		for i := range p.CarStatusData {
+			engine.cars[i].tyreAge = p.CarStatusData[i].TyresAgeLaps
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			engine.processLapData(uint8(i), &p.LapData[i])
+		}
+		engine.lapData = p.LapData
+		engine.haveLapData = true
+
+		if engine.playerCar < F1_MAX_NUM_CARS && BroadcastDue(&engine.lastBroadcast, header.SessionTime, STRATEGY_BROADCAST_INTERVAL_SECONDS) {
+			prediction, err := engine.predict(engine.playerCar, -1)
+			if err == nil {
+				prediction.SessionTime = header.SessionTime
+				WSSBroadcastDerived(engine.WSS, header, PacketID_PitStrategy, prediction)
+			}
+		}
+	}
+}
+
+func (engine *StrategyEngine) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &engine.cars[carIndex]
+
+	if lapData.CurrentLapNum != state.lapNum {
+		if state.lapNum != 0 && lapData.CurrentLapNum == state.lapNum+1 && !state.lapPitted && lapData.LastLapTimeInMS > 0 {
+			state.pace = float32(lapData.LastLapTimeInMS)
+		}
+		state.lapNum = lapData.CurrentLapNum
+		state.lapPitted = false
+	}
+
+	if lapData.PitStatus != 0 {
+		state.lapPitted = true
+	}
+
+	// the lane timer stops when the car leaves the pit lane, the last time it showed is the time spent in the lane
+	if lapData.PitLaneTimerActive == 1 {
+		if !state.inPitLane {
+			state.inPitLane = true
+			state.laneEntry = lapData.LapDistance
+		}
+		state.laneTimeInMS = lapData.PitLaneTimeInLaneInMS
+	} else if state.inPitLane {
+		state.inPitLane = false
+		engine.addPitLoss(carIndex, lapData, state)
+	}
+}
+
+func (engine *StrategyEngine) addPitLoss(carIndex uint8, lapData *F1LapData, state *strategyCarState) {
+	if state.pace <= 0 || engine.trackLength <= 0 || state.laneTimeInMS == 0 || state.laneTimeInMS > STRATEGY_MAX_PIT_LANE_TIME_MS {
+		return
+	}
+
+	distance := lapData.LapDistance - state.laneEntry
+	if distance < 0 {
+		distance += engine.trackLength
+	}
+
+	expected := distance / engine.trackLength * state.pace
+	engine.pitLosses = append(engine.pitLosses, PitLossSample{
+		CarIndex:     carIndex,
+		LapNum:       lapData.CurrentLapNum,
+		LaneTimeInMS: state.laneTimeInMS,
+		LaneDistance: distance,
+		LossInMS:     float32(state.laneTimeInMS) - expected,
+	})
+}
+
+// pitLoss averages all measured stops of the session
+func (engine *StrategyEngine) pitLoss() float32 {
+	if len(engine.pitLosses) == 0 {
+		return STRATEGY_DEFAULT_PIT_LOSS_MS
+	}
+
+	total := float32(0)
+	for _, sample := range engine.pitLosses {
+		total += sample.LossInMS
+	}
+	return total / float32(len(engine.pitLosses))
+}
+
+// raceTimes puts every running car on one timeline, in ms behind the leader, counting laps down at the leader's pace
+func (engine *StrategyEngine) raceTimes() map[uint8]float32 {
+	leader := -1
+	for i := range engine.lapData {
+		if engine.lapData[i].ResultStatus == 2 && engine.lapData[i].CarPosition == 1 {
+			leader = i
+		}
+	}
+
+	times := make(map[uint8]float32)
+	for i := range engine.lapData {
+		ld := &engine.lapData[i]
+		if ld.ResultStatus != 2 || ld.CarPosition == 0 {
+			continue
+		}
+
+		raceTime := float32(ld.DeltaToRaceLeaderInMS)
+		if leader >= 0 && leader != i {
+			raceTime += float32(LapsDown(&engine.lapData[leader], ld)) * engine.cars[leader].pace
+		} else if leader == i {
+			raceTime = 0
+		}
+		times[uint8(i)] = raceTime
+	}
+	return times
+}
+
+// degradation returns the lap time a car loses per lap of tyre age, from its current stint
+func (engine *StrategyEngine) degradation(carIndex uint8) float32 {
+	if engine.Tyres == nil {
+		return 0
+	}
+
+	stint := engine.Tyres.GetActiveStint(carIndex)
+	if stint == nil || stint.LapTimeLossPerLap < 0 {
+		return 0
+	}
+	return stint.LapTimeLossPerLap
+}
+
+// stintGain is the time a car on fresh tyres gains over `laps` laps on a car whose tyres are `age` laps old
+func stintGain(age uint8, oldLossPerLap float32, freshLossPerLap float32, laps int) float32 {
+	gain := float32(-STRATEGY_OUTLAP_WARMUP_MS)
+	for k := 0; k < laps; k++ {
+		gain += oldLossPerLap*float32(int(age)+k) - freshLossPerLap*float32(k)
+	}
+	return gain
+}
+
+func (engine *StrategyEngine) strategyCar(carIndex uint8, gap float32) *StrategyCar {
+	car := &StrategyCar{
+		CarIndex: carIndex,
+		Position: engine.lapData[carIndex].CarPosition,
+		GapInMS:  gap,
+		TyreAge:  engine.cars[carIndex].tyreAge,
+	}
+	if engine.Tyres != nil {
+		if stint := engine.Tyres.GetActiveStint(carIndex); stint != nil {
+			car.Compound = stint.VisualCompound
+		}
+	}
+	return car
+}
+
+func (engine *StrategyEngine) undercut(carIndex uint8, rival uint8, raceTimes map[uint8]float32) UndercutEstimate {
+	ownLoss, rivalLoss := engine.degradation(carIndex), engine.degradation(rival)
+	ownAge, rivalAge := engine.cars[carIndex].tyreAge, engine.cars[rival].tyreAge
+
+	estimate := UndercutEstimate{
+		RivalIndex:     rival,
+		RivalPosition:  engine.lapData[rival].CarPosition,
+		GapToRivalInMS: raceTimes[carIndex] - raceTimes[rival],
+		RivalTyreAge:   rivalAge,
+		UndercutGainMS: stintGain(rivalAge, rivalLoss, ownLoss, STRATEGY_UNDERCUT_LAPS),
+		OvercutGainMS:  -stintGain(ownAge, ownLoss, rivalLoss, STRATEGY_UNDERCUT_LAPS),
+		Verdict:        StrategyVerdict_Hold,
+	}
+
+	if estimate.GapToRivalInMS > 0 {
+		if estimate.UndercutGainMS > estimate.GapToRivalInMS {
+			estimate.Verdict = StrategyVerdict_Undercut
+		} else if estimate.OvercutGainMS > estimate.GapToRivalInMS {
+			estimate.Verdict = StrategyVerdict_Overcut
+		}
+	} else if -estimate.OvercutGainMS > -estimate.GapToRivalInMS {
+		// the car behind would get past by pitting first
+		estimate.Verdict = StrategyVerdict_Cover
+	}
+
+	return estimate
+}
+
+// predict answers "if this car pits now, where does it rejoin", comparing it against the cars directly ahead and behind and `rival` if >= 0
+func (engine *StrategyEngine) predict(carIndex uint8, rival int) (*PitPrediction, error) {
+	if !engine.haveLapData {
+		return nil, fmt.Errorf("no lap data received")
+	}
+	if carIndex >= F1_MAX_NUM_CARS || engine.lapData[carIndex].ResultStatus != 2 {
+		return nil, fmt.Errorf("car %d is not running", carIndex)
+	}
+
+	raceTimes := engine.raceTimes()
+	ld := &engine.lapData[carIndex]
+	prediction := &PitPrediction{
+		CarIndex:       carIndex,
+		LapNum:         ld.CurrentLapNum,
+		Position:       ld.CarPosition,
+		TyreAge:        engine.cars[carIndex].tyreAge,
+		PitLossInMS:    engine.pitLoss(),
+		PitLossSamples: len(engine.pitLosses),
+		Undercuts:      make([]UndercutEstimate, 0, 3),
+		Recommendation: StrategyRecommendation_StayOut,
+	}
+
+	others := make([]uint8, 0, len(raceTimes))
+	for car := range raceTimes {
+		if car != carIndex {
+			others = append(others, car)
+		}
+	}
+	sort.Slice(others, func(a, b int) bool { return raceTimes[others[a]] < raceTimes[others[b]] })
+
+	rejoinTime := raceTimes[carIndex] + prediction.PitLossInMS
+	prediction.RejoinGapToLeaderMS = rejoinTime
+	prediction.RejoinPosition = 1
+	for _, car := range others {
+		if raceTimes[car] < rejoinTime {
+			prediction.RejoinPosition++
+			prediction.CarAhead = engine.strategyCar(car, rejoinTime-raceTimes[car])
+		} else if prediction.CarBehind == nil {
+			prediction.CarBehind = engine.strategyCar(car, raceTimes[car]-rejoinTime)
+		}
+	}
+
+	// the cars directly ahead and behind on the road right now
+	rivals := make([]uint8, 0, 3)
+	ahead, behind := -1, -1
+	for i, car := range others {
+		if raceTimes[car] < raceTimes[carIndex] {
+			ahead = i
+		} else if behind < 0 {
+			behind = i
+		}
+	}
+	if ahead >= 0 {
+		rivals = append(rivals, others[ahead])
+	}
+	if behind >= 0 {
+		rivals = append(rivals, others[behind])
+	}
+	if _, ok := raceTimes[uint8(rival)]; ok && rival >= 0 && rival < F1_MAX_NUM_CARS && uint8(rival) != carIndex {
+		known := false
+		for _, r := range rivals {
+			known = known || r == uint8(rival)
+		}
+		if !known {
+			rivals = append(rivals, uint8(rival))
+		}
+	}
+
+	for _, r := range rivals {
+		estimate := engine.undercut(carIndex, r, raceTimes)
+		if estimate.Verdict == StrategyVerdict_Undercut || estimate.Verdict == StrategyVerdict_Cover {
+			prediction.Recommendation = StrategyRecommendation_Box
+		}
+		prediction.Undercuts = append(prediction.Undercuts, estimate)
+	}
+
+	return prediction, nil
+}
+
+// Predict returns the pit stop prediction for a car (255 = player car), with an extra undercut estimate against `rival` if >= 0
+func (engine *StrategyEngine) Predict(carIndex uint8, rival int) (*PitPrediction, error) {
+	engine.RWLock.RLock()
+	defer engine.RWLock.RUnlock()
+
+	if carIndex == 255 {
+		carIndex = engine.playerCar
+	}
+	return engine.predict(carIndex, rival)
+}
+
+func (engine *StrategyEngine) GetPitLosses() []PitLossSample {
+	engine.RWLock.RLock()
+	defer engine.RWLock.RUnlock()
+
+	return append([]PitLossSample{}, engine.pitLosses...)
+}
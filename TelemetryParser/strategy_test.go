@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPitRejoinPrediction(t *testing.T) {
+	engine := StrategyEngine{}
+	engine.Init(nil, nil)
+
+	header := &F1PacketHeader{SessionUID: 1, PlayerCarIndex: 255}
+	lapData := F1LapDataPacket{f1PacketHeader: header}
+	for i, gap := range []uint16{0, 5000, 25000, 30000} {
+		lapData.LapData[i].ResultStatus = 2
+		lapData.LapData[i].CarPosition = uint8(i + 1)
+		lapData.LapData[i].CurrentLapNum = 10
+		lapData.LapData[i].DeltaToRaceLeaderInMS = gap
+	}
+	engine.ConsumePacket(lapData)
+
+	prediction, err := engine.Predict(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5s behind the leader plus the default pit loss puts the car between P3 (25s) and P4 (30s)
+	if prediction.RejoinPosition != 3 || prediction.CarAhead.CarIndex != 2 || prediction.CarBehind.CarIndex != 3 {
+		t.Fatalf("Unexpected rejoin - P%d, ahead %+v, behind %+v\n", prediction.RejoinPosition, prediction.CarAhead, prediction.CarBehind)
+	}
+	if prediction.CarAhead.GapInMS != 2000 || prediction.CarBehind.GapInMS != 3000 {
+		t.Errorf("Unexpected gaps around the car - %.0f, %.0f\n", prediction.CarAhead.GapInMS, prediction.CarBehind.GapInMS)
+	}
+
+	// cars directly ahead and behind, plus the requested rival
+	if len(prediction.Undercuts) != 3 || prediction.Undercuts[0].RivalIndex != 0 || prediction.Undercuts[2].RivalIndex != 3 {
+		t.Fatalf("Unexpected undercut rivals - %+v\n", prediction.Undercuts)
+	}
+	// without tyre data there's nothing to gain from fresh tyres
+	if prediction.Undercuts[0].Verdict != StrategyVerdict_Hold || prediction.Recommendation != StrategyRecommendation_StayOut {
+		t.Errorf("Unexpected verdict - %s, %s\n", prediction.Undercuts[0].Verdict, prediction.Recommendation)
+	}
+}
+
+func TestStintGain(t *testing.T) {
+	// tyres 10 laps old losing 150ms per lap are 1.5s slower than fresh ones, minus the out lap warm up
+	gain := stintGain(10, 150, 100, 1)
+	if gain != 1500-STRATEGY_OUTLAP_WARMUP_MS {
+		t.Errorf("Unexpected undercut gain - %.0f\n", gain)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	TEMPERATURE_DEFAULT_ALERT_SECONDS float32 = 3 // how long a temperature has to stay out of its window before an alert is sent
+	TEMPERATURE_MAX_SAMPLE_GAP        float32 = 1 // longer gaps between telemetry packets (pauses, flashbacks) aren't counted
+	TEMPERATURE_MAX_LAPS_PER_CAR              = 200
+	TEMPERATURE_CHANNEL_COUNT                 = 3
+)
+
+const (
+	TemperatureChannel_TyreSurface = iota
+	TemperatureChannel_TyreInner
+	TemperatureChannel_Brakes
+)
+
+const (
+	TemperatureState_Cold     = "too cold"
+	TemperatureState_Hot      = "too hot"
+	TemperatureState_InWindow = "in window"
+)
+
+var TEMPERATURE_CHANNEL_NAMES = [TEMPERATURE_CHANNEL_COUNT]string{"tyre surface", "tyre inner", "brakes"}
+
+type TemperatureWindow struct {
+	Min float32
+	Max float32
+}
+
+// Operating windows per visual compound, for the tyre surface and tyre inner temperatures
+var TYRE_TEMPERATURE_WINDOWS = map[uint8][2]TemperatureWindow{
+	16: {{90, 110}, {95, 110}}, // soft
+	17: {{85, 105}, {90, 105}}, // medium
+	18: {{80, 100}, {85, 100}}, // hard
+	7:  {{60, 80}, {65, 85}},   // inter
+	8:  {{45, 65}, {50, 70}},   // wet
+}
+
+var DEFAULT_TYRE_TEMPERATURE_WINDOWS = [2]TemperatureWindow{{85, 105}, {90, 105}}
+
+var BRAKE_TEMPERATURE_WINDOW = TemperatureWindow{400, 900}
+
+// TemperatureLap holds the seconds each corner's tyres and brakes spent below, in and above their window, indexed [channel][corner]
+type TemperatureLap struct {
+	LapNum         uint8
+	StintNum       int
+	VisualCompound string
+	TimeS          float32
+	TimeBelowS     [TEMPERATURE_CHANNEL_COUNT][4]float32
+	TimeInWindowS  [TEMPERATURE_CHANNEL_COUNT][4]float32
+	TimeAboveS     [TEMPERATURE_CHANNEL_COUNT][4]float32
+}
+
+type TemperatureStintSummary struct {
+	StintNum        int
+	VisualCompound  string
+	StartLap        uint8
+	EndLap          uint8
+	Laps            int
+	TimeS           float32
+	InWindowPercent [TEMPERATURE_CHANNEL_COUNT][4]float32
+	BelowPercent    [TEMPERATURE_CHANNEL_COUNT][4]float32
+	AbovePercent    [TEMPERATURE_CHANNEL_COUNT][4]float32
+}
+
+type TemperatureAlert struct {
+	SessionTime float32
+	CarIndex    uint8
+	Channel     string
+	Corner      string
+	Temperature float32
+	Window      TemperatureWindow
+	State       string
+	DurationS   float32 // how long the temperature has been out of window, 0 once it's back in
+}
+
+type carTemperatureState struct {
+	lapNum         uint8
+	haveTime       bool
+	lastTime       float32
+	compound       uint8
+	stintNum       int
+	lap            *TemperatureLap
+	laps           []TemperatureLap
+	outOfWindowFor [TEMPERATURE_CHANNEL_COUNT][4]float32
+	alerted        [TEMPERATURE_CHANNEL_COUNT][4]bool
+}
+
+// TemperatureMonitor measures how long tyres and brakes spend in their operating window and alerts the player when they leave it.
+// Laps are grouped into the stints of the tyre wear model, so they match the stints of /api/tyres.
+type TemperatureMonitor struct {
+	RWLock        sync.RWMutex
+	WSS           *WebsocketServer
+	Tyres         *TyreWearModel
+	AlertDuration float32
+
+	sessionUID uint64
+	playerCar  uint8
+	cars       [F1_MAX_NUM_CARS]carTemperatureState
+}
+
+// Init takes the tyre wear model the stints come from, it has to consume every packet before the monitor does
+func (monitor *TemperatureMonitor) Init(wss *WebsocketServer, tyres *TyreWearModel, alertDuration float32) {
+	monitor.WSS = wss
+	monitor.Tyres = tyres
+	monitor.AlertDuration = alertDuration
+	monitor.Reset()
+}
+
+func (monitor *TemperatureMonitor) Reset() {
+	monitor.RWLock.Lock()
+	defer monitor.RWLock.Unlock()
+
+	monitor.reset(0)
+}
+
+func (monitor *TemperatureMonitor) SetAlertDuration(seconds float32) {
+	monitor.RWLock.Lock()
+	defer monitor.RWLock.Unlock()
+
+	monitor.AlertDuration = seconds
+}
+
+func (monitor *TemperatureMonitor) reset(sessionUID uint64) {
+	monitor.sessionUID = sessionUID
+	for i := range monitor.cars {
+		monitor.cars[i] = carTemperatureState{laps: make([]TemperatureLap, 0)}
+	}
+}
+
+func (monitor *TemperatureMonitor) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	monitor.RWLock.Lock()
+	defer monitor.RWLock.Unlock()
+
+	if header.SessionUID != monitor.sessionUID {
+		monitor.reset(header.SessionUID)
+	}
+	monitor.playerCar = header.PlayerCarIndex
+
+	switch p := packet.(type) {
+	case F1CarStatusDataPacket:
+		for i := range p.CarStatusData {
+			monitor.cars[i].compound = p.CarStatusData[i].VisualTyreCompound
+		}
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			monitor.updateStint(uint8(i))
+			monitor.processLapData(uint8(i), &p.LapData[i])
+		}
+	case F1CarTelemetryDataPacket:
+		for i := range p.CarTelemetryData {
+			monitor.processTelemetry(uint8(i), header, &p.CarTelemetryData[i])
+		}
+	}
+}
+
+func (monitor *TemperatureMonitor) updateStint(carIndex uint8) {
+	if monitor.Tyres == nil {
+		return
+	}
+
+	state := &monitor.cars[carIndex]
+	stintNum, compound := monitor.Tyres.GetActiveStintNum(carIndex)
+	if stintNum != state.stintNum && state.lap != nil {
+		state.lap.StintNum = stintNum
+		state.lap.VisualCompound = compound
+	}
+	state.stintNum = stintNum
+}
+
+func (monitor *TemperatureMonitor) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &monitor.cars[carIndex]
+	if lapData.ResultStatus < 2 || lapData.CurrentLapNum == state.lapNum {
+		return
+	}
+
+	if state.lap != nil && lapData.CurrentLapNum == state.lapNum+1 {
+		state.laps = append(state.laps, *state.lap)
+		if len(state.laps) > TEMPERATURE_MAX_LAPS_PER_CAR {
+			state.laps = state.laps[1:]
+		}
+	}
+
+	state.lapNum = lapData.CurrentLapNum
+	state.lap = &TemperatureLap{
+		LapNum:         lapData.CurrentLapNum,
+		StintNum:       state.stintNum,
+		VisualCompound: CompoundName(VISUAL_COMPOUND_NAMES, state.compound),
+	}
+}
+
+func (monitor *TemperatureMonitor) processTelemetry(carIndex uint8, header *F1PacketHeader, telemetry *F1CarTelemetryData) {
+	state := &monitor.cars[carIndex]
+
+	dt := header.SessionTime - state.lastTime
+	valid := state.haveTime && dt > 0 && dt <= TEMPERATURE_MAX_SAMPLE_GAP
+	state.haveTime = true
+	state.lastTime = header.SessionTime
+	if !valid || state.lap == nil || state.stintNum == 0 {
+		return
+	}
+
+	tyreWindows, ok := TYRE_TEMPERATURE_WINDOWS[state.compound]
+	if !ok {
+		tyreWindows = DEFAULT_TYRE_TEMPERATURE_WINDOWS
+	}
+	windows := [TEMPERATURE_CHANNEL_COUNT]TemperatureWindow{tyreWindows[0], tyreWindows[1], BRAKE_TEMPERATURE_WINDOW}
+
+	lap := state.lap
+	lap.TimeS += dt
+	for corner := 0; corner < 4; corner++ {
+		temperatures := [TEMPERATURE_CHANNEL_COUNT]float32{
+			float32(telemetry.TyresSurfaceTemperature[corner]),
+			float32(telemetry.TyresInnerTemperature[corner]),
+			float32(telemetry.BrakesTemperature[corner]),
+		}
+
+		for channel, temperature := range temperatures {
+			window := windows[channel]
+			temperatureState := TemperatureState_InWindow
+			switch {
+			case temperature < window.Min:
+				lap.TimeBelowS[channel][corner] += dt
+				temperatureState = TemperatureState_Cold
+			case temperature > window.Max:
+				lap.TimeAboveS[channel][corner] += dt
+				temperatureState = TemperatureState_Hot
+			default:
+				lap.TimeInWindowS[channel][corner] += dt
+			}
+
+			if carIndex != monitor.playerCar {
+				continue
+			}
+
+			alert := TemperatureAlert{
+				SessionTime: header.SessionTime,
+				CarIndex:    carIndex,
+				Channel:     TEMPERATURE_CHANNEL_NAMES[channel],
+				Corner:      TYRE_CORNER_NAMES[corner],
+				Temperature: temperature,
+				Window:      window,
+				State:       temperatureState,
+			}
+
+			if temperatureState == TemperatureState_InWindow {
+				// let the client know the alert is over
+				if state.alerted[channel][corner] {
+					WSSBroadcastDerived(monitor.WSS, header, PacketID_TemperatureAlert, &alert)
+				}
+				state.outOfWindowFor[channel][corner] = 0
+				state.alerted[channel][corner] = false
+				continue
+			}
+
+			state.outOfWindowFor[channel][corner] += dt
+			if !state.alerted[channel][corner] && state.outOfWindowFor[channel][corner] >= monitor.AlertDuration {
+				alert.DurationS = state.outOfWindowFor[channel][corner]
+				WSSBroadcastDerived(monitor.WSS, header, PacketID_TemperatureAlert, &alert)
+				state.alerted[channel][corner] = true
+			}
+		}
+	}
+}
+
+func (monitor *TemperatureMonitor) GetLaps(carIndex uint8) ([]TemperatureLap, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	monitor.RWLock.RLock()
+	defer monitor.RWLock.RUnlock()
+
+	return append([]TemperatureLap{}, monitor.cars[carIndex].laps...), nil
+}
+
+// GetStintSummaries adds up the completed laps of each stint of a car
+func (monitor *TemperatureMonitor) GetStintSummaries(carIndex uint8) ([]TemperatureStintSummary, error) {
+	laps, err := monitor.GetLaps(carIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]TemperatureStintSummary, 0)
+	var current *TemperatureStintSummary
+	var below, in, above [TEMPERATURE_CHANNEL_COUNT][4]float32
+
+	finish := func() {
+		if current == nil || current.TimeS <= 0 {
+			return
+		}
+		for channel := 0; channel < TEMPERATURE_CHANNEL_COUNT; channel++ {
+			for corner := 0; corner < 4; corner++ {
+				current.BelowPercent[channel][corner] = below[channel][corner] / current.TimeS * 100
+				current.InWindowPercent[channel][corner] = in[channel][corner] / current.TimeS * 100
+				current.AbovePercent[channel][corner] = above[channel][corner] / current.TimeS * 100
+			}
+		}
+		summaries = append(summaries, *current)
+	}
+
+	for _, lap := range laps {
+		if current == nil || lap.StintNum != current.StintNum {
+			finish()
+			current = &TemperatureStintSummary{StintNum: lap.StintNum, VisualCompound: lap.VisualCompound, StartLap: lap.LapNum}
+			below, in, above = [TEMPERATURE_CHANNEL_COUNT][4]float32{}, [TEMPERATURE_CHANNEL_COUNT][4]float32{}, [TEMPERATURE_CHANNEL_COUNT][4]float32{}
+		}
+
+		current.EndLap = lap.LapNum
+		current.Laps++
+		current.TimeS += lap.TimeS
+		for channel := 0; channel < TEMPERATURE_CHANNEL_COUNT; channel++ {
+			for corner := 0; corner < 4; corner++ {
+				below[channel][corner] += lap.TimeBelowS[channel][corner]
+				in[channel][corner] += lap.TimeInWindowS[channel][corner]
+				above[channel][corner] += lap.TimeAboveS[channel][corner]
+			}
+		}
+	}
+	finish()
+
+	return summaries, nil
+}
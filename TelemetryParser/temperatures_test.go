@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// subscribeTestClient adds a client to the server that only buffers the broadcast messages
+func subscribeTestClient(wss *WebsocketServer) *WebsocketClient {
+	client := &WebsocketClient{NewPacket: make(chan []byte, 1024)}
+	wss.Clients[client] = struct{}{}
+	return client
+}
+
+// receiveTemperatureAlerts decodes the alerts a test client got so far
+func receiveTemperatureAlerts(t *testing.T, client *WebsocketClient) []TemperatureAlert {
+	alerts := make([]TemperatureAlert, 0)
+	for {
+		select {
+		case data := <-client.NewPacket:
+			packet := SavedPacket[TemperatureAlert]{}
+			if err := json.Unmarshal(data, &packet); err != nil {
+				t.Fatal(err)
+			}
+			if packet.Header.PacketId == PacketID_TemperatureAlert {
+				alerts = append(alerts, packet.Body)
+			}
+		default:
+			return alerts
+		}
+	}
+}
+
+func TestTemperatureWindows(t *testing.T) {
+	wss := WebsocketServer{}
+	wss.Init()
+	client := subscribeTestClient(&wss)
+
+	tyres := &TyreWearModel{}
+	tyres.Init(t.TempDir())
+	monitor := &TemperatureMonitor{}
+	monitor.Init(&wss, tyres, TEMPERATURE_DEFAULT_ALERT_SECONDS)
+	consumers := consumerChain{tyres, monitor}
+
+	status := F1CarStatusDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+	status.CarStatusData[0].VisualTyreCompound = 16
+	status.CarStatusData[0].ActualTyreCompound = 16
+	consumers.ConsumePacket(status)
+	consumers.ConsumePacket(F1CarDamageDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}})
+
+	// one 10s lap at 10Hz: the front left surface is cold for the first 4s, everything else sits in its window.
+	// On lap 2 it's only cold for 2s, below the alert duration.
+	for lap := uint8(1); lap <= 2; lap++ {
+		lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 1}}
+		lapData.LapData[0].ResultStatus = 2
+		lapData.LapData[0].CurrentLapNum = lap
+		consumers.ConsumePacket(lapData)
+
+		for i := 0; i < 100; i++ {
+			header := &F1PacketHeader{SessionUID: 1, SessionTime: float32(lap-1)*10 + float32(i)*0.1}
+			telemetry := F1CarTelemetryDataPacket{f1PacketHeader: header}
+			for corner := 0; corner < 4; corner++ {
+				telemetry.CarTelemetryData[0].TyresSurfaceTemperature[corner] = 100
+				telemetry.CarTelemetryData[0].TyresInnerTemperature[corner] = 100
+				telemetry.CarTelemetryData[0].BrakesTemperature[corner] = 600
+			}
+			if i < 40 && lap == 1 || i < 20 && lap == 2 {
+				telemetry.CarTelemetryData[0].TyresSurfaceTemperature[2] = 70
+			}
+			consumers.ConsumePacket(telemetry)
+		}
+	}
+
+	laps, err := monitor.GetLaps(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(laps) != 1 {
+		t.Fatalf("Expected 1 completed lap, got %d\n", len(laps))
+	}
+
+	cold := laps[0].TimeBelowS[TemperatureChannel_TyreSurface][2]
+	if math.Abs(float64(cold-4)) > 0.15 || laps[0].TimeAboveS[TemperatureChannel_Brakes][0] != 0 {
+		t.Errorf("Unexpected time out of window - %.2fs cold\n", cold)
+	}
+
+	stints, err := monitor.GetStintSummaries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stints) != 1 || stints[0].VisualCompound != "Soft" || math.Abs(float64(stints[0].InWindowPercent[TemperatureChannel_TyreSurface][2]-60)) > 2 {
+		t.Errorf("Unexpected stint summary - %+v\n", stints)
+	}
+
+	// the tyre wear model numbers the stint
+	if tyreStints, _ := tyres.GetStints(0, 0); len(tyreStints) != 1 || stints[0].StintNum != tyreStints[0].StintNum {
+		t.Errorf("Expected the stint of the tyre wear model - %+v\n", tyreStints)
+	}
+
+	// an alert once the surface has been cold for 3s, and one when it's back in its window
+	alerts := receiveTemperatureAlerts(t, client)
+	if len(alerts) != 2 {
+		t.Fatalf("Expected an alert and its end, got %+v\n", alerts)
+	}
+	if alerts[0].State != TemperatureState_Cold || alerts[0].Corner != TYRE_CORNER_NAMES[2] || alerts[0].Channel != "tyre surface" ||
+		alerts[0].DurationS < TEMPERATURE_DEFAULT_ALERT_SECONDS || alerts[0].SessionTime > 3.15 {
+		t.Errorf("Unexpected alert - %+v\n", alerts[0])
+	}
+	if alerts[1].State != TemperatureState_InWindow || alerts[1].Corner != TYRE_CORNER_NAMES[2] || alerts[1].DurationS != 0 || alerts[1].SessionTime != 4 {
+		t.Errorf("Expected the alert to clear when the surface warmed up - %+v\n", alerts[1])
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	TIMING_DEFAULT_MINI_SECTORS       = 24
+	TIMING_MAX_MINI_SECTORS           = 500 // about 14m each at Spa, the longest track
+	TIMING_BROADCAST_INTERVAL_SECONDS = 0.5 // the tower is broadcast at most this often, and only when something changed
+)
+
+const (
+	TimingStatus_OverallBest  = "purple"
+	TimingStatus_PersonalBest = "green"
+	TimingStatus_Slower       = "yellow"
+)
+
+type TimedSegment struct {
+	TimeInMS uint32
+	Status   string
+}
+
+type LapTiming struct {
+	LapNum      uint8
+	LapTimeInMS uint32
+	Valid       bool
+	Sectors     [3]TimedSegment
+	MiniSectors []TimedSegment
+}
+
+type CarTiming struct {
+	CarIndex                       uint8
+	Laps                           []LapTiming // completed laps
+	BestLapTimeInMS                uint32
+	BestSectors                    [3]uint32
+	BestMiniSectors                []uint32
+	TheoreticalBestInMS            uint32 // sum of the personal best sectors, 0 until all are set
+	TheoreticalBestMiniSectorsInMS uint32 // sum of the personal best mini-sectors, 0 until all are set
+}
+
+// CarTimingSummary is one row of the timing tower
+type CarTimingSummary struct {
+	CarIndex            uint8
+	Position            uint8
+	CurrentLap          LapTiming
+	LastLap             *LapTiming
+	BestLapTimeInMS     uint32
+	BestSectors         [3]uint32
+	TheoreticalBestInMS uint32
+}
+
+type TimingTower struct {
+	MiniSectorCount            int
+	TrackLength                float32
+	OverallBestLapTimeInMS     uint32
+	OverallBestSectors         [3]uint32
+	OverallBestMiniSectors     []uint32
+	OverallTheoreticalBestInMS uint32
+	Cars                       []CarTimingSummary
+}
+
+type carTimingState struct {
+	Timing       CarTiming
+	Current      LapTiming
+	Position     uint8
+	LastSector   uint8
+	LastDistance float32
+	LastTime     float32
+	SegmentStart float32 // session time the current mini-sector started at, < 0 if mini-sector timing is suspended for this lap
+	OnGrid       bool    // lap 1 started behind the line, mini-sectors are timed from crossing it
+	HaveSample   bool
+}
+
+// TimingEngine keeps the sector and mini-sector history of every car and works out personal and overall bests
+type TimingEngine struct {
+	RWLock          sync.RWMutex
+	WSS             *WebsocketServer
+	MiniSectorCount int
+
+	sessionUID             uint64
+	trackLength            float32
+	cars                   [F1_MAX_NUM_CARS]carTimingState
+	overallBestLap         uint32
+	overallBestSectors     [3]uint32
+	overallBestMiniSectors []uint32
+	dirty                  bool
+	lastBroadcast          float32
+}
+
+func (engine *TimingEngine) Init(wss *WebsocketServer, miniSectorCount int) {
+	engine.WSS = wss
+	engine.MiniSectorCount = miniSectorCount
+	engine.Reset()
+}
+
+func (engine *TimingEngine) Reset() {
+	engine.RWLock.Lock()
+	defer engine.RWLock.Unlock()
+
+	engine.reset(0)
+}
+
+func (engine *TimingEngine) SetMiniSectorCount(count int) error {
+	if count < 1 || count > TIMING_MAX_MINI_SECTORS {
+		return fmt.Errorf("mini-sector count has to be between 1 and %d, got %d", TIMING_MAX_MINI_SECTORS, count)
+	}
+
+	engine.RWLock.Lock()
+	defer engine.RWLock.Unlock()
+
+	engine.MiniSectorCount = count
+	engine.reset(engine.sessionUID)
+	return nil
+}
+
+func (engine *TimingEngine) reset(sessionUID uint64) {
+	engine.sessionUID = sessionUID
+	engine.trackLength = 0
+	engine.overallBestLap = 0
+	engine.overallBestSectors = [3]uint32{}
+	engine.overallBestMiniSectors = make([]uint32, engine.MiniSectorCount)
+	engine.dirty = false
+	engine.lastBroadcast = 0
+	for i := range engine.cars {
+		engine.cars[i] = carTimingState{Timing: CarTiming{CarIndex: uint8(i), Laps: make([]LapTiming, 0), BestMiniSectors: make([]uint32, engine.MiniSectorCount)}}
+	}
+}
+
+func (engine *TimingEngine) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	engine.RWLock.Lock()
+	defer engine.RWLock.Unlock()
+
+	if header.SessionUID != engine.sessionUID {
+		engine.reset(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		engine.trackLength = float32(p.SessionData.TrackLength)
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			engine.processLapData(&engine.cars[i], header.SessionTime, &p.LapData[i])
+		}
+
+		if engine.dirty && BroadcastDue(&engine.lastBroadcast, header.SessionTime, TIMING_BROADCAST_INTERVAL_SECONDS) {
+			WSSBroadcastDerived(engine.WSS, header, PacketID_TimingTower, engine.tower())
+			engine.dirty = false
+		}
+	}
+}
+
+func (engine *TimingEngine) processLapData(state *carTimingState, sessionTime float32, lapData *F1LapData) {
+	state.Position = lapData.CarPosition
+	if lapData.ResultStatus < 2 {
+		return // car isn't taking part
+	}
+
+	if lapData.CurrentLapNum != state.Current.LapNum {
+		if state.HaveSample && state.Current.LapNum != 0 && lapData.CurrentLapNum == state.Current.LapNum+1 {
+			engine.closeLap(state, sessionTime, lapData)
+		} else {
+			state.SegmentStart = -1 // joined mid-lap or skipped laps, mini-sectors are timed from the next line crossing
+		}
+		state.OnGrid = state.Current.LapNum == 0 && lapData.CurrentLapNum == 1 && lapData.LapDistance < 0
+
+		state.Current = LapTiming{LapNum: lapData.CurrentLapNum, Valid: true, MiniSectors: make([]TimedSegment, 0, engine.MiniSectorCount)}
+		state.LastSector = 0
+	}
+
+	if lapData.CurrentLapInvalid == 1 {
+		state.Current.Valid = false
+	}
+
+	if lapData.Sector != state.LastSector {
+		if lapData.Sector == 1 && state.LastSector == 0 {
+			engine.completeSector(state, 0, uint32(lapData.Sector1TimeMinutes)*60000+uint32(lapData.Sector1TimeInMS))
+		} else if lapData.Sector == 2 && state.LastSector == 1 {
+			engine.completeSector(state, 1, uint32(lapData.Sector2TimeMinutes)*60000+uint32(lapData.Sector2TimeInMS))
+		}
+		state.LastSector = lapData.Sector
+	}
+
+	engine.processMiniSectors(state, sessionTime, lapData.LapDistance)
+	state.HaveSample = true
+}
+
+func (engine *TimingEngine) processMiniSectors(state *carTimingState, sessionTime float32, distance float32) {
+	defer func() {
+		state.LastDistance = distance
+		state.LastTime = sessionTime
+	}()
+
+	if state.OnGrid && distance >= 0 {
+		// the start from the grid is the first line crossing
+		state.OnGrid = false
+		state.SegmentStart = state.LastTime
+		if state.LastDistance < 0 {
+			state.SegmentStart += (sessionTime - state.LastTime) * -state.LastDistance / (distance - state.LastDistance)
+		}
+	}
+
+	if engine.trackLength <= 0 || engine.MiniSectorCount <= 0 || distance < 0 || state.SegmentStart < 0 {
+		return
+	}
+
+	if distance < state.LastDistance-LAP_TRACE_FLASHBACK_DISTANCE {
+		state.SegmentStart = -1 // flashback, timing resumes on the next lap
+		return
+	}
+
+	segmentLength := engine.trackLength / float32(engine.MiniSectorCount)
+	for {
+		index := len(state.Current.MiniSectors)
+		boundary := segmentLength * float32(index+1)
+		if index >= engine.MiniSectorCount-1 || distance < boundary {
+			break // the last mini-sector is closed by the line
+		}
+
+		crossing := state.LastTime
+		if distance > state.LastDistance && state.LastDistance < boundary {
+			crossing += (sessionTime - state.LastTime) * (boundary - state.LastDistance) / (distance - state.LastDistance)
+		}
+		engine.completeMiniSector(state, index, crossing)
+	}
+}
+
+func (engine *TimingEngine) completeMiniSector(state *carTimingState, index int, crossing float32) {
+	timeInMS := uint32((crossing - state.SegmentStart) * 1000)
+	state.SegmentStart = crossing
+
+	segment := TimedSegment{timeInMS, TimingStatus_Slower}
+	if state.Current.Valid {
+		segment.Status = updateBests(&engine.overallBestMiniSectors[index], &state.Timing.BestMiniSectors[index], timeInMS)
+	}
+	state.Current.MiniSectors = append(state.Current.MiniSectors, segment)
+	engine.dirty = true
+}
+
+func (engine *TimingEngine) completeSector(state *carTimingState, sector int, timeInMS uint32) {
+	if timeInMS == 0 {
+		return
+	}
+
+	segment := TimedSegment{timeInMS, TimingStatus_Slower}
+	if state.Current.Valid {
+		segment.Status = updateBests(&engine.overallBestSectors[sector], &state.Timing.BestSectors[sector], timeInMS)
+	}
+	state.Current.Sectors[sector] = segment
+	engine.dirty = true
+}
+
+func (engine *TimingEngine) closeLap(state *carTimingState, sessionTime float32, lapData *F1LapData) {
+	lap := &state.Current
+	lap.LapTimeInMS = lapData.LastLapTimeInMS
+
+	if lap.Sectors[0].TimeInMS > 0 && lap.Sectors[1].TimeInMS > 0 && lap.LapTimeInMS > lap.Sectors[0].TimeInMS+lap.Sectors[1].TimeInMS {
+		engine.completeSector(state, 2, lap.LapTimeInMS-lap.Sectors[0].TimeInMS-lap.Sectors[1].TimeInMS)
+	}
+
+	// the line closes the last mini-sector and opens the first one of the next lap,
+	// its crossing is interpolated between the last sample of this lap and the first one of the next
+	lineCrossing := float32(-1)
+	if engine.trackLength > 0 && lapData.LapDistance >= 0 && lapData.LapDistance < LAP_TRACE_START_TOLERANCE {
+		lineCrossing = state.LastTime
+		if toLine := engine.trackLength - state.LastDistance; toLine > 0 {
+			lineCrossing += (sessionTime - state.LastTime) * toLine / (toLine + lapData.LapDistance)
+		}
+	}
+	if state.SegmentStart >= 0 && lineCrossing >= 0 && len(lap.MiniSectors) == engine.MiniSectorCount-1 {
+		engine.completeMiniSector(state, engine.MiniSectorCount-1, lineCrossing)
+	}
+
+	if lap.Valid && lap.LapTimeInMS > 0 {
+		if state.Timing.BestLapTimeInMS == 0 || lap.LapTimeInMS < state.Timing.BestLapTimeInMS {
+			state.Timing.BestLapTimeInMS = lap.LapTimeInMS
+		}
+		if engine.overallBestLap == 0 || lap.LapTimeInMS < engine.overallBestLap {
+			engine.overallBestLap = lap.LapTimeInMS
+		}
+	}
+
+	state.Timing.TheoreticalBestInMS = sumIfComplete(state.Timing.BestSectors[:])
+	state.Timing.TheoreticalBestMiniSectorsInMS = sumIfComplete(state.Timing.BestMiniSectors)
+	state.Timing.Laps = append(state.Timing.Laps, *lap)
+
+	state.SegmentStart = lineCrossing
+	state.LastDistance = 0
+	engine.dirty = true
+}
+
+// updateBests records a new segment time and returns its colour
+func updateBests(overallBest *uint32, personalBest *uint32, timeInMS uint32) string {
+	status := TimingStatus_Slower
+	if *personalBest == 0 || timeInMS < *personalBest {
+		*personalBest = timeInMS
+		status = TimingStatus_PersonalBest
+	}
+	if *overallBest == 0 || timeInMS < *overallBest {
+		*overallBest = timeInMS
+		status = TimingStatus_OverallBest
+	}
+	return status
+}
+
+func sumIfComplete(times []uint32) uint32 {
+	sum := uint32(0)
+	for _, t := range times {
+		if t == 0 {
+			return 0
+		}
+		sum += t
+	}
+	return sum
+}
+
+func (engine *TimingEngine) tower() *TimingTower {
+	tower := &TimingTower{
+		MiniSectorCount:            engine.MiniSectorCount,
+		TrackLength:                engine.trackLength,
+		OverallBestLapTimeInMS:     engine.overallBestLap,
+		OverallBestSectors:         engine.overallBestSectors,
+		OverallBestMiniSectors:     append([]uint32{}, engine.overallBestMiniSectors...),
+		OverallTheoreticalBestInMS: sumIfComplete(engine.overallBestSectors[:]),
+		Cars:                       make([]CarTimingSummary, 0, F1_MAX_NUM_CARS),
+	}
+
+	for i := range engine.cars {
+		state := &engine.cars[i]
+		if !state.HaveSample {
+			continue
+		}
+
+		summary := CarTimingSummary{
+			CarIndex:            uint8(i),
+			Position:            state.Position,
+			CurrentLap:          state.Current,
+			BestLapTimeInMS:     state.Timing.BestLapTimeInMS,
+			BestSectors:         state.Timing.BestSectors,
+			TheoreticalBestInMS: state.Timing.TheoreticalBestInMS,
+		}
+		summary.CurrentLap.MiniSectors = append([]TimedSegment{}, state.Current.MiniSectors...)
+		if n := len(state.Timing.Laps); n > 0 {
+			last := state.Timing.Laps[n-1]
+			summary.LastLap = &last
+		}
+		tower.Cars = append(tower.Cars, summary)
+	}
+
+	return tower
+}
+
+func (engine *TimingEngine) GetTower() *TimingTower {
+	engine.RWLock.RLock()
+	defer engine.RWLock.RUnlock()
+
+	return engine.tower()
+}
+
+func (engine *TimingEngine) GetCarTiming(carIndex uint8) (*CarTiming, error) {
+	if carIndex >= F1_MAX_NUM_CARS {
+		return nil, fmt.Errorf("invalid car index %d", carIndex)
+	}
+
+	engine.RWLock.RLock()
+	defer engine.RWLock.RUnlock()
+
+	timing := engine.cars[carIndex].Timing
+	timing.Laps = append([]LapTiming{}, timing.Laps...)
+	timing.BestMiniSectors = append([]uint32{}, timing.BestMiniSectors...)
+	return &timing, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTimingEngine(t *testing.T) {
+	wss := WebsocketServer{}
+	wss.Init()
+
+	engine := TimingEngine{}
+	engine.Init(&wss, 4)
+	feedSyntheticLaps(&engine, 2)
+
+	timing, err := engine.GetCarTiming(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(timing.Laps) != 2 {
+		t.Fatalf("Expected 2 completed laps, got %d\n", len(timing.Laps))
+	}
+
+	// lap 1 is joined at the line, so only lap 2 has mini-sectors: 250m at 50m/s each
+	if len(timing.Laps[0].MiniSectors) != 0 || len(timing.Laps[1].MiniSectors) != 4 {
+		t.Fatalf("Unexpected mini-sector counts - %d, %d\n", len(timing.Laps[0].MiniSectors), len(timing.Laps[1].MiniSectors))
+	}
+
+	for i, segment := range timing.Laps[1].MiniSectors {
+		if segment.TimeInMS < 4990 || segment.TimeInMS > 5010 || segment.Status != TimingStatus_OverallBest {
+			t.Errorf("Mini-sector %d - %dms (%s)\n", i, segment.TimeInMS, segment.Status)
+		}
+	}
+
+	sectors := timing.Laps[1].Sectors
+	if sectors[0].TimeInMS != 6000 || sectors[1].TimeInMS != 7000 || sectors[2].TimeInMS != 7000 {
+		t.Errorf("Unexpected sector times - %v\n", sectors)
+	}
+
+	// equal sector times on lap 2 are neither a personal nor an overall best
+	if sectors[0].Status != TimingStatus_Slower || timing.TheoreticalBestInMS != 20000 {
+		t.Errorf("Unexpected bests - sector 1 %s, theoretical best %d\n", sectors[0].Status, timing.TheoreticalBestInMS)
+	}
+
+	for _, count := range []int{0, -1, TIMING_MAX_MINI_SECTORS + 1} {
+		if engine.SetMiniSectorCount(count) == nil {
+			t.Errorf("Expected %d mini-sectors to be rejected\n", count)
+		}
+	}
+}
+
+func TestTimingEngineGridStart(t *testing.T) {
+	wss := WebsocketServer{}
+	wss.Init()
+
+	engine := TimingEngine{}
+	engine.Init(&wss, 4)
+
+	sessionHeader := F1PacketHeader{PacketId: PacketID_Session, SessionUID: 7}
+	session := F1SessionDataPacket{f1PacketHeader: &sessionHeader}
+	session.SessionData.TrackLength = 1000
+	engine.ConsumePacket(session)
+
+	// the car starts 60m behind the line and runs at 50m/s into lap 2
+	sessionTime := float32(0)
+	for d := float32(-60); d < 1010; d += 2.5 {
+		header := F1PacketHeader{PacketId: PacketID_LapData, SessionUID: 7, SessionTime: sessionTime}
+		lapData := F1LapDataPacket{f1PacketHeader: &header}
+		lapData.LapData[0].CurrentLapNum = 1
+		lapData.LapData[0].LapDistance = d
+		lapData.LapData[0].ResultStatus = 2
+		if d >= 1000 {
+			lapData.LapData[0].CurrentLapNum = 2
+			lapData.LapData[0].LapDistance = d - 1000
+			lapData.LapData[0].LastLapTimeInMS = 20000
+		}
+		engine.ConsumePacket(lapData)
+		sessionTime += 0.05
+	}
+
+	timing, err := engine.GetCarTiming(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(timing.Laps) != 1 || len(timing.Laps[0].MiniSectors) != 4 {
+		t.Fatalf("Expected lap 1 to have 4 mini-sectors - %v\n", timing.Laps)
+	}
+
+	for i, segment := range timing.Laps[0].MiniSectors {
+		if segment.TimeInMS < 4990 || segment.TimeInMS > 5010 {
+			t.Errorf("Mini-sector %d - %dms\n", i, segment.TimeInMS)
+		}
+	}
+}
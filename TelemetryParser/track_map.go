@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	TRACK_DATA_DIR             = "track_data"
+	TRACK_MAP_DISTANCE_STEP    = 5  // metres between two points of the centerline
+	TRACK_MAP_SMOOTHING_WINDOW = 3  // points on either side averaged when smoothing
+	TRACK_MAP_MAX_LAPS         = 10 // clean laps averaged into a map before it's considered final
+	TRACK_MAP_SVG_SIZE         = 1000
+)
+
+type TrackMapPoint struct {
+	Distance float32
+	X        float32
+	Y        float32 // elevation
+	Z        float32
+}
+
+type TrackMap struct {
+	TrackId      int8
+	TrackLength  float32
+	DistanceStep float32
+	LapsUsed     int
+	Points       []TrackMapPoint
+	MinX         float32
+	MaxX         float32
+	MinZ         float32
+	MaxZ         float32
+}
+
+// TrackCarPosition is where a car is on the map, X/Y/Z are world coordinates and SVGX/SVGY the same point in the viewbox of TrackMap.SVG
+type TrackCarPosition struct {
+	CarIndex    uint8
+	Position    uint8
+	LapDistance float32
+	X           float32
+	Y           float32
+	Z           float32
+	SVGX        float32
+	SVGY        float32
+}
+
+type TrackCarPositions struct {
+	TrackId int8
+	Cars    []TrackCarPosition
+}
+
+type trackMapBin struct {
+	SumX, SumY, SumZ float64
+	Count            int
+}
+
+type carTrackMapState struct {
+	LapNum uint8
+	Clean  bool
+	Bins   []trackMapBin
+}
+
+// TrackMapBuilder averages the world positions of every car's clean laps into a centerline per track
+type TrackMapBuilder struct {
+	RWLock  sync.RWMutex
+	DataDir string
+
+	trackId     int8
+	trackLength float32
+	lapData     [F1_MAX_NUM_CARS]F1LapData
+	haveLapData bool
+	motion      [F1_MAX_NUM_CARS]F1CarMotionData
+	haveMotion  bool
+	cars        [F1_MAX_NUM_CARS]carTrackMapState
+	accumulated map[int8][]trackMapBin // sum of the per lap averages of all clean laps so far
+	maps        map[int8]*TrackMap
+}
+
+func (builder *TrackMapBuilder) Init(dataDir string) {
+	builder.DataDir = dataDir
+	builder.accumulated = make(map[int8][]trackMapBin)
+	builder.maps = make(map[int8]*TrackMap)
+	builder.Reset()
+}
+
+func (builder *TrackMapBuilder) Reset() {
+	builder.RWLock.Lock()
+	defer builder.RWLock.Unlock()
+
+	builder.trackId = -1
+	builder.haveLapData = false
+	builder.haveMotion = false
+	for i := range builder.cars {
+		builder.cars[i] = carTrackMapState{}
+	}
+}
+
+func (builder *TrackMapBuilder) ConsumePacket(packet F1Packet) {
+	builder.RWLock.Lock()
+	defer builder.RWLock.Unlock()
+
+	switch p := packet.(type) {
+	case F1SessionDataPacket:
+		if p.SessionData.TrackId != builder.trackId {
+			builder.trackId = p.SessionData.TrackId
+			for i := range builder.cars {
+				builder.cars[i] = carTrackMapState{}
+			}
+		}
+		builder.trackLength = float32(p.SessionData.TrackLength)
+	case F1LapDataPacket:
+		for i := range p.LapData {
+			builder.processLapData(uint8(i), &p.LapData[i])
+		}
+		builder.lapData = p.LapData
+		builder.haveLapData = true
+	case F1CarMotionDataPacket:
+		builder.motion = p.CarMotionData
+		builder.haveMotion = true
+		if !builder.haveLapData || builder.trackId < 0 {
+			return
+		}
+		for i := range p.CarMotionData {
+			builder.processMotion(uint8(i), &p.CarMotionData[i])
+		}
+	}
+}
+
+func (builder *TrackMapBuilder) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &builder.cars[carIndex]
+
+	if lapData.CurrentLapNum != state.LapNum {
+		if state.Clean && state.LapNum != 0 && lapData.CurrentLapNum == state.LapNum+1 {
+			builder.addCleanLap(state.Bins)
+		}
+
+		// a lap only counts if we see it from the start
+		*state = carTrackMapState{LapNum: lapData.CurrentLapNum, Clean: lapData.LapDistance < LAP_TRACE_START_TOLERANCE}
+	}
+
+	if lapData.CurrentLapInvalid == 1 || lapData.PitStatus != 0 || lapData.DriverStatus == 0 {
+		state.Clean = false
+	}
+}
+
+func (builder *TrackMapBuilder) processMotion(carIndex uint8, motion *F1CarMotionData) {
+	state := &builder.cars[carIndex]
+	distance := builder.lapData[carIndex].LapDistance
+	if !state.Clean || distance < 0 {
+		return
+	}
+
+	bin := int(distance / TRACK_MAP_DISTANCE_STEP)
+	for len(state.Bins) <= bin {
+		state.Bins = append(state.Bins, trackMapBin{})
+	}
+
+	b := &state.Bins[bin]
+	b.SumX += float64(motion.WorldPositionX)
+	b.SumY += float64(motion.WorldPositionY)
+	b.SumZ += float64(motion.WorldPositionZ)
+	b.Count += 1
+}
+
+func (builder *TrackMapBuilder) addCleanLap(bins []trackMapBin) {
+	if builder.trackLength > 0 && float32(len(bins))*TRACK_MAP_DISTANCE_STEP < builder.trackLength*0.95 {
+		return // lap ended early, e.g. the session was restarted
+	}
+
+	// a map saved by an earlier run is refined, not replaced
+	if m, err := builder.getTrackMap(builder.trackId); err == nil && m.LapsUsed >= TRACK_MAP_MAX_LAPS {
+		return
+	}
+
+	lap := fillTrackMapGaps(bins)
+	if lap == nil {
+		return
+	}
+
+	acc := builder.accumulated[builder.trackId]
+	if acc == nil {
+		if m, ok := builder.maps[builder.trackId]; ok {
+			acc = m.toAccumulator() // continue refining a map loaded from disk
+		}
+	}
+	for len(acc) < len(lap) {
+		acc = append(acc, trackMapBin{})
+	}
+	for i := range lap {
+		acc[i].SumX += lap[i].SumX
+		acc[i].SumY += lap[i].SumY
+		acc[i].SumZ += lap[i].SumZ
+		acc[i].Count += 1
+	}
+	builder.accumulated[builder.trackId] = acc
+
+	trackMap := buildTrackMap(builder.trackId, builder.trackLength, acc)
+	builder.maps[builder.trackId] = trackMap
+
+	if trackMap.LapsUsed == 1 || trackMap.LapsUsed == TRACK_MAP_MAX_LAPS {
+		err := trackMap.Save(builder.DataDir)
+		if err != nil {
+			Log.Printf("Failed to save track map for track %d - %s\n", builder.trackId, err)
+		}
+	}
+}
+
+// fillTrackMapGaps averages every bin of a lap and interpolates bins without samples, returns nil if the lap has no samples
+func fillTrackMapGaps(bins []trackMapBin) []trackMapBin {
+	lap := make([]trackMapBin, len(bins))
+	last := -1
+	for i, b := range bins {
+		if b.Count == 0 {
+			continue
+		}
+
+		n := float64(b.Count)
+		lap[i] = trackMapBin{b.SumX / n, b.SumY / n, b.SumZ / n, 1}
+		if last >= 0 && last < i-1 {
+			for j := last + 1; j < i; j++ {
+				t := float64(j-last) / float64(i-last)
+				lap[j] = trackMapBin{
+					lap[last].SumX + (lap[i].SumX-lap[last].SumX)*t,
+					lap[last].SumY + (lap[i].SumY-lap[last].SumY)*t,
+					lap[last].SumZ + (lap[i].SumZ-lap[last].SumZ)*t,
+					1,
+				}
+			}
+		} else if last < 0 {
+			for j := 0; j < i; j++ {
+				lap[j] = lap[i]
+			}
+		}
+		last = i
+	}
+
+	if last < 0 {
+		return nil
+	}
+	for j := last + 1; j < len(lap); j++ {
+		lap[j] = lap[last]
+	}
+	return lap
+}
+
+// buildTrackMap averages the accumulated laps and smooths the result with a moving average that wraps around the line
+func buildTrackMap(trackId int8, trackLength float32, acc []trackMapBin) *TrackMap {
+	n := len(acc)
+	trackMap := &TrackMap{TrackId: trackId, TrackLength: trackLength, DistanceStep: TRACK_MAP_DISTANCE_STEP, Points: make([]TrackMapPoint, n)}
+
+	for i := 0; i < n; i++ {
+		var x, y, z float64
+		count := 0
+		for k := -TRACK_MAP_SMOOTHING_WINDOW; k <= TRACK_MAP_SMOOTHING_WINDOW; k++ {
+			b := acc[((i+k)%n+n)%n]
+			if b.Count == 0 {
+				continue
+			}
+			x += b.SumX / float64(b.Count)
+			y += b.SumY / float64(b.Count)
+			z += b.SumZ / float64(b.Count)
+			count++
+		}
+
+		if acc[i].Count > trackMap.LapsUsed {
+			trackMap.LapsUsed = acc[i].Count
+		}
+
+		c := float64(count)
+		trackMap.Points[i] = TrackMapPoint{float32(i) * TRACK_MAP_DISTANCE_STEP, float32(x / c), float32(y / c), float32(z / c)}
+	}
+
+	trackMap.computeBounds()
+	return trackMap
+}
+
+func (trackMap *TrackMap) computeBounds() {
+	trackMap.MinX, trackMap.MinZ = math.MaxFloat32, math.MaxFloat32
+	trackMap.MaxX, trackMap.MaxZ = -math.MaxFloat32, -math.MaxFloat32
+	for _, p := range trackMap.Points {
+		trackMap.MinX = float32(math.Min(float64(trackMap.MinX), float64(p.X)))
+		trackMap.MaxX = float32(math.Max(float64(trackMap.MaxX), float64(p.X)))
+		trackMap.MinZ = float32(math.Min(float64(trackMap.MinZ), float64(p.Z)))
+		trackMap.MaxZ = float32(math.Max(float64(trackMap.MaxZ), float64(p.Z)))
+	}
+}
+
+func (trackMap *TrackMap) toAccumulator() []trackMapBin {
+	acc := make([]trackMapBin, len(trackMap.Points))
+	n := float64(trackMap.LapsUsed)
+	for i, p := range trackMap.Points {
+		acc[i] = trackMapBin{float64(p.X) * n, float64(p.Y) * n, float64(p.Z) * n, trackMap.LapsUsed}
+	}
+	return acc
+}
+
+// PositionAtDistance interpolates the centerline position at a lap distance, a map without points returns the origin
+func (trackMap *TrackMap) PositionAtDistance(distance float32) TrackMapPoint {
+	n := len(trackMap.Points)
+	if n == 0 {
+		return TrackMapPoint{Distance: distance}
+	}
+	pos := distance / trackMap.DistanceStep
+	if !(pos > 0) {
+		pos = 0 // also catches the NaN of a map without a distance step
+	}
+	if pos >= float32(n-1) {
+		return trackMap.Points[n-1]
+	}
+
+	i := int(pos)
+
+	a, b := trackMap.Points[i], trackMap.Points[i+1]
+	t := pos - float32(i)
+	return TrackMapPoint{distance, Lerp(a.X, b.X, t), Lerp(a.Y, b.Y, t), Lerp(a.Z, b.Z, t)}
+}
+
+func TrackDataPath(dataDir string, trackId int8, kind string) string {
+	return filepath.Join(dataDir, fmt.Sprintf("track_%d_%s.json", trackId, kind))
+}
+
+func (trackMap *TrackMap) Save(dataDir string) error {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(trackMap)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(TrackDataPath(dataDir, trackMap.TrackId, "map"), data, 0644)
+}
+
+func LoadTrackMap(dataDir string, trackId int8) (*TrackMap, error) {
+	data, err := os.ReadFile(TrackDataPath(dataDir, trackId, "map"))
+	if err != nil {
+		return nil, err
+	}
+
+	trackMap := &TrackMap{}
+	err = json.Unmarshal(data, trackMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return trackMap, nil
+}
+
+// GetTrackMap returns the map of a track, building it from disk if this session hasn't produced one. -1 selects the current track.
+func (builder *TrackMapBuilder) GetTrackMap(trackId int8) (*TrackMap, error) {
+	builder.RWLock.Lock()
+	defer builder.RWLock.Unlock()
+
+	if trackId < 0 {
+		trackId = builder.trackId
+		if trackId < 0 {
+			return nil, fmt.Errorf("no active session")
+		}
+	}
+
+	return builder.getTrackMap(trackId)
+}
+
+func (builder *TrackMapBuilder) getTrackMap(trackId int8) (*TrackMap, error) {
+	if trackMap, ok := builder.maps[trackId]; ok {
+		return trackMap, nil
+	}
+
+	trackMap, err := LoadTrackMap(builder.DataDir, trackId)
+	if err != nil {
+		return nil, fmt.Errorf("no map for track %d yet", trackId)
+	}
+
+	builder.maps[trackId] = trackMap
+	return trackMap, nil
+}
+
+func (builder *TrackMapBuilder) CurrentTrackId() int8 {
+	builder.RWLock.RLock()
+	defer builder.RWLock.RUnlock()
+
+	return builder.trackId
+}
+
+// svgScale returns the factor world coordinates are scaled by to fit the viewbox, 0 if the map has no extent to scale
+func (trackMap *TrackMap) svgScale() float32 {
+	size := math.Max(float64(trackMap.MaxX-trackMap.MinX), float64(trackMap.MaxZ-trackMap.MinZ))
+	if len(trackMap.Points) == 0 || !(size > 0) {
+		return 0
+	}
+	return float32(TRACK_MAP_SVG_SIZE / size)
+}
+
+// SVGPoint converts world coordinates to the viewbox of SVG
+func (trackMap *TrackMap) SVGPoint(x float32, z float32) (float32, float32) {
+	scale := trackMap.svgScale()
+	return (x - trackMap.MinX) * scale, (z - trackMap.MinZ) * scale
+}
+
+// SVG renders the centerline as a closed path, scaled to fit a TRACK_MAP_SVG_SIZE square viewbox. A map without
+// any extent renders as an empty viewbox.
+func (trackMap *TrackMap) SVG() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="-10 -10 %d %d">`, TRACK_MAP_SVG_SIZE+20, TRACK_MAP_SVG_SIZE+20)
+	if trackMap.svgScale() == 0 {
+		sb.WriteString(`</svg>`)
+		return sb.String()
+	}
+
+	sb.WriteString(`<path fill="none" stroke="black" stroke-width="6" stroke-linejoin="round" d="`)
+	for i, p := range trackMap.Points {
+		command := "L"
+		if i == 0 {
+			command = "M"
+		}
+		x, y := trackMap.SVGPoint(p.X, p.Z)
+		fmt.Fprintf(&sb, "%s%.1f %.1f ", command, x, y)
+	}
+	sb.WriteString(`Z"/></svg>`)
+
+	return sb.String()
+}
+
+// GetCarPositions returns where every car taking part is on the map of the current track
+func (builder *TrackMapBuilder) GetCarPositions() (*TrackCarPositions, error) {
+	builder.RWLock.Lock()
+	defer builder.RWLock.Unlock()
+
+	if builder.trackId < 0 || !builder.haveLapData || !builder.haveMotion {
+		return nil, fmt.Errorf("no active session")
+	}
+
+	trackMap, err := builder.getTrackMap(builder.trackId)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := &TrackCarPositions{TrackId: builder.trackId, Cars: make([]TrackCarPosition, 0, F1_MAX_NUM_CARS)}
+	for i := range builder.lapData {
+		lapData, motion := &builder.lapData[i], &builder.motion[i]
+		if lapData.ResultStatus < 2 {
+			continue
+		}
+
+		car := TrackCarPosition{
+			CarIndex:    uint8(i),
+			Position:    lapData.CarPosition,
+			LapDistance: lapData.LapDistance,
+			X:           motion.WorldPositionX,
+			Y:           motion.WorldPositionY,
+			Z:           motion.WorldPositionZ,
+		}
+		car.SVGX, car.SVGY = trackMap.SVGPoint(car.X, car.Z)
+		positions.Cars = append(positions.Cars, car)
+	}
+	return positions, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFillTrackMapGaps(t *testing.T) {
+	bins := []trackMapBin{{}, {20, 2, 40, 2}, {}, {}, {40, 4, 80, 1}, {}}
+	lap := fillTrackMapGaps(bins)
+
+	expectedX := []float64{10, 10, 20, 30, 40, 40}
+	for i, b := range lap {
+		if b.Count != 1 || b.SumX != expectedX[i] {
+			t.Errorf("Bin %d - %+v, expected X %f\n", i, b, expectedX[i])
+		}
+	}
+	if math.Abs(lap[2].SumZ-40) > 1e-9 || math.Abs(lap[3].SumY-3) > 1e-9 {
+		t.Errorf("Expected the gap to be interpolated on every axis - %+v\n", lap[2:4])
+	}
+
+	if fillTrackMapGaps(make([]trackMapBin, 4)) != nil {
+		t.Errorf("Expected no lap without samples\n")
+	}
+}
+
+func TestBuildTrackMap(t *testing.T) {
+	// two laps accumulated on a square, smoothing has to wrap around the line
+	acc := make([]trackMapBin, 40)
+	for i := range acc {
+		x, z := float64(i%10), 0.0
+		switch i / 10 {
+		case 1:
+			x, z = 10, float64(i%10)
+		case 2:
+			x, z = float64(10-i%10), 10
+		case 3:
+			x, z = 0, float64(10-i%10)
+		}
+		acc[i] = trackMapBin{2 * x, 0, 2 * z, 2}
+	}
+
+	trackMap := buildTrackMap(3, 200, acc)
+	if trackMap.LapsUsed != 2 || len(trackMap.Points) != 40 || trackMap.Points[39].Distance != 195 {
+		t.Fatalf("Unexpected map - %d laps, %d points\n", trackMap.LapsUsed, len(trackMap.Points))
+	}
+
+	// the point on the line averages the last points of the lap with the first ones
+	start := trackMap.Points[0]
+	if start.X <= 0 || start.Z <= 0 || start.X >= 1 || start.Z >= 1 {
+		t.Errorf("Expected the start to be smoothed towards the last corner, got %+v\n", start)
+	}
+	if trackMap.Points[5].X != 5 || trackMap.Points[5].Z != 0 {
+		t.Errorf("Expected a straight to stay straight, got %+v\n", trackMap.Points[5])
+	}
+	if trackMap.MinX >= trackMap.MaxX || trackMap.MinZ >= trackMap.MaxZ {
+		t.Errorf("Unexpected bounds - %+v\n", trackMap)
+	}
+}
+
+func TestPositionAtDistance(t *testing.T) {
+	trackMap := makeStadiumTrackMap()
+
+	if p := trackMap.PositionAtDistance(102.5); p.X != 102.5 || p.Z != 0 || p.Distance != 102.5 {
+		t.Errorf("Expected a point between two centerline points, got %+v\n", p)
+	}
+	if p := trackMap.PositionAtDistance(-10); p.X != 0 {
+		t.Errorf("Expected negative distances to clamp to the line, got %+v\n", p)
+	}
+	last := trackMap.Points[len(trackMap.Points)-1]
+	if p := trackMap.PositionAtDistance(trackMap.TrackLength + 100); p != last {
+		t.Errorf("Expected distances past the line to clamp to the last point, got %+v\n", p)
+	}
+}
+
+// feedTrackMapLap drives car 0 along the x axis of the 100m track 5, joined from the line, starting lap 2 completes lap 1
+func feedTrackMapLap(builder *TrackMapBuilder) {
+	session := F1SessionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Session}}
+	session.SessionData.TrackId = 5
+	session.SessionData.TrackLength = 100
+	builder.ConsumePacket(session)
+
+	for lap := 1; lap <= 2; lap++ {
+		for d := float32(0); d < 100; d += 2 {
+			lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData}}
+			lapData.LapData[0].CurrentLapNum = uint8(lap)
+			lapData.LapData[0].LapDistance = d
+			lapData.LapData[0].DriverStatus = 1
+			builder.ConsumePacket(lapData)
+
+			motion := F1CarMotionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Motion}}
+			motion.CarMotionData[0].WorldPositionX = d
+			builder.ConsumePacket(motion)
+		}
+	}
+}
+
+func TestTrackMapBuilder(t *testing.T) {
+	builder := TrackMapBuilder{}
+	builder.Init(t.TempDir())
+	feedTrackMapLap(&builder)
+
+	trackMap, err := builder.GetTrackMap(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trackMap.LapsUsed != 1 || len(trackMap.Points) != 20 || math.Abs(float64(trackMap.Points[10].X-52)) > 1 {
+		t.Errorf("Unexpected map - %d laps, %d points, %+v\n", trackMap.LapsUsed, len(trackMap.Points), trackMap.Points[10])
+	}
+	if _, err := LoadTrackMap(builder.DataDir, 5); err != nil {
+		t.Errorf("Expected the first map of a track to be saved - %s\n", err)
+	}
+}
+
+func TestTrackMapBuilderRefinesSavedMap(t *testing.T) {
+	builder := TrackMapBuilder{}
+	builder.Init(t.TempDir())
+	feedTrackMapLap(&builder)
+
+	saved, err := LoadTrackMap(builder.DataDir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.LapsUsed = 3
+	if err := saved.Save(builder.DataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a restart nothing asked for the map before the first clean lap
+	restarted := TrackMapBuilder{}
+	restarted.Init(builder.DataDir)
+	feedTrackMapLap(&restarted)
+
+	trackMap, err := restarted.GetTrackMap(5)
+	if err != nil || trackMap.LapsUsed != 4 {
+		t.Fatalf("Expected the saved map to be refined to 4 laps - %v, %v\n", trackMap, err)
+	}
+	if onDisk, _ := LoadTrackMap(builder.DataDir, 5); onDisk == nil || onDisk.LapsUsed != 3 {
+		t.Errorf("Expected the saved map not to be overwritten by a single lap - %v\n", onDisk)
+	}
+
+	// a final map isn't changed
+	saved.LapsUsed = TRACK_MAP_MAX_LAPS
+	saved.Save(builder.DataDir)
+	final := TrackMapBuilder{}
+	final.Init(builder.DataDir)
+	feedTrackMapLap(&final)
+	if trackMap, _ := final.GetTrackMap(5); trackMap.LapsUsed != TRACK_MAP_MAX_LAPS {
+		t.Errorf("Expected the final map to stay at %d laps, got %d\n", TRACK_MAP_MAX_LAPS, trackMap.LapsUsed)
+	}
+}
+
+func TestTrackMapSVG(t *testing.T) {
+	trackMap := makeStadiumTrackMap()
+	svg := trackMap.SVG()
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `d="M`) || strings.Contains(svg, "NaN") {
+		t.Errorf("Unexpected SVG - %.100s\n", svg)
+	}
+
+	// the 600m wide stadium is scaled to the viewbox, its far end lies on the right edge
+	if x, y := trackMap.SVGPoint(trackMap.MaxX, trackMap.MinZ); math.Abs(float64(x-TRACK_MAP_SVG_SIZE)) > 1e-3 || y != 0 {
+		t.Errorf("Unexpected SVG point - %f, %f\n", x, y)
+	}
+
+	for _, degenerate := range []*TrackMap{{}, {Points: []TrackMapPoint{{0, 5, 0, 5}, {5, 5, 0, 5}}}} {
+		degenerate.computeBounds()
+		if svg := degenerate.SVG(); strings.Contains(svg, "NaN") || strings.Contains(svg, "Inf") || strings.Contains(svg, "<path") {
+			t.Errorf("Expected an empty SVG for a map without extent - %s\n", svg)
+		}
+		if p := degenerate.PositionAtDistance(10); len(degenerate.Points) == 0 && p != (TrackMapPoint{Distance: 10}) {
+			t.Errorf("Expected the origin on a map without points - %+v\n", p)
+		}
+	}
+}
+
+func TestTrackCarPositions(t *testing.T) {
+	builder := TrackMapBuilder{}
+	builder.Init(t.TempDir())
+	if _, err := builder.GetCarPositions(); err == nil {
+		t.Errorf("Expected no positions without a session\n")
+	}
+
+	trackMap := makeStadiumTrackMap()
+	builder.maps[trackMap.TrackId] = trackMap
+
+	session := F1SessionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Session}}
+	session.SessionData.TrackId = trackMap.TrackId
+	builder.ConsumePacket(session)
+
+	lapData := F1LapDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_LapData}}
+	lapData.LapData[1] = F1LapData{CarPosition: 2, LapDistance: 250, ResultStatus: 2}
+	lapData.LapData[4] = F1LapData{CarPosition: 1, LapDistance: 500, ResultStatus: 2}
+	builder.ConsumePacket(lapData)
+
+	motion := F1CarMotionDataPacket{f1PacketHeader: &F1PacketHeader{PacketId: PacketID_Motion}}
+	motion.CarMotionData[1].WorldPositionX = 250
+	motion.CarMotionData[4].WorldPositionX = 500
+	builder.ConsumePacket(motion)
+
+	positions, err := builder.GetCarPositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions.Cars) != 2 || positions.Cars[0].CarIndex != 1 || positions.Cars[1].Position != 1 {
+		t.Fatalf("Expected the two cars taking part - %+v\n", positions.Cars)
+	}
+
+	x, y := trackMap.SVGPoint(500, 0)
+	if car := positions.Cars[1]; car.X != 500 || car.SVGX != x || car.SVGY != y {
+		t.Errorf("Unexpected position of car 4 - %+v\n", car)
+	}
+}
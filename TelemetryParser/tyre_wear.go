@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	TYRE_WEAR_THRESHOLD      float32 = 70 // wear percentage at which a tyre is considered done
+	TYRE_MAX_STORED_SESSIONS         = 20
+	TYRE_DATA_DIR                    = "tyre_data"
+	TYRE_STINTS_FILE                 = "stints.json"
+)
+
+// Tyre corners in the order the game uses for all [4] arrays
+var TYRE_CORNER_NAMES = [4]string{"RL", "RR", "FL", "FR"}
+
+var ACTUAL_COMPOUND_NAMES = map[uint8]string{
+	16: "C5", 17: "C4", 18: "C3", 19: "C2", 20: "C1", 21: "C0", 7: "Inter", 8: "Wet",
+	9: "Dry (classic)", 10: "Wet (classic)",
+	11: "Super Soft (F2)", 12: "Soft (F2)", 13: "Medium (F2)", 14: "Hard (F2)", 15: "Wet (F2)",
+}
+
+var VISUAL_COMPOUND_NAMES = map[uint8]string{
+	16: "Soft", 17: "Medium", 18: "Hard", 7: "Inter", 8: "Wet",
+	15: "Wet (F2)", 19: "Super Soft (F2)", 20: "Soft (F2)", 21: "Medium (F2)", 22: "Hard (F2)",
+}
+
+type TyreStintLap struct {
+	LapNum      uint8
+	TyreAge     uint8
+	Wear        [4]float32
+	LapTimeInMS uint32
+	Clean       bool // valid lap without a pit stop, used for the lap time fit
+}
+
+type TyreStint struct {
+	SessionUID        uint64
+	CarIndex          uint8
+	StintNum          int
+	ActualCompound    string
+	VisualCompound    string
+	StartLap          uint8
+	EndLap            uint8
+	StartTyreAge      uint8
+	Active            bool
+	Laps              []TyreStintLap
+	WearRatePerLap    [4]float32 // % per lap for each corner, fitted over the stint
+	LapsToThreshold   float32    // laps until the most worn tyre reaches TYRE_WEAR_THRESHOLD, -1 if not wearing
+	LapTimeLossPerLap float32    // ms each lap is slower than the previous one due to degradation
+}
+
+type CompoundDegradation struct {
+	ActualCompound    string
+	Stints            int
+	Laps              int
+	WearRatePerLap    [4]float32
+	LapTimeLossPerLap float32
+}
+
+type carTyreState struct {
+	LapNum     uint8
+	LapInvalid bool
+	LapPitted  bool
+	TyreAge    uint8 // last seen, a lower age means new tyres were fitted
+	InPit      bool
+	TyreStop   bool // stood still in the pit box, not to serve a penalty
+	Stint      *TyreStint
+}
+
+// TyreSessionStints are the stints of a finished session, as they are stored
+type TyreSessionStints struct {
+	SessionUID uint64
+	Stints     []*TyreStint
+}
+
+// TyreWearModel follows tyre wear of every car lap by lap, splits it into stints and fits wear and lap time loss.
+// The stints of the last TYRE_MAX_STORED_SESSIONS sessions are saved when a session ends.
+type TyreWearModel struct {
+	RWLock  sync.RWMutex
+	DataDir string
+
+	sessionUID    uint64
+	status        [F1_MAX_NUM_CARS]F1CarStatusData
+	haveStatus    bool
+	damage        [F1_MAX_NUM_CARS]F1CarDamageData
+	haveDamage    bool
+	cars          [F1_MAX_NUM_CARS]carTyreState
+	sessions      map[uint64][]*TyreStint
+	sessionsOrder []uint64
+}
+
+func (model *TyreWearModel) Init(dataDir string) {
+	model.DataDir = dataDir
+	model.sessions = make(map[uint64][]*TyreStint)
+	model.sessionsOrder = make([]uint64, 0)
+
+	sessions, err := LoadTyreStints(dataDir)
+	if err == nil {
+		for _, session := range sessions {
+			model.sessions[session.SessionUID] = session.Stints
+			model.sessionsOrder = append(model.sessionsOrder, session.SessionUID)
+		}
+	} else if !os.IsNotExist(err) {
+		Log.Printf("Failed to load tyre stints - %s\n", err)
+	}
+
+	model.Reset()
+}
+
+// Reset only forgets the state of the running session, stints of past sessions are kept
+func (model *TyreWearModel) Reset() {
+	model.RWLock.Lock()
+	defer model.RWLock.Unlock()
+
+	model.startSession(0)
+}
+
+// Close saves the stints of the running session, so they aren't lost when the app quits before the next session starts
+func (model *TyreWearModel) Close() {
+	model.RWLock.Lock()
+	defer model.RWLock.Unlock()
+
+	model.finishSession()
+}
+
+func (model *TyreWearModel) finishSession() {
+	stints := model.sessions[model.sessionUID]
+	if model.sessionUID == 0 || len(stints) == 0 {
+		return
+	}
+	for _, stint := range stints {
+		stint.Active = false
+	}
+
+	sessions := make([]TyreSessionStints, 0, len(model.sessionsOrder))
+	for _, sessionUID := range model.sessionsOrder {
+		sessions = append(sessions, TyreSessionStints{sessionUID, model.sessions[sessionUID]})
+	}
+	err := SaveTyreStints(model.DataDir, sessions)
+	if err != nil {
+		Log.Printf("Failed to save tyre stints - %s\n", err)
+	}
+}
+
+func (model *TyreWearModel) startSession(sessionUID uint64) {
+	model.finishSession()
+
+	model.sessionUID = sessionUID
+	model.haveStatus = false
+	model.haveDamage = false
+	for i := range model.cars {
+		model.cars[i] = carTyreState{}
+	}
+
+	if _, ok := model.sessions[sessionUID]; sessionUID == 0 || ok {
+		return
+	}
+
+	model.sessions[sessionUID] = make([]*TyreStint, 0)
+	model.sessionsOrder = append(model.sessionsOrder, sessionUID)
+	if len(model.sessionsOrder) > TYRE_MAX_STORED_SESSIONS {
+		delete(model.sessions, model.sessionsOrder[0])
+		model.sessionsOrder = model.sessionsOrder[1:]
+	}
+}
+
+func (model *TyreWearModel) ConsumePacket(packet F1Packet) {
+	header := packet.Header()
+
+	model.RWLock.Lock()
+	defer model.RWLock.Unlock()
+
+	if header.SessionUID != model.sessionUID {
+		model.startSession(header.SessionUID)
+	}
+
+	switch p := packet.(type) {
+	case F1CarStatusDataPacket:
+		model.status = p.CarStatusData
+		model.haveStatus = true
+	case F1CarDamageDataPacket:
+		model.damage = p.CarDamageData
+		model.haveDamage = true
+	case F1LapDataPacket:
+		if !model.haveStatus || !model.haveDamage {
+			return
+		}
+		for i := range p.LapData {
+			model.processLapData(uint8(i), &p.LapData[i])
+		}
+	}
+}
+
+func (model *TyreWearModel) processLapData(carIndex uint8, lapData *F1LapData) {
+	state := &model.cars[carIndex]
+	status := &model.status[carIndex]
+
+	if lapData.ResultStatus < 2 {
+		return
+	}
+
+	// a completed stop catches new tyres of the same compound fitted before the old set aged
+	pitStopDone := false
+	if lapData.PitStatus != 0 {
+		state.InPit = true
+		if lapData.PitStopTimerInMS > 0 && lapData.PitStopShouldServePen == 0 {
+			state.TyreStop = true
+		}
+	} else if state.InPit {
+		pitStopDone = state.TyreStop
+		state.InPit = false
+		state.TyreStop = false
+	}
+
+	// fitting new tyres starts a new stint
+	if state.Stint == nil || state.Stint.ActualCompound != CompoundName(ACTUAL_COMPOUND_NAMES, status.ActualTyreCompound) ||
+		status.TyresAgeLaps < state.TyreAge || pitStopDone {
+		model.startStint(carIndex, lapData.CurrentLapNum, status)
+	}
+	state.TyreAge = status.TyresAgeLaps
+
+	if lapData.CurrentLapNum != state.LapNum {
+		if state.LapNum != 0 && lapData.CurrentLapNum == state.LapNum+1 {
+			state.Stint.Laps = append(state.Stint.Laps, TyreStintLap{
+				LapNum:      state.LapNum,
+				TyreAge:     status.TyresAgeLaps,
+				Wear:        model.damage[carIndex].TyresWear,
+				LapTimeInMS: lapData.LastLapTimeInMS,
+				Clean:       !state.LapInvalid && !state.LapPitted,
+			})
+			state.Stint.EndLap = state.LapNum
+			state.Stint.fit()
+		}
+
+		state.LapNum = lapData.CurrentLapNum
+		state.LapInvalid = false
+		state.LapPitted = false
+	}
+
+	if lapData.CurrentLapInvalid == 1 {
+		state.LapInvalid = true
+	}
+	if lapData.PitStatus != 0 {
+		state.LapPitted = true
+	}
+}
+
+func (model *TyreWearModel) startStint(carIndex uint8, lapNum uint8, status *F1CarStatusData) {
+	state := &model.cars[carIndex]
+	stints := model.sessions[model.sessionUID]
+
+	if state.Stint != nil {
+		state.Stint.Active = false
+	}
+
+	stintNum := 1
+	for _, s := range stints {
+		if s.CarIndex == carIndex {
+			stintNum++
+		}
+	}
+
+	state.Stint = &TyreStint{
+		SessionUID:      model.sessionUID,
+		CarIndex:        carIndex,
+		StintNum:        stintNum,
+		ActualCompound:  CompoundName(ACTUAL_COMPOUND_NAMES, status.ActualTyreCompound),
+		VisualCompound:  CompoundName(VISUAL_COMPOUND_NAMES, status.VisualTyreCompound),
+		StartLap:        lapNum,
+		EndLap:          lapNum,
+		StartTyreAge:    status.TyresAgeLaps,
+		Active:          true,
+		Laps:            make([]TyreStintLap, 0),
+		LapsToThreshold: -1,
+	}
+	model.sessions[model.sessionUID] = append(stints, state.Stint)
+}
+
+func CompoundName(names map[uint8]string, compound uint8) string {
+	if name, ok := names[compound]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (%d)", compound)
+}
+
+// fit updates the wear rates, laps left until the threshold and lap time loss of the stint
+func (stint *TyreStint) fit() {
+	n := len(stint.Laps)
+	ages := make([]float32, n)
+	for i, lap := range stint.Laps {
+		ages[i] = float32(lap.TyreAge)
+	}
+
+	stint.LapsToThreshold = -1
+	last := stint.Laps[n-1]
+	for corner := 0; corner < 4; corner++ {
+		wear := make([]float32, n)
+		for i, lap := range stint.Laps {
+			wear[i] = lap.Wear[corner]
+		}
+		stint.WearRatePerLap[corner], _ = LinearFit(ages, wear)
+
+		if rate := stint.WearRatePerLap[corner]; rate > 0 {
+			laps := (TYRE_WEAR_THRESHOLD - last.Wear[corner]) / rate
+			if laps < 0 {
+				laps = 0
+			}
+			if stint.LapsToThreshold < 0 || laps < stint.LapsToThreshold {
+				stint.LapsToThreshold = laps
+			}
+		}
+	}
+
+	cleanAges, lapTimes := make([]float32, 0, n), make([]float32, 0, n)
+	for _, lap := range stint.Laps {
+		if lap.Clean && lap.LapTimeInMS > 0 {
+			cleanAges = append(cleanAges, float32(lap.TyreAge))
+			lapTimes = append(lapTimes, float32(lap.LapTimeInMS))
+		}
+	}
+	stint.LapTimeLossPerLap, _ = LinearFit(cleanAges, lapTimes)
+}
+
+// GetStints returns the stints of a session (0 = current session), optionally filtered to one car (255 = all cars)
+func (model *TyreWearModel) GetStints(sessionUID uint64, carIndex uint8) ([]TyreStint, error) {
+	model.RWLock.RLock()
+	defer model.RWLock.RUnlock()
+
+	if sessionUID == 0 {
+		sessionUID = model.sessionUID
+	}
+
+	stints, ok := model.sessions[sessionUID]
+	if !ok {
+		return nil, fmt.Errorf("no tyre data for session %d", sessionUID)
+	}
+
+	result := make([]TyreStint, 0, len(stints))
+	for _, stint := range stints {
+		if carIndex == 255 || stint.CarIndex == carIndex {
+			s := *stint
+			s.Laps = append([]TyreStintLap{}, stint.Laps...)
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// GetCompoundDegradation pools all laps of every stint in a session per compound, using the wear added since the start of each stint
+func (model *TyreWearModel) GetCompoundDegradation(sessionUID uint64) ([]CompoundDegradation, error) {
+	model.RWLock.RLock()
+	defer model.RWLock.RUnlock()
+
+	if sessionUID == 0 {
+		sessionUID = model.sessionUID
+	}
+
+	stints, ok := model.sessions[sessionUID]
+	if !ok {
+		return nil, fmt.Errorf("no tyre data for session %d", sessionUID)
+	}
+
+	type pooled struct {
+		stints         int
+		ages           []float32
+		wear           [4][]float32
+		cleanAges      []float32
+		lapTimeOffsets []float32
+	}
+	compounds := make(map[string]*pooled)
+
+	for _, stint := range stints {
+		if len(stint.Laps) == 0 {
+			continue
+		}
+
+		p, ok := compounds[stint.ActualCompound]
+		if !ok {
+			p = &pooled{}
+			compounds[stint.ActualCompound] = p
+		}
+		p.stints++
+
+		first := stint.Laps[0]
+		var firstCleanTime float32
+		for _, lap := range stint.Laps {
+			p.ages = append(p.ages, float32(lap.TyreAge-first.TyreAge))
+			for corner := 0; corner < 4; corner++ {
+				p.wear[corner] = append(p.wear[corner], lap.Wear[corner]-first.Wear[corner])
+			}
+
+			if lap.Clean && lap.LapTimeInMS > 0 {
+				if firstCleanTime == 0 {
+					firstCleanTime = float32(lap.LapTimeInMS)
+				}
+				p.cleanAges = append(p.cleanAges, float32(lap.TyreAge-first.TyreAge))
+				p.lapTimeOffsets = append(p.lapTimeOffsets, float32(lap.LapTimeInMS)-firstCleanTime)
+			}
+		}
+	}
+
+	result := make([]CompoundDegradation, 0, len(compounds))
+	for name, p := range compounds {
+		degradation := CompoundDegradation{ActualCompound: name, Stints: p.stints, Laps: len(p.ages)}
+		for corner := 0; corner < 4; corner++ {
+			degradation.WearRatePerLap[corner], _ = LinearFit(p.ages, p.wear[corner])
+		}
+		degradation.LapTimeLossPerLap, _ = LinearFit(p.cleanAges, p.lapTimeOffsets)
+		result = append(result, degradation)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ActualCompound < result[j].ActualCompound })
+
+	return result, nil
+}
+
+// GetActiveStint returns a copy of the stint a car is currently on, or nil
+func (model *TyreWearModel) GetActiveStint(carIndex uint8) *TyreStint {
+	model.RWLock.RLock()
+	defer model.RWLock.RUnlock()
+
+	if carIndex >= F1_MAX_NUM_CARS || model.cars[carIndex].Stint == nil {
+		return nil
+	}
+
+	stint := *model.cars[carIndex].Stint
+	stint.Laps = append([]TyreStintLap{}, stint.Laps...)
+	return &stint
+}
+
+// GetActiveStintNum returns the number and visual compound of the stint a car is on, without copying its laps. The number is 0
+// before the car's first stint.
+func (model *TyreWearModel) GetActiveStintNum(carIndex uint8) (int, string) {
+	model.RWLock.RLock()
+	defer model.RWLock.RUnlock()
+
+	if carIndex >= F1_MAX_NUM_CARS || model.cars[carIndex].Stint == nil {
+		return 0, ""
+	}
+	return model.cars[carIndex].Stint.StintNum, model.cars[carIndex].Stint.VisualCompound
+}
+
+func SaveTyreStints(dataDir string, sessions []TyreSessionStints) error {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dataDir, TYRE_STINTS_FILE), data, 0644)
+}
+
+func LoadTyreStints(dataDir string) ([]TyreSessionStints, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, TYRE_STINTS_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]TyreSessionStints, 0)
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
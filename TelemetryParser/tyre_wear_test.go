@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// feedTyreStint drives one car through `laps` laps on a fresh set of `compound`, wearing 2% per lap and losing 100ms per lap
+func feedTyreStint(model *TyreWearModel, compound uint8, firstLap uint8, laps int) {
+	header := &F1PacketHeader{SessionUID: 1}
+
+	for i := 0; i <= laps; i++ {
+		status := F1CarStatusDataPacket{f1PacketHeader: header}
+		status.CarStatusData[0].ActualTyreCompound = compound
+		status.CarStatusData[0].VisualTyreCompound = compound
+		status.CarStatusData[0].TyresAgeLaps = uint8(i)
+		model.ConsumePacket(status)
+
+		damage := F1CarDamageDataPacket{f1PacketHeader: header}
+		for corner := 0; corner < 4; corner++ {
+			damage.CarDamageData[0].TyresWear[corner] = float32(i) * 2
+		}
+		model.ConsumePacket(damage)
+
+		lapData := F1LapDataPacket{f1PacketHeader: header}
+		lapData.LapData[0].ResultStatus = 2
+		lapData.LapData[0].CurrentLapNum = firstLap + uint8(i)
+		lapData.LapData[0].LastLapTimeInMS = 90000 + uint32(i)*100
+		model.ConsumePacket(lapData)
+	}
+}
+
+func TestTyreStints(t *testing.T) {
+	model := TyreWearModel{}
+	model.Init(t.TempDir())
+
+	feedTyreStint(&model, 16, 1, 5)
+	feedTyreStint(&model, 18, 6, 3)
+
+	stints, err := model.GetStints(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stints) != 2 {
+		t.Fatalf("Expected 2 stints, got %d\n", len(stints))
+	}
+
+	soft := stints[0]
+	if soft.ActualCompound != "C5" || soft.Active || len(soft.Laps) != 5 {
+		t.Fatalf("Unexpected first stint - %s, active %v, %d laps\n", soft.ActualCompound, soft.Active, len(soft.Laps))
+	}
+	if math.Abs(float64(soft.WearRatePerLap[2]-2)) > 0.01 || math.Abs(float64(soft.LapTimeLossPerLap-100)) > 0.1 {
+		t.Errorf("Unexpected fit - %.2f%%/lap, %.2fms/lap\n", soft.WearRatePerLap[2], soft.LapTimeLossPerLap)
+	}
+	// 10% worn after 5 laps, 60% to go at 2% per lap
+	if math.Abs(float64(soft.LapsToThreshold-30)) > 0.1 {
+		t.Errorf("Expected 30 laps to the wear threshold, got %.2f\n", soft.LapsToThreshold)
+	}
+
+	hard := stints[1]
+	if hard.ActualCompound != "C3" || !hard.Active || hard.StintNum != 2 || hard.StartLap != 6 {
+		t.Errorf("Unexpected second stint - %+v\n", hard)
+	}
+
+	degradation, err := model.GetCompoundDegradation(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(degradation) != 2 || degradation[0].ActualCompound != "C3" || degradation[1].Laps != 5 {
+		t.Errorf("Unexpected compound degradation - %+v\n", degradation)
+	}
+}
+
+func TestTyreStintSameCompoundStop(t *testing.T) {
+	model := TyreWearModel{}
+	model.Init(t.TempDir())
+
+	header := &F1PacketHeader{SessionUID: 1}
+	status := F1CarStatusDataPacket{f1PacketHeader: header}
+	status.CarStatusData[0].ActualTyreCompound = 16
+	model.ConsumePacket(status)
+	model.ConsumePacket(F1CarDamageDataPacket{f1PacketHeader: header})
+
+	// new softs for new softs before the first set completed a lap, the tyre age stays 0
+	for _, pit := range []struct {
+		status uint8
+		timer  uint16
+	}{{0, 0}, {1, 0}, {2, 2500}, {1, 2500}, {0, 0}} {
+		lapData := F1LapDataPacket{f1PacketHeader: header}
+		lapData.LapData[0].ResultStatus = 2
+		lapData.LapData[0].CurrentLapNum = 1
+		lapData.LapData[0].PitStatus = pit.status
+		lapData.LapData[0].PitStopTimerInMS = pit.timer
+		model.ConsumePacket(lapData)
+	}
+
+	stints, _ := model.GetStints(0, 0)
+	if len(stints) != 2 || stints[0].Active || !stints[1].Active || stints[1].ActualCompound != "C5" {
+		t.Errorf("Expected a new stint on the same compound after the stop - %+v\n", stints)
+	}
+
+	// a drive through doesn't change tyres
+	for _, pitStatus := range []uint8{1, 0} {
+		lapData := F1LapDataPacket{f1PacketHeader: header}
+		lapData.LapData[0].ResultStatus = 2
+		lapData.LapData[0].CurrentLapNum = 1
+		lapData.LapData[0].PitStatus = pitStatus
+		model.ConsumePacket(lapData)
+	}
+	if stints, _ = model.GetStints(0, 0); len(stints) != 2 {
+		t.Errorf("Expected no stint for a drive through, got %d stints\n", len(stints))
+	}
+}
+
+func TestTyreStintsStored(t *testing.T) {
+	dataDir := t.TempDir()
+	model := TyreWearModel{}
+	model.Init(dataDir)
+	feedTyreStint(&model, 16, 1, 5)
+
+	// the next session stores the stints of this one
+	model.ConsumePacket(F1LapDataPacket{f1PacketHeader: &F1PacketHeader{SessionUID: 2}})
+	if _, err := LoadTyreStints(dataDir); err != nil {
+		t.Fatalf("Expected the stints of session 1 to be saved - %s\n", err)
+	}
+
+	restarted := TyreWearModel{}
+	restarted.Init(dataDir)
+	stints, err := restarted.GetStints(1, 0)
+	if err != nil || len(stints) != 1 || stints[0].ActualCompound != "C5" || len(stints[0].Laps) != 5 || stints[0].Active {
+		t.Errorf("Expected the finished stint of session 1 after a restart - %+v, %v\n", stints, err)
+	}
+}
@@ -10,10 +10,23 @@ import (
 const CLIENT_TICK_INTERVAL_MS = 8
 const CLIENT_NEW_PACKET_CHANNEL_BUFFER_SIZE = 8
 
+// Packets computed by the backend are broadcast like game packets, with IDs outside of the game's range
+const (
+	PacketID_LapDelta uint8 = 100 + iota
+	PacketID_TimingTower
+	PacketID_GapTower
+	PacketID_FuelStrategy
+	PacketID_PitStrategy
+	PacketID_TemperatureAlert
+	PacketID_SlipEvent
+	PacketID_PenaltyUpdate
+)
+
 type WebsocketClient struct {
 	Connection *websocket.Conn
 	NewPacket  chan []byte
 	exitFlag   bool
+	metrics    *WebsocketClientMetrics
 }
 
 type WebsocketServer struct {
@@ -40,11 +53,24 @@ func WSSBroadcast[T any](wss *WebsocketServer, f1Packet *SavedPacket[T]) {
 		select {
 		case cl.NewPacket <- data:
 		default:
+			Metrics.WebsocketMessage(cl.metrics, false)
 			continue // we don't wait on the channel, just drop the packet for this client
 		}
 	}
 }
 
+// WSSBroadcastDerived sends data computed from game packets, using the header of the packet it was derived from
+func WSSBroadcastDerived[T any](wss *WebsocketServer, header *F1PacketHeader, packetID uint8, body T) {
+	// trackers fed from recordings have no server to broadcast to
+	if wss == nil {
+		return
+	}
+
+	s := SavedPacket[T]{*header, body}
+	s.Header.PacketId = packetID
+	WSSBroadcast(wss, &s)
+}
+
 func (s *WebsocketServer) SubscribeNewClient(cl *WebsocketClient) {
 	if _, ok := s.Clients[cl]; ok {
 		Log.Println("WSS: Tried to register a client that is already registered")
@@ -52,6 +78,7 @@ func (s *WebsocketServer) SubscribeNewClient(cl *WebsocketClient) {
 	}
 
 	cl.Connection.EnableWriteCompression(true)
+	cl.metrics = Metrics.AddWebsocketClient(cl.Connection.RemoteAddr().String())
 	s.Clients[cl] = struct{}{}
 	go cl.Run(s)
 }
@@ -59,6 +86,7 @@ func (s *WebsocketServer) SubscribeNewClient(cl *WebsocketClient) {
 func (cl *WebsocketClient) Run(wss *WebsocketServer) {
 	defer cl.Connection.Close()
 	defer delete(wss.Clients, cl)
+	defer Metrics.RemoveWebsocketClient(cl.metrics)
 
 	cl.Connection.SetCloseHandler(func(code int, text string) error {
 		Log.Printf("WSS: Client %s disconnected with code %d (reason: %s)\n", cl.Connection.RemoteAddr().String(), code, text)
@@ -78,6 +106,7 @@ func (cl *WebsocketClient) Run(wss *WebsocketServer) {
 				Log.Printf("Error writing packet to client, closing connection - %s\n", err)
 				return
 			}
+			Metrics.WebsocketMessage(cl.metrics, true)
 		default:
 			time.Sleep(time.Millisecond * CLIENT_TICK_INTERVAL_MS)
 		}